@@ -6,19 +6,21 @@ import (
 	"app/domain/model"
 	"app/domain/service"
 	"app/utils"
+	"context"
 	"fmt"
 	"github.com/markcheno/go-talib"
 	"log"
 	"math"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/sync/semaphore"
 )
 
 type AI struct {
-	API                  *bitflyer.APIClient
+	API                  bitflyer.Exchange
 	ProductCode          string
 	CurrencyCode         string
 	CoinCode             string
@@ -28,80 +30,188 @@ type AI struct {
 	PastPeriod           int
 	SignalEvents         *model.SignalEvents
 	OptimizedTradeParams *model.TradeParams
+	SignalStrategies     []model.Strategy // Tradeで売買の判定に使う戦略（config.iniのtrade_strategies）
+	Ensemble             *model.Ensemble  // 有効な場合はSignalStrategiesの代わりに売買の判定に使う（config.iniの[ensemble]）
 	TradeSemaphore       *semaphore.Weighted
+	OptimizeSemaphore    *semaphore.Weighted
 	StopLimit            float64
 	StopLimitPercent     float64
 	BackTest             bool
 	StartTrade           time.Time
 	Profit               float64
+	Strategies           []*Strategy               // 並行して動かす戦略（空の場合はTradeで取引する）
+	walkForwardResult    *model.WalkForwardResult  // 直近のウォークフォワード最適化の結果
+	lastReconcile        *service.ReconcileReport  // 直近の建玉の照合結果
+	lastGapReport        *service.CandleGapReport  // 直近のキャンドルの欠けの検出結果
+	resultMu             sync.Mutex                // walkForwardResult・lastReconcile・lastGapReportを保護する
+	replay               *backTestReplay           // バックテストで過去のキャンドルを再生している時のみ設定される
+	closeTime            time.Time                 // キャンドルの確定で取引している時のみ設定される
+	ticker               bitflyer.Ticker           // リアルタイムAPIで受信した最新のTicker
+	tickerMu             sync.Mutex                // ticker・closeTimeを保護する
+	candles              *service.CandleAggregator // Ticker・約定からキャンドルを作成する
+	tradeState
 }
 
-// TODO mutex, singleton
-var Ai *AI
-
-var longReOpen bool
-
-var shortReOpen bool
-
-var tradeDuration int
+/** 取引中の状態（プロダクトごとにAIが持つ） */
+type tradeState struct {
+	longReOpen    bool
+	shortReOpen   bool
+	profit        float64 // オープン時に設定する1取引ごとの利益
+	stopLimit     float64 // 損切りライン
+	atrRate       float64 // atr率
+	isLongProfit  bool
+	isShortProfit bool
+	size          float64
+	sellOpen      bool
+	buyOpen       bool
+	isNoPosition  bool    // 取引中じゃない状態
+	isStopLimit   bool    // 損切りを行った後にreOpenさせないためのフラグ
+	tradeDuration int     // 取引する時間足（分）
+	netted        float64 // 前回ネッティングした戦略の建玉の合計
+}
 
-func NewAI(productCode string, duration time.Duration, pastPeriod int, UsePercent, stopLimitPercent float64, backTest bool) *AI {
-	apiClient := bitflyer.New(config.Config.ApiKey, config.Config.ApiSecret)
-	tradeDuration, _ = strconv.Atoi(strings.TrimSuffix(config.Config.TradeDuration, config.Config.TradeSuffix))
+/** exchangeにはbitFlyerのAPIClientの他、ペーパートレードやテスト用のフェイクを渡せる */
+func NewAI(exchange bitflyer.Exchange, productCode string, duration time.Duration, pastPeriod int, UsePercent, stopLimitPercent float64, backTest bool) *AI {
+	tradeDuration, _ := strconv.Atoi(strings.TrimSuffix(config.Config.TradeDuration, config.Config.TradeSuffix))
 	var signalEvents *model.SignalEvents
-	signalEvents = model.GetSignalEventsByCount(1)
+	signalEvents = model.GetSignalEventsByCount(productCode, 1)
 	codes := strings.Split(productCode, "_")
-	Ai = &AI{
-		API:              apiClient,
-		ProductCode:      productCode,
-		CoinCode:         codes[2],
-		CurrencyCode:     codes[1],
-		UsePercent:       UsePercent,
-		MinuteToExpires:  1, // どれくらいオーダーを保持するか（単位：分）
-		PastPeriod:       pastPeriod,
-		Duration:         duration,
-		SignalEvents:     signalEvents,
-		TradeSemaphore:   semaphore.NewWeighted(1), // AIでのトレード中は他のgorutineはできないようにする
-		BackTest:         backTest,
-		StartTrade:       time.Now(),
-		StopLimitPercent: stopLimitPercent,
-	}
-	Ai.UpdateOptimizeParams(false, false)
-	return Ai
+	ai := &AI{
+		API:               exchange,
+		ProductCode:       productCode,
+		CoinCode:          codes[len(codes)-1],
+		CurrencyCode:      codes[len(codes)-2],
+		UsePercent:        UsePercent,
+		MinuteToExpires:   1, // どれくらいオーダーを保持するか（単位：分）
+		PastPeriod:        pastPeriod,
+		Duration:          duration,
+		SignalEvents:      signalEvents,
+		TradeSemaphore:    semaphore.NewWeighted(1), // AIでのトレード中は他のgorutineはできないようにする
+		OptimizeSemaphore: semaphore.NewWeighted(1), // 最適化は同時に1つだけ実行する
+		BackTest:          backTest,
+		StartTrade:        time.Now(),
+		StopLimitPercent:  stopLimitPercent,
+	}
+	ai.tradeDuration = tradeDuration
+	signalStrategies, err := model.NewStrategies(config.Config.TradeStrategies)
+	if err != nil {
+		log.Fatalf("action=NewAI err=%s", err.Error())
+	}
+	ai.SignalStrategies = signalStrategies
+	if config.Config.EnsembleEnable {
+		ai.Ensemble = model.NewEnsemble(config.Config.EnsembleThreshold)
+	}
+	ai.UpdateOptimizeParams(false, false)
+	return ai
 }
 
-/** インディケータの最適化 */
+/*
+インディケータの最適化
+グリッドサーチはワーカープールで並列に行い、OptimizeTimeoutで打ち切る
+isContinueの場合、インディケータが1つも使えなければキャンドルを取得し直してOptimizeMaxRetries回まで再試行する
+最適化中に呼ばれた場合は何もしない（1秒ごとのTradeから呼ばれても最適化が積み重ならないようにする）
+*/
 func (ai *AI) UpdateOptimizeParams(isContinue, reOpen bool) {
-	df, _ := service.GetAllCandle(ai.ProductCode, ai.Duration, ai.PastPeriod)
-	ai.OptimizedTradeParams = df.OptimizeParams(reOpen)
-	log.Printf("optimized_trade_params=%+v", ai.OptimizedTradeParams)
-	// インディケータが1つも使えない場合は再起呼び出し
-	if ai.OptimizedTradeParams == nil && isContinue && !ai.BackTest {
+	if !ai.OptimizeSemaphore.TryAcquire(1) {
+		log.Println("action=UpdateOptimizeParams status=already_running")
+		return
+	}
+	defer ai.OptimizeSemaphore.Release(1)
+
+	for retry := 0; ; retry++ {
+		params, err := ai.optimizeParams(reOpen)
+		if err != nil {
+			log.Printf("action=UpdateOptimizeParams err=%s", err.Error())
+		} else {
+			ai.OptimizedTradeParams = params
+		}
+		log.Printf("optimized_trade_params=%+v", ai.OptimizedTradeParams)
+		if ai.OptimizedTradeParams != nil || !isContinue || ai.BackTest {
+			return
+		}
+		// インディケータが1つも使えない場合は再試行する
+		if retry >= config.Config.OptimizeMaxRetries {
+			log.Printf("action=UpdateOptimizeParams status=no_params retries=%d", retry)
+			return
+		}
 		log.Print("status_no_params")
 		reOpen = false
-		if longReOpen || shortReOpen {
+		if ai.longReOpen || ai.shortReOpen {
 			reOpen = true
 		}
-		ai.UpdateOptimizeParams(isContinue, reOpen)
+	}
+}
+
+/** 1回分の最適化（タイムアウトした場合はエラーを返す） */
+func (ai *AI) optimizeParams(reOpen bool) (*model.TradeParams, error) {
+	df, _ := ai.getDataFrame()
+	ctx := context.Background()
+	// バックテストの再生中は結果が実行環境に左右されないようタイムアウトさせない
+	if ai.replay == nil && config.Config.OptimizeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Config.OptimizeTimeout)
+		defer cancel()
+	}
+	options := model.OptimizeOptions{
+		Workers:  config.Config.OptimizeWorkers,
+		Progress: logOptimizeProgress(),
+	}
+	if config.Config.WalkForward {
+		// 学習期間で最適化したパラメータのうち検証期間でも通用したものだけを使う
+		result, err := df.WalkForwardContext(ctx, config.Config.WalkForwardTrainSize, config.Config.WalkForwardTestSize, config.Config.WalkForwardMinHitRate, reOpen, options)
+		if err != nil {
+			return nil, err
+		}
+		ai.setWalkForwardResult(result)
+		log.Printf("walk_forward_stability=%+v", result.Stability)
+		return result.Params, nil
+	}
+	return df.OptimizeParamsContext(ctx, reOpen, options)
+}
+
+/** 直近のウォークフォワード最適化の結果を保存する */
+func (ai *AI) setWalkForwardResult(result *model.WalkForwardResult) {
+	ai.resultMu.Lock()
+	defer ai.resultMu.Unlock()
+	ai.walkForwardResult = result
+}
+
+/** 直近のウォークフォワード最適化の結果（まだ実行していない場合はnil） */
+func (ai *AI) latestWalkForwardResult() *model.WalkForwardResult {
+	ai.resultMu.Lock()
+	defer ai.resultMu.Unlock()
+	return ai.walkForwardResult
+}
+
+/** 最適化の進捗を10%ごとにログに出す */
+func logOptimizeProgress() func(model.OptimizeProgress) {
+	lastPercent := -1
+	return func(progress model.OptimizeProgress) {
+		percent := progress.Done * 100 / progress.Total
+		if percent/10 == lastPercent/10 {
+			return
+		}
+		lastPercent = percent
+		log.Printf("action=UpdateOptimizeParams progress=%d/%d(%d%%) indicator=%s", progress.Done, progress.Total, percent, progress.Indicator)
 	}
 }
 
 /** bitflyer用のBUY */
-func (ai *AI) Buy(candle model.Candle, price, bbRate float64) (childOrderAcceptanceID string, isOrderCompleted bool, orderPrice float64) {
+func (ai *AI) Buy(candle model.Candle, price, bbRate float64, contributions map[string]float64) (childOrderAcceptanceID string, isOrderCompleted bool, orderPrice float64) {
 	orderPrice = 0.0
 	pnl := 0.0
-	size = 0.0
-	atr, _ := service.Atr(30)
+	ai.size = 0.0
+	atr, _ := ai.atr(30)
 	// トレード時間の妥当性チェック
 	if ai.StartTrade.After(candle.Time) {
 		log.Println("candle.TimeがStartTradeより過去のため取引しません")
 		return "timeError", false, 0.0
 	}
 	// ショートの利益確定後にロングでインしないようにreOpenをfalseにする
-	if isShortProfit {
-		longReOpen = false
+	if ai.isShortProfit {
+		ai.longReOpen = false
 	}
-	if !ai.SignalEvents.CanBuy(candle.Time, longReOpen) {
+	if !ai.SignalEvents.CanBuy(candle.Time, ai.longReOpen) {
 		return
 	}
 
@@ -118,27 +228,24 @@ func (ai *AI) Buy(candle model.Candle, price, bbRate float64) (childOrderAccepta
 			return
 		}
 		// 証拠金の4倍でどれだけ買えるか調査
-		size = 1.0 / (ticker.BestAsk / useCurrency)
-		size = ai.AdjustSize(size)
+		ai.size = 1.0 / (ticker.BestAsk / useCurrency)
+		ai.size = ai.AdjustSize(ai.size)
 
-		params := map[string]string{
-			"product_code": "FX_BTC_JPY",
-		}
-		positionRes, _ := ai.API.GetPositions(params)
+		positionRes, _ := ai.getPositions()
 		fmt.Println("positionRessssssssssss")
 		fmt.Println(positionRes)
 		// positionResの中身
 		// (注文単位で配列で返却される)positionResが1以上の場合、注文を決済するのでSizeを格納する
 		if len(positionRes) > 0 {
 			// positionResがあった場合、sizeを初期化（上記で新規購入のsizeを出しているので決済のsizeで上書きする）
-			size = 0.0
+			ai.size = 0.0
 			for _, position := range positionRes {
-				size += position.Size
+				ai.size += position.Size
 				pnl += position.Pnl
 			}
-			size = math.Round(size*10000) / 10000
+			ai.size = math.Round(ai.size*10000) / 10000
 		}
-		if math.IsNaN(size) {
+		if math.IsNaN(ai.size) {
 			log.Println("sizeの計算が出来ませんでした。BUYを中止します。")
 			return
 		}
@@ -146,7 +253,7 @@ func (ai *AI) Buy(candle model.Candle, price, bbRate float64) (childOrderAccepta
 			ProductCode:     ai.ProductCode,
 			ChildOrderType:  "MARKET",
 			Side:            "BUY",
-			Size:            size,
+			Size:            ai.size,
 			MinuteToExpires: ai.MinuteToExpires,
 			TimeInForce:     "GTC",
 		}
@@ -163,42 +270,49 @@ func (ai *AI) Buy(candle model.Candle, price, bbRate float64) (childOrderAccepta
 			log.Printf("order=%+v status=no_id（不正なsize指定がされている可能性があります。）", order)
 			return
 		}
-		isOrderCompleted, orderPrice = ai.WaitUntilOrderComplete(childOrderAcceptanceID, pnl, bbRate)
+		isOrderCompleted, orderPrice = ai.WaitUntilOrderComplete(childOrderAcceptanceID, pnl, bbRate, contributions)
 		// continueフラグがtrueのときは連続売買する。positionResが0件のときは新規なのでReOpenはしない
-		if config.Config.Continue && len(positionRes) > 0 && !isShortProfit {
-			longReOpen = true
+		if config.Config.Continue && len(positionRes) > 0 && !ai.isShortProfit {
+			ai.longReOpen = true
 		}
 		// StopLimit後はreOpenしない
-		if (config.Config.Continue && isStopLimit) || !config.Config.Continue {
-			longReOpen = false
+		if (config.Config.Continue && ai.isStopLimit) || !config.Config.Continue {
+			ai.longReOpen = false
 		}
 		return childOrderAcceptanceID, isOrderCompleted, orderPrice
 	} else {
-		couldBuy := ai.SignalEvents.Buy(ai.ProductCode, time.Now(), candle.Close, 1.0, true, longReOpen, price, atr, pnl, bbRate)
-		utils.SendLine("couldBuy： " + strconv.FormatBool(couldBuy))
+		couldBuy := ai.SignalEvents.Buy(ai.ProductCode, ai.now(), candle.Close, 1.0, ai.replay == nil, ai.longReOpen, price, atr, pnl, bbRate, contributions)
+		ai.sendLine("couldBuy： " + strconv.FormatBool(couldBuy))
 		return "", couldBuy, candle.Close
 	}
 }
 
 /** bitflyer用のSELL */
-func (ai *AI) Sell(candle model.Candle, price, bbRate float64) (childOrderAcceptanceID string, isOrderCompleted bool, orderPrice float64) {
+func (ai *AI) Sell(candle model.Candle, price, bbRate float64, contributions map[string]float64) (childOrderAcceptanceID string, isOrderCompleted bool, orderPrice float64) {
 	orderPrice = 0.0
 	pnl := 0.0
-	size = 0.0
-	atr, _ := service.Atr(30)
+	ai.size = 0.0
+	atr, _ := ai.atr(30)
 
 	if ai.StartTrade.After(candle.Time) {
 		log.Println("candle.TimeがStartTradeより過去のため取引しません")
 		return "timeError", false, 0.0
 	}
 	// ロングの利益確定後にショートでインしないようにreOpenをfalseにする
-	if isLongProfit {
-		shortReOpen = false
+	if ai.isLongProfit {
+		ai.shortReOpen = false
 	}
-	if !ai.SignalEvents.CanSell(candle.Time, shortReOpen) {
+	if !ai.SignalEvents.CanSell(candle.Time, ai.shortReOpen) {
 		log.Println("canSell: falseのためreturn")
 		return
 	}
+	// 現物はショートできないため、ロングの建玉を決済する場合のみ売る
+	if bitflyer.IsSpot(ai.ProductCode) {
+		if trade, _ := ai.openTrade(); trade == nil || trade.Side != "BUY" {
+			log.Printf("product_code=%s 現物はショートできないため取引しません", ai.ProductCode)
+			return
+		}
+	}
 
 	if !ai.BackTest {
 		availableCurrency := ai.GetAvailableBalance()
@@ -213,27 +327,24 @@ func (ai *AI) Sell(candle model.Candle, price, bbRate float64) (childOrderAccept
 			return
 		}
 		// 証拠金の4倍でどれだけ買えるか調査
-		size = 1.0 / (ticker.BestAsk / useCurrency)
-		size = ai.AdjustSize(size)
+		ai.size = 1.0 / (ticker.BestAsk / useCurrency)
+		ai.size = ai.AdjustSize(ai.size)
 
-		params := map[string]string{
-			"product_code": "FX_BTC_JPY",
-		}
-		positionRes, _ := ai.API.GetPositions(params)
+		positionRes, _ := ai.getPositions()
 		fmt.Println("positionRessssssss")
 		fmt.Println(positionRes)
 		// (注文単位で配列で返却される)positionResが1以上の場合、注文を決済するのでSizeを格納する
 		// pnl: 利益
 		if len(positionRes) > 0 {
 			// positionResがあった場合、sizeを初期化（上記で新規購入のsizeを出しているので決済のsizeで上書きする）
-			size = 0.0
+			ai.size = 0.0
 			for _, position := range positionRes {
-				size += position.Size
+				ai.size += position.Size
 				pnl += position.Pnl
 			}
-			size = math.Round(size*10000) / 10000
+			ai.size = math.Round(ai.size*10000) / 10000
 		}
-		if math.IsNaN(size) {
+		if math.IsNaN(ai.size) {
 			log.Println("sizeの計算が出来ませんでした。SELLを中止します。")
 			return
 		}
@@ -241,7 +352,7 @@ func (ai *AI) Sell(candle model.Candle, price, bbRate float64) (childOrderAccept
 			ProductCode:     ai.ProductCode,
 			ChildOrderType:  "MARKET",
 			Side:            "SELL",
-			Size:            size,
+			Size:            ai.size,
 			MinuteToExpires: ai.MinuteToExpires,
 			TimeInForce:     "GTC",
 		}
@@ -257,74 +368,66 @@ func (ai *AI) Sell(candle model.Candle, price, bbRate float64) (childOrderAccept
 			return
 		}
 		childOrderAcceptanceID = resp.ChildOrderAcceptanceID
-		isOrderCompleted, orderPrice = ai.WaitUntilOrderComplete(childOrderAcceptanceID, pnl, bbRate)
+		isOrderCompleted, orderPrice = ai.WaitUntilOrderComplete(childOrderAcceptanceID, pnl, bbRate, contributions)
 		// continueフラグがtrueのときは連続売買する。positionResが0件のときは新規なのでReOpenはしない。ADD:ロングにて利益確定済みじゃないとき（isLongProfit）
-		if config.Config.Continue && len(positionRes) > 0 && !isLongProfit {
-			shortReOpen = true
+		if config.Config.Continue && len(positionRes) > 0 && !ai.isLongProfit {
+			ai.shortReOpen = true
 		}
 		// StopLimit後はreOpenしない
-		if (config.Config.Continue && isStopLimit) || !config.Config.Continue {
-			shortReOpen = false
+		if (config.Config.Continue && ai.isStopLimit) || !config.Config.Continue {
+			ai.shortReOpen = false
 		}
 		return childOrderAcceptanceID, isOrderCompleted, orderPrice
 	} else {
-		couldSell := ai.SignalEvents.Sell(ai.ProductCode, time.Now(), candle.Close, 1.0, true, shortReOpen, price, atr, pnl, bbRate)
-		utils.SendLine("couldSell： " + strconv.FormatBool(couldSell))
+		couldSell := ai.SignalEvents.Sell(ai.ProductCode, ai.now(), candle.Close, 1.0, ai.replay == nil, ai.shortReOpen, price, atr, pnl, bbRate, contributions)
+		ai.sendLine("couldSell： " + strconv.FormatBool(couldSell))
 		log.Printf("couldSell: %s", strconv.FormatBool(couldSell))
 		return "", couldSell, orderPrice
 	}
 }
 
-var profit float64    // オープン時に設定する1取引ごとの利益
-var stopLimit float64 // 損切りライン
-var atrRate float64   // atr率
-var isLongProfit bool
-var isShortProfit bool
-var size float64
-var sellOpen bool
-var buyOpen bool
-var isNoPosition bool // 取引中じゃない状態
-//var isCandleOpportunity bool // キャンドルでの取引機会（Profit以外を指す）
-var isStopLimit bool // 損切りを行った後にreOpenさせないためのフラグ
-
 //var count int
 
 func (ai *AI) Trade(ticker bitflyer.Ticker) {
-	eventLength := model.GetAllSignalEventsCount()
-
-	// TODO 関数にできる
-	if eventLength%2 == 0 {
-		isNoPosition = true
-	} else {
-		isNoPosition = false
+	// ポジションの有無は決済されていない建玉から判断する
+	openTrade, err := ai.openTrade()
+	if err != nil {
+		log.Printf("action=Trade err=%s", err.Error())
+		return
 	}
-	if !shortReOpen && !longReOpen && time.Now().Minute()%tradeDuration != 0 && time.Now().Second() != 0 && isNoPosition {
-		fmt.Printf("フラット（reOpenが無い && positionがない）状態かつ15分00秒じゃないため取引はしません。%s\n", time.Now().Truncate(time.Second))
+	ai.isNoPosition = openTrade == nil
+	if !ai.shortReOpen && !ai.longReOpen && ai.now().Minute()%ai.tradeDuration != 0 && ai.now().Second() != 0 && ai.isNoPosition {
+		fmt.Printf("フラット（reOpenが無い && positionがない）状態かつ15分00秒じゃないため取引はしません。%s\n", ai.now().Truncate(time.Second))
 		return
 	}
-	atr, _ := service.Atr(30)
+	atr, _ := ai.atr(30)
 	price := ticker.GetMidPrice()
 	// ボラティリティが低い時はトレードしない
 	fmt.Println(atr)
-	if atr > 0 && eventLength%2 == 0 {
-		atrRate = (float64(atr) / price) * 100
-		if atrRate < 0.10 {
-			log.Printf("低ボラティリティのため取引しません。（atrRate:%s\n", strconv.FormatFloat(atrRate, 'f', -1, 64))
-			atrRate = 0.0
+	if atr > 0 && ai.isNoPosition {
+		ai.atrRate = (float64(atr) / price) * 100
+		if ai.atrRate < 0.10 {
+			log.Printf("低ボラティリティのため取引しません。（atrRate:%s\n", strconv.FormatFloat(ai.atrRate, 'f', -1, 64))
+			ai.atrRate = 0.0
 			return
 		} else {
-			fmt.Printf("atrRate:%s\n", strconv.FormatFloat(atrRate, 'f', -1, 64))
+			fmt.Printf("atrRate:%s\n", strconv.FormatFloat(ai.atrRate, 'f', -1, 64))
 		}
 	}
-	fmt.Printf("eventLength:%s\n", strconv.Itoa(eventLength))
+	fmt.Printf("isNoPosition:%s\n", strconv.FormatBool(ai.isNoPosition))
 	// 取引が完了していたらParamsを更新する
-	if eventLength%2 == 0 {
+	if ai.isNoPosition {
 		reOpen := false
-		if longReOpen || shortReOpen {
+		if ai.longReOpen || ai.shortReOpen {
 			reOpen = true
 		}
 		if ai.OptimizedTradeParams == nil {
-			go ai.UpdateOptimizeParams(true, reOpen)
+			// バックテストの再生中は同期的に最適化する
+			if ai.replay != nil {
+				ai.UpdateOptimizeParams(true, reOpen)
+			} else {
+				go ai.UpdateOptimizeParams(true, reOpen)
+			}
 		}
 	}
 	// goroutineの同時実行数を制御
@@ -336,136 +439,31 @@ func (ai *AI) Trade(ticker bitflyer.Ticker) {
 	defer ai.TradeSemaphore.Release(1)
 	params := ai.OptimizedTradeParams
 	log.Println(params)
-	log.Printf("profit:%s\n", strconv.FormatFloat(profit, 'f', -1, 64))
+	log.Printf("profit:%s\n", strconv.FormatFloat(ai.profit, 'f', -1, 64))
 	if params == nil {
 		return
 	}
-	df, _ := service.GetAllCandle(ai.ProductCode, ai.Duration, ai.PastPeriod)
+	df, _ := ai.getDataFrame()
 	lenCandles := len(df.Candles)
-	params.EmaEnable = true
-	params.MacdEnable = true
-
-	// EMA
-	var emaValues1 []float64
-	var emaValues2 []float64
-	// var emaValues3 []float64
-	if params.EmaEnable {
-		emaValues1 = talib.Ema(df.Closes(), 7)
-		emaValues2 = talib.Ema(df.Closes(), 14)
-		// emaValues3 = talib.Ema(df.Closes(), 50)
-	}
-
-	// ボリンジャーバンド
-	var bbUp []float64
-	var bbDown []float64
-	params.BbEnable = true
-	if params.BbEnable {
-		bbUp, _, bbDown = talib.BBands(df.Closes(), 20, 2, 2, 0)
-	}
-
-	//// 一目均衡表
-	//var tenkan, kijun, senkouA, senkouB, chikou []float64
-	//if params.IchimokuEnable {
-	//	tenkan, kijun, senkouA, senkouB, chikou = tradingalgo.IchimokuCloud(df.Closes())
-	//}
-	//
-	// MACD
-	var outMACD, outMACDSignal, outMACDHist []float64
-	if params.MacdEnable {
-		outMACD, outMACDSignal, outMACDHist = talib.Macd(df.Closes(), params.MacdFastPeriod, params.MacdSlowPeriod, params.MacdSignalPeriod)
-	}
-	//
-	//// RSI
-	//var rsiValues []float64
-	//if params.RsiEnable {
-	//	rsiValues = talib.Rsi(df.Closes(), params.RsiPeriod)
-	//}
+	// 最適化したパラメータで判定する（戦略が使うインディケータのパラメータのみ使われる）
+	for _, strategy := range ai.SignalStrategies {
+		strategy.SetParams(*params)
+	}
+	if ai.Ensemble != nil {
+		ai.Ensemble.Learn(params)
+	}
+
+	// ボリンジャーバンド（利確・オープンの判定に使う）
+	bbUp, _, bbDown := talib.BBands(df.Closes(), 20, 2, 2, 0)
 	fmt.Printf("lenCandles:%s\n", strconv.Itoa(lenCandles))
 	for i := lenCandles - 2; i < lenCandles; i++ {
-		// 有効なインディケータの数
-		buyPoint, sellPoint := 0, 0
-		// ゴールデンクロス・デッドクロスが計算できる条件
-		if params.EmaEnable && params.EmaPeriod1 <= i && params.EmaPeriod2 <= i {
-			// ゴールデンクロス with MACD
-			// buyOpenのオープン
-			//log.Printf("MACDのロング条件??: %s\n", strconv.FormatBool((outMACD[i] > 0 || outMACDHist[i] > 0) && outMACD[i] >= outMACDSignal[i]))
-			//log.Printf("MACDのショート条件??: %s\n", strconv.FormatBool((outMACD[i] < 0 || outMACDHist[i] < 0) && outMACD[i] <= outMACDSignal[i]))
-			// ADD: #63 MACDのメインライン（outMACD[i]）が0より大きい && シグナル（outMACDSignal）より大きい を条件として追加
-			// #64 if !buyOpen && !sellOpen && emaValues1[i-1] < emaValues2[i-1] && emaValues1[i] >= emaValues2[i] && (outMACD[i] > 0 || outMACDHist[i] > 0) && outMACD[i] >= outMACDSignal[i] {
-			//	buyPoint++
-			//}
-			// buyOpenのオープン
-			if !buyOpen && !sellOpen && emaValues1[i-1] < emaValues2[i-1] && emaValues1[i] >= emaValues2[i] && (outMACD[i] > 0 || outMACDHist[i] > 0) && outMACD[i] >= outMACDSignal[i] {
-				buyPoint++
-			}
-			// buyOpenのクローズ
-			if buyOpen && !sellOpen && emaValues1[i-1] > emaValues2[i-1] && emaValues1[i] <= emaValues2[i] && (outMACD[i] < 0 || outMACDHist[i] < 0) && outMACD[i] <= outMACDSignal[i] {
-				sellPoint++
-			}
-			// デッドクロス
-			// sellOpenのオープン
-			// ADD: #63 MACDのメインライン（outMACD[i]）が0より小さい && シグナル（outMACDSignal）より小さい を条件として追加
-			// #64 if !buyOpen && !sellOpen && emaValues1[i-1] > emaValues2[i-1] && emaValues1[i] <= emaValues2[i] && (outMACD[i] < 0 || outMACDHist[i] < 0) && outMACD[i] <= outMACDSignal[i] {
-			//	sellPoint++
-			//}
-			// ショートのオープン
-			if !buyOpen && !sellOpen && emaValues1[i-1] > emaValues2[i-1] && emaValues1[i] <= emaValues2[i] && (outMACD[i] < 0 || outMACDHist[i] < 0) && outMACD[i] <= outMACDSignal[i] { // && pauseDone
-				sellPoint++
-			}
-			// sellOpenのクローズ ADD: #63 MACDのメインライン（outMACD[i]）が0より大きい && シグナル（outMACDSignal）より大きい を条件として追加
-			if sellOpen && !buyOpen && emaValues1[i-1] < emaValues2[i-1] && emaValues1[i] >= emaValues2[i] && (outMACD[i] > 0 || outMACDHist[i] > 0) && outMACD[i] >= outMACDSignal[i] {
-				buyPoint++
-			}
+		if i < 0 {
+			continue
 		}
+		// i本目のキャンドルでシグナルを出した戦略の数
+		window := &model.DataFrameCandle{ProductCode: df.ProductCode, Duration: df.Duration, Candles: df.Candles[:i+1]}
+		buyPoint, sellPoint, contributions := ai.signalPoints(window)
 
-		// ボリンジャーバンド
-		//if params.BbEnable && params.BbN <= i {
-		//	// 上抜け（買い）
-		//	if bbDown[i-1] > df.Candles[i-1].Close && bbDown[i] <= df.Candles[i].Close {
-		//		sellPoint++
-		//	}
-		//	// 下抜け（売り）
-		//	if bbUp[i-1] < df.Candles[i-1].Close && bbUp[i] >= df.Candles[i].Close {
-		//		sellPoint++
-		//	}
-		//}
-
-		//// MACD
-		//if params.MacdEnable {
-		//	// 上抜け（買い）
-		//	if outMACD[i] < 0 && outMACDSignal[i] < 0 && outMACD[i-1] < outMACDSignal[i-1] && outMACD[i] >= outMACDSignal[i] {
-		//		buyPoint++
-		//	}
-		//	// 下抜け（売り）
-		//	if outMACD[i] > 0 && outMACDSignal[i] > 0 && outMACD[i-1] > outMACDSignal[i-1] && outMACD[i] <= outMACDSignal[i] {
-		//		sellPoint++
-		//	}
-		//}
-		//// 一目均衡表
-		//if params.IchimokuEnable {
-		//	if chikou[i-1] < df.Candles[i-1].High && chikou[i] >= df.Candles[i].High &&
-		//		senkouA[i] < df.Candles[i].Low && senkouB[i] < df.Candles[i].Low &&
-		//		tenkan[i] > kijun[i] {
-		//		buyPoint++
-		//	}
-		//
-		//	if chikou[i-1] > df.Candles[i-1].Low && chikou[i] <= df.Candles[i].Low &&
-		//		senkouA[i] > df.Candles[i].High && senkouB[i] > df.Candles[i].High &&
-		//		tenkan[i] < kijun[i] {
-		//		sellPoint++
-		//	}
-		//}
-		//// RSI
-		//if params.RsiEnable && rsiValues[i-1] != 0 && rsiValues[i-1] != 100 {
-		//	// 30% 上抜け（買い）
-		//	if rsiValues[i-1] < params.RsiBuyThread && rsiValues[i] >= params.RsiBuyThread {
-		//		buyPoint++
-		//	}
-		//	// 70% 下抜け（売り）
-		//	if rsiValues[i-1] > params.RsiSellThread && rsiValues[i] <= params.RsiSellThread {
-		//		sellPoint++
-		//	}
-		//}
 		// オープンの場合はbuyPoint,sellPointどちらかが2以上のときでStopLimitを設定する
 		bbRate := 1.0
 		bbWith := 0.0
@@ -479,36 +477,36 @@ func (ai *AI) Trade(ticker bitflyer.Ticker) {
 		if len(bbUp) >= i && len(bbDown) >= i {
 			bbWith = (bbUp[i] / bbDown[i]) - 1.0
 		}
-		log.Printf("オープン可能かどうか：%s\n", strconv.FormatBool(isNoPosition && bbWith > config.Config.OpenableBbWith && bbRate < config.Config.OpenableBbRate || (shortReOpen || longReOpen)))
+		log.Printf("オープン可能かどうか：%s\n", strconv.FormatBool(ai.isNoPosition && bbWith > config.Config.OpenableBbWith && bbRate < config.Config.OpenableBbRate || (ai.shortReOpen || ai.longReOpen)))
 		log.Println("--------------------------以下、詳細です--------------------------")
 		log.Printf("bbRate:%s\n", strconv.FormatFloat(bbRate, 'f', -1, 64))
 		log.Printf("bbWith:%s\n", strconv.FormatFloat(bbWith, 'f', -1, 64))
-		log.Printf("isNoPosition:%s\n", strconv.FormatBool(isNoPosition))
-		log.Printf("sellOpen?:%s\n", strconv.FormatBool(sellOpen))
-		log.Printf("buyOpen?:%s\n", strconv.FormatBool(buyOpen))
-		if time.Now().Minute() == 0 || (shortReOpen || longReOpen) {
-			if isNoPosition && bbWith > config.Config.OpenableBbWith && bbRate < config.Config.OpenableBbRate || (shortReOpen || longReOpen) {
+		log.Printf("isNoPosition:%s\n", strconv.FormatBool(ai.isNoPosition))
+		log.Printf("sellOpen?:%s\n", strconv.FormatBool(ai.sellOpen))
+		log.Printf("buyOpen?:%s\n", strconv.FormatBool(ai.buyOpen))
+		if ai.now().Minute() == 0 || (ai.shortReOpen || ai.longReOpen) {
+			if ai.isNoPosition && bbWith > config.Config.OpenableBbWith && bbRate < config.Config.OpenableBbRate || (ai.shortReOpen || ai.longReOpen) {
 				// 1つでも買いのインディケータがあれば買い
 				// #64 if sellPoint > buyPoint || (shortReOpen && (outMACD[i] < 0 || outMACDHist[i] < 0) && outMACD[i] <= outMACDSignal[i]) {
 				log.Printf("ショート？？:%s\n", strconv.FormatBool(sellPoint > buyPoint))
-				if sellPoint > buyPoint || shortReOpen {
-					childOrderAcceptanceID, isOrderCompleted, orderPrice := ai.Sell(df.Candles[i], price, bbRate)
+				if sellPoint > buyPoint || ai.shortReOpen {
+					childOrderAcceptanceID, isOrderCompleted, orderPrice := ai.Sell(df.Candles[i], price, bbRate, contributions)
 					log.Printf("childOrderAcceptanceID: %s", childOrderAcceptanceID)
 					if childOrderAcceptanceID == "timeError" {
 						continue
 					}
 					if !isOrderCompleted {
-						utils.SendLine("オープンショート：注文が保存できませんでした。logを確認してください。")
+						ai.sendLine("オープンショート：注文が保存できませんでした。logを確認してください。")
 						log.Println("オープンショート：注文が保存できませんでした。logを確認してください。")
 						continue
 					}
 					// StopLimit後のオープンの場合はisStopLimitを初期化する
-					if isStopLimit {
-						isStopLimit = false
+					if ai.isStopLimit {
+						ai.isStopLimit = false
 					}
 					// ロングの利確後のオープンの場合はisLongProfitを初期化する
-					if isLongProfit {
-						isLongProfit = false
+					if ai.isLongProfit {
+						ai.isLongProfit = false
 					}
 					log.Printf("bbRate:%s\n", strconv.FormatFloat(bbRate, 'f', -1, 64))
 					if ai.BackTest {
@@ -518,54 +516,54 @@ func (ai *AI) Trade(ticker bitflyer.Ticker) {
 					// オープン時にボリンジャーバンドの下抜け値をターゲットに設定
 					if len(bbDown) >= i {
 						//profit = bbDown[i] * 0.997
-						profit = bbDown[i] * 0.99
+						ai.profit = bbDown[i] * 0.99
 						//profit = orderPrice * 0.9997
-						log.Printf("profit(bbDownから):%s\n", strconv.FormatFloat(profit, 'f', -1, 64))
+						log.Printf("profit(bbDownから):%s\n", strconv.FormatFloat(ai.profit, 'f', -1, 64))
 					} else {
-						profit = math.Floor(orderPrice*0.975*10000) / 10000
+						ai.profit = math.Floor(orderPrice*0.975*10000) / 10000
 						//profit = math.Floor(orderPrice*0.9995*10000) / 10000
-						log.Printf("profit(bbDownから取れなかったのでパーセントで出す):%s\n", strconv.FormatFloat(profit, 'f', -1, 64))
+						log.Printf("profit(bbDownから取れなかったのでパーセントで出す):%s\n", strconv.FormatFloat(ai.profit, 'f', -1, 64))
 					}
 					// ボリンジャーバンドの下抜け値がorderPriceより小さかったらorderPriceから利益を算出する
 					if len(bbDown) >= i {
 						if orderPrice < bbDown[i] {
 							log.Println("急激な値の変化です。bbandsは使わずに%で利益を決定します。")
-							profit = math.Floor(orderPrice*0.975*10000) / 10000
+							ai.profit = math.Floor(orderPrice*0.975*10000) / 10000
 							//profit = math.Floor(orderPrice*0.9995*10000) / 10000
-							log.Println(profit)
+							log.Println(ai.profit)
 						}
 					}
-					stopLimit = orderPrice * (1.0 + (1.0 - ai.StopLimitPercent))
+					ai.stopLimit = orderPrice * (1.0 + (1.0 - ai.StopLimitPercent))
 					log.Printf("orderPrice:%s\n", strconv.FormatFloat(orderPrice, 'f', -1, 64))
-					log.Printf("profit:%s\n", strconv.FormatFloat(profit, 'f', -1, 64))
+					log.Printf("profit:%s\n", strconv.FormatFloat(ai.profit, 'f', -1, 64))
 					log.Println("sellOpenのオープン")
-					utils.SendLine("ショートのオープン（sell): " + strconv.FormatFloat(orderPrice, 'f', -1, 64) + "\nstopLimit: " + strconv.FormatFloat(stopLimit, 'f', -1, 64) + "\nbbRate: " + strconv.FormatFloat(bbRate, 'f', -1, 64) + "\nbbWith: " + strconv.FormatFloat(bbWith, 'f', -1, 64))
-					sellOpen = true
-					if shortReOpen {
+					ai.sendLine("ショートのオープン（sell): " + strconv.FormatFloat(orderPrice, 'f', -1, 64) + "\nstopLimit: " + strconv.FormatFloat(ai.stopLimit, 'f', -1, 64) + "\nbbRate: " + strconv.FormatFloat(bbRate, 'f', -1, 64) + "\nbbWith: " + strconv.FormatFloat(bbWith, 'f', -1, 64))
+					ai.sellOpen = true
+					if ai.shortReOpen {
 						log.Println("shortReOpen成功")
-						shortReOpen = false
+						ai.shortReOpen = false
 					}
 				}
 				// #64
 				//if buyPoint > sellPoint || (longReOpen && (outMACD[i] > 0 || outMACDHist[i] > 0) && outMACD[i] >= outMACDSignal[i]) {
 				log.Printf("ロング？？buyPoint > sellPoint:%s\n", strconv.FormatBool(buyPoint > sellPoint))
-				if buyPoint > sellPoint || longReOpen {
-					childOrderAcceptanceID, isOrderCompleted, orderPrice := ai.Buy(df.Candles[i], price, bbRate)
+				if buyPoint > sellPoint || ai.longReOpen {
+					childOrderAcceptanceID, isOrderCompleted, orderPrice := ai.Buy(df.Candles[i], price, bbRate, contributions)
 					if childOrderAcceptanceID == "timeError" {
 						continue
 					}
 					if !isOrderCompleted {
-						utils.SendLine("オープンロング：注文が保存できませんでした。logを確認してください。")
+						ai.sendLine("オープンロング：注文が保存できませんでした。logを確認してください。")
 						log.Println("オープンロング：注文が保存できませんでした。logを確認してください。")
 						continue
 					}
 					// StopLimit後のオープンの場合はisStopLimitを初期化する
-					if isStopLimit {
-						isStopLimit = false
+					if ai.isStopLimit {
+						ai.isStopLimit = false
 					}
 					// ショートの利確後のオープンの場合はisShortProfitを初期化する
-					if isShortProfit {
-						isShortProfit = false
+					if ai.isShortProfit {
+						ai.isShortProfit = false
 					}
 					log.Printf("bbRate:%s\n", strconv.FormatFloat(bbRate, 'f', -1, 64))
 					if ai.BackTest {
@@ -575,32 +573,32 @@ func (ai *AI) Trade(ticker bitflyer.Ticker) {
 					// オープン時にボリンジャーバンドの上抜けけ値をターゲットに設定
 					if len(bbUp) >= i {
 						//profit = bbUp[i] * 1.003
-						profit = bbUp[i] * 1.01
+						ai.profit = bbUp[i] * 1.01
 						// profit = bbUp[i]
 						//profit = orderPrice * 1.0003
-						log.Printf("profit(bbUpから):%s\n", strconv.FormatFloat(profit, 'f', -1, 64))
+						log.Printf("profit(bbUpから):%s\n", strconv.FormatFloat(ai.profit, 'f', -1, 64))
 					} else {
-						profit = math.Floor(orderPrice*1.025*10000) / 10000
+						ai.profit = math.Floor(orderPrice*1.025*10000) / 10000
 						//profit = math.Floor(orderPrice*1.0005*10000) / 10000
-						log.Printf("profit(bbUpから取れなかったのでパーセントで):%s\n", strconv.FormatFloat(profit, 'f', -1, 64))
+						log.Printf("profit(bbUpから取れなかったのでパーセントで):%s\n", strconv.FormatFloat(ai.profit, 'f', -1, 64))
 					}
 					if len(bbUp) >= i {
 						if orderPrice > bbUp[i] {
 							log.Println("急激な値の変化です。bbandsは使わずに%で利益を決定します。")
-							profit = math.Floor(orderPrice*1.025*10000) / 10000
+							ai.profit = math.Floor(orderPrice*1.025*10000) / 10000
 							//profit = math.Floor(orderPrice* 1.0005*10000) / 10000
-							log.Println(profit)
+							log.Println(ai.profit)
 						}
 					}
-					stopLimit = orderPrice * ai.StopLimitPercent
+					ai.stopLimit = orderPrice * ai.StopLimitPercent
 					log.Printf("orderPrice:%s\n", strconv.FormatFloat(orderPrice, 'f', -1, 64))
-					log.Printf("profit:%s\n", strconv.FormatFloat(profit, 'f', -1, 64))
+					log.Printf("profit:%s\n", strconv.FormatFloat(ai.profit, 'f', -1, 64))
 					log.Println("buyOpenのオープン")
-					utils.SendLine("ロングのオープン（buy): " + strconv.FormatFloat(orderPrice, 'f', -1, 64) + "\nstopLimit: " + strconv.FormatFloat(stopLimit, 'f', -1, 64) + "\nbbRate: " + strconv.FormatFloat(bbRate, 'f', -1, 64) + "\nbbWith: " + strconv.FormatFloat(bbWith, 'f', -1, 64))
-					buyOpen = true
-					if longReOpen {
+					ai.sendLine("ロングのオープン（buy): " + strconv.FormatFloat(orderPrice, 'f', -1, 64) + "\nstopLimit: " + strconv.FormatFloat(ai.stopLimit, 'f', -1, 64) + "\nbbRate: " + strconv.FormatFloat(bbRate, 'f', -1, 64) + "\nbbWith: " + strconv.FormatFloat(bbWith, 'f', -1, 64))
+					ai.buyOpen = true
+					if ai.longReOpen {
 						log.Println("longReOpen成功")
-						longReOpen = false
+						ai.longReOpen = false
 					}
 				}
 			}
@@ -609,68 +607,68 @@ func (ai *AI) Trade(ticker bitflyer.Ticker) {
 		// クローズ時はbuyPoint, sellPointどちらも1以上でParamsをUpdateしてStopLimitを初期化
 		// sellOpenのクローズ（buyPointにてクローズする場合は15分単位のみ）
 		//if sellOpen == true && (buyPoint > 0 || price <= profit || price >= stopLimit) {
-		if sellOpen {
-			log.Printf("クローズsellOpen?:%s\n", strconv.FormatBool(sellOpen))
+		if ai.sellOpen {
+			log.Printf("クローズsellOpen?:%s\n", strconv.FormatBool(ai.sellOpen))
 			log.Printf("クローズショート？？buyPoint > sellPoint:%s\n", strconv.FormatBool(buyPoint > sellPoint))
-			log.Printf("クローズショート？？price <= profit:%s\n", strconv.FormatBool(price <= profit))
-			log.Printf("クローズショート？？総合判定:%s\n", strconv.FormatBool((buyPoint > 0 && time.Now().Minute()%tradeDuration == 0 && time.Now().Second() < 5) || (price <= profit || price >= stopLimit)))
-			if buyPoint > 0 || price <= profit || price >= stopLimit {
-				_, isOrderCompleted, _ := ai.Buy(df.Candles[i], price, bbRate)
+			log.Printf("クローズショート？？price <= profit:%s\n", strconv.FormatBool(price <= ai.profit))
+			log.Printf("クローズショート？？総合判定:%s\n", strconv.FormatBool((buyPoint > 0 && ai.now().Minute()%ai.tradeDuration == 0 && ai.now().Second() < 5) || (price <= ai.profit || price >= ai.stopLimit)))
+			if buyPoint > 0 || price <= ai.profit || price >= ai.stopLimit {
+				_, isOrderCompleted, _ := ai.Buy(df.Candles[i], price, bbRate, contributions)
 				if !isOrderCompleted {
-					utils.SendLine("クローズショート：注文が保存できませんでした。logを確認してください。")
+					ai.sendLine("クローズショート：注文が保存できませんでした。logを確認してください。")
 					log.Println("クローズショート：注文が保存できませんでした。logを確認してください。")
 					continue
 				}
-				if price <= profit {
-					isShortProfit = true
+				if price <= ai.profit {
+					ai.isShortProfit = true
 				}
-				if price >= stopLimit {
+				if price >= ai.stopLimit {
 					log.Println("損切り")
-					isStopLimit = true
+					ai.isStopLimit = true
 				}
-				utils.SendLine("ショートのクローズ（buy): " + strconv.FormatFloat(price, 'f', -1, 64))
+				ai.sendLine("ショートのクローズ（buy): " + strconv.FormatFloat(price, 'f', -1, 64))
 				fmt.Printf("priceの値:%s\n", strconv.FormatFloat(price, 'f', -1, 64))
-				fmt.Printf("isProfit??: %s\n", strconv.FormatBool(price <= profit))
-				fmt.Printf("Profitの値:%s\n", strconv.FormatFloat(profit, 'f', -1, 64))
-				fmt.Printf("isStopLimit??: %s\n", strconv.FormatBool(price >= stopLimit))
-				fmt.Printf("StopLimitの値:%s\n", strconv.FormatFloat(stopLimit, 'f', -1, 64))
+				fmt.Printf("isProfit??: %s\n", strconv.FormatBool(price <= ai.profit))
+				fmt.Printf("Profitの値:%s\n", strconv.FormatFloat(ai.profit, 'f', -1, 64))
+				fmt.Printf("isStopLimit??: %s\n", strconv.FormatBool(price >= ai.stopLimit))
+				fmt.Printf("StopLimitの値:%s\n", strconv.FormatFloat(ai.stopLimit, 'f', -1, 64))
 				log.Println("sellOpenのクローズ")
-				sellOpen = false
-				profit = 0.0
-				stopLimit = 0.0
+				ai.sellOpen = false
+				ai.profit = 0.0
+				ai.stopLimit = 0.0
 				// ai.UpdateOptimizeParams(true)
 			}
 		}
 		// buyOpenのクローズ（sellPointにてクローズする場合は15分単位のみ）
-		if buyOpen {
-			log.Printf("クローズbuyOpen?:%s\n", strconv.FormatBool(buyOpen))
+		if ai.buyOpen {
+			log.Printf("クローズbuyOpen?:%s\n", strconv.FormatBool(ai.buyOpen))
 			log.Printf("クローズロングbuyPoint > sellPoint:%s\n", strconv.FormatBool(buyPoint < sellPoint))
-			log.Printf("クローズロングprice >= profit:%s\n", strconv.FormatBool(price >= profit))
-			log.Printf("クローズロング最終判定:%s\n", strconv.FormatBool((sellPoint > 0 && time.Now().Minute()%tradeDuration == 0 && time.Now().Second() < 5) || (price >= profit || price <= stopLimit)))
-			if sellPoint > 0 || price >= profit || price <= stopLimit {
-				_, isOrderCompleted, _ := ai.Sell(df.Candles[i], price, bbRate)
+			log.Printf("クローズロングprice >= profit:%s\n", strconv.FormatBool(price >= ai.profit))
+			log.Printf("クローズロング最終判定:%s\n", strconv.FormatBool((sellPoint > 0 && ai.now().Minute()%ai.tradeDuration == 0 && ai.now().Second() < 5) || (price >= ai.profit || price <= ai.stopLimit)))
+			if sellPoint > 0 || price >= ai.profit || price <= ai.stopLimit {
+				_, isOrderCompleted, _ := ai.Sell(df.Candles[i], price, bbRate, contributions)
 				if !isOrderCompleted {
-					utils.SendLine("クローズロング：注文が保存できませんでした。logを確認してください。")
+					ai.sendLine("クローズロング：注文が保存できませんでした。logを確認してください。")
 					log.Println("クローズロング：注文が保存できませんでした。logを確認してください。")
 					continue
 				}
-				if price >= profit {
-					isLongProfit = true
+				if price >= ai.profit {
+					ai.isLongProfit = true
 				}
-				if price <= stopLimit {
+				if price <= ai.stopLimit {
 					log.Println("損切り")
-					isStopLimit = true
+					ai.isStopLimit = true
 				}
-				utils.SendLine("ロングのクローズ（sell): " + strconv.FormatFloat(price, 'f', -1, 64))
+				ai.sendLine("ロングのクローズ（sell): " + strconv.FormatFloat(price, 'f', -1, 64))
 				log.Println("buyOpenのクローズ")
 				fmt.Printf("priceの値:%s\n", strconv.FormatFloat(price, 'f', -1, 64))
-				fmt.Printf("isProfit??: %s\n", strconv.FormatBool(price <= profit))
-				fmt.Printf("Profitの値:%s\n", strconv.FormatFloat(profit, 'f', -1, 64))
-				fmt.Printf("isStopLimit??: %s\n", strconv.FormatBool(price >= stopLimit))
-				fmt.Printf("StopLimitの値:%s\n", strconv.FormatFloat(stopLimit, 'f', -1, 64))
-				buyOpen = false
-				profit = 0.0
-				stopLimit = 0.0
+				fmt.Printf("isProfit??: %s\n", strconv.FormatBool(price <= ai.profit))
+				fmt.Printf("Profitの値:%s\n", strconv.FormatFloat(ai.profit, 'f', -1, 64))
+				fmt.Printf("isStopLimit??: %s\n", strconv.FormatBool(price >= ai.stopLimit))
+				fmt.Printf("StopLimitの値:%s\n", strconv.FormatFloat(ai.stopLimit, 'f', -1, 64))
+				ai.buyOpen = false
+				ai.profit = 0.0
+				ai.stopLimit = 0.0
 				// ai.UpdateOptimizeParams(true)
 			}
 		}
@@ -696,12 +694,65 @@ func (ai *AI) Trade(ticker bitflyer.Ticker) {
 	}
 }
 
+/*
+windowの最後のキャンドルで買い・売りのシグナルを出した戦略の数
+アンサンブルが有効な場合は閾値を超えた方向を1とし、売買イベントに記録するインディケータごとのスコアも返す
+*/
+func (ai *AI) signalPoints(window *model.DataFrameCandle) (buyPoint, sellPoint int, contributions map[string]float64) {
+	if ai.Ensemble != nil {
+		decision := ai.Ensemble.Decide(window)
+		log.Printf("action=signalPoints side=%s score=%v contributions=%v", decision.Side, decision.Score, decision.Contributions)
+		switch {
+		// ロングのオープン・ショートのクローズ（ロング中は数えない）
+		case decision.Side == "BUY" && !ai.buyOpen:
+			buyPoint++
+		// ショートのオープン・ロングのクローズ（ショート中は数えない）
+		case decision.Side == "SELL" && !ai.sellOpen:
+			sellPoint++
+		}
+		// シグナルが出ていないキャンドルでの売買（利確・損切り）にはスコアを記録しない
+		if decision.Side != "" {
+			contributions = decision.Contributions
+		}
+		return buyPoint, sellPoint, contributions
+	}
+	for _, strategy := range ai.SignalStrategies {
+		switch strategy.OnCandle(window).Side {
+		// ロングのオープン・ショートのクローズ（ロング中は数えない）
+		case "BUY":
+			if !ai.buyOpen {
+				buyPoint++
+			}
+		// ショートのオープン・ロングのクローズ（ショート中は数えない）
+		case "SELL":
+			if !ai.sellOpen {
+				sellPoint++
+			}
+		}
+	}
+	return buyPoint, sellPoint, nil
+}
+
 /** 使用できる証拠金と取引中かどうかを返す
-availableCurrency: 使用可能な証拠金
+availableCurrency: 使用可能な証拠金（現物は日本円の残高）
 isTrading: 取引中かどうか
 */
 func (ai *AI) GetAvailableBalance() (availableCurrency float64) {
 	//isTrading = false
+	// 現物は証拠金を使えないため、日本円（CoinCode）の残高のうち使えるものを返す
+	if bitflyer.IsSpot(ai.ProductCode) {
+		balances, err := ai.API.GetBalance()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		for _, balance := range balances {
+			if balance.CurrencyCode == ai.CoinCode {
+				return balance.Available
+			}
+		}
+		return
+	}
 	balances, err := ai.API.GetCollateral()
 	if err != nil {
 		log.Println(err)
@@ -715,9 +766,66 @@ func (ai *AI) AdjustSize(size float64) float64 {
 	return math.Floor(size*10000) / 10000
 }
 
+/** 現在時刻（バックテストの再生中は再生しているキャンドル、キャンドルの確定で取引している間は確定したキャンドルのクローズ時刻） */
+func (ai *AI) now() time.Time {
+	if ai.replay != nil {
+		return ai.replay.now
+	}
+	ai.tickerMu.Lock()
+	defer ai.tickerMu.Unlock()
+	if !ai.closeTime.IsZero() {
+		return ai.closeTime
+	}
+	return time.Now()
+}
+
+/** 取引に使うキャンドル（バックテストの再生中は再生位置までのキャンドル） */
+func (ai *AI) getDataFrame() (*model.DataFrameCandle, error) {
+	if ai.replay != nil {
+		return ai.replay.dataFrame(ai.PastPeriod), nil
+	}
+	return service.GetAllCandle(ai.ProductCode, ai.Duration, ai.PastPeriod)
+}
+
+/** 1分足のATR（バックテストの再生中は再生位置までの1分足で算出する） */
+func (ai *AI) atr(limit int) (int, error) {
+	if ai.replay != nil {
+		return ai.replay.atr(limit), nil
+	}
+	return service.Atr(ai.ProductCode, limit)
+}
+
+/** 決済されていない建玉（バックテストの再生中はメモリ上の売買イベントから判断する） */
+func (ai *AI) openTrade() (*model.Trade, error) {
+	if ai.replay != nil {
+		return ai.SignalEvents.OpenTrade(), nil
+	}
+	return model.GetOpenTrade(ai.ProductCode)
+}
+
+/** 決済する建玉（現物はgetpositionsで取得できないため、決済されていない建玉のサイズを使う） */
+func (ai *AI) getPositions() ([]bitflyer.Position, error) {
+	if !bitflyer.IsSpot(ai.ProductCode) {
+		return ai.API.GetPositions(map[string]string{"product_code": ai.ProductCode})
+	}
+	trade, err := ai.openTrade()
+	if err != nil || trade == nil {
+		return nil, err
+	}
+	return []bitflyer.Position{{ProductCode: trade.ProductCode, Side: trade.Side, Price: trade.Open.Price, Size: trade.Size}}, nil
+}
+
+/** LINE通知（バックテストの再生中は通知しない） */
+func (ai *AI) sendLine(message string) {
+	if ai.replay != nil {
+		return
+	}
+	utils.SendLine(message)
+}
+
 /** 注文が確定したかを確認し、signalEventsテーブルに売買情報を保存する */
-func (ai *AI) WaitUntilOrderComplete(childOrderAcceptanceID string, pnl, bbRate float64) (bool, float64) {
-	atr, _ := service.Atr(30)
+func (ai *AI) WaitUntilOrderComplete(childOrderAcceptanceID string, pnl, bbRate float64, contributions map[string]float64) (bool, float64) {
+	atr, _ := service.Atr(ai.ProductCode, 30)
 	params := map[string]string{
 		"product_code":              ai.ProductCode,
 		"child_order_acceptance_id": childOrderAcceptanceID,
@@ -741,14 +849,14 @@ func (ai *AI) WaitUntilOrderComplete(childOrderAcceptanceID string, pnl, bbRate
 				order := listOrders[0]
 				if order.ChildOrderState == "COMPLETED" {
 					if order.Side == "BUY" {
-						couldBuy := ai.SignalEvents.Buy(ai.ProductCode, time.Now().Truncate(time.Second), order.AveragePrice, order.Size, true, longReOpen, order.AveragePrice, atr, pnl, bbRate)
+						couldBuy := ai.SignalEvents.Buy(ai.ProductCode, time.Now().Truncate(time.Second), order.AveragePrice, order.Size, true, ai.longReOpen, order.AveragePrice, atr, pnl, bbRate, contributions)
 						if !couldBuy {
 							log.Printf("status=buy childOrderAcceptanceID=%s order=%+v", childOrderAcceptanceID, order)
 						}
 						return couldBuy, order.AveragePrice
 					}
 					if order.Side == "SELL" {
-						couldSell := ai.SignalEvents.Sell(ai.ProductCode, time.Now().Truncate(time.Second), order.AveragePrice, order.Size, true, shortReOpen, order.AveragePrice, atr, pnl, bbRate)
+						couldSell := ai.SignalEvents.Sell(ai.ProductCode, time.Now().Truncate(time.Second), order.AveragePrice, order.Size, true, ai.shortReOpen, order.AveragePrice, atr, pnl, bbRate, contributions)
 						if !couldSell {
 							log.Printf("status=sell childOrderAcceptanceID=%s order=%+v", childOrderAcceptanceID, order)
 						}
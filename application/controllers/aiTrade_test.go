@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"app/bitflyer"
+	"app/domain/model"
+	"app/domain/repository"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// テスト用の取引所
+type fakeExchange struct {
+	collateral   *bitflyer.Collateral
+	balances     []bitflyer.Balance
+	ticker       *bitflyer.Ticker
+	positions    []bitflyer.Position
+	orders       []bitflyer.Order
+	sent         []bitflyer.Order
+	parentOrders []bitflyer.ParentOrder
+	err          error
+}
+
+func (f *fakeExchange) SendOrder(order *bitflyer.Order) (*bitflyer.ResponseSendChildOrder, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.sent = append(f.sent, *order)
+	return &bitflyer.ResponseSendChildOrder{ChildOrderAcceptanceID: "JRF-TEST"}, nil
+}
+
+func (f *fakeExchange) ListOrder(query map[string]string) ([]bitflyer.Order, error) {
+	return f.orders, f.err
+}
+
+func (f *fakeExchange) GetPositions(query map[string]string) ([]bitflyer.Position, error) {
+	return f.positions, f.err
+}
+
+func (f *fakeExchange) GetCollateral() (*bitflyer.Collateral, error) {
+	return f.collateral, f.err
+}
+
+func (f *fakeExchange) GetBalance() ([]bitflyer.Balance, error) {
+	return f.balances, f.err
+}
+
+func (f *fakeExchange) GetTicker(productCode string) (*bitflyer.Ticker, error) {
+	return f.ticker, f.err
+}
+
+func (f *fakeExchange) GetTradingCommission(productCode string) (*bitflyer.TradingCommission, error) {
+	return &bitflyer.TradingCommission{}, f.err
+}
+
+func (f *fakeExchange) SendParentOrder(order *bitflyer.ParentOrder) (*bitflyer.ResponseSendParentOrder, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.parentOrders = append(f.parentOrders, *order)
+	return &bitflyer.ResponseSendParentOrder{ParentOrderAcceptanceID: "JRF-PARENT-TEST"}, nil
+}
+
+func (f *fakeExchange) GetRealTimeTicker(ctx context.Context, symbol string, ch chan<- bitflyer.Ticker) {
+	defer close(ch)
+	if f.ticker != nil {
+		ch <- *f.ticker
+	}
+}
+
+func (f *fakeExchange) GetRealTimeExecutions(ctx context.Context, symbol string, ch chan<- bitflyer.Execution) {
+	close(ch)
+}
+
+func (f *fakeExchange) GetRealTimeBoard(ctx context.Context, symbol string, ch chan<- bitflyer.Board) {
+	close(ch)
+}
+
+func TestGetAvailableBalance(t *testing.T) {
+	ai := &AI{API: &fakeExchange{collateral: &bitflyer.Collateral{Collateral: 100000}}}
+	if got := ai.GetAvailableBalance(); got != 100000 {
+		t.Errorf("GetAvailableBalance() = %v, want 100000", got)
+	}
+
+	ai = &AI{API: &fakeExchange{err: errors.New("unavailable")}}
+	if got := ai.GetAvailableBalance(); got != 0 {
+		t.Errorf("GetAvailableBalance() with error = %v, want 0", got)
+	}
+
+	// 現物は証拠金ではなく日本円の残高を使う
+	exchange := &fakeExchange{
+		collateral: &bitflyer.Collateral{Collateral: 100000},
+		balances:   []bitflyer.Balance{{CurrencyCode: "BTC", Amount: 1, Available: 1}, {CurrencyCode: "JPY", Amount: 50000, Available: 30000}},
+	}
+	ai = &AI{API: exchange, ProductCode: "BTC_JPY", CoinCode: "JPY"}
+	if got := ai.GetAvailableBalance(); got != 30000 {
+		t.Errorf("GetAvailableBalance() spot = %v, want 30000", got)
+	}
+}
+
+func TestSpotPositions(t *testing.T) {
+	model.SetSignalEventRepository(repository.NewMemorySignalEventRepository())
+	exchange := &fakeExchange{positions: []bitflyer.Position{{ProductCode: "FX_BTC_JPY", Side: "BUY", Size: 0.5}}}
+	ai := &AI{API: exchange, ProductCode: "ETH_JPY"}
+	// 現物は建玉がなければ決済しない（取引所のgetpositionsは使わない）
+	if positions, err := ai.getPositions(); err != nil || len(positions) != 0 {
+		t.Errorf("getPositions() = %+v, %v", positions, err)
+	}
+	if _, err := model.RecordSignalEvent(&model.SignalEvent{Time: time.Now(), ProductCode: "ETH_JPY", Side: "BUY", Price: 300000, Size: 0.2}); err != nil {
+		t.Fatal(err)
+	}
+	positions, err := ai.getPositions()
+	if err != nil || len(positions) != 1 || positions[0].Side != "BUY" || positions[0].Size != 0.2 {
+		t.Errorf("getPositions() = %+v, %v", positions, err)
+	}
+
+	ai.ProductCode = "FX_BTC_JPY"
+	if positions, _ := ai.getPositions(); len(positions) != 1 || positions[0].Size != 0.5 {
+		t.Errorf("getPositions(FX) = %+v", positions)
+	}
+}
+
+func TestAIFor(t *testing.T) {
+	fx, spot := &AI{ProductCode: "FX_BTC_JPY"}, &AI{ProductCode: "ETH_JPY"}
+	ais.list = []*AI{fx, spot}
+	defer func() { ais.list = nil }()
+	if aiFor("") != fx || aiFor("ETH_JPY") != spot || aiFor("BTC_JPY") != nil {
+		t.Errorf("aiFor() returned a wrong AI")
+	}
+	// 取引中の状態はプロダクトごとに独立している
+	fx.stopLimit, fx.longReOpen = 100, true
+	if spot.stopLimit != 0 || spot.longReOpen {
+		t.Errorf("spot state = %+v", spot.tradeState)
+	}
+}
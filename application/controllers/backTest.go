@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"app/bitflyer"
+	"app/config"
+	"app/domain/model"
+	"app/domain/service"
+	"errors"
+	"fmt"
+	"github.com/markcheno/go-talib"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+/** バックテストで再生中のキャンドル */
+type backTestReplay struct {
+	productCode   string
+	duration      time.Duration
+	candles       []model.Candle // 取引に使う時間足（インディケータのウォームアップ分を含む）
+	minuteCandles []model.Candle // ATR算出用の1分足
+	index         int            // 再生中のキャンドルの位置
+	now           time.Time      // 再生中のキャンドルのクローズ時刻
+}
+
+/** 再生位置までの直近limit件のキャンドル */
+func (r *backTestReplay) dataFrame(limit int) *model.DataFrameCandle {
+	end := r.index + 1
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	return &model.DataFrameCandle{
+		ProductCode: r.productCode,
+		Duration:    r.duration,
+		Candles:     r.candles[start:end],
+	}
+}
+
+/** 再生位置までの1分足でATRを算出する（件数が足りない場合は本番と同様に0） */
+func (r *backTestReplay) atr(limit int) int {
+	end := sort.Search(len(r.minuteCandles), func(i int) bool {
+		return !r.minuteCandles[i].Time.Before(r.now)
+	})
+	if end < limit {
+		return 0
+	}
+	df := &model.DataFrameCandle{Candles: r.minuteCandles[end-limit : end]}
+	atr := talib.Atr(df.Highs(), df.Low(), df.Closes(), limit-1)
+	return int(atr[len(atr)-1])
+}
+
+/** バックテストの結果 */
+type BackTestReport struct {
+	ProductCode string              `json:"product_code"`
+	Duration    time.Duration       `json:"duration"`
+	From        time.Time           `json:"from"`
+	To          time.Time           `json:"to"`
+	Candles     int                 `json:"candles"`
+	Performance *model.Performance  `json:"performance"`
+	Events      *model.SignalEvents `json:"events,omitempty"`
+}
+
+/*
+DBに保存されているキャンドルの指定期間をAI.Tradeで再生する
+productCode: プロダクトコード
+duration: 取引に使う時間足
+from, to: 再生する期間（from <= time < to）
+commissionRate: 成績の算出に使う手数料率
+注文は送らず、売買イベントも保存しない
+*/
+func RunBackTest(productCode string, duration time.Duration, from, to time.Time, commissionRate float64) (*BackTestReport, error) {
+	if !from.Before(to) {
+		return nil, errors.New("fromはtoより前の日時を指定してください")
+	}
+	pastPeriod := config.Config.DataLimit
+	// インディケータの算出に必要な分だけfromより前のキャンドルも読み込む
+	warmupFrom := from.Add(-duration * time.Duration(pastPeriod))
+	df, err := service.GetCandlesBetween(productCode, duration, warmupFrom, to)
+	if err != nil {
+		return nil, err
+	}
+	start := sort.Search(len(df.Candles), func(i int) bool {
+		return !df.Candles[i].Time.Before(from)
+	})
+	if start >= len(df.Candles) {
+		return nil, fmt.Errorf("%sに%s〜%sのキャンドルがありません", service.GetCandleTableName(productCode, duration), from, to)
+	}
+	minuteDf, err := service.GetCandlesBetween(productCode, time.Minute, from.Add(-time.Hour), to)
+	if err != nil {
+		return nil, err
+	}
+
+	signalStrategies, err := model.NewStrategies(config.Config.TradeStrategies)
+	if err != nil {
+		return nil, err
+	}
+
+	ai := newBackTestAI(productCode, duration, pastPeriod, from, &backTestReplay{
+		productCode:   productCode,
+		duration:      duration,
+		candles:       df.Candles,
+		minuteCandles: minuteDf.Candles,
+		index:         start,
+		now:           df.Candles[start].Time,
+	})
+	ai.SignalStrategies = signalStrategies
+	if config.Config.EnsembleEnable {
+		ai.Ensemble = model.NewEnsemble(config.Config.EnsembleThreshold)
+	}
+	ai.UpdateOptimizeParams(false, false)
+
+	for i := start; i < len(df.Candles); i++ {
+		candle := df.Candles[i]
+		ai.replay.index = i
+		ai.replay.now = candle.Time.Add(duration)
+		ai.Trade(candleTicker(productCode, candle, ai.replay.now))
+	}
+
+	return &BackTestReport{
+		ProductCode: productCode,
+		Duration:    duration,
+		From:        from,
+		To:          to,
+		Candles:     len(df.Candles) - start,
+		Performance: ai.SignalEvents.Performance(commissionRate),
+		Events:      ai.SignalEvents,
+	}, nil
+}
+
+/** キャンドルの終値をTickerとして扱う */
+func candleTicker(productCode string, candle model.Candle, now time.Time) bitflyer.Ticker {
+	return bitflyer.Ticker{
+		ProductCode: productCode,
+		Timestamp:   now.Format(time.RFC3339),
+		BestBid:     candle.Close,
+		BestAsk:     candle.Close,
+		Ltp:         candle.Close,
+	}
+}
+
+/** バックテスト用のAI（注文は送らずメモリ上で売買イベントを管理する） */
+func newBackTestAI(productCode string, duration time.Duration, pastPeriod int, startTrade time.Time, replay *backTestReplay) *AI {
+	codes := strings.Split(productCode, "_")
+	ai := &AI{
+		ProductCode:       productCode,
+		CoinCode:          codes[len(codes)-1],
+		CurrencyCode:      codes[len(codes)-2],
+		UsePercent:        config.Config.UsePercent,
+		MinuteToExpires:   1,
+		PastPeriod:        pastPeriod,
+		Duration:          duration,
+		SignalEvents:      model.NewSignalEvents(),
+		TradeSemaphore:    semaphore.NewWeighted(1),
+		OptimizeSemaphore: semaphore.NewWeighted(1),
+		BackTest:          true,
+		StartTrade:        startTrade,
+		StopLimitPercent:  config.Config.StopLimitPercent,
+		replay:            replay,
+	}
+	ai.tradeDuration = int(duration.Minutes())
+	if ai.tradeDuration < 1 {
+		ai.tradeDuration = 1
+	}
+	return ai
+}
+
+/** CLI向けにテキストで出力する */
+func (r *BackTestReport) WriteText(w io.Writer) error {
+	header := fmt.Sprintf("product_code: %s\nduration:     %s\nperiod:       %s - %s\ncandles:      %d\n\n",
+		r.ProductCode, r.Duration, r.From.Format(time.RFC3339), r.To.Format(time.RFC3339), r.Candles)
+	_, err := io.WriteString(w, header+r.Performance.String())
+	return err
+}
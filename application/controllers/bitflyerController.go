@@ -6,93 +6,253 @@ import (
 	"app/domain/model"
 	"app/domain/service"
 	"app/utils"
+	"context"
+	"fmt"
+	"log"
+	"sync"
 	"time"
 )
 
-var tradeTicker bitflyer.Ticker
+// 設定されたプロダクトごとの取引AI（StreamIngestionDataで作成する）
+var ais struct {
+	sync.RWMutex
+	list []*AI
+}
+
+/** productCodeのAIを返す（空の場合は最初のプロダクトのAI、見つからない場合はnil） */
+func aiFor(productCode string) *AI {
+	ais.RLock()
+	defer ais.RUnlock()
+	for _, ai := range ais.list {
+		if productCode == "" || ai.ProductCode == productCode {
+			return ai
+		}
+	}
+	return nil
+}
+
+/** 全てのプロダクトのAIを返す */
+func allAIs() []*AI {
+	ais.RLock()
+	defer ais.RUnlock()
+	return append([]*AI(nil), ais.list...)
+}
+
+// この時間足のキャンドルが確定する毎に取引する（ATRの計算や上位の時間足の作成にも使う）
+const tradeTickDuration = time.Minute
+
+// 起動時に1分足から上位の時間足を作成し直す期間
+const resampleRebuildWindow = 7 * 24 * time.Hour
+
+// キャンドルの作成を行うgoroutine（停止時に作成途中のキャンドルを保存し終わるのを待つ）
+var ingestion sync.WaitGroup
+
+// リアルタイムAPIの再接続がこの回数続いたらLINEで通知する
+const streamAlertAttempts = 5
+
+/** リアルタイムAPI（Ticker・約定）の接続状態をログに出し、切断が続いた場合と復旧した場合はLINEで通知する */
+func streamStateHandler() func(bitflyer.StreamEvent) {
+	var mu sync.Mutex
+	alerted := false
+	return func(event bitflyer.StreamEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if event.Err != nil {
+			log.Printf("action=StreamIngestionData state=%s attempt=%d err=%s", event.State, event.Attempt, event.Err.Error())
+		} else {
+			log.Printf("action=StreamIngestionData state=%s attempt=%d", event.State, event.Attempt)
+		}
+		switch {
+		case event.State == bitflyer.StreamDisconnected && event.Attempt == streamAlertAttempts:
+			alerted = true
+			utils.SendLine(fmt.Sprintf("リアルタイムAPIに%d回続けて接続できていません。", event.Attempt))
+		case event.State == bitflyer.StreamConnected && alerted:
+			alerted = false
+			utils.SendLine("リアルタイムAPIに再接続しました。")
+		}
+	}
+}
+
+/** キャンドルを作成する全ての時間足（取引に使う1分足とconfig.iniのdurations・derived_durations） */
+func candleDurations() []time.Duration {
+	durations := []time.Duration{tradeTickDuration}
+	for _, duration := range config.Config.Durations {
+		if duration != tradeTickDuration {
+			durations = append(durations, duration)
+		}
+	}
+	return durations
+}
 
-var isTruncate bool
+/** 約定から作成する時間足（derived_durationsは1分足からまとめて作成する） */
+func liveCandleDurations() []time.Duration {
+	derived := map[time.Duration]bool{}
+	for _, duration := range config.Config.DerivedDurations {
+		derived[duration] = true
+	}
+	var durations []time.Duration
+	for _, duration := range candleDurations() {
+		if !derived[duration] {
+			durations = append(durations, duration)
+		}
+	}
+	return durations
+}
+
+/** ctxがキャンセルされるとTicker・約定の購読、取引、照合を止める（停止処理はShutdownで行う） */
+func StreamIngestionData(ctx context.Context) {
+	client := bitflyer.New(config.Config.ApiKey, config.Config.ApiSecret)
+	client.OnStreamState(streamStateHandler())
+	var exchange bitflyer.Exchange = client
+	// ペーパートレードの場合、マーケットデータはbitFlyerから取得し注文はローカルで約定させる
+	if config.Config.PaperTrade {
+		exchange = bitflyer.NewPaperClient(exchange, config.Config.PaperCollateral, config.Config.PaperCommissionRate, config.Config.PaperLeverage)
+	}
+	// プロダクトごとに独立したAIで取引する（注文・資産の取得はクライアントを共有する）
+	for _, product := range config.Config.Products {
+		ai := NewAI(exchange, product.ProductCode, config.Config.Durations[config.Config.TradeDuration], config.Config.DataLimit, product.UsePercent, product.StopLimitPercent, config.Config.BackTest)
+		strategies, err := newStrategies(product.ProductCode, config.Config.Strategies)
+		if err != nil {
+			log.Fatalf("action=StreamIngestionData err=%s", err.Error())
+		}
+		ai.Strategies = strategies
+		// 前回停止した時点では戦略の建玉の合計とネッティングした建玉は一致しているものとする
+		ai.netted, _ = ai.strategyPosition()
+		ais.Lock()
+		ais.list = append(ais.list, ai)
+		ais.Unlock()
+		ai.startIngestion(ctx)
+		ai.startReconcile(ctx)
+		ai.startGapCheck(ctx, client)
+	}
+	if config.Config.IsProduction {
+		go uploadLogFileDaily(ctx)
+	}
+}
 
-func StreamIngestionData() {
-	ai := NewAI(config.Config.ProductCode, config.Config.Durations[config.Config.TradeDuration], config.Config.DataLimit, config.Config.UsePercent, config.Config.StopLimitPercent, config.Config.BackTest)
+/** ai.ProductCodeのTicker・約定からキャンドルを作成し、確定したキャンドルで取引する */
+func (ai *AI) startIngestion(ctx context.Context) {
+	// Ticker・約定からキャンドルを作成する（確定したキャンドルはSubscribeで受け取れる）
+	ai.candles = service.NewCandleAggregator(ai.ProductCode, liveCandleDurations())
+	ingestion.Add(1)
+	go func() {
+		defer ingestion.Done()
+		// 停止時は作成途中のキャンドルも保存してから終了する
+		ai.candles.Run(ctx, config.Config.CandleFlush)
+	}()
+	// 上位の時間足は1分足から作成し直して値を揃える（停止していた間の分も作成する）
+	resampler := service.NewCandleResampler(ai.ProductCode, tradeTickDuration, candleDurations(), config.Config.DerivedDurations)
+	go func() {
+		if err := resampler.Rebuild(time.Now().Add(-resampleRebuildWindow), time.Now().Truncate(tradeTickDuration)); err != nil {
+			log.Printf("action=CandleResampler product_code=%s err=%s", ai.ProductCode, err.Error())
+		}
+		resampler.Run(ctx, tradeTickDuration)
+	}()
 
 	var tickerChannl = make(chan bitflyer.Ticker)
-	bitflyerClient := bitflyer.New(config.Config.ApiKey, config.Config.ApiSecret)
-	go bitflyerClient.GetRealTimeTicker(config.Config.ProductCode, tickerChannl)
+	go ai.API.GetRealTimeTicker(ctx, ai.ProductCode, tickerChannl)
 	go func() {
-		for {
-			for ticker := range tickerChannl {
-				for _, duration := range config.Config.Durations {
-					tradeTicker = ticker
-					isCreated := service.CreateCandleWithDuration(ticker, ticker.ProductCode, duration)
-					if isCreated == true {
-					}
-				}
+		// 購読を止めるとtickerChannlがcloseされる
+		for ticker := range tickerChannl {
+			ai.setTicker(ticker)
+			// 約定からキャンドルを作成する場合、Tickerは取引に使うだけ
+			if config.Config.CandleSource == config.CandleSourceTicker {
+				ai.candles.AddTicker(ticker)
 			}
 		}
 	}()
-	go func() {
-		for range time.Tick(1 * time.Second) {
-			eventLength := model.GetAllSignalEventsCount()
-			df, _ := service.GetAllCandle(ai.ProductCode, ai.Duration, ai.PastPeriod)
-			lenCandles := len(df.Candles)
-			// キャンドル数が設定数ない場合取引しない
-			if lenCandles < config.Config.CandleLengthMin {
-				// めっっちゃログ出るからとりあえずコメントアウト
-				//fmt.Printf("キャンドル数が設定値に満たないため取引しません。現在のキャンドル数: %s", strconv.Itoa(lenCandles))
-				continue
+	if config.Config.CandleSource == config.CandleSourceExecutions {
+		var executionChannel = make(chan bitflyer.Execution)
+		go ai.API.GetRealTimeExecutions(ctx, ai.ProductCode, executionChannel)
+		go func() {
+			for execution := range executionChannel {
+				ai.candles.AddExecution(execution)
 			}
-			if config.Config.IsProduction {
-				if time.Now().Hour() == 23 && time.Now().Minute() == 59 && time.Now().Second() == 50 {
-					utils.UploadLogFile()
-				}
-				if (time.Now().Hour() != 4 && time.Now().Second() == 0) || (time.Now().Hour() == 4 && eventLength%2 == 1 && time.Now().Second() == 0) {
-					ai.Trade(tradeTicker)
-				}
-				if time.Now().Hour() == 4 && time.Now().Minute() == 0 && time.Now().Second() == 10 {
-					// Truncateは一旦なし
-					//if !isTruncate {
-					//	isTruncate, _ = service.Truncate()
-					//	if isTruncate {
-					//		log.Println("テーブル削除完了")
-					//		isTruncate = false
-					//	}
-					//}
-				}
-			} else {
-				if (time.Now().Hour() != 19 && time.Now().Second() == 0) || (time.Now().Hour() == 19 && eventLength%2 == 1 && time.Now().Second() == 0) {
-					ai.Trade(tradeTicker)
-				}
-				if time.Now().Hour() == 19 && time.Now().Minute() == 0 && time.Now().Second() == 10 {
-					// Truncateは一旦なし
-					//if !isTruncate {
-					//	isTruncate, _ = service.Truncate()
-					//	if isTruncate {
-					//		log.Println("テーブル削除完了")
-					//		isTruncate = false
-					//	}
-					//}
-				}
+		}()
+	}
+	// 確定したキャンドルで取引する（取引に数十秒かかっても他の時間足の確定でバッファが埋まらないよう取引する時間足のみ受け取る）
+	candleClosed := ai.candles.Subscribe(tradeTickDuration)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case candle := <-candleClosed:
+				ai.onCandleClosed(candle)
 			}
-			// 取引時間6時~23時
-			//if (time.Now().Hour() < 14 || time.Now().Hour() > 20) && time.Now().Second()%10 == 0 {
-			//	ai.Trade(tradeTicker)
-			//} else if time.Now().Hour() == 14 && time.Now().Minute() == 1 {
-			//eventLength := model.GetAllSignalEventsCount()
-			//	if eventLength%2 == 0 {
-			//		// Truncate
-			//		if !isTruncate {
-			//			isTruncate, _ = service.Truncate()
-			//			if isTruncate {
-			//				log.Println("テーブル削除完了")
-			//			}
-			//		}
-			//	}
-			//}
-			// Truncate フラグ初期化
-			//if time.Now().Hour() == 20 && time.Now().Minute() == 59 {
-			//	isTruncate = false
-			//}
 		}
 	}()
 }
+
+/** 受信した最新のTickerを保存する */
+func (ai *AI) setTicker(ticker bitflyer.Ticker) {
+	ai.tickerMu.Lock()
+	defer ai.tickerMu.Unlock()
+	ai.ticker = ticker
+}
+
+/** 受信した最新のTicker */
+func (ai *AI) latestTicker() bitflyer.Ticker {
+	ai.tickerMu.Lock()
+	defer ai.tickerMu.Unlock()
+	return ai.ticker
+}
+
+/** キャンドルの確定で取引する間の現在時刻を設定する（取引が終わったらゼロ値に戻す） */
+func (ai *AI) setCloseTime(closeTime time.Time) {
+	ai.tickerMu.Lock()
+	defer ai.tickerMu.Unlock()
+	ai.closeTime = closeTime
+}
+
+/*
+取引の判定に使う時間足のキャンドルが確定した時に取引する
+取引時間外（メンテナンス中）は決済されていない建玉がある場合のみ決済のために取引する
+*/
+func (ai *AI) onCandleClosed(candle model.Candle) {
+	closeTime := candle.Time.Add(candle.Duration)
+	if len(ai.Strategies) > 0 {
+		// 戦略は取引の判定に使う時間足のキャンドルが確定した時のみ判定する（取引時間外は決済のみ行う）
+		if closeTime.Truncate(ai.Duration).Equal(closeTime) {
+			ai.setCloseTime(closeTime)
+			defer ai.setCloseTime(time.Time{})
+			ai.TradeStrategies(closeTime, config.Config.TradingCalendar.IsOpen(closeTime))
+		}
+		return
+	}
+	openTrade, err := model.GetOpenTrade(ai.ProductCode)
+	if err != nil {
+		log.Printf("action=GetOpenTrade err=%s", err.Error())
+		return
+	}
+	hasPosition := openTrade != nil
+	if !hasPosition && !config.Config.TradingCalendar.IsOpen(closeTime) {
+		return
+	}
+	df, _ := service.GetAllCandle(ai.ProductCode, ai.Duration, ai.PastPeriod)
+	// キャンドル数が設定数ない場合取引しない
+	if len(df.Candles) < config.Config.CandleLengthMin {
+		return
+	}
+	// 判定のタイミングがずれないよう、現在時刻の代わりにキャンドルのクローズ時刻で取引する
+	ai.setCloseTime(closeTime)
+	defer ai.setCloseTime(time.Time{})
+	ai.Trade(ai.latestTicker())
+}
+
+/** 毎日23:59:50にログファイルをアップロードする（ctxがキャンセルされると止める） */
+func uploadLogFileDaily(ctx context.Context) {
+	for {
+		now := time.Now()
+		next := time.Date(now.Year(), now.Month(), now.Day(), 23, 59, 50, 0, now.Location())
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next.Sub(now)):
+			utils.UploadLogFile()
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"app/config"
+	"app/domain/service"
+	"context"
+	"log"
+	"time"
+)
+
+// 直近のこの時間は保存中のキャンドルがあるため欠けを探さない
+const gapCheckDelay = time.Minute
+
+// 約定履歴から修復する時のリクエストの間隔（bitFlyerの流量制限は5分間に500回。他のAPIの分を残すため半分に抑える）
+const gapRepairInterval = 1200 * time.Millisecond
+
+/*
+直近GapCheckWindowの間に欠けているキャンドルを全ての時間足で探し、ログとLINEで通知する（同じ欠けは一度だけ通知する）
+メンテナンス中のキャンドルと、前回までに約定がなかったと分かったキャンドルは欠けとみなさない
+GapRepairの場合は細かい時間足のキャンドルかhistoryの約定履歴から修復する
+*/
+func (ai *AI) CheckCandleGaps(ctx context.Context, history service.ExecutionHistory) (*service.CandleGapReport, error) {
+	durations := candleDurations()
+	now := time.Now().Add(-gapCheckDelay)
+	previous := ai.latestGapReport()
+	excluded := func(duration time.Duration, candleTime time.Time) bool {
+		return inMaintenance(duration, candleTime) || (previous != nil && previous.NoTrade(duration, candleTime))
+	}
+	report, err := service.DetectCandleGaps(ai.ProductCode, durations, now, config.Config.GapCheckWindow, excluded)
+	if err != nil {
+		log.Printf("action=CheckCandleGaps err=%s", err.Error())
+		return nil, err
+	}
+	// 約定がなかった期間は検出する期間を過ぎるまで引き継ぐ
+	if previous != nil {
+		for _, noTrade := range previous.NoTrades {
+			if noTrade.To.After(now.Add(-config.Config.GapCheckWindow)) {
+				report.NoTrades = append(report.NoTrades, noTrade)
+			}
+		}
+	}
+	if !report.OK() && config.Config.GapRepair {
+		if err := service.RepairCandleGaps(ctx, history, report, durations, gapRepairInterval); err != nil {
+			log.Printf("action=CheckCandleGaps err=%s", err.Error())
+		}
+	}
+	ai.setLastGapReport(report)
+	if !report.OK() {
+		for _, gap := range report.Gaps {
+			log.Printf("action=CheckCandleGaps gap=%s", gap)
+		}
+		if report.HasNewGaps(previous) {
+			ai.sendLine(report.String())
+		}
+	}
+	return report, nil
+}
+
+/** 直近のキャンドルの欠けの検出結果を保存する */
+func (ai *AI) setLastGapReport(report *service.CandleGapReport) {
+	ai.resultMu.Lock()
+	defer ai.resultMu.Unlock()
+	ai.lastGapReport = report
+}
+
+/** 直近のキャンドルの欠けの検出結果（まだ検出していない場合はnil） */
+func (ai *AI) latestGapReport() *service.CandleGapReport {
+	ai.resultMu.Lock()
+	defer ai.resultMu.Unlock()
+	return ai.lastGapReport
+}
+
+/** キャンドルの期間が全てメンテナンスの時間帯か（約定がないため欠けとみなさない） */
+func inMaintenance(duration time.Duration, candleTime time.Time) bool {
+	step := time.Minute
+	if duration < step {
+		step = duration
+	}
+	for t := candleTime; t.Before(candleTime.Add(duration)); t = t.Add(step) {
+		if config.Config.TradingCalendar.IsOpen(t) {
+			return false
+		}
+	}
+	return true
+}
+
+/** 起動時とGapCheckInterval毎にキャンドルの欠けを探す（GapCheckIntervalが0の場合は行わない。ctxがキャンセルされると止める） */
+func (ai *AI) startGapCheck(ctx context.Context, history service.ExecutionHistory) {
+	if config.Config.GapCheckInterval <= 0 {
+		return
+	}
+	go func() {
+		// 停止していた間の欠けは起動時に修復する
+		ai.CheckCandleGaps(ctx, history)
+		tick := time.NewTicker(config.Config.GapCheckInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				ai.CheckCandleGaps(ctx, history)
+			}
+		}
+	}()
+}
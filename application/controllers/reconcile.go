@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"app/bitflyer"
+	"app/config"
+	"app/domain/model"
+	"app/domain/service"
+	"context"
+	"log"
+	"time"
+)
+
+/*
+ローカルの建玉と取引所の建玉を照合し、不一致をログとLINEで通知する
+ReconcileRepairの場合はローカルの建玉を取引所に合わせて修復し、売買イベントとbuyOpen・sellOpenを読み直す
+トレード中に建玉が変わらないようTradeSemaphoreを取得してから行う
+*/
+func (ai *AI) Reconcile() (*service.ReconcileReport, error) {
+	if err := ai.TradeSemaphore.Acquire(context.Background(), 1); err != nil {
+		return nil, err
+	}
+	defer ai.TradeSemaphore.Release(1)
+
+	report, err := service.Reconcile(ai.API, ai.ProductCode, config.Config.ReconcileRepair)
+	if err != nil {
+		log.Printf("action=Reconcile err=%s", err.Error())
+		return nil, err
+	}
+	ai.setLastReconcile(report)
+	if !report.OK() {
+		for _, d := range report.Discrepancies {
+			log.Printf("action=Reconcile kind=%s message=%s", d.Kind, d.Message)
+		}
+		ai.sendLine(report.String())
+	}
+	if len(report.Repaired) > 0 {
+		ai.SignalEvents = model.GetSignalEventsByCount(ai.ProductCode, 1)
+	}
+	// 再起動時もDBの建玉からポジションの状態を復元する
+	ai.sellOpen, ai.buyOpen = model.OpenStatus(ai.ProductCode)
+	return report, nil
+}
+
+/** 起動時とReconcileInterval毎に建玉を照合する（ReconcileIntervalが0の場合は起動時のみ。ctxがキャンセルされると止める） */
+func (ai *AI) startReconcile(ctx context.Context) {
+	// 現物は取引所の建玉と照合できないため、DBの建玉からポジションの状態を復元するだけにする
+	// 戦略で取引する場合は取引所の建玉を毎回ネッティングで合わせるため照合しない
+	// back_testの場合はローカルの建玉が取引所に注文していない記録のみのため照合しない
+	if bitflyer.IsSpot(ai.ProductCode) || len(ai.Strategies) > 0 || ai.BackTest {
+		ai.sellOpen, ai.buyOpen = model.OpenStatus(ai.ProductCode)
+		return
+	}
+	ai.Reconcile()
+	if config.Config.ReconcileInterval <= 0 {
+		return
+	}
+	go func() {
+		tick := time.NewTicker(config.Config.ReconcileInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				ai.Reconcile()
+			}
+		}
+	}()
+}
+
+/** 直近の建玉の照合結果を保存する */
+func (ai *AI) setLastReconcile(report *service.ReconcileReport) {
+	ai.resultMu.Lock()
+	defer ai.resultMu.Unlock()
+	ai.lastReconcile = report
+}
+
+/** 直近の建玉の照合結果（まだ照合していない場合はnil） */
+func (ai *AI) latestReconcile() *service.ReconcileReport {
+	ai.resultMu.Lock()
+	defer ai.resultMu.Unlock()
+	return ai.lastReconcile
+}
@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"app/bitflyer"
+	"app/domain/model"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// 停止時の建玉の扱い（config.iniの[shutdown] position_policy）
+const (
+	PositionPolicyKeep  = "keep"  // 建玉を残したまま停止する
+	PositionPolicyClose = "close" // 成行で決済してから停止する
+	PositionPolicyStop  = "stop"  // 損切りラインに逆指値を置いてから停止する
+)
+
+/*
+停止処理
+StreamIngestionDataのctxをキャンセルした後に呼ぶ
+作成途中のキャンドルが保存されるのを待ち、
+実行中の取引が終わるまでTradeSemaphoreを待ってから建玉をpolicyに従って処理する
+timeoutを過ぎた場合は建玉を処理せずに戻る
+*/
+func Shutdown(policy string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		ingestion.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Println("action=Shutdown err=candles were not flushed")
+	}
+
+	// プロダクトごとに建玉を処理する（1つのプロダクトで失敗しても他のプロダクトは処理する）
+	var firstErr error
+	for _, ai := range allAIs() {
+		if err := ai.shutdown(ctx, policy); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+/** 実行中の取引が終わるのを待ってから建玉をpolicyに従って処理する */
+func (ai *AI) shutdown(ctx context.Context, policy string) error {
+	// 新しい取引を始めないよう、停止するまでTradeSemaphoreを返さない
+	if err := ai.TradeSemaphore.Acquire(ctx, 1); err != nil {
+		log.Printf("action=Shutdown product_code=%s err=trade did not finish: %s", ai.ProductCode, err.Error())
+		ai.sendLine("停止処理：取引が終わらないため建玉を処理せずに停止します。")
+		return err
+	}
+	return ai.applyPositionPolicy(policy)
+}
+
+/** 停止時に決済されていない建玉をpolicyに従って処理する */
+func (ai *AI) applyPositionPolicy(policy string) error {
+	if len(ai.Strategies) > 0 {
+		return ai.applyStrategyPositionPolicy(policy)
+	}
+	trade, err := model.GetOpenTrade(ai.ProductCode)
+	if err != nil {
+		log.Printf("action=applyPositionPolicy err=%s", err.Error())
+		return err
+	}
+	if trade == nil {
+		log.Println("停止処理：建玉はありません")
+		return nil
+	}
+	closeSide := "SELL"
+	if trade.Side == "SELL" {
+		closeSide = "BUY"
+	}
+	if ai.BackTest {
+		return ai.applyBackTestPositionPolicy(policy, trade, closeSide)
+	}
+
+	switch policy {
+	case PositionPolicyClose:
+		// 停止時の決済ではreOpenしない
+		ai.longReOpen, ai.shortReOpen = false, false
+		resp, err := ai.API.SendOrder(&bitflyer.Order{
+			ProductCode:     ai.ProductCode,
+			ChildOrderType:  "MARKET",
+			Side:            closeSide,
+			Size:            trade.Size,
+			MinuteToExpires: ai.MinuteToExpires,
+			TimeInForce:     "GTC",
+		})
+		if err != nil {
+			log.Printf("action=applyPositionPolicy err=%s", err.Error())
+			ai.sendLine("停止処理：建玉を決済できませんでした。logを確認してください。")
+			return err
+		}
+		isOrderCompleted, orderPrice := ai.WaitUntilOrderComplete(resp.ChildOrderAcceptanceID, 0, 0, nil)
+		if !isOrderCompleted {
+			ai.sendLine("停止処理：決済の注文が保存できませんでした。logを確認してください。")
+			return fmt.Errorf("close order %s is not completed", resp.ChildOrderAcceptanceID)
+		}
+		ai.sendLine(fmt.Sprintf("停止処理：%s %vを%vで決済しました", trade.Side, trade.Size, orderPrice))
+		return nil
+	case PositionPolicyStop:
+		triggerPrice := ai.stopTriggerPrice(trade)
+		resp, err := ai.API.SendParentOrder(&bitflyer.ParentOrder{
+			OrderMethod: "SIMPLE",
+			Parameters: []bitflyer.ParentOrderParameter{{
+				ProductCode:   ai.ProductCode,
+				ConditionType: bitflyer.ConditionTypeStop,
+				Side:          closeSide,
+				Size:          trade.Size,
+				TriggerPrice:  triggerPrice,
+			}},
+		})
+		if err != nil {
+			log.Printf("action=applyPositionPolicy err=%s", err.Error())
+			ai.sendLine("停止処理：逆指値を置けませんでした。logを確認してください。")
+			return err
+		}
+		log.Printf("status=stop parentOrderAcceptanceID=%s triggerPrice=%v", resp.ParentOrderAcceptanceID, triggerPrice)
+		ai.sendLine(fmt.Sprintf("停止処理：%s %vに%vの逆指値を置きました", trade.Side, trade.Size, triggerPrice))
+		return nil
+	default:
+		ai.sendLine(fmt.Sprintf("停止処理：%s %vの建玉を残したまま停止します", trade.Side, trade.Size))
+		return nil
+	}
+}
+
+/*
+back_testの場合は取引所に注文していないため、注文を送らずにローカルの建玉のみ処理する
+closeは現在の仲値で決済を記録し、stopは逆指値を置けないため建玉を残す
+*/
+func (ai *AI) applyBackTestPositionPolicy(policy string, trade *model.Trade, closeSide string) error {
+	if policy != PositionPolicyClose {
+		ai.sendLine(fmt.Sprintf("停止処理：back_testのため%s %vの建玉を残したまま停止します", trade.Side, trade.Size))
+		return nil
+	}
+	ai.longReOpen, ai.shortReOpen = false, false
+	price := trade.Open.Price
+	if ticker, err := ai.API.GetTicker(ai.ProductCode); err == nil && ticker != nil {
+		price = ticker.GetMidPrice()
+	}
+	closed, err := model.RecordSignalEvent(&model.SignalEvent{
+		Time:        ai.now().Truncate(time.Second),
+		ProductCode: ai.ProductCode,
+		Side:        closeSide,
+		Price:       price,
+		Size:        trade.Size,
+	})
+	if err != nil {
+		log.Printf("action=applyPositionPolicy err=%s", err.Error())
+		return err
+	}
+	ai.sendLine(fmt.Sprintf("停止処理：back_testのため%s %vを%vで決済したことにしました（損益%v）", trade.Side, trade.Size, price, closed.Pnl))
+	return nil
+}
+
+/** 逆指値のトリガー価格（取引中の損切りラインがなければオープン価格とStopLimitPercentから算出する） */
+func (ai *AI) stopTriggerPrice(trade *model.Trade) float64 {
+	if ai.stopLimit > 0 {
+		return math.Round(ai.stopLimit)
+	}
+	if trade.Side == "SELL" {
+		return math.Round(trade.Open.Price * (1.0 + (1.0 - ai.StopLimitPercent)))
+	}
+	return math.Round(trade.Open.Price * ai.StopLimitPercent)
+}
@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"app/bitflyer"
+	"app/config"
+	"app/domain/model"
+	"app/domain/repository"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStopTriggerPrice(t *testing.T) {
+	ai := &AI{StopLimitPercent: 0.98}
+	if got := ai.stopTriggerPrice(&model.Trade{Side: "BUY", Open: model.SignalEvent{Price: 1000000}}); got != 980000 {
+		t.Errorf("stopTriggerPrice(BUY) = %v, want 980000", got)
+	}
+	if got := ai.stopTriggerPrice(&model.Trade{Side: "SELL", Open: model.SignalEvent{Price: 1000000}}); got != 1020000 {
+		t.Errorf("stopTriggerPrice(SELL) = %v, want 1020000", got)
+	}
+
+	// 取引中の損切りラインがあればそれを使う
+	ai.stopLimit = 990000.4
+	if got := ai.stopTriggerPrice(&model.Trade{Side: "BUY", Open: model.SignalEvent{Price: 1000000}}); got != 990000 {
+		t.Errorf("stopTriggerPrice() = %v, want 990000", got)
+	}
+}
+
+func TestApplyPositionPolicyWithoutPosition(t *testing.T) {
+	model.SetSignalEventRepository(repository.NewMemorySignalEventRepository())
+	exchange := &fakeExchange{}
+	ai := &AI{API: exchange, ProductCode: "FX_BTC_JPY"}
+	for _, policy := range []string{PositionPolicyKeep, PositionPolicyClose, PositionPolicyStop} {
+		if err := ai.applyPositionPolicy(policy); err != nil {
+			t.Errorf("applyPositionPolicy(%s) = %v", policy, err)
+		}
+	}
+	if len(exchange.sent) != 0 || len(exchange.parentOrders) != 0 {
+		t.Errorf("orders = %+v, %+v, want none", exchange.sent, exchange.parentOrders)
+	}
+}
+
+func TestApplyPositionPolicyBackTest(t *testing.T) {
+	model.SetSignalEventRepository(repository.NewMemorySignalEventRepository())
+	// LINEの通知先をテスト用のサーバーにする
+	line := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer line.Close()
+	postUrl := config.Config.LinePostUrl
+	config.Config.LinePostUrl = line.URL + "/"
+	defer func() { config.Config.LinePostUrl = postUrl }()
+
+	const productCode = "FX_BTC_JPY"
+	if _, err := model.RecordSignalEvent(&model.SignalEvent{Time: time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC), ProductCode: productCode, Side: "BUY", Price: 1000, Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+	exchange := &fakeExchange{ticker: &bitflyer.Ticker{BestBid: 1090, BestAsk: 1110}}
+	ai := &AI{API: exchange, ProductCode: productCode, BackTest: true}
+
+	// back_testでは取引所に注文せず、keep・stopは建玉を残す
+	for _, policy := range []string{PositionPolicyKeep, PositionPolicyStop} {
+		if err := ai.applyPositionPolicy(policy); err != nil {
+			t.Fatalf("applyPositionPolicy(%s) = %v", policy, err)
+		}
+		if trade, _ := model.GetOpenTrade(productCode); trade == nil {
+			t.Fatalf("applyPositionPolicy(%s) closed the position", policy)
+		}
+	}
+
+	// closeは仲値でローカルの建玉のみ決済する
+	if err := ai.applyPositionPolicy(PositionPolicyClose); err != nil {
+		t.Fatal(err)
+	}
+	if len(exchange.sent) != 0 || len(exchange.parentOrders) != 0 {
+		t.Errorf("orders = %+v, %+v, want none", exchange.sent, exchange.parentOrders)
+	}
+	trades := model.GetTrades(productCode, 10)
+	if len(trades) != 1 || trades[0].IsOpen() || trades[0].Close.Price != 1100 {
+		t.Errorf("GetTrades() = %+v", trades)
+	}
+}
@@ -0,0 +1,382 @@
+package controllers
+
+import (
+	"app/bitflyer"
+	"app/config"
+	"app/domain/model"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+同じプロダクトで並行して動かす戦略
+売買は戦略ごとの建玉（strategy_idを付けた売買イベント）として記録し、
+取引所への注文は全ての戦略の建玉を合計してからまとめて出す（ネッティング）
+*/
+type Strategy struct {
+	ID           string              `json:"id"`
+	Indicators   []string            `json:"indicators"` // 売買の判定に使う戦略の名前（model.RegisterStrategyで登録したもの）
+	Allocation   float64             `json:"allocation"` // プロダクトの資金のうちこの戦略に割り当てる割合
+	Params       *model.TradeParams  `json:"-"`          // 最適化したパラメータ（最適化前・決済後はnil。muで保護する）
+	SignalEvents *model.SignalEvents `json:"-"`
+	signals      []model.Strategy    // 売買を判定する戦略（シグナルの多い方で売買する。muで保護する）
+	mu           sync.Mutex          // 最適化のgoroutineとの間でParams・signalsを保護する
+}
+
+/** 最適化したパラメータと売買を判定する戦略 */
+func (s *Strategy) optimized() (*model.TradeParams, []model.Strategy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Params, s.signals
+}
+
+/** 最適化したパラメータと売買を判定する戦略を入れ替える（paramsがnilの場合は最適化し直す） */
+func (s *Strategy) setOptimized(params *model.TradeParams, signals []model.Strategy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Params = params
+	if signals != nil {
+		s.signals = signals
+	}
+}
+
+/** 戦略ごとの状態と成績 */
+type StrategyReport struct {
+	*Strategy
+	Params      *model.TradeParams `json:"params"` // 最適化したパラメータ（取得した時点のもの）
+	OpenTrade   *model.Trade       `json:"open_trade"`
+	Performance *model.Performance `json:"performance"`
+}
+
+/** 設定から戦略を作成し、保存済みの売買イベントを読み込む */
+func newStrategies(productCode string, configs []config.StrategyConfig) ([]*Strategy, error) {
+	var strategies []*Strategy
+	for _, c := range configs {
+		signals, err := model.NewStrategies(c.Indicators)
+		if err != nil {
+			return nil, fmt.Errorf("strategy %s: %s", c.ID, err)
+		}
+		signalEvents := model.GetStrategySignalEvents(productCode, c.ID)
+		if signalEvents == nil {
+			signalEvents = &model.SignalEvents{StrategyID: c.ID}
+		}
+		strategies = append(strategies, &Strategy{
+			ID:           c.ID,
+			Indicators:   c.Indicators,
+			Allocation:   c.Allocation,
+			SignalEvents: signalEvents,
+			signals:      signals,
+		})
+	}
+	return strategies, nil
+}
+
+/*
+取引の判定に使う時間足のキャンドルが確定した時に、戦略ごとに売買を判定してから建玉をネッティングする
+canOpenがfalse（取引時間外）の場合は新規にオープンせず決済のみ行う
+*/
+func (ai *AI) TradeStrategies(closeTime time.Time, canOpen bool) {
+	if !ai.TradeSemaphore.TryAcquire(1) {
+		log.Println("Could not get trade lock")
+		return
+	}
+	defer ai.TradeSemaphore.Release(1)
+
+	df, err := ai.getDataFrame()
+	if err != nil {
+		log.Printf("action=TradeStrategies err=%s", err.Error())
+		return
+	}
+	// 作成途中のキャンドルでは判定しない
+	for len(df.Candles) > 0 && df.Candles[len(df.Candles)-1].Time.Add(ai.Duration).After(closeTime) {
+		df.Candles = df.Candles[:len(df.Candles)-1]
+	}
+	// キャンドル数が設定数ない場合取引しない
+	if len(df.Candles) == 0 || len(df.Candles) < config.Config.CandleLengthMin {
+		return
+	}
+	price := df.Candles[len(df.Candles)-1].Close
+	budget := ai.GetAvailableBalance() * ai.UsePercent
+	for _, strategy := range ai.Strategies {
+		ai.tradeStrategy(strategy, df, price, budget, canOpen)
+	}
+	if err := ai.netPositions(); err != nil {
+		log.Printf("action=netPositions err=%s", err.Error())
+		ai.sendLine("ネッティング：注文できませんでした。logを確認してください。")
+	}
+}
+
+/** 戦略の売買シグナルで戦略の建玉をオープン・決済する（注文はnetPositionsで出す） */
+func (ai *AI) tradeStrategy(strategy *Strategy, df *model.DataFrameCandle, price, budget float64, canOpen bool) {
+	open, err := ai.openStrategyTrade(strategy)
+	if err != nil {
+		log.Printf("action=tradeStrategy strategy_id=%s err=%s", strategy.ID, err.Error())
+		return
+	}
+	params, signals := strategy.optimized()
+	if params == nil {
+		// 建玉がない間に最適化する（バックテストの再生中は同期的に最適化する）
+		if open == nil {
+			if ai.replay != nil {
+				ai.optimizeStrategy(strategy)
+			} else {
+				go ai.optimizeStrategy(strategy)
+			}
+		}
+		return
+	}
+	signal := model.MajoritySignal(df, signals)
+	if signal == "" || (open != nil && open.Side == signal) {
+		return
+	}
+	now := ai.now()
+	if open != nil {
+		if !ai.recordStrategyEvent(strategy, signal, now, price, open.Size) {
+			return
+		}
+		log.Printf("action=tradeStrategy strategy_id=%s status=close side=%s size=%v price=%v", strategy.ID, open.Side, open.Size, price)
+		// 決済後は最適化し直す
+		strategy.setOptimized(nil, nil)
+		return
+	}
+	// 現物はショートできない
+	if !canOpen || (signal == "SELL" && bitflyer.IsSpot(ai.ProductCode)) {
+		return
+	}
+	size := ai.AdjustSize(budget * strategy.Allocation / price)
+	if size <= 0 {
+		return
+	}
+	if ai.recordStrategyEvent(strategy, signal, now, price, size) {
+		log.Printf("action=tradeStrategy strategy_id=%s status=open side=%s size=%v price=%v", strategy.ID, signal, size, price)
+	}
+}
+
+/*
+戦略の売買イベントを記録する（約定はネッティングした注文で行うため、判定したキャンドルの終値で記録する）
+バックテストの再生中・back_testでは注文しないため、記録のみで売買したことにする
+*/
+func (ai *AI) recordStrategyEvent(strategy *Strategy, side string, now time.Time, price, size float64) bool {
+	if !ai.placesOrders() {
+		log.Printf("action=recordStrategyEvent strategy_id=%s status=back_test side=%s size=%v price=%v", strategy.ID, side, size, price)
+	}
+	atr, _ := ai.atr(30)
+	if side == "BUY" {
+		return strategy.SignalEvents.Buy(ai.ProductCode, now, price, size, ai.replay == nil, false, price, atr, 0, 0, nil)
+	}
+	return strategy.SignalEvents.Sell(ai.ProductCode, now, price, size, ai.replay == nil, false, price, atr, 0, 0, nil)
+}
+
+/** 戦略の決済されていない建玉（バックテストの再生中はメモリ上の売買イベントから判断する） */
+func (ai *AI) openStrategyTrade(strategy *Strategy) (*model.Trade, error) {
+	if ai.replay != nil {
+		return strategy.SignalEvents.OpenTrade(), nil
+	}
+	return model.GetOpenStrategyTrade(ai.ProductCode, strategy.ID)
+}
+
+/*
+売買を判定する戦略ごとにパラメータを最適化する（最適化中に呼ばれた場合は何もしない）
+取引中の判定に使っている戦略は変更せず、新しく作成した戦略を最適化してから入れ替える
+*/
+func (ai *AI) optimizeStrategy(strategy *Strategy) {
+	if !ai.OptimizeSemaphore.TryAcquire(1) {
+		return
+	}
+	defer ai.OptimizeSemaphore.Release(1)
+
+	df, _ := ai.getDataFrame()
+	ctx := context.Background()
+	if ai.replay == nil && config.Config.OptimizeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Config.OptimizeTimeout)
+		defer cancel()
+	}
+	_, current := strategy.optimized()
+	var signals []model.Strategy
+	for _, signal := range current {
+		optimized, err := model.NewStrategy(signal.Name())
+		if err != nil {
+			log.Printf("action=optimizeStrategy strategy_id=%s err=%s", strategy.ID, err.Error())
+			return
+		}
+		if _, err := optimized.Optimize(ctx, df, false); err != nil {
+			log.Printf("action=optimizeStrategy strategy_id=%s err=%s", strategy.ID, err.Error())
+			return
+		}
+		signals = append(signals, optimized)
+	}
+	params := model.StrategyParams(signals)
+	strategy.setOptimized(params, signals)
+	log.Printf("action=optimizeStrategy strategy_id=%s params=%+v", strategy.ID, params)
+}
+
+/** 取引所に注文するか（バックテストの再生中・back_testでは売買イベントの記録のみ行う） */
+func (ai *AI) placesOrders() bool {
+	return ai.replay == nil && !ai.BackTest
+}
+
+/** 全ての戦略の建玉を合計した数量（ロングは正、ショートは負） */
+func (ai *AI) strategyPosition() (float64, error) {
+	position := 0.0
+	for _, strategy := range ai.Strategies {
+		open, err := ai.openStrategyTrade(strategy)
+		if err != nil {
+			return 0, err
+		}
+		position += signedSize(open)
+	}
+	return position, nil
+}
+
+/** 建玉の数量（ロングは正、ショートは負、建玉がない場合は0） */
+func signedSize(trade *model.Trade) float64 {
+	if trade == nil {
+		return 0
+	}
+	if trade.Side == "SELL" {
+		return -trade.Size
+	}
+	return trade.Size
+}
+
+/*
+全ての戦略の建玉を合計した建玉と取引所の建玉の差を成行で注文する
+取引所の建玉は毎回取得し直すため、約定しなかった注文は次の判定で注文し直す
+（現物は取引所の建玉を取得できないため、前回ネッティングした数量と比べる）
+FXの取引所の建玉はアカウント全体の合計のため、手動や他のツールで建てた同じプロダクトの建玉も合計に合わせて決済される
+（戦略で取引するプロダクトは他で取引しないこと。前回ネッティングした数量と異なる場合はログに残す）
+未約定の注文がある場合は約定を待つため注文しない
+バックテストの再生中・back_testでは注文しない
+*/
+func (ai *AI) netPositions() error {
+	target, err := ai.strategyPosition()
+	if err != nil {
+		return err
+	}
+	if !ai.placesOrders() {
+		ai.netted = target
+		return nil
+	}
+	current := ai.netted
+	if !bitflyer.IsSpot(ai.ProductCode) {
+		positions, err := ai.API.GetPositions(map[string]string{"product_code": ai.ProductCode})
+		if err != nil {
+			return err
+		}
+		current = 0
+		for _, position := range positions {
+			if position.Side == "SELL" {
+				current -= position.Size
+			} else {
+				current += position.Size
+			}
+		}
+		if math.Abs(current-ai.netted) >= 1e-8 {
+			log.Printf("action=netPositions status=unowned_position current=%v netted=%v", current, ai.netted)
+		}
+	}
+	// 浮動小数点の誤差で注文単位を切り捨てないよう丸めてから調整する
+	size := ai.AdjustSize(math.Round(math.Abs(target-current)*1e8) / 1e8)
+	if size <= 0 {
+		ai.netted = target
+		return nil
+	}
+	orders, err := ai.API.ListOrder(map[string]string{"product_code": ai.ProductCode, "child_order_state": "ACTIVE"})
+	if err != nil {
+		return err
+	}
+	if len(orders) > 0 {
+		log.Printf("action=netPositions status=wait active_orders=%d", len(orders))
+		return nil
+	}
+	side := "BUY"
+	if target < current {
+		side = "SELL"
+	}
+	order := &bitflyer.Order{
+		ProductCode:     ai.ProductCode,
+		ChildOrderType:  "MARKET",
+		Side:            side,
+		Size:            size,
+		MinuteToExpires: ai.MinuteToExpires,
+		TimeInForce:     "GTC",
+	}
+	log.Printf("action=netPositions target=%v current=%v order=%+v", target, current, order)
+	resp, err := ai.API.SendOrder(order)
+	if err != nil {
+		return err
+	}
+	if resp.ChildOrderAcceptanceID == "" {
+		return fmt.Errorf("order was not accepted: %+v", order)
+	}
+	ai.netted = target
+	log.Printf("action=netPositions status=ordered childOrderAcceptanceID=%s", resp.ChildOrderAcceptanceID)
+	return nil
+}
+
+/** 停止時に戦略の建玉をpolicyに従って処理する（closeの場合は全ての戦略の建玉を決済してから取引所の建玉を決済する） */
+func (ai *AI) applyStrategyPositionPolicy(policy string) error {
+	if policy != PositionPolicyClose {
+		position, err := ai.strategyPosition()
+		if err != nil {
+			return err
+		}
+		// 逆指値は戦略ごとの建玉を表現できないため置かない
+		ai.sendLine(fmt.Sprintf("停止処理：戦略の建玉（合計 %v）を残したまま停止します", position))
+		return nil
+	}
+	ticker, err := ai.API.GetTicker(ai.ProductCode)
+	if err != nil {
+		log.Printf("action=applyStrategyPositionPolicy err=%s", err.Error())
+		return err
+	}
+	now := time.Now().Truncate(time.Second)
+	for _, strategy := range ai.Strategies {
+		open, err := ai.openStrategyTrade(strategy)
+		if err != nil {
+			return err
+		}
+		if open == nil {
+			continue
+		}
+		closeSide := "SELL"
+		if open.Side == "SELL" {
+			closeSide = "BUY"
+		}
+		if !ai.recordStrategyEvent(strategy, closeSide, now, ticker.GetMidPrice(), open.Size) {
+			return fmt.Errorf("strategy %s could not be closed", strategy.ID)
+		}
+	}
+	// back_testでは取引所に注文していないため、戦略の建玉の決済を記録するだけにする
+	if !ai.placesOrders() {
+		ai.netted = 0
+		ai.sendLine(fmt.Sprintf("停止処理：back_testのため戦略の建玉を%vで決済したことにしました", ticker.GetMidPrice()))
+		return nil
+	}
+	if err := ai.netPositions(); err != nil {
+		ai.sendLine("停止処理：建玉を決済できませんでした。logを確認してください。")
+		return err
+	}
+	return nil
+}
+
+/** 戦略ごとの状態と成績 */
+func (ai *AI) StrategyReports(commissionRate float64) []StrategyReport {
+	var reports []StrategyReport
+	for _, strategy := range ai.Strategies {
+		open, _ := ai.openStrategyTrade(strategy)
+		params, _ := strategy.optimized()
+		reports = append(reports, StrategyReport{
+			Strategy:    strategy,
+			Params:      params,
+			OpenTrade:   open,
+			Performance: strategy.SignalEvents.Performance(commissionRate),
+		})
+	}
+	return reports
+}
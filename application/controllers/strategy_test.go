@@ -0,0 +1,150 @@
+package controllers
+
+import (
+	"app/bitflyer"
+	"app/config"
+	"app/domain/model"
+	"app/domain/repository"
+	"app/domain/service"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+func TestNewStrategies(t *testing.T) {
+	model.SetSignalEventRepository(repository.NewMemorySignalEventRepository())
+	strategies, err := newStrategies("FX_BTC_JPY", []config.StrategyConfig{{ID: "trend", Indicators: []string{"ema", "macd"}, Allocation: 0.5}})
+	if err != nil || len(strategies) != 1 || strategies[0].SignalEvents.StrategyID != "trend" || len(strategies[0].signals) != 2 {
+		t.Fatalf("newStrategies() = %+v, %v", strategies, err)
+	}
+	if _, err := newStrategies("FX_BTC_JPY", []config.StrategyConfig{{ID: "x", Indicators: []string{"unknown"}}}); err == nil {
+		t.Error("newStrategies() with unknown indicator err = nil")
+	}
+}
+
+func TestTradeStrategyAndNetPositions(t *testing.T) {
+	model.SetSignalEventRepository(repository.NewMemorySignalEventRepository())
+	exchange := &fakeExchange{}
+	ai := &AI{API: exchange, ProductCode: "FX_BTC_JPY", MinuteToExpires: 1, TradeSemaphore: semaphore.NewWeighted(1), OptimizeSemaphore: semaphore.NewWeighted(1)}
+	ema, _ := model.NewStrategy(model.IndicatorEma)
+	trend := &Strategy{ID: "trend", Allocation: 0.6, Params: &model.TradeParams{EmaEnable: true, EmaPeriod1: 7, EmaPeriod2: 14}, SignalEvents: &model.SignalEvents{StrategyID: "trend"}, signals: []model.Strategy{ema}}
+	reversal := &Strategy{ID: "reversal", Allocation: 0.4, SignalEvents: &model.SignalEvents{StrategyID: "reversal"}}
+	ai.Strategies = []*Strategy{trend, reversal}
+
+	// EMAのシグナルが最後のキャンドルで出ているデータフレーム
+	df := &model.DataFrameCandle{ProductCode: "FX_BTC_JPY", Duration: time.Hour}
+	base := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 200; i++ {
+		price := 1000 + 100*math.Sin(float64(i)/8)
+		df.Candles = append(df.Candles, model.Candle{Time: base.Add(time.Duration(i) * time.Hour), Open: price, Close: price, High: price + 5, Low: price - 5})
+	}
+	events := df.BackTestEma(7, 14, false)
+	signal := events.Signals[len(events.Signals)-1]
+	for len(df.Candles) > 0 && df.Candles[len(df.Candles)-1].Time.After(signal.Time) {
+		df.Candles = df.Candles[:len(df.Candles)-1]
+	}
+
+	ai.tradeStrategy(trend, df, 1000, 100, true)
+	open, _ := model.GetOpenStrategyTrade("FX_BTC_JPY", "trend")
+	if open == nil || open.Side != signal.Side || open.Size != 0.06 {
+		t.Fatalf("trend open trade = %+v, want %s 0.06", open, signal.Side)
+	}
+	// 同じシグナルでは建玉を増やさない
+	ai.tradeStrategy(trend, df, 1000, 100, true)
+	if events := model.GetStrategySignalEvents("FX_BTC_JPY", "trend"); len(events.Signals) != 1 {
+		t.Errorf("trend events = %+v", events.Signals)
+	}
+	if open, _ := model.GetOpenTrade("FX_BTC_JPY"); open != nil {
+		t.Errorf("strategy trade is visible as AI.Trade position: %+v", open)
+	}
+
+	// 反対方向の戦略の建玉と相殺した数量だけ注文する
+	opposite := "SELL"
+	if signal.Side == "SELL" {
+		opposite = "BUY"
+	}
+	if !ai.recordStrategyEvent(reversal, opposite, base, 1000, 0.02) {
+		t.Fatal("recordStrategyEvent() = false")
+	}
+	if err := ai.netPositions(); err != nil {
+		t.Fatal(err)
+	}
+	if len(exchange.sent) != 1 || exchange.sent[0].Side != signal.Side || exchange.sent[0].Size != 0.04 {
+		t.Fatalf("sent = %+v, want %s 0.04", exchange.sent, signal.Side)
+	}
+	// 取引所の建玉が合計と一致していれば注文しない
+	exchange.positions = []bitflyer.Position{{ProductCode: "FX_BTC_JPY", Side: signal.Side, Size: 0.04}}
+	if err := ai.netPositions(); err != nil || len(exchange.sent) != 1 {
+		t.Errorf("netPositions() = %v, sent = %+v", err, exchange.sent)
+	}
+}
+
+func TestStrategiesBackTest(t *testing.T) {
+	model.SetSignalEventRepository(repository.NewMemorySignalEventRepository())
+	// LINEの通知先をテスト用のサーバーにする
+	line := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer line.Close()
+	postUrl := config.Config.LinePostUrl
+	config.Config.LinePostUrl = line.URL + "/"
+	defer func() { config.Config.LinePostUrl = postUrl }()
+
+	exchange := &fakeExchange{ticker: &bitflyer.Ticker{BestBid: 1090, BestAsk: 1110}}
+	ai := &AI{API: exchange, ProductCode: "FX_BTC_JPY", MinuteToExpires: 1, BackTest: true}
+	trend := &Strategy{ID: "trend", Allocation: 1, SignalEvents: &model.SignalEvents{StrategyID: "trend"}}
+	ai.Strategies = []*Strategy{trend}
+
+	// back_testでは戦略の建玉を記録するだけで取引所に注文しない
+	if !ai.recordStrategyEvent(trend, "BUY", time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC), 1000, 0.1) {
+		t.Fatal("recordStrategyEvent() = false")
+	}
+	if err := ai.netPositions(); err != nil || ai.netted != 0.1 {
+		t.Errorf("netPositions() = %v, netted = %v", err, ai.netted)
+	}
+	if err := ai.applyStrategyPositionPolicy(PositionPolicyClose); err != nil {
+		t.Fatal(err)
+	}
+	if open, _ := model.GetOpenStrategyTrade("FX_BTC_JPY", "trend"); open != nil {
+		t.Errorf("trend open trade = %+v, want closed", open)
+	}
+	if len(exchange.sent) != 0 {
+		t.Errorf("sent = %+v, want none", exchange.sent)
+	}
+}
+
+func TestOptimizeStrategyConcurrently(t *testing.T) {
+	model.SetSignalEventRepository(repository.NewMemorySignalEventRepository())
+	candles := repository.NewMemoryCandleRepository()
+	service.SetCandleRepository(candles)
+	base := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 200; i++ {
+		price := 1000 + 100*math.Sin(float64(i)/8)
+		candles.Insert(&model.Candle{ProductCode: "FX_BTC_JPY", Duration: time.Hour, Time: base.Add(time.Duration(i) * time.Hour), Open: price, Close: price, High: price + 5, Low: price - 5})
+	}
+	ema, _ := model.NewStrategy(model.IndicatorEma)
+	trend := &Strategy{ID: "trend", Allocation: 1, SignalEvents: &model.SignalEvents{StrategyID: "trend"}, signals: []model.Strategy{ema}}
+	ai := &AI{API: &fakeExchange{}, ProductCode: "FX_BTC_JPY", Duration: time.Hour, PastPeriod: 200, OptimizeSemaphore: semaphore.NewWeighted(1), Strategies: []*Strategy{trend}}
+	df, _ := ai.getDataFrame()
+
+	// 最適化中も取引の判定とAPIの読み取りができる（go test -raceで競合がないこと）
+	done := make(chan struct{})
+	go func() {
+		ai.optimizeStrategy(trend)
+		close(done)
+	}()
+	for optimizing := true; optimizing; {
+		select {
+		case <-done:
+			optimizing = false
+		default:
+			ai.tradeStrategy(trend, df, 1000, 0, false)
+			ai.StrategyReports(0)
+		}
+	}
+	if params, signals := trend.optimized(); params == nil || len(signals) != 1 || signals[0] == ema {
+		t.Errorf("optimized() = %+v, %v", params, signals)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"app/config"
 	"app/domain/model"
 	"app/domain/service"
+	"app/domain/tradingalgo"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
@@ -97,10 +99,31 @@ func ApiCandleHandler() http.HandlerFunc {
 			df.AddBBands(n, float64(k))
 		}
 
-		/** 一目均衡表 +/
+		/** 一目均衡表 */
 		ichimoku := r.URL.Query().Get("ichimoku")
 		if ichimoku != "" {
-			df.AddIchimoku()
+			periods := tradingalgo.DefaultIchimokuPeriods
+			strTenkan := r.URL.Query().Get("ichimokuTenkan")
+			strKijun := r.URL.Query().Get("ichimokuKijun")
+			strSenkouB := r.URL.Query().Get("ichimokuSenkouB")
+			strDisplacement := r.URL.Query().Get("ichimokuDisplacement")
+			tenkan, err := strconv.Atoi(strTenkan)
+			if strTenkan == "" || err != nil || tenkan <= 0 {
+				tenkan = periods.Tenkan
+			}
+			kijun, err := strconv.Atoi(strKijun)
+			if strKijun == "" || err != nil || kijun <= 0 {
+				kijun = periods.Kijun
+			}
+			senkouB, err := strconv.Atoi(strSenkouB)
+			if strSenkouB == "" || err != nil || senkouB <= 0 {
+				senkouB = periods.SenkouB
+			}
+			displacement, err := strconv.Atoi(strDisplacement)
+			if strDisplacement == "" || err != nil || displacement <= 0 {
+				displacement = periods.Displacement
+			}
+			df.AddIchimoku(tenkan, kijun, senkouB, displacement)
 		}
 
 		/** rsi */
@@ -208,7 +231,9 @@ func ApiCandleHandler() http.HandlerFunc {
 
 		if events != "" {
 			if config.Config.BackTest {
-				df.Events = Ai.SignalEvents.CollectAfter(df.Candles[0].Time)
+				if ai := aiFor(productCode); ai != nil {
+					df.Events = ai.SignalEvents.CollectAfter(df.Candles[0].Time)
+				}
 			} else {
 				firstTime := df.Candles[0].Time
 				df.AddEvents(firstTime)
@@ -256,10 +281,106 @@ func GetEvents() http.HandlerFunc {
 		if productCode == "" {
 			productCode = config.Config.ProductCode
 		}
-		events := model.GetAllSignalEvents()
+		events := model.GetAllSignalEvents(productCode)
 		if events == nil {
 			response.Success(w, time.Now())
 		}
 		response.Success(w, events)
 	}
 }
+
+/** 売買イベントから算出した成績（手数料控除後の損益、ドローダウン、シャープレシオ等）を返す */
+func GetPerformance() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		productCode := r.URL.Query().Get("product_code")
+		// パラメータで指定がない場合は設定ファイルのものを使う
+		if productCode == "" {
+			productCode = config.Config.ProductCode
+		}
+		events := model.GetAllSignalEvents(productCode)
+		if events == nil {
+			response.InternalServerError(w, "signal events could not be loaded")
+			return
+		}
+		commissionRate := 0.0
+		if ai := aiFor(productCode); ai != nil {
+			commission, err := ai.API.GetTradingCommission(productCode)
+			if err != nil {
+				log.Printf("action=GetPerformance err=%s", err.Error())
+			} else {
+				commissionRate = commission.CommissionRate
+			}
+		}
+		response.Success(w, events.Performance(commissionRate))
+	}
+}
+
+/** 直近のウォークフォワード最適化の結果（区間ごとの損益とインディケータごとの安定性）を返す */
+func GetWalkForward() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// パラメータで指定がない場合は最初のプロダクトのものを返す
+		ai := aiFor(r.URL.Query().Get("product_code"))
+		var result *model.WalkForwardResult
+		if ai != nil {
+			result = ai.latestWalkForwardResult()
+		}
+		if result == nil {
+			response.BadRequest(w, "walk forward optimization has not run")
+			return
+		}
+		response.Success(w, result)
+	}
+}
+
+/** 直近の建玉の照合結果を返す */
+func GetReconcile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// パラメータで指定がない場合は最初のプロダクトのものを返す
+		ai := aiFor(r.URL.Query().Get("product_code"))
+		var report *service.ReconcileReport
+		if ai != nil {
+			report = ai.latestReconcile()
+		}
+		if report == nil {
+			response.BadRequest(w, "reconciliation has not run")
+			return
+		}
+		response.Success(w, report)
+	}
+}
+
+/** 直近のキャンドルの欠けの検出・修復結果を返す */
+func GetCandleGaps() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// パラメータで指定がない場合は最初のプロダクトのものを返す
+		ai := aiFor(r.URL.Query().Get("product_code"))
+		var report *service.CandleGapReport
+		if ai != nil {
+			report = ai.latestGapReport()
+		}
+		if report == nil {
+			response.BadRequest(w, "gap check has not run")
+			return
+		}
+		response.Success(w, report)
+	}
+}
+
+/** 戦略ごとのパラメータ・建玉・成績を返す */
+func GetStrategies() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ai := aiFor(r.URL.Query().Get("product_code"))
+		if ai == nil || len(ai.Strategies) == 0 {
+			response.BadRequest(w, "strategies are not configured")
+			return
+		}
+		commissionRate := 0.0
+		commission, err := ai.API.GetTradingCommission(ai.ProductCode)
+		if err != nil {
+			log.Printf("action=GetStrategies err=%s", err.Error())
+		} else {
+			commissionRate = commission.CommissionRate
+		}
+		response.Success(w, ai.StrategyReports(commissionRate))
+	}
+}
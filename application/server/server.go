@@ -2,16 +2,36 @@ package server
 
 import (
 	"app/application/controllers"
+	"context"
 	"html/template"
+	"log"
 	"net/http"
+	"time"
 )
 
-func Serve() {
+/** ctxがキャンセルされると受付中のリクエストを待ってから停止する */
+func Serve(ctx context.Context) {
 	http.HandleFunc("/api/latestCandle", get(controllers.GetLatestCandle()))
 	http.HandleFunc("/api/candle/", get(controllers.ApiCandleHandler()))
 	http.HandleFunc("/api/allEvents", get(controllers.GetEvents()))
+	http.HandleFunc("/api/performance", get(controllers.GetPerformance()))
+	http.HandleFunc("/api/walkForward", get(controllers.GetWalkForward()))
+	http.HandleFunc("/api/reconcile", get(controllers.GetReconcile()))
+	http.HandleFunc("/api/gaps", get(controllers.GetCandleGaps()))
+	http.HandleFunc("/api/strategies", get(controllers.GetStrategies()))
 	http.HandleFunc("/api/chart", viewChartHandler)
-	http.ListenAndServe(":8080", nil)
+	srv := &http.Server{Addr: ":8080"}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("action=Serve err=%s", err.Error())
+		}
+	}()
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("action=Serve err=%s", err.Error())
+	}
 }
 
 var templates = template.Must(template.ParseFiles("views/chart.html"))
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"app/application/controllers"
+	"app/config"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+backtestサブコマンド
+DBに保存されているキャンドルの指定期間をAI.Tradeの売買ロジックで再生し、レポートを出力する
+例）go run . backtest -from 2021-07-01 -to 2021-08-01 -duration 15m -out report.txt
+ルールファイルの戦略で試す場合）go run . backtest -from 2021-07-01 -rule_file rules.yaml -strategies rule_ema_macd
+*/
+func runBackTest(args []string) {
+	flags := flag.NewFlagSet("backtest", flag.ExitOnError)
+	productCode := flags.String("product_code", config.Config.ProductCode, "プロダクトコード")
+	durationKey := flags.String("duration", config.Config.TradeDuration, "時間足（15m, 30m, 1h）")
+	strFrom := flags.String("from", "", "開始日時（2006-01-02 または RFC3339）")
+	strTo := flags.String("to", "", "終了日時（省略時は現在時刻）")
+	out := flags.String("out", "", "レポートの出力先ファイル（省略時は標準出力）")
+	format := flags.String("format", "text", "レポートの形式（text または json）")
+	commissionRate := flags.Float64("commission_rate", -1, "手数料率（省略時はbitFlyerのGetTradingCommissionから取得する）")
+	verbose := flags.Bool("v", false, "売買ロジックのログを出力する")
+	ruleFile := flags.String("rule_file", config.Config.RuleFile, "戦略として登録するルールファイル（YAML・JSON）")
+	strategies := flags.String("strategies", strings.Join(config.Config.TradeStrategies, ","), "売買の判定に使う戦略（カンマ区切り）")
+	flags.Parse(args)
+
+	loadRuleStrategies(*ruleFile)
+	config.Config.TradeStrategies = strings.Split(strings.ReplaceAll(*strategies, " ", ""), ",")
+
+	duration, ok := config.Config.Durations[*durationKey]
+	if !ok {
+		log.Fatalf("action=backtest err=unknown duration %s", *durationKey)
+	}
+	from, err := parseCommandTime(*strFrom)
+	if err != nil {
+		log.Fatalf("action=backtest err=invalid from %s", err)
+	}
+	to := time.Now()
+	if *strTo != "" {
+		to, err = parseCommandTime(*strTo)
+		if err != nil {
+			log.Fatalf("action=backtest err=invalid to %s", err)
+		}
+	}
+
+	*commissionRate = tradingCommissionRate(*productCode, *commissionRate)
+
+	// 売買ロジックのログ（標準出力含む）はレポートと混ざるので-vの時だけ出す
+	stdout := os.Stdout
+	if !*verbose {
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err == nil {
+			os.Stdout = devNull
+			defer devNull.Close()
+		}
+		log.SetOutput(ioutil.Discard)
+	}
+	report, err := controllers.RunBackTest(*productCode, duration, from, to, *commissionRate)
+	os.Stdout = stdout
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		log.Fatalf("action=backtest err=%s", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("action=backtest err=%s", err)
+		}
+		defer file.Close()
+		w = file
+	}
+	switch *format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	default:
+		err = report.WriteText(w)
+	}
+	if err != nil {
+		log.Fatalf("action=backtest err=%s", err)
+	}
+}
+
+/** コマンドライン引数の日時を解析する（日付のみの場合はローカル時間の0時） */
+func parseCommandTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("日時が指定されていません")
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
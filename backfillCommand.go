@@ -0,0 +1,90 @@
+package main
+
+import (
+	"app/bitflyer"
+	"app/config"
+	"app/domain/service"
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+/*
+backfillサブコマンド
+bitFlyerの約定履歴（/v1/executions）から全ての時間足のキャンドルを作成してDBに保存する（derived_durationsは作成した1分足から作成する）
+保存済みのキャンドルがある場合は、最新のキャンドルより後と最古のキャンドルより前のみ作成する（中断した場合も続きから再開する）
+例）go run . backfill -from 2021-08-01
+*/
+func runBackfill(args []string) {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	productCode := flags.String("product_code", config.Config.ProductCode, "プロダクトコード")
+	strFrom := flags.String("from", "", "開始日時（2006-01-02 または RFC3339。省略時は30日前。約定履歴は約31日分しか取得できない）")
+	strTo := flags.String("to", "", "終了日時（省略時は現在時刻）")
+	intervalMs := flags.Int("interval_ms", 1200, "リクエストの間隔（bitFlyerの流量制限は5分間に500回のため、取引で使う分を残して半分にする）")
+	flags.Parse(args)
+
+	from := time.Now().AddDate(0, 0, -30)
+	var err error
+	if *strFrom != "" {
+		from, err = parseCommandTime(*strFrom)
+		if err != nil {
+			log.Fatalf("action=backfill err=invalid from %s", err)
+		}
+	}
+	to := time.Now()
+	if *strTo != "" {
+		to, err = parseCommandTime(*strTo)
+		if err != nil {
+			log.Fatalf("action=backfill err=invalid to %s", err)
+		}
+	}
+
+	// 取引で使う1分足も作成する（derived_durationsは後で1分足から作成する）
+	derived := map[time.Duration]bool{}
+	for _, duration := range config.Config.DerivedDurations {
+		derived[duration] = true
+	}
+	durations := []time.Duration{time.Minute}
+	for _, duration := range config.Config.Durations {
+		if duration != time.Minute && !derived[duration] {
+			durations = append(durations, duration)
+		}
+	}
+	spans, err := service.BackfillSpans(*productCode, durations, from, to)
+	if err != nil {
+		log.Fatalf("action=backfill err=%s", err)
+	}
+	if len(spans) == 0 {
+		log.Printf("action=backfill 保存済みのキャンドルが%sから%sまであるためバックフィルしません", from, to)
+		return
+	}
+
+	// Ctrl-Cで中断する（それまでに保存したキャンドルは残る）
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	client := bitflyer.New(config.Config.ApiKey, config.Config.ApiSecret)
+	resampler := service.NewCandleResampler(*productCode, time.Minute, config.Config.DerivedDurations, config.Config.DerivedDurations)
+	for _, span := range spans {
+		log.Printf("action=backfill product_code=%s from=%s to=%s", *productCode, span.From, span.To)
+		result, err := service.Backfill(ctx, client, *productCode, durations, span.From, span.To, time.Duration(*intervalMs)*time.Millisecond)
+		if err != nil {
+			log.Fatalf("action=backfill candles=%d err=%s", result.Candles, err)
+		}
+		log.Printf("action=backfill requests=%d executions=%d candles=%d", result.Requests, result.Executions, result.Candles)
+
+		if err := resampler.Rebuild(span.From, span.To); err != nil {
+			log.Fatalf("action=backfill err=%s", err)
+		}
+	}
+}
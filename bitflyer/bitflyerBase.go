@@ -8,6 +8,7 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -18,18 +19,39 @@ import (
 
 const baseURL = "https://api.bitflyer.com/v1/"
 
+// 流量制限（HTTP 429）で断られた場合のエラー（errors.Isで判定する）
+var ErrTooManyRequests = errors.New("too many requests")
+
 // TODO usecaces/dto/配下へファイルとして格納
 type APIClient struct {
-	key        string
-	secret     string
-	httpClient *http.Client
+	key           string
+	secret        string
+	httpClient    *http.Client
+	onStreamState func(StreamEvent)
 }
 
 func New(key, secret string) *APIClient {
-	bitflyerClient := &APIClient{key, secret, &http.Client{}}
+	bitflyerClient := &APIClient{key: key, secret: secret, httpClient: &http.Client{}}
 	return bitflyerClient
 }
 
+/** リアルタイムTickerの接続状態が変わった時の処理を設定する（未設定の場合はログに出す） */
+func (api *APIClient) OnStreamState(handler func(StreamEvent)) {
+	api.onStreamState = handler
+}
+
+func (api *APIClient) streamState(event StreamEvent) {
+	if api.onStreamState != nil {
+		api.onStreamState(event)
+		return
+	}
+	if event.Err != nil {
+		log.Printf("action=Lightstream state=%s attempt=%d err=%s", event.State, event.Attempt, event.Err.Error())
+		return
+	}
+	log.Printf("action=Lightstream state=%s attempt=%d", event.State, event.Attempt)
+}
+
 // header returns the map[string]string
 func (api APIClient) header(method, endpoint string, body []byte) map[string]string {
 	timeStamp := strconv.FormatInt(time.Now().Unix(), 10)
@@ -0,0 +1,166 @@
+package bitflyer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+)
+
+/** 板の1つの価格 */
+type BoardOrder struct {
+	Price float64 `json:"price"`
+	Size  float64 `json:"size"`
+}
+
+/** 板（Bidsは価格の降順、Asksは価格の昇順） */
+type Board struct {
+	MidPrice float64      `json:"mid_price"`
+	Bids     []BoardOrder `json:"bids"`
+	Asks     []BoardOrder `json:"asks"`
+}
+
+/** 最良気配の差（どちらかが空の場合は0） */
+func (b *Board) Spread() float64 {
+	if len(b.Bids) == 0 || len(b.Asks) == 0 {
+		return 0
+	}
+	return b.Asks[0].Price - b.Bids[0].Price
+}
+
+/** 仲値からwithin以内の価格にある数量の合計（side: BUYは買い板、SELLは売り板） */
+func (b *Board) Depth(side string, within float64) float64 {
+	orders := b.Asks
+	if side == "BUY" {
+		orders = b.Bids
+	}
+	depth := 0.0
+	for _, order := range orders {
+		if math.Abs(order.Price-b.MidPrice) > within {
+			break
+		}
+		depth += order.Size
+	}
+	return depth
+}
+
+/*
+板の状態
+lightning_board_snapshotで全体を置き換え、lightning_boardの差分（数量0は削除）を反映する
+スナップショットを受信するまでは差分を反映しない
+*/
+type OrderBook struct {
+	mu       sync.Mutex
+	ready    bool
+	midPrice float64
+	bids     map[float64]float64 // 価格 -> 数量
+	asks     map[float64]float64
+}
+
+func NewOrderBook() *OrderBook {
+	return &OrderBook{bids: map[float64]float64{}, asks: map[float64]float64{}}
+}
+
+/** スナップショットで置き換える */
+func (o *OrderBook) ApplySnapshot(snapshot *Board) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.bids = map[float64]float64{}
+	o.asks = map[float64]float64{}
+	o.ready = true
+	o.apply(snapshot)
+}
+
+/** 差分を反映する（スナップショットを受信する前はfalse） */
+func (o *OrderBook) ApplyDiff(diff *Board) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.ready {
+		return false
+	}
+	o.apply(diff)
+	return true
+}
+
+func (o *OrderBook) apply(board *Board) {
+	if board.MidPrice > 0 {
+		o.midPrice = board.MidPrice
+	}
+	for _, order := range board.Bids {
+		applyBoardOrder(o.bids, order)
+	}
+	for _, order := range board.Asks {
+		applyBoardOrder(o.asks, order)
+	}
+}
+
+func applyBoardOrder(orders map[float64]float64, order BoardOrder) {
+	if order.Size <= 0 {
+		delete(orders, order.Price)
+		return
+	}
+	orders[order.Price] = order.Size
+}
+
+/** 現在の板 */
+func (o *OrderBook) Board() Board {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	board := Board{MidPrice: o.midPrice}
+	for price, size := range o.bids {
+		board.Bids = append(board.Bids, BoardOrder{Price: price, Size: size})
+	}
+	for price, size := range o.asks {
+		board.Asks = append(board.Asks, BoardOrder{Price: price, Size: size})
+	}
+	sort.Slice(board.Bids, func(i, j int) bool { return board.Bids[i].Price > board.Bids[j].Price })
+	sort.Slice(board.Asks, func(i, j int) bool { return board.Asks[i].Price < board.Asks[j].Price })
+	return board
+}
+
+// リアルタイム板取得（ctxがキャンセルされると購読を止めてchをcloseする）
+func (api *APIClient) GetRealTimeBoard(ctx context.Context, symbol string, ch chan<- Board) {
+	defer close(ch)
+	stream := NewLightstream()
+	SubscribeBoard(ctx, stream, symbol, ch)
+	api.runStream(ctx, stream)
+}
+
+/*
+streamでlightning_board_snapshot_<symbol>とlightning_board_<symbol>を購読し、
+スナップショットに差分を反映した板を更新のたびにchに流す
+*/
+func SubscribeBoard(ctx context.Context, stream *Lightstream, symbol string, ch chan<- Board) error {
+	book := NewOrderBook()
+	send := func() {
+		select {
+		case ch <- book.Board():
+		case <-ctx.Done():
+		}
+	}
+	err := stream.Subscribe(fmt.Sprintf("lightning_board_snapshot_%s", symbol), func(message json.RawMessage) {
+		var snapshot Board
+		if err := json.Unmarshal(message, &snapshot); err != nil {
+			log.Printf("action=SubscribeBoard err=%s", err.Error())
+			return
+		}
+		book.ApplySnapshot(&snapshot)
+		send()
+	})
+	if err != nil {
+		return err
+	}
+	return stream.Subscribe(fmt.Sprintf("lightning_board_%s", symbol), func(message json.RawMessage) {
+		var diff Board
+		if err := json.Unmarshal(message, &diff); err != nil {
+			log.Printf("action=SubscribeBoard err=%s", err.Error())
+			return
+		}
+		if book.ApplyDiff(&diff) {
+			send()
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package bitflyer
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOrderBook(t *testing.T) {
+	book := NewOrderBook()
+	// スナップショットの前の差分は反映しない
+	if book.ApplyDiff(&Board{Bids: []BoardOrder{{Price: 990, Size: 1}}}) {
+		t.Fatal("ApplyDiff() before snapshot = true")
+	}
+
+	var snapshot Board
+	json.Unmarshal([]byte(`{"mid_price":1000,"bids":[{"price":995,"size":1},{"price":999,"size":0.5}],"asks":[{"price":1005,"size":2},{"price":1001,"size":0.1}]}`), &snapshot)
+	book.ApplySnapshot(&snapshot)
+	book.ApplyDiff(&Board{MidPrice: 1000.5, Bids: []BoardOrder{{Price: 999, Size: 0}, {Price: 1000, Size: 0.3}}, Asks: []BoardOrder{{Price: 1005, Size: 3}}})
+
+	board := book.Board()
+	if board.MidPrice != 1000.5 || len(board.Bids) != 2 || board.Bids[0].Price != 1000 || board.Bids[1].Price != 995 {
+		t.Fatalf("Board() = %+v", board)
+	}
+	if len(board.Asks) != 2 || board.Asks[0].Price != 1001 || board.Asks[1].Size != 3 {
+		t.Fatalf("Board() = %+v", board)
+	}
+	if spread := board.Spread(); spread != 1 {
+		t.Errorf("Spread() = %v, want 1", spread)
+	}
+	if depth := board.Depth("SELL", 5); depth != 3.1 {
+		t.Errorf("Depth(SELL, 5) = %v, want 3.1", depth)
+	}
+	if depth := board.Depth("BUY", 1); depth != 0.3 {
+		t.Errorf("Depth(BUY, 1) = %v, want 0.3", depth)
+	}
+
+	// スナップショットは全体を置き換える
+	book.ApplySnapshot(&Board{MidPrice: 2000, Asks: []BoardOrder{{Price: 2001, Size: 1}}})
+	if board := book.Board(); len(board.Bids) != 0 || len(board.Asks) != 1 {
+		t.Errorf("Board() = %+v", board)
+	}
+}
+
+func TestExecutionDateTime(t *testing.T) {
+	var executions []Execution
+	json.Unmarshal([]byte(`[{"id":2288018946,"side":"BUY","price":4800000,"size":0.01,"exec_date":"2021-08-01T12:34:56.789Z"},{"id":2288018947,"side":"","price":4800000,"size":0.02,"exec_date":"2021-08-01T12:34:57.1"}]`), &executions)
+	if len(executions) != 2 {
+		t.Fatalf("executions = %+v", executions)
+	}
+	if got := executions[0].DateTime(); got.Second() != 56 || got.Nanosecond() != 789000000 {
+		t.Errorf("DateTime() = %v", got)
+	}
+	if got := executions[1].DateTime(); got.Second() != 57 || got.IsZero() {
+		t.Errorf("DateTime() = %v", got)
+	}
+}
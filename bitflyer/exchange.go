@@ -0,0 +1,44 @@
+package bitflyer
+
+import (
+	"context"
+	"strings"
+)
+
+/*
+取引所の抽象
+AIはこのinterfaceを通して注文・建玉・証拠金・Tickerを扱うので、
+bitFlyer以外（ペーパートレードや他の取引所、テスト用のフェイク）に差し替えられる
+*/
+type Exchange interface {
+	// 注文を送る
+	SendOrder(order *Order) (*ResponseSendChildOrder, error)
+	// 特殊注文（逆指値など）を送る
+	SendParentOrder(order *ParentOrder) (*ResponseSendParentOrder, error)
+	// 注文の詳細を取得する
+	ListOrder(query map[string]string) ([]Order, error)
+	// 建玉を取得する
+	GetPositions(query map[string]string) ([]Position, error)
+	// 証拠金情報の取得
+	GetCollateral() (*Collateral, error)
+	// 資産残高の取得（現物の取引に使う）
+	GetBalance() ([]Balance, error)
+	// ビットコインの情報を取得する
+	GetTicker(productCode string) (*Ticker, error)
+	// 手数料を取得する
+	GetTradingCommission(productCode string) (*TradingCommission, error)
+	// リアルタイムTicker情報取得（ctxがキャンセルされると購読を止めてchをcloseする）
+	GetRealTimeTicker(ctx context.Context, symbol string, ch chan<- Ticker)
+	// リアルタイム約定取得（ctxがキャンセルされると購読を止めてchをcloseする）
+	GetRealTimeExecutions(ctx context.Context, symbol string, ch chan<- Execution)
+	// リアルタイム板取得（ctxがキャンセルされると購読を止めてchをcloseする）
+	GetRealTimeBoard(ctx context.Context, symbol string, ch chan<- Board)
+}
+
+// APIClientがExchangeを満たしているかをコンパイル時にチェックする
+var _ Exchange = (*APIClient)(nil)
+
+/** 現物のプロダクトか（BTC_JPY・ETH_JPYなど。現物はショートできず、getpositionsで建玉を取得できない） */
+func IsSpot(productCode string) bool {
+	return !strings.HasPrefix(productCode, "FX_") && strings.Contains(productCode, "_")
+}
@@ -0,0 +1,95 @@
+package bitflyer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+/*
+約定（lightning_executions・/v1/executionsの1件）
+Sideは成行側（テイカー）の売買方向。板寄せの場合は空になる
+*/
+type Execution struct {
+	ID                         int64   `json:"id"`
+	Side                       string  `json:"side"`
+	Price                      float64 `json:"price"`
+	Size                       float64 `json:"size"`
+	ExecDate                   string  `json:"exec_date"`
+	BuyChildOrderAcceptanceID  string  `json:"buy_child_order_acceptance_id"`
+	SellChildOrderAcceptanceID string  `json:"sell_child_order_acceptance_id"`
+}
+
+/** 約定日時（exec_dateはUTC） */
+func (e *Execution) DateTime() time.Time {
+	dateTime, err := time.Parse(time.RFC3339Nano, e.ExecDate)
+	if err != nil {
+		// /v1/executionsはタイムゾーンなしで返ってくる
+		dateTime, err = time.Parse("2006-01-02T15:04:05.999999999", e.ExecDate)
+		if err != nil {
+			log.Printf("action=DateTime, err=%s", err.Error())
+		}
+	}
+	return dateTime
+}
+
+/** 約定日時をdurationで切り捨てる */
+func (e *Execution) TruncateDateTime(duration time.Duration) time.Time {
+	return e.DateTime().Truncate(duration)
+}
+
+/*
+約定履歴（/v1/executions）を新しい順に取得する
+queryにはproduct_code・count（最大500）・before・after（約定IDで範囲を指定する）を渡す
+*/
+func (api *APIClient) GetExecutions(query map[string]string) ([]Execution, error) {
+	resp, statusCode, err := api.doRequest("GET", "executions", query, nil)
+	if err != nil {
+		log.Printf("action=GetExecutions err=%s", err.Error())
+		return nil, err
+	}
+	// 流量制限（429）などの場合はエラーのJSONが返ってくる
+	if statusCode == http.StatusTooManyRequests {
+		return nil, fmt.Errorf("executions status=%d body=%s: %w", statusCode, string(resp), ErrTooManyRequests)
+	}
+	if statusCode != http.StatusOK {
+		return nil, fmt.Errorf("executions status=%d body=%s", statusCode, string(resp))
+	}
+	var executions []Execution
+	err = json.Unmarshal(resp, &executions)
+	if err != nil {
+		log.Printf("action=GetExecutions err=%s", err.Error())
+		return nil, err
+	}
+	return executions, nil
+}
+
+// リアルタイム約定取得（ctxがキャンセルされると購読を止めてchをcloseする）
+func (api *APIClient) GetRealTimeExecutions(ctx context.Context, symbol string, ch chan<- Execution) {
+	defer close(ch)
+	stream := NewLightstream()
+	SubscribeExecutions(ctx, stream, symbol, ch)
+	api.runStream(ctx, stream)
+}
+
+/** streamでlightning_executions_<symbol>を購読し、受信した約定を1件ずつchに流す */
+func SubscribeExecutions(ctx context.Context, stream *Lightstream, symbol string, ch chan<- Execution) error {
+	return stream.Subscribe(fmt.Sprintf("lightning_executions_%s", symbol), func(message json.RawMessage) {
+		// 1メッセージに複数の約定が入っている
+		var executions []Execution
+		if err := json.Unmarshal(message, &executions); err != nil {
+			log.Printf("action=SubscribeExecutions err=%s", err.Error())
+			return
+		}
+		for _, execution := range executions {
+			select {
+			case ch <- execution:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
@@ -10,9 +10,9 @@ getBalanceのレスポンス
 https://lightning.bitflyer.com/docs/playground#GETv1%2Fme%2Fgetbalance/javascript
 */
 type Balance struct {
-	CurrentCode string  `json:"current_code"`
-	Amount      float64 `json:amount`
-	Available   float64 `json:available`
+	CurrencyCode string  `json:"currency_code"`
+	Amount       float64 `json:"amount"`
+	Available    float64 `json:"available"`
 }
 
 /*
@@ -0,0 +1,34 @@
+package bitflyer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// リクエストを送らずに固定のレスポンスを返す
+type staticTransport struct {
+	body string
+}
+
+func (s *staticTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(s.body)), Header: http.Header{}, Request: req}, nil
+}
+
+func TestGetBalance(t *testing.T) {
+	// https://lightning.bitflyer.com/docs#資産残高を取得 のレスポンス
+	api := New("key", "secret")
+	api.httpClient = &http.Client{Transport: &staticTransport{body: `[
+		{"currency_code": "JPY", "amount": 1024078, "available": 508000},
+		{"currency_code": "BTC", "amount": 10.24, "available": 4.12},
+		{"currency_code": "ETH", "amount": 20.48, "available": 16.38}
+	]`}}
+	balances, err := api.GetBalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(balances) != 3 || balances[0] != (Balance{CurrencyCode: "JPY", Amount: 1024078, Available: 508000}) || balances[1].CurrencyCode != "BTC" {
+		t.Errorf("GetBalance() = %+v", balances)
+	}
+}
@@ -0,0 +1,230 @@
+package bitflyer
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const lightstreamURL = "wss://ws.lightstream.bitflyer.com/json-rpc"
+
+// lightstreamの接続状態
+const (
+	StreamConnecting   = "connecting"   // 接続中
+	StreamConnected    = "connected"    // 接続してチャンネルを購読した
+	StreamDisconnected = "disconnected" // 切断された（バックオフ後に再接続する）
+	StreamClosed       = "closed"       // ctxがキャンセルされて終了した
+)
+
+/** 接続状態の変化 */
+type StreamEvent struct {
+	State   string    `json:"state"`
+	Attempt int       `json:"attempt"` // 連続して接続に失敗した回数（メッセージを受信するとリセットする）
+	Err     error     `json:"-"`       // 切断の原因
+	Time    time.Time `json:"time"`
+}
+
+/** channelMessageのparams */
+type channelMessage struct {
+	Channel string          `json:"channel"`
+	Message json.RawMessage `json:"message"`
+}
+
+/** lightstreamから受信するJSON-RPCのメッセージ */
+type streamMessage struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Error  json.RawMessage `json:"error,omitempty"`
+}
+
+/*
+bitFlyerのリアルタイムAPI（lightstream）のJSON-RPCクライアント
+切断されると指数バックオフで再接続し、購読中の全てのチャンネルを購読し直す
+PingIntervalごとにpingを送り、ReadTimeoutの間メッセージもpongも届かない場合は切断して再接続する
+*/
+type Lightstream struct {
+	URL          string
+	PingInterval time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+
+	mu       sync.Mutex
+	handlers map[string]func(json.RawMessage) // チャンネル名 -> 受信したメッセージの処理
+	conn     *websocket.Conn
+	writeMu  sync.Mutex // websocket.Connは同時に1つしか書き込めない
+	states   chan StreamEvent
+}
+
+func NewLightstream() *Lightstream {
+	return &Lightstream{
+		URL:          lightstreamURL,
+		PingInterval: 15 * time.Second,
+		ReadTimeout:  60 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		MinBackoff:   1 * time.Second,
+		MaxBackoff:   1 * time.Minute,
+		handlers:     map[string]func(json.RawMessage){},
+		states:       make(chan StreamEvent, 16),
+	}
+}
+
+/** 接続状態の変化（受信が追いつかずバッファが埋まっている間の変化は捨てる） */
+func (l *Lightstream) States() <-chan StreamEvent {
+	return l.states
+}
+
+/** チャンネルを購読する（接続中であればすぐに購読し、再接続時にも購読し直す） */
+func (l *Lightstream) Subscribe(channel string, handler func(message json.RawMessage)) error {
+	l.mu.Lock()
+	l.handlers[channel] = handler
+	conn := l.conn
+	l.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return l.subscribe(conn, channel)
+}
+
+/** ctxがキャンセルされるまで接続・再接続を繰り返す（終了時にStatesをcloseするため1回だけ呼べる） */
+func (l *Lightstream) Run(ctx context.Context) error {
+	defer func() {
+		l.emit(StreamEvent{State: StreamClosed})
+		close(l.states)
+	}()
+	failures := 0
+	for {
+		l.emit(StreamEvent{State: StreamConnecting, Attempt: failures + 1})
+		received, err := l.serve(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if received {
+			failures = 0
+		}
+		failures++
+		l.emit(StreamEvent{State: StreamDisconnected, Attempt: failures, Err: err})
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(l.backoff(failures)):
+		}
+	}
+}
+
+/** 1回の接続（切断されるまで受信したメッセージをhandlerに渡す） */
+func (l *Lightstream) serve(ctx context.Context) (received bool, err error) {
+	dialer := websocket.Dialer{Proxy: http.ProxyFromEnvironment, HandshakeTimeout: l.WriteTimeout}
+	conn, _, err := dialer.DialContext(ctx, l.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go l.keepAlive(ctx, conn, done)
+
+	conn.SetReadDeadline(time.Now().Add(l.ReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(l.ReadTimeout))
+	})
+
+	l.mu.Lock()
+	l.conn = conn
+	channels := make([]string, 0, len(l.handlers))
+	for channel := range l.handlers {
+		channels = append(channels, channel)
+	}
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.conn = nil
+		l.mu.Unlock()
+	}()
+	for _, channel := range channels {
+		if err := l.subscribe(conn, channel); err != nil {
+			return false, err
+		}
+	}
+	l.emit(StreamEvent{State: StreamConnected})
+
+	for {
+		var message streamMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			return received, err
+		}
+		conn.SetReadDeadline(time.Now().Add(l.ReadTimeout))
+		if len(message.Error) > 0 {
+			log.Printf("action=Lightstream err=%s", string(message.Error))
+			continue
+		}
+		if message.Method != "channelMessage" {
+			continue
+		}
+		var params channelMessage
+		if err := json.Unmarshal(message.Params, &params); err != nil {
+			log.Printf("action=Lightstream err=%s", err.Error())
+			continue
+		}
+		l.mu.Lock()
+		handler := l.handlers[params.Channel]
+		l.mu.Unlock()
+		if handler != nil {
+			received = true
+			handler(params.Message)
+		}
+	}
+}
+
+/** PingIntervalごとにpingを送る。ctxがキャンセルされるかpingを送れない場合は接続を閉じてReadJSONを抜ける */
+func (l *Lightstream) keepAlive(ctx context.Context, conn *websocket.Conn, done <-chan struct{}) {
+	tick := time.NewTicker(l.PingInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			conn.Close()
+			return
+		case <-tick.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(l.WriteTimeout)); err != nil {
+				log.Printf("action=Lightstream err=ping: %s", err.Error())
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (l *Lightstream) subscribe(conn *websocket.Conn, channel string) error {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(l.WriteTimeout))
+	return conn.WriteJSON(&JsonRPC2{Version: "2.0", Method: "subscribe", Params: &SubscribeParams{channel}})
+}
+
+/** 連続した失敗回数に応じた再接続までの待ち時間（MinBackoffから倍々にしてMaxBackoffまで） */
+func (l *Lightstream) backoff(failures int) time.Duration {
+	wait := l.MinBackoff
+	for i := 1; i < failures && wait < l.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > l.MaxBackoff {
+		wait = l.MaxBackoff
+	}
+	return wait
+}
+
+func (l *Lightstream) emit(event StreamEvent) {
+	event.Time = time.Now()
+	select {
+	case l.states <- event:
+	default:
+	}
+}
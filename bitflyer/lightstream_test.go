@@ -0,0 +1,114 @@
+package bitflyer
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+テスト用のlightstream
+購読されたチャンネルにメッセージを1件送ってから切断する
+*/
+func newTestLightstreamServer(t *testing.T, subscribed chan<- string) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+		var request JsonRPC2
+		if err := conn.ReadJSON(&request); err != nil {
+			return
+		}
+		params, _ := json.Marshal(request.Params)
+		var subscribe SubscribeParams
+		json.Unmarshal(params, &subscribe)
+		subscribed <- subscribe.Channel
+		conn.WriteJSON(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"method":  "channelMessage",
+			"params":  map[string]interface{}{"channel": subscribe.Channel, "message": map[string]interface{}{"product_code": "FX_BTC_JPY", "best_bid": 1000}},
+		})
+	}))
+}
+
+func TestLightstreamResubscribesAfterReconnect(t *testing.T) {
+	subscribed := make(chan string, 10)
+	server := newTestLightstreamServer(t, subscribed)
+	defer server.Close()
+
+	stream := NewLightstream()
+	stream.URL = "ws" + strings.TrimPrefix(server.URL, "http")
+	stream.MinBackoff = 10 * time.Millisecond
+	received := make(chan Ticker, 10)
+	stream.Subscribe("lightning_ticker_FX_BTC_JPY", func(message json.RawMessage) {
+		var ticker Ticker
+		json.Unmarshal(message, &ticker)
+		received <- ticker
+	})
+
+	states := make(chan []string)
+	go func() {
+		var collected []string
+		for event := range stream.States() {
+			collected = append(collected, event.State)
+		}
+		states <- collected
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- stream.Run(ctx) }()
+
+	// 切断されても再接続して購読し直す
+	for i := 0; i < 2; i++ {
+		select {
+		case channel := <-subscribed:
+			if channel != "lightning_ticker_FX_BTC_JPY" {
+				t.Errorf("subscribed %q", channel)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("not subscribed")
+		}
+		select {
+		case ticker := <-received:
+			if ticker.BestBid != 1000 {
+				t.Errorf("ticker = %+v", ticker)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message")
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Run() = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stop")
+	}
+
+	// 終了するとStatesがcloseされる
+	collected := <-states
+	if len(collected) < 5 || collected[0] != StreamConnecting || collected[1] != StreamConnected || collected[2] != StreamDisconnected || collected[len(collected)-1] != StreamClosed {
+		t.Errorf("states = %v", collected)
+	}
+}
+
+func TestLightstreamBackoff(t *testing.T) {
+	stream := &Lightstream{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for failures, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if got := stream.backoff(failures); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", failures, got, want)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package bitflyer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	paperOrderDateLayout    = "2006-01-02T15:04:05"
+	paperPositionDateLayout = "2006-01-02T15:04:05.000"
+)
+
+/*
+ペーパートレード用の取引所
+マーケットデータ（Ticker）はsourceから取得し、注文はローカルで約定させる
+MARKETは注文したプロダクトの最新のTickerのBestAsk/BestBid、LIMITはTickerが指値に届いた時点で約定する
+証拠金・建玉・注文履歴はメモリ上で管理する
+*/
+type PaperClient struct {
+	source         Exchange
+	commissionRate float64
+	leverage       float64
+
+	mu         sync.Mutex
+	collateral float64
+	tickers    map[string]*Ticker // プロダクトごとの最新のTicker
+	orders     []*Order
+	positions  []Position
+	sequence   int
+}
+
+/*
+collateral: 初期証拠金
+commissionRate: 約定金額に対する手数料率
+leverage: レバレッジ（必要証拠金の算出に使う）
+*/
+func NewPaperClient(source Exchange, collateral, commissionRate, leverage float64) *PaperClient {
+	if leverage <= 0 {
+		leverage = 1
+	}
+	return &PaperClient{
+		source:         source,
+		commissionRate: commissionRate,
+		leverage:       leverage,
+		collateral:     collateral,
+		tickers:        map[string]*Ticker{},
+	}
+}
+
+// PaperClientがExchangeを満たしているかをコンパイル時にチェックする
+var _ Exchange = (*PaperClient)(nil)
+
+/** 注文を受け付ける（MARKETは即時約定、LIMITは約定可能になるまで保持） */
+func (p *PaperClient) SendOrder(order *Order) (*ResponseSendChildOrder, error) {
+	if order.Size <= 0 {
+		return nil, fmt.Errorf("action=SendOrder err=invalid size %v", order.Size)
+	}
+	if order.Side != "BUY" && order.Side != "SELL" {
+		return nil, fmt.Errorf("action=SendOrder err=invalid side %s", order.Side)
+	}
+	if order.ChildOrderType != "MARKET" && order.ChildOrderType != "LIMIT" {
+		return nil, fmt.Errorf("action=SendOrder err=invalid child_order_type %s", order.ChildOrderType)
+	}
+
+	p.mu.Lock()
+	ticker := p.tickers[order.ProductCode]
+	p.mu.Unlock()
+	// まだTickerを受け取っていない場合はsourceから取得する
+	if ticker == nil {
+		t, err := p.source.GetTicker(order.ProductCode)
+		if err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		p.tickers[order.ProductCode] = t
+		p.mu.Unlock()
+		ticker = t
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	price := order.Price
+	if order.ChildOrderType == "MARKET" {
+		price = p.marketPrice(order.Side, ticker)
+	}
+	// 証拠金が足りない場合はbitFlyerと同様にIDなしで返す
+	if !p.hasEnoughCollateral(order.ProductCode, order.Side, price, order.Size) {
+		log.Printf("action=PaperClient.SendOrder status=insufficient_collateral order=%+v", order)
+		return &ResponseSendChildOrder{}, nil
+	}
+
+	p.sequence++
+	accepted := *order
+	accepted.ID = p.sequence
+	accepted.ChildOrderAcceptanceID = fmt.Sprintf("PAPER-%d", p.sequence)
+	accepted.ChildOrderState = "ACTIVE"
+	accepted.ChildOrderDate = time.Now().UTC().Format(paperOrderDateLayout)
+	accepted.OutstandingSize = order.Size
+	if accepted.MinuteToExpires > 0 {
+		accepted.ExpireDate = time.Now().UTC().Add(time.Duration(accepted.MinuteToExpires) * time.Minute).Format(paperOrderDateLayout)
+	}
+	p.orders = append(p.orders, &accepted)
+
+	if accepted.ChildOrderType == "MARKET" || p.isMarketable(&accepted, ticker) {
+		p.fill(&accepted, price)
+	}
+	return &ResponseSendChildOrder{ChildOrderAcceptanceID: accepted.ChildOrderAcceptanceID}, nil
+}
+
+/** 注文の詳細を取得する（product_code, child_order_acceptance_id, child_order_stateで絞り込み可能） */
+func (p *PaperClient) ListOrder(query map[string]string) ([]Order, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var orders []Order
+	// bitFlyerと同様に新しい順で返す
+	for i := len(p.orders) - 1; i >= 0; i-- {
+		order := p.orders[i]
+		if v, ok := query["product_code"]; ok && v != order.ProductCode {
+			continue
+		}
+		if v, ok := query["child_order_acceptance_id"]; ok && v != order.ChildOrderAcceptanceID {
+			continue
+		}
+		if v, ok := query["child_order_state"]; ok && v != order.ChildOrderState {
+			continue
+		}
+		orders = append(orders, *order)
+	}
+	return orders, nil
+}
+
+/** 建玉を取得する（pnlは最新のTickerで評価する） */
+func (p *PaperClient) GetPositions(query map[string]string) ([]Position, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var positions []Position
+	for _, position := range p.positions {
+		if v, ok := query["product_code"]; ok && v != position.ProductCode {
+			continue
+		}
+		position.Pnl = p.positionPnl(position)
+		positions = append(positions, position)
+	}
+	return positions, nil
+}
+
+/** 証拠金情報の取得 */
+func (p *PaperClient) GetCollateral() (*Collateral, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	openPositionPnl := 0.0
+	requireCollateral := 0.0
+	for _, position := range p.positions {
+		openPositionPnl += p.positionPnl(position)
+		requireCollateral += position.RequireCollateral
+	}
+	keepRate := 0.0
+	if requireCollateral > 0 {
+		keepRate = (p.collateral + openPositionPnl) / requireCollateral
+	}
+	return &Collateral{
+		Collateral:        p.collateral,
+		OpenPositionPnl:   openPositionPnl,
+		RequireCollateral: requireCollateral,
+		KeepRate:          keepRate,
+	}, nil
+}
+
+/** 資産残高の取得（日本円の残高として証拠金を返す） */
+func (p *PaperClient) GetBalance() ([]Balance, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return []Balance{{CurrencyCode: "JPY", Amount: p.collateral, Available: p.collateral}}, nil
+}
+
+/** Tickerはsourceから取得し、約定判定にも使う */
+func (p *PaperClient) GetTicker(productCode string) (*Ticker, error) {
+	ticker, err := p.source.GetTicker(productCode)
+	if err != nil {
+		return nil, err
+	}
+	p.OnTicker(*ticker)
+	return ticker, nil
+}
+
+/** 手数料率はNewPaperClientで指定したもの */
+func (p *PaperClient) GetTradingCommission(productCode string) (*TradingCommission, error) {
+	return &TradingCommission{CommissionRate: p.commissionRate}, nil
+}
+
+/** sourceのリアルタイムTickerで指値を約定させてからchに流す */
+func (p *PaperClient) GetRealTimeTicker(ctx context.Context, symbol string, ch chan<- Ticker) {
+	defer close(ch)
+	in := make(chan Ticker)
+	go p.source.GetRealTimeTicker(ctx, symbol, in)
+	for ticker := range in {
+		p.OnTicker(ticker)
+		select {
+		case ch <- ticker:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/** 約定はsourceのものをそのまま流す */
+func (p *PaperClient) GetRealTimeExecutions(ctx context.Context, symbol string, ch chan<- Execution) {
+	p.source.GetRealTimeExecutions(ctx, symbol, ch)
+}
+
+/** 板はsourceのものをそのまま流す */
+func (p *PaperClient) GetRealTimeBoard(ctx context.Context, symbol string, ch chan<- Board) {
+	p.source.GetRealTimeBoard(ctx, symbol, ch)
+}
+
+/** 特殊注文はペーパートレードでは扱わない（建玉はプロセスの終了とともに消えるため） */
+func (p *PaperClient) SendParentOrder(order *ParentOrder) (*ResponseSendParentOrder, error) {
+	return nil, errors.New("action=SendParentOrder err=parent orders are not supported in paper trade")
+}
+
+/** オーダーをキャンセルする */
+func (p *PaperClient) CancelOrder(cancelOrder *CancelOrder) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, order := range p.orders {
+		if order.ChildOrderAcceptanceID != cancelOrder.ChildOrderAcceptanceID {
+			continue
+		}
+		if order.ChildOrderState != "ACTIVE" {
+			return 400, errors.New("action=CancelOrder err=order is not active")
+		}
+		order.ChildOrderState = "CANCELED"
+		order.CancelSize = order.OutstandingSize
+		order.OutstandingSize = 0
+		return 200, nil
+	}
+	return 404, errors.New("action=CancelOrder err=order not found")
+}
+
+/** 最新のTickerを反映し、約定可能な指値と期限切れの注文を処理する */
+func (p *PaperClient) OnTicker(ticker Ticker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tickers[ticker.ProductCode] = &ticker
+	now := time.Now().UTC()
+	for _, order := range p.orders {
+		if order.ChildOrderState != "ACTIVE" || order.ProductCode != ticker.ProductCode {
+			continue
+		}
+		if order.ExpireDate != "" {
+			expireDate, err := time.Parse(paperOrderDateLayout, order.ExpireDate)
+			if err == nil && now.After(expireDate) {
+				order.ChildOrderState = "EXPIRED"
+				order.CancelSize = order.OutstandingSize
+				order.OutstandingSize = 0
+				continue
+			}
+		}
+		if p.isMarketable(order, &ticker) {
+			p.fill(order, order.Price)
+		}
+	}
+}
+
+/** 成行で約定する価格（買いはBestAsk、売りはBestBid） */
+func (p *PaperClient) marketPrice(side string, ticker *Ticker) float64 {
+	if side == "BUY" {
+		return ticker.BestAsk
+	}
+	return ticker.BestBid
+}
+
+/** 指値がTickerに対して約定可能か */
+func (p *PaperClient) isMarketable(order *Order, ticker *Ticker) bool {
+	if order.Side == "BUY" {
+		return ticker.BestAsk > 0 && order.Price >= ticker.BestAsk
+	}
+	return ticker.BestBid > 0 && order.Price <= ticker.BestBid
+}
+
+/** 同じプロダクトの反対売買（決済）にならない分の必要証拠金が足りているか（証拠金は全てのプロダクトで共有する） */
+func (p *PaperClient) hasEnoughCollateral(productCode, side string, price, size float64) bool {
+	openSize := size
+	requireCollateral := 0.0
+	openPositionPnl := 0.0
+	for _, position := range p.positions {
+		if position.ProductCode == productCode && position.Side != side {
+			openSize -= position.Size
+		}
+		requireCollateral += position.RequireCollateral
+		openPositionPnl += p.positionPnl(position)
+	}
+	if openSize <= 0 {
+		return true
+	}
+	return p.collateral+openPositionPnl-requireCollateral >= price*openSize/p.leverage
+}
+
+/** 建玉の評価損益（建玉のプロダクトの最新のTickerで評価する） */
+func (p *PaperClient) positionPnl(position Position) float64 {
+	ticker := p.tickers[position.ProductCode]
+	if ticker == nil {
+		return 0
+	}
+	if position.Side == "BUY" {
+		return (ticker.BestBid - position.Price) * position.Size
+	}
+	return (position.Price - ticker.BestAsk) * position.Size
+}
+
+/** 注文を約定させ、反対の建玉から先に決済（FIFO）して残りを新規建玉にする */
+func (p *PaperClient) fill(order *Order, price float64) {
+	size := order.OutstandingSize
+	commission := price * size * p.commissionRate
+	p.collateral -= commission
+
+	remaining := size
+	var positions []Position
+	for _, position := range p.positions {
+		if remaining <= 0 || position.Side == order.Side || position.ProductCode != order.ProductCode {
+			positions = append(positions, position)
+			continue
+		}
+		closeSize := position.Size
+		if remaining < closeSize {
+			closeSize = remaining
+		}
+		if position.Side == "BUY" {
+			p.collateral += (price - position.Price) * closeSize
+		} else {
+			p.collateral += (position.Price - price) * closeSize
+		}
+		remaining -= closeSize
+		position.Size -= closeSize
+		if position.Size > 0 {
+			position.RequireCollateral = position.Price * position.Size / p.leverage
+			positions = append(positions, position)
+		}
+	}
+	if remaining > 0 {
+		positions = append(positions, Position{
+			ProductCode:       order.ProductCode,
+			Side:              order.Side,
+			Price:             price,
+			Size:              remaining,
+			Commission:        commission * remaining / size,
+			RequireCollateral: price * remaining / p.leverage,
+			OpenDate:          time.Now().UTC().Format(paperPositionDateLayout),
+			Leverage:          p.leverage,
+		})
+	}
+	p.positions = positions
+
+	order.ChildOrderState = "COMPLETED"
+	order.AveragePrice = price
+	order.ExecutedSize = size
+	order.OutstandingSize = 0
+	order.TotalCommission = commission
+	log.Printf("action=PaperClient.fill side=%s price=%v size=%v commission=%v collateral=%v", order.Side, price, size, commission, p.collateral)
+}
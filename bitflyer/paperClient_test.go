@@ -0,0 +1,149 @@
+package bitflyer
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+// 固定のTickerを返すマーケットデータ
+type staticSource struct {
+	ticker Ticker
+}
+
+func (s *staticSource) SendOrder(order *Order) (*ResponseSendChildOrder, error) { return nil, nil }
+func (s *staticSource) ListOrder(query map[string]string) ([]Order, error)      { return nil, nil }
+func (s *staticSource) GetPositions(query map[string]string) ([]Position, error) {
+	return nil, nil
+}
+func (s *staticSource) GetCollateral() (*Collateral, error) { return nil, nil }
+func (s *staticSource) GetBalance() ([]Balance, error)      { return nil, nil }
+func (s *staticSource) GetTicker(productCode string) (*Ticker, error) {
+	t := s.ticker
+	return &t, nil
+}
+func (s *staticSource) GetTradingCommission(productCode string) (*TradingCommission, error) {
+	return &TradingCommission{}, nil
+}
+func (s *staticSource) SendParentOrder(order *ParentOrder) (*ResponseSendParentOrder, error) {
+	return nil, nil
+}
+func (s *staticSource) GetRealTimeTicker(ctx context.Context, symbol string, ch chan<- Ticker) {
+	close(ch)
+}
+func (s *staticSource) GetRealTimeExecutions(ctx context.Context, symbol string, ch chan<- Execution) {
+	close(ch)
+}
+func (s *staticSource) GetRealTimeBoard(ctx context.Context, symbol string, ch chan<- Board) {
+	close(ch)
+}
+
+func newTestTicker(bid, ask float64) Ticker {
+	return Ticker{ProductCode: "FX_BTC_JPY", BestBid: bid, BestAsk: ask}
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestPaperClientMarketRoundTrip(t *testing.T) {
+	source := &staticSource{ticker: newTestTicker(999, 1000)}
+	p := NewPaperClient(source, 100000, 0.001, 4)
+
+	resp, err := p.SendOrder(&Order{ProductCode: "FX_BTC_JPY", ChildOrderType: "MARKET", Side: "BUY", Size: 10})
+	if err != nil || resp.ChildOrderAcceptanceID == "" {
+		t.Fatalf("SendOrder() = %+v, %v", resp, err)
+	}
+	orders, _ := p.ListOrder(map[string]string{"child_order_acceptance_id": resp.ChildOrderAcceptanceID})
+	if len(orders) != 1 || orders[0].ChildOrderState != "COMPLETED" || orders[0].AveragePrice != 1000 {
+		t.Fatalf("ListOrder() = %+v", orders)
+	}
+	positions, _ := p.GetPositions(map[string]string{"product_code": "FX_BTC_JPY"})
+	if len(positions) != 1 || positions[0].Side != "BUY" || positions[0].Size != 10 {
+		t.Fatalf("GetPositions() = %+v", positions)
+	}
+
+	p.OnTicker(newTestTicker(1100, 1101))
+	if _, err := p.SendOrder(&Order{ProductCode: "FX_BTC_JPY", ChildOrderType: "MARKET", Side: "SELL", Size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	positions, _ = p.GetPositions(map[string]string{})
+	if len(positions) != 0 {
+		t.Fatalf("positions should be closed: %+v", positions)
+	}
+	// 利益1000 - 手数料(10000*0.001 + 11000*0.001)
+	collateral, _ := p.GetCollateral()
+	if want := 100000 + 1000 - 10.0 - 11.0; !almostEqual(collateral.Collateral, want) {
+		t.Errorf("Collateral = %v, want %v", collateral.Collateral, want)
+	}
+}
+
+func TestPaperClientLimitOrder(t *testing.T) {
+	source := &staticSource{ticker: newTestTicker(999, 1000)}
+	p := NewPaperClient(source, 100000, 0, 4)
+
+	resp, err := p.SendOrder(&Order{ProductCode: "FX_BTC_JPY", ChildOrderType: "LIMIT", Side: "SELL", Price: 1050, Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, _ := p.ListOrder(map[string]string{"child_order_state": "ACTIVE"})
+	if len(active) != 1 {
+		t.Fatalf("limit order should be active: %+v", active)
+	}
+
+	p.OnTicker(newTestTicker(1060, 1061))
+	orders, _ := p.ListOrder(map[string]string{"child_order_acceptance_id": resp.ChildOrderAcceptanceID})
+	if orders[0].ChildOrderState != "COMPLETED" || orders[0].AveragePrice != 1050 {
+		t.Fatalf("limit order should be filled at its price: %+v", orders[0])
+	}
+	positions, _ := p.GetPositions(map[string]string{})
+	if len(positions) != 1 || positions[0].Side != "SELL" || !almostEqual(positions[0].Pnl, 1050-1061) {
+		t.Fatalf("GetPositions() = %+v", positions)
+	}
+}
+
+func TestPaperClientInsufficientCollateral(t *testing.T) {
+	source := &staticSource{ticker: newTestTicker(999, 1000)}
+	p := NewPaperClient(source, 1000, 0, 2)
+
+	resp, err := p.SendOrder(&Order{ProductCode: "FX_BTC_JPY", ChildOrderType: "MARKET", Side: "BUY", Size: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ChildOrderAcceptanceID != "" {
+		t.Errorf("order exceeding collateral should be rejected: %+v", resp)
+	}
+}
+
+func TestPaperClientMultipleProducts(t *testing.T) {
+	source := &staticSource{ticker: newTestTicker(999, 1000)}
+	p := NewPaperClient(source, 1000, 0, 1)
+	p.OnTicker(Ticker{ProductCode: "BTC_JPY", BestBid: 5000, BestAsk: 5001})
+
+	// 成行は注文したプロダクトのTickerで約定する（最後に届いたBTC_JPYのTickerではない）
+	resp, err := p.SendOrder(&Order{ProductCode: "FX_BTC_JPY", ChildOrderType: "MARKET", Side: "SELL", Size: 0.9})
+	if err != nil || resp.ChildOrderAcceptanceID == "" {
+		t.Fatalf("SendOrder() = %+v, %v", resp, err)
+	}
+	orders, _ := p.ListOrder(map[string]string{"child_order_acceptance_id": resp.ChildOrderAcceptanceID})
+	if orders[0].AveragePrice != 999 {
+		t.Errorf("AveragePrice = %v, want 999", orders[0].AveragePrice)
+	}
+
+	// 評価損益は建玉のプロダクトのTickerで評価する
+	p.OnTicker(newTestTicker(989, 990))
+	p.OnTicker(Ticker{ProductCode: "BTC_JPY", BestBid: 9000, BestAsk: 9001})
+	positions, _ := p.GetPositions(map[string]string{})
+	if len(positions) != 1 || !almostEqual(positions[0].Pnl, (999-990)*0.9) {
+		t.Fatalf("GetPositions() = %+v", positions)
+	}
+
+	// 他のプロダクトの反対の建玉は決済にならないため、証拠金が足りなければ注文できない
+	resp, err = p.SendOrder(&Order{ProductCode: "BTC_JPY", ChildOrderType: "MARKET", Side: "BUY", Size: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ChildOrderAcceptanceID != "" {
+		t.Errorf("BTC_JPY order should be rejected: %+v", resp)
+	}
+}
@@ -0,0 +1,56 @@
+package bitflyer
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// 特殊注文（sendparentorder）の執行条件
+const (
+	ConditionTypeStop      = "STOP"       // 逆指値
+	ConditionTypeStopLimit = "STOP_LIMIT" // ストップ・リミット
+)
+
+/** 特殊注文の1つの注文 */
+type ParentOrderParameter struct {
+	ProductCode   string  `json:"product_code"`
+	ConditionType string  `json:"condition_type"`
+	Side          string  `json:"side"`
+	Size          float64 `json:"size"`
+	Price         float64 `json:"price,omitempty"`         // STOP_LIMITの指値
+	TriggerPrice  float64 `json:"trigger_price,omitempty"` // STOP・STOP_LIMITのトリガー価格
+}
+
+/** 特殊注文（SIMPLEの場合はParametersを1つだけ指定する） */
+type ParentOrder struct {
+	OrderMethod     string                 `json:"order_method"`
+	MinuteToExpires int                    `json:"minute_to_expire,omitempty"` // 省略時は43200（30日）
+	TimeInForce     string                 `json:"time_in_force,omitempty"`
+	Parameters      []ParentOrderParameter `json:"parameters"`
+}
+
+// SendParentOrder responce
+type ResponseSendParentOrder struct {
+	ParentOrderAcceptanceID string `json:"parent_order_acceptance_id"`
+}
+
+// 特殊注文を送る
+func (api *APIClient) SendParentOrder(order *ParentOrder) (*ResponseSendParentOrder, error) {
+	data, err := json.Marshal(order)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	resp, _, err := api.doRequest("POST", "me/sendparentorder", map[string]string{}, data)
+	if err != nil {
+		log.Printf("action=SendParentOrder err=%s", err.Error())
+		return nil, err
+	}
+	var response ResponseSendParentOrder
+	err = json.Unmarshal(resp, &response)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return &response, nil
+}
@@ -1,12 +1,10 @@
 package bitflyer
 
 import (
-	"app/config"
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/gorilla/websocket"
 	"log"
-	"net/url"
 )
 
 /*
@@ -40,50 +38,35 @@ type SubscribeParams struct {
 	Channel string `json:"channel"`
 }
 
-// リアルタイムTicker情報取得
-func (api *APIClient) GetRealTimeTicker(symbol string, ch chan<- Ticker) {
-START:
-	u := url.URL{Scheme: "wss", Host: "ws.lightstream.bitflyer.com", Path: "/json-rpc"}
-	log.Printf("connecting to %s", u.String())
-
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		log.Println("dial:", err)
-		api.GetRealTimeTicker(config.Config.ProductCode, ch)
-	}
-	defer c.Close()
-
-	channel := fmt.Sprintf("lightning_ticker_%s", symbol)
-	if err := c.WriteJSON(&JsonRPC2{Version: "2.0", Method: "subscribe", Params: &SubscribeParams{channel}}); err != nil {
-		log.Fatal("subscribe:", err)
-		return
-	}
+// リアルタイムTicker情報取得（ctxがキャンセルされると購読を止めてchをcloseする）
+func (api *APIClient) GetRealTimeTicker(ctx context.Context, symbol string, ch chan<- Ticker) {
+	defer close(ch)
+	stream := NewLightstream()
+	SubscribeTicker(ctx, stream, symbol, ch)
+	api.runStream(ctx, stream)
+}
 
-OUTER:
-	for {
-		message := new(JsonRPC2)
-		if err := c.ReadJSON(message); err != nil {
-			log.Println("read:", err)
-			goto START
+/** streamでlightning_ticker_<symbol>を購読し、受信したTickerをchに流す */
+func SubscribeTicker(ctx context.Context, stream *Lightstream, symbol string, ch chan<- Ticker) error {
+	return stream.Subscribe(fmt.Sprintf("lightning_ticker_%s", symbol), func(message json.RawMessage) {
+		var ticker Ticker
+		if err := json.Unmarshal(message, &ticker); err != nil {
+			log.Printf("action=SubscribeTicker err=%s", err.Error())
+			return
+		}
+		select {
+		case ch <- ticker:
+		case <-ctx.Done():
 		}
+	})
+}
 
-		if message.Method == "channelMessage" {
-			switch v := message.Params.(type) {
-			case map[string]interface{}:
-				for key, binary := range v {
-					if key == "message" {
-						marshaTic, err := json.Marshal(binary)
-						if err != nil {
-							continue OUTER
-						}
-						var ticker Ticker
-						if err := json.Unmarshal(marshaTic, &ticker); err != nil {
-							continue OUTER
-						}
-						ch <- ticker
-					}
-				}
-			}
+/** streamの接続状態をOnStreamStateの処理に渡しながら、ctxがキャンセルされるまで受信する */
+func (api *APIClient) runStream(ctx context.Context, stream *Lightstream) {
+	go func() {
+		for event := range stream.States() {
+			api.streamState(event)
 		}
-	}
+	}()
+	stream.Run(ctx)
 }
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/** 1日の中の時間帯（0時からの経過時間。EndがStartより前の場合は日付をまたぐ） */
+type TimeRange struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+/** tの時刻が時間帯に含まれるか（Start <= t < End） */
+func (r TimeRange) Contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if r.Start <= r.End {
+		return r.Start <= offset && offset < r.End
+	}
+	return r.Start <= offset || offset < r.End
+}
+
+/*
+取引時間のカレンダー
+メンテナンスの時間帯は新規の取引をしない（建玉の決済のための取引は行う）
+*/
+type TradingCalendar struct {
+	Maintenance []TimeRange
+	Location    *time.Location
+}
+
+/** 新規の取引をしてよい時刻か */
+func (c *TradingCalendar) IsOpen(t time.Time) bool {
+	if c.Location != nil {
+		t = t.In(c.Location)
+	}
+	for _, maintenance := range c.Maintenance {
+		if maintenance.Contains(t) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+"04:00-05:00,12:30-12:45"の形式の時間帯を読み込む
+"none"または空文字列の場合はメンテナンスなし
+*/
+func ParseTradingCalendar(maintenance string, location *time.Location) (*TradingCalendar, error) {
+	calendar := &TradingCalendar{Location: location}
+	if strings.TrimSpace(maintenance) == "none" {
+		return calendar, nil
+	}
+	for _, spec := range strings.Split(maintenance, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		bounds := strings.Split(spec, "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid maintenance %q", spec)
+		}
+		start, err := parseClock(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		calendar.Maintenance = append(calendar.Maintenance, TimeRange{Start: start, End: end})
+	}
+	return calendar, nil
+}
+
+/** "HH:MM"を0時からの経過時間にする（"24:00"は1日の終わり） */
+func parseClock(clock string) (time.Duration, error) {
+	clock = strings.TrimSpace(clock)
+	if clock == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTradingCalendar(t *testing.T) {
+	jst := time.FixedZone("JST", 9*60*60)
+	calendar, err := ParseTradingCalendar("04:00-05:00, 23:30-00:30", jst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{time.Date(2021, 8, 1, 3, 59, 59, 0, jst), true},
+		{time.Date(2021, 8, 1, 4, 0, 0, 0, jst), false},
+		{time.Date(2021, 8, 1, 4, 59, 59, 0, jst), false},
+		{time.Date(2021, 8, 1, 5, 0, 0, 0, jst), true},
+		// 日付をまたぐ時間帯
+		{time.Date(2021, 8, 1, 23, 45, 0, 0, jst), false},
+		{time.Date(2021, 8, 2, 0, 15, 0, 0, jst), false},
+		{time.Date(2021, 8, 2, 0, 30, 0, 0, jst), true},
+		// 別のタイムゾーンの時刻はカレンダーのタイムゾーンで判定する（UTC19時 = JST4時）
+		{time.Date(2021, 8, 1, 19, 30, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := calendar.IsOpen(tt.t); got != tt.want {
+			t.Errorf("IsOpen(%s) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+
+	none, err := ParseTradingCalendar("none", jst)
+	if err != nil || len(none.Maintenance) != 0 {
+		t.Errorf("ParseTradingCalendar(none) = %+v, %v", none, err)
+	}
+	for _, invalid := range []string{"04:00", "04:00-25:00", "4時-5時"} {
+		if _, err := ParseTradingCalendar(invalid, jst); err == nil {
+			t.Errorf("ParseTradingCalendar(%q) err = nil", invalid)
+		}
+	}
+}
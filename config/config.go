@@ -1,12 +1,21 @@
 package config
 
 import (
+	"fmt"
 	"gopkg.in/ini.v1"
 	"log"
 	"os"
+	"strings"
 	"time"
 )
 
+/** プロダクトごとの設定（config.iniの[product.<プロダクトコード>]。省略時は[gotrade]の値） */
+type ProductConfig struct {
+	ProductCode      string
+	UsePercent       float64 // 証拠金のうち注文に使う割合（プロダクトごとのリスク予算）
+	StopLimitPercent float64
+}
+
 type ConfigList struct {
 	ApiKey           string
 	ApiSecret        string
@@ -21,6 +30,7 @@ type ConfigList struct {
 	DbUserName       string
 	DbPort           string
 	SQLDriver        string
+	SQLitePath       string
 	Port             int
 	BackTest         bool
 	UsePercent       float64
@@ -37,8 +47,71 @@ type ConfigList struct {
 	LineNotifyToken  string
 	LinePostUrl      string
 	BacketName       string
+	CandleSource     string
+	CandleFlush      time.Duration
+
+	// ペーパートレード
+	PaperTrade          bool
+	PaperCollateral     float64
+	PaperCommissionRate float64
+	PaperLeverage       float64
+
+	// ウォークフォワード最適化
+	WalkForward           bool
+	WalkForwardTrainSize  int
+	WalkForwardTestSize   int
+	WalkForwardMinHitRate float64
+
+	// 並列最適化
+	OptimizeWorkers    int
+	OptimizeTimeout    time.Duration
+	OptimizeMaxRetries int
+	OptimizeSearch     string                   // 探索方法（grid・random）
+	OptimizeSamples    int                      // randomの場合に評価する組み合わせ数（インディケータごと）
+	OptimizeSeed       int64                    // randomの場合の乱数のシード
+	OptimizeRanges     map[string]OptimizeRange // インディケータのパラメータの探索範囲（指定がないパラメータは組み込みの範囲）
+
+	// 建玉の照合
+	ReconcileInterval time.Duration
+	ReconcileRepair   bool
+
+	// キャンドルの欠けの検出
+	GapCheckInterval time.Duration
+	GapCheckWindow   time.Duration
+	GapRepair        bool
+
+	// 取引時間
+	TradingCalendar *TradingCalendar
+
+	// 1分足からまとめて作成する時間足（Durationsにも含まれる）
+	DerivedDurations []time.Duration
+
+	// 同時に取引するプロダクト（先頭はProductCode）
+	Products []ProductConfig
+
+	// AI.Tradeで売買の判定に使う戦略の名前（model.RegisterStrategyで登録したもの）
+	TradeStrategies []string
+	// 戦略として登録するルールファイル（YAML・JSON）
+	RuleFile string
+
+	// インディケータの確信度を重み付けして合算するアンサンブル（有効な場合はTradeStrategiesの代わりに使う）
+	EnsembleEnable    bool
+	EnsembleThreshold float64
+
+	// プロダクトごとに並行して動かす戦略（空の場合はAI.Tradeで取引する）
+	Strategies []StrategyConfig
+
+	// 停止時の処理
+	ShutdownPositionPolicy string
+	ShutdownTimeout        time.Duration
 }
 
+// キャンドルの作成元
+const (
+	CandleSourceExecutions = "executions" // lightning_executionsの約定から作成する
+	CandleSourceTicker     = "ticker"     // lightning_tickerの仲値から作成する（以前の方式）
+)
+
 var Config ConfigList
 
 func init() {
@@ -67,6 +140,8 @@ func init() {
 		DbPass:           cfg.Section("db").Key("password").String(),
 		DbUserName:       cfg.Section("db").Key("user_name").String(),
 		DbPort:           cfg.Section("db").Key("port").String(),
+		SQLDriver:        cfg.Section("db").Key("driver").MustString("mysql"),
+		SQLitePath:       cfg.Section("db").Key("sqlite_path").MustString("gotrade.sqlite"),
 		BackTest:         cfg.Section("gotrade").Key("back_test").MustBool(),
 		UsePercent:       cfg.Section("gotrade").Key("use_percent").MustFloat64(),
 		DataLimit:        cfg.Section("gotrade").Key("data_limit").MustInt(),
@@ -82,5 +157,128 @@ func init() {
 		LineNotifyToken:  cfg.Section("line").Key("notify_token").String(),
 		LinePostUrl:      cfg.Section("line").Key("post_url").String(),
 		BacketName:       cfg.Section("aws").Key("backet_name").String(),
+		CandleSource:     cfg.Section("gotrade").Key("candle_source").In(CandleSourceExecutions, []string{CandleSourceExecutions, CandleSourceTicker}),
+		CandleFlush:      time.Duration(cfg.Section("gotrade").Key("candle_flush_ms").MustInt(1000)) * time.Millisecond,
+
+		PaperTrade:          cfg.Section("paper").Key("enable").MustBool(),
+		PaperCollateral:     cfg.Section("paper").Key("collateral").MustFloat64(100000),
+		PaperCommissionRate: cfg.Section("paper").Key("commission_rate").MustFloat64(),
+		PaperLeverage:       cfg.Section("paper").Key("leverage").MustFloat64(4),
+
+		WalkForward:           cfg.Section("optimize").Key("walk_forward").MustBool(),
+		WalkForwardTrainSize:  cfg.Section("optimize").Key("train_size").MustInt(300),
+		WalkForwardTestSize:   cfg.Section("optimize").Key("test_size").MustInt(100),
+		WalkForwardMinHitRate: cfg.Section("optimize").Key("min_hit_rate").MustFloat64(0.5),
+
+		EnsembleEnable:    cfg.Section("ensemble").Key("enable").MustBool(),
+		EnsembleThreshold: cfg.Section("ensemble").Key("threshold").MustFloat64(0.5),
+
+		OptimizeWorkers:    cfg.Section("optimize").Key("workers").MustInt(),
+		OptimizeTimeout:    time.Duration(cfg.Section("optimize").Key("timeout_sec").MustInt(30)) * time.Second,
+		OptimizeMaxRetries: cfg.Section("optimize").Key("max_retries").MustInt(3),
+		OptimizeSearch:     cfg.Section("optimize").Key("search").In(OptimizeSearchGrid, []string{OptimizeSearchGrid, OptimizeSearchRandom}),
+		OptimizeSamples:    cfg.Section("optimize").Key("samples").MustInt(200),
+		OptimizeSeed:       cfg.Section("optimize").Key("seed").MustInt64(1),
+
+		ReconcileInterval: time.Duration(cfg.Section("reconcile").Key("interval_min").MustInt(10)) * time.Minute,
+		ReconcileRepair:   cfg.Section("reconcile").Key("repair").MustBool(),
+
+		GapCheckInterval: time.Duration(cfg.Section("gap").Key("interval_min").MustInt(60)) * time.Minute,
+		GapCheckWindow:   time.Duration(cfg.Section("gap").Key("window_hour").MustInt(24)) * time.Hour,
+		GapRepair:        cfg.Section("gap").Key("repair").MustBool(),
+
+		ShutdownPositionPolicy: cfg.Section("shutdown").Key("position_policy").In("keep", []string{"keep", "close", "stop"}),
+		ShutdownTimeout:        time.Duration(cfg.Section("shutdown").Key("timeout_sec").MustInt(60)) * time.Second,
+	}
+
+	// 4h・1d・1wなど、約定からは作成せず1分足からまとめて作成する時間足
+	for _, key := range strings.Split(cfg.Section("gotrade").Key("derived_durations").MustString("4h,1d,1w"), ",") {
+		if strings.TrimSpace(key) == "" {
+			continue
+		}
+		duration, err := ParseDurationKey(key)
+		if err != nil {
+			log.Printf("Failed to read derived_durations: %v", err)
+			os.Exit(1)
+		}
+		if _, ok := Config.Durations[strings.TrimSpace(key)]; ok {
+			continue
+		}
+		Config.Durations[strings.TrimSpace(key)] = duration
+		Config.DerivedDurations = append(Config.DerivedDurations, duration)
+	}
+
+	Config.OptimizeRanges, err = parseOptimizeRanges(cfg.Section("optimize.range"))
+	if err != nil {
+		log.Printf("Failed to read optimize.range: %v", err)
+		os.Exit(1)
+	}
+
+	// 同時に取引するプロダクト（product_codesの指定がない場合はproduct_codeのみ）
+	Config.Products, err = parseProducts(cfg, cfg.Section("gotrade").Key("product_codes").MustString(Config.ProductCode), Config.UsePercent, Config.StopLimitPercent)
+	if err != nil {
+		log.Printf("Failed to read product_codes: %v", err)
+		os.Exit(1)
+	}
+	if len(Config.Products) > 0 {
+		Config.ProductCode = Config.Products[0].ProductCode
+	}
+
+	// AI.Tradeで使う戦略（指定がない場合はEMAのクロスをMACDで絞り込む以前の判定）
+	for _, name := range strings.Split(cfg.Section("gotrade").Key("trade_strategies").MustString("ema_macd"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			Config.TradeStrategies = append(Config.TradeStrategies, name)
+		}
+	}
+
+	Config.RuleFile = cfg.Section("gotrade").Key("rule_file").String()
+
+	Config.Strategies, err = parseStrategies(cfg, cfg.Section("gotrade").Key("strategies").String())
+	if err != nil {
+		log.Printf("Failed to read strategies: %v", err)
+		os.Exit(1)
+	}
+
+	// メンテナンスの時間帯（指定がない場合は本番は4時台、それ以外は19時台）
+	maintenance := "19:00-20:00"
+	if Config.IsProduction {
+		maintenance = "04:00-05:00"
+	}
+	location, err := time.LoadLocation(cfg.Section("schedule").Key("timezone").MustString("Local"))
+	if err != nil {
+		log.Printf("Failed to load timezone: %v", err)
+		os.Exit(1)
+	}
+	Config.TradingCalendar, err = ParseTradingCalendar(cfg.Section("schedule").Key("maintenance").MustString(maintenance), location)
+	if err != nil {
+		log.Printf("Failed to read schedule: %v", err)
+		os.Exit(1)
+	}
+}
+
+/*
+カンマ区切りのプロダクトコードと[product.<プロダクトコード>]のセクションからプロダクトごとの設定を作成する
+複数のプロダクトは同じ証拠金を分け合うため、use_percentの合計が1を超える場合はエラーにする
+*/
+func parseProducts(cfg *ini.File, productCodes string, usePercent, stopLimitPercent float64) ([]ProductConfig, error) {
+	var products []ProductConfig
+	total := 0.0
+	for _, productCode := range strings.Split(productCodes, ",") {
+		productCode = strings.TrimSpace(productCode)
+		if productCode == "" {
+			continue
+		}
+		section := cfg.Section("product." + productCode)
+		products = append(products, ProductConfig{
+			ProductCode:      productCode,
+			UsePercent:       section.Key("use_percent").MustFloat64(usePercent),
+			StopLimitPercent: section.Key("stop_limit_percent").MustFloat64(stopLimitPercent),
+		})
+		total += products[len(products)-1].UsePercent
+	}
+	// 1つのプロダクトのみの場合は従来どおり証拠金に掛ける倍率として1を超えてもよい
+	if len(products) > 1 && total > 1 {
+		return nil, fmt.Errorf("total use_percent %v of %d products exceeds 1", total, len(products))
 	}
+	return products, nil
 }
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/** "4h"・"1d"・"1w"の形式の時間足を読み込む（d・wの他はtime.ParseDurationの形式） */
+func ParseDurationKey(key string) (time.Duration, error) {
+	key = strings.TrimSpace(key)
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if strings.HasSuffix(key, suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(key, suffix))
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid duration %q", key)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	duration, err := time.ParseDuration(key)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", key)
+	}
+	return duration, nil
+}
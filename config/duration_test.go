@@ -0,0 +1,25 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDurationKey(t *testing.T) {
+	tests := map[string]time.Duration{
+		"15m": 15 * time.Minute,
+		"4h":  4 * time.Hour,
+		"1d":  24 * time.Hour,
+		"1w":  7 * 24 * time.Hour,
+	}
+	for key, want := range tests {
+		if got, err := ParseDurationKey(key); err != nil || got != want {
+			t.Errorf("ParseDurationKey(%q) = %s, %v, want %s", key, got, err, want)
+		}
+	}
+	for _, invalid := range []string{"", "0d", "xd", "-1h"} {
+		if _, err := ParseDurationKey(invalid); err == nil {
+			t.Errorf("ParseDurationKey(%q) err = nil", invalid)
+		}
+	}
+}
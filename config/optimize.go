@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"gopkg.in/ini.v1"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 最適化の探索方法
+const (
+	OptimizeSearchGrid   = "grid"   // 探索範囲の全ての組み合わせ
+	OptimizeSearchRandom = "random" // 探索範囲の組み合わせからsamples個を無作為に選ぶ（seedが同じなら同じ組み合わせ）
+)
+
+// 探索範囲を指定できるパラメータと期間かどうか（期間はmin・max・stepが整数でminが1以上でなければならない）
+var optimizeRangeKeys = map[string]bool{
+	"ema_period1":           true,
+	"ema_period2":           true,
+	"bb_n":                  true,
+	"bb_k":                  false,
+	"macd_fast":             true,
+	"macd_slow":             true,
+	"macd_signal":           true,
+	"rsi_period":            true,
+	"rsi_buy":               false,
+	"rsi_sell":              false,
+	"ichimoku_tenkan":       true,
+	"ichimoku_kijun":        true,
+	"ichimoku_senkou_b":     true,
+	"ichimoku_displacement": true,
+}
+
+/** パラメータの探索範囲（min以上max以下をstep刻み） */
+type OptimizeRange struct {
+	Min  float64
+	Max  float64
+	Step float64
+}
+
+/** [optimize.range]の「パラメータ名 = min,max,step」から探索範囲を作成する */
+func parseOptimizeRanges(section *ini.Section) (map[string]OptimizeRange, error) {
+	ranges := map[string]OptimizeRange{}
+	for _, key := range section.Keys() {
+		period, ok := optimizeRangeKeys[key.Name()]
+		if !ok {
+			return nil, fmt.Errorf("unknown optimize range %s", key.Name())
+		}
+		values := strings.Split(key.String(), ",")
+		if len(values) != 3 {
+			return nil, fmt.Errorf("optimize range %s must be min,max,step: %s", key.Name(), key.String())
+		}
+		var r [3]float64
+		for i, value := range values {
+			v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				return nil, fmt.Errorf("optimize range %s: %v", key.Name(), err)
+			}
+			r[i] = v
+		}
+		if r[0] > r[1] || r[2] <= 0 {
+			return nil, fmt.Errorf("optimize range %s must be min <= max and step > 0: %s", key.Name(), key.String())
+		}
+		if period && (r[0] <= 0 || r[0] != math.Trunc(r[0]) || r[1] != math.Trunc(r[1]) || r[2] != math.Trunc(r[2])) {
+			return nil, fmt.Errorf("optimize range %s is a period and must be integers with min > 0: %s", key.Name(), key.String())
+		}
+		ranges[key.Name()] = OptimizeRange{Min: r[0], Max: r[1], Step: r[2]}
+	}
+	return ranges, nil
+}
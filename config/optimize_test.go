@@ -0,0 +1,33 @@
+package config
+
+import (
+	"gopkg.in/ini.v1"
+	"testing"
+)
+
+func TestParseOptimizeRanges(t *testing.T) {
+	cfg, err := ini.Load([]byte("[optimize.range]\nema_period1 = 5, 20, 1\nbb_k = 1.5,2.5,0.1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges, err := parseOptimizeRanges(cfg.Section("optimize.range"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 || ranges["ema_period1"] != (OptimizeRange{Min: 5, Max: 20, Step: 1}) || ranges["bb_k"] != (OptimizeRange{Min: 1.5, Max: 2.5, Step: 0.1}) {
+		t.Errorf("ranges = %+v", ranges)
+	}
+
+	for _, data := range []string{"rsi_period = 5,30", "rsi_period = 30,5,1", "rsi_period = 5,30,0", "rsi_period = a,30,1", "rsi_period = 0,30,1", "ichimoku_tenkan = -1,9,1", "rsi_period = 0.4,3,0.5", "bb_n = 10,30.5,1", "macd_fast = 8,16,1.5", "rsi_periods = 5,30,1"} {
+		cfg, _ := ini.Load([]byte("[optimize.range]\n" + data))
+		if _, err := parseOptimizeRanges(cfg.Section("optimize.range")); err == nil {
+			t.Errorf("parseOptimizeRanges(%s) err = nil", data)
+		}
+	}
+
+	// 期間ではないパラメータは0以下でもよい
+	cfg, _ = ini.Load([]byte("[optimize.range]\nrsi_buy = 0,40,10\n"))
+	if _, err := parseOptimizeRanges(cfg.Section("optimize.range")); err != nil {
+		t.Errorf("parseOptimizeRanges(rsi_buy) = %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"gopkg.in/ini.v1"
+	"testing"
+)
+
+func TestParseProducts(t *testing.T) {
+	cfg, err := ini.Load([]byte("[product.ETH_JPY]\nuse_percent = 0.2\nstop_limit_percent = 0.9\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	products, err := parseProducts(cfg, "FX_BTC_JPY, ETH_JPY,", 0.5, 0.95)
+	if err != nil || len(products) != 2 {
+		t.Fatalf("products = %+v", products)
+	}
+	// セクションがないプロダクトは[gotrade]の値を使う
+	if p := products[0]; p.ProductCode != "FX_BTC_JPY" || p.UsePercent != 0.5 || p.StopLimitPercent != 0.95 {
+		t.Errorf("products[0] = %+v", p)
+	}
+	if p := products[1]; p.ProductCode != "ETH_JPY" || p.UsePercent != 0.2 || p.StopLimitPercent != 0.9 {
+		t.Errorf("products[1] = %+v", p)
+	}
+
+	// 1つのプロダクトのみの場合はuse_percentが1を超えてもよい（証拠金に掛ける倍率）
+	if products, err := parseProducts(ini.Empty(), "FX_BTC_JPY", 3.5, 0.95); err != nil || products[0].UsePercent != 3.5 {
+		t.Errorf("parseProducts() with one product = %+v, %v", products, err)
+	}
+	// 複数のプロダクトでuse_percentの合計が1を超える場合はエラー
+	if _, err := parseProducts(cfg, "FX_BTC_JPY,BTC_JPY,ETH_JPY", 0.5, 0.95); err == nil {
+		t.Error("parseProducts() with total use_percent 1.2 should fail")
+	}
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+	"gopkg.in/ini.v1"
+	"strings"
+)
+
+/** 同じプロダクトで並行して動かす戦略の設定（config.iniの[strategy.<戦略ID>]） */
+type StrategyConfig struct {
+	ID         string
+	Indicators []string // 売買の判定に使う戦略の名前（ema・bb・macd・ichimoku・rsi・ema_macdなど）
+	Allocation float64  // プロダクトの資金のうちこの戦略に割り当てる割合
+}
+
+/*
+カンマ区切りの戦略IDと[strategy.<戦略ID>]のセクションから戦略ごとの設定を作成する
+allocationの省略時は指定された戦略の残りを等分する。allocationの合計が1を超える場合はエラー
+*/
+func parseStrategies(cfg *ini.File, strategyIDs string) ([]StrategyConfig, error) {
+	var ids []string
+	for _, id := range strings.Split(strategyIDs, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	var strategies []StrategyConfig
+	specified, unspecified := 0.0, 0
+	for _, id := range ids {
+		section := cfg.Section("strategy." + id)
+		// Keyは存在しないキーを作成するため先に確認する
+		hasAllocation := section.HasKey("allocation")
+		strategy := StrategyConfig{ID: id, Allocation: section.Key("allocation").MustFloat64(0)}
+		for _, indicator := range strings.Split(section.Key("indicators").String(), ",") {
+			if indicator = strings.TrimSpace(indicator); indicator != "" {
+				strategy.Indicators = append(strategy.Indicators, indicator)
+			}
+		}
+		if len(strategy.Indicators) == 0 {
+			return nil, fmt.Errorf("strategy %s has no indicators", id)
+		}
+		if hasAllocation {
+			if strategy.Allocation <= 0 {
+				return nil, fmt.Errorf("strategy %s allocation must be positive: %v", id, strategy.Allocation)
+			}
+			specified += strategy.Allocation
+		} else {
+			unspecified++
+		}
+		strategies = append(strategies, strategy)
+	}
+	if unspecified > 0 && specified >= 1 {
+		return nil, fmt.Errorf("no allocation is left for strategies without allocation: %v", specified)
+	}
+	total := specified
+	for i := range strategies {
+		if strategies[i].Allocation == 0 {
+			strategies[i].Allocation = (1 - specified) / float64(unspecified)
+			total += strategies[i].Allocation
+		}
+	}
+	// 浮動小数点の誤差は許容する
+	if total > 1+1e-9 {
+		return nil, fmt.Errorf("total allocation of strategies exceeds 1: %v", total)
+	}
+	return strategies, nil
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+	"gopkg.in/ini.v1"
+	"math"
+	"testing"
+)
+
+func TestParseStrategies(t *testing.T) {
+	cfg, err := ini.Load([]byte("[strategy.trend]\nindicators = ema, macd\nallocation = 0.6\n[strategy.reversal]\nindicators = rsi\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	strategies, err := parseStrategies(cfg, "trend,reversal")
+	if err != nil || len(strategies) != 2 {
+		t.Fatalf("parseStrategies() = %+v, %v", strategies, err)
+	}
+	if s := strategies[0]; s.ID != "trend" || len(s.Indicators) != 2 || s.Indicators[1] != "macd" || s.Allocation != 0.6 {
+		t.Errorf("strategies[0] = %+v", s)
+	}
+	// allocationの省略時は残りを割り当てる
+	if s := strategies[1]; s.Indicators[0] != "rsi" || math.Abs(s.Allocation-0.4) > 1e-9 {
+		t.Errorf("strategies[1] = %+v", s)
+	}
+
+	if strategies, err := parseStrategies(cfg, ""); err != nil || len(strategies) != 0 {
+		t.Errorf("parseStrategies(empty) = %+v, %v", strategies, err)
+	}
+	over, _ := ini.Load([]byte("[strategy.a]\nindicators = ema\nallocation = 0.7\n[strategy.b]\nindicators = rsi\nallocation = 0.7\n"))
+	if _, err := parseStrategies(over, "a,b"); err == nil {
+		t.Error("parseStrategies() with allocation over 1 err = nil")
+	}
+	if _, err := parseStrategies(cfg, "unknown"); err == nil {
+		t.Error("parseStrategies() without indicators err = nil")
+	}
+}
@@ -0,0 +1,14 @@
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS `TRADES` (
+    `id` INT PRIMARY KEY NOT NULL AUTO_INCREMENT,
+    `product_code` VARCHAR(50) NOT NULL,
+    `side` VARCHAR(50) NOT NULL,
+    `size` float NOT NULL,
+    `open_event_id` INT NOT NULL,
+    `close_event_id` INT,
+    `pnl` float NOT NULL DEFAULT 0,
+    `open_product_code` VARCHAR(50) UNIQUE
+);
+-- +migrate Down
+DROP TABLE IF EXISTS `TRADES`;
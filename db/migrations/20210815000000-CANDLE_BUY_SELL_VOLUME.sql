@@ -0,0 +1,17 @@
+-- マイグレーションで作成した全ての時間足のテーブル（それ以外のテーブルはCandleRepositoryが初回アクセス時に列を追加する）
+-- +migrate Up
+ALTER TABLE `FX_BTC_JPY_1s` ADD COLUMN `buy_volume` float NOT NULL DEFAULT 0, ADD COLUMN `sell_volume` float NOT NULL DEFAULT 0;
+ALTER TABLE `FX_BTC_JPY_30s` ADD COLUMN `buy_volume` float NOT NULL DEFAULT 0, ADD COLUMN `sell_volume` float NOT NULL DEFAULT 0;
+ALTER TABLE `FX_BTC_JPY_1m0s` ADD COLUMN `buy_volume` float NOT NULL DEFAULT 0, ADD COLUMN `sell_volume` float NOT NULL DEFAULT 0;
+ALTER TABLE `FX_BTC_JPY_5m0s` ADD COLUMN `buy_volume` float NOT NULL DEFAULT 0, ADD COLUMN `sell_volume` float NOT NULL DEFAULT 0;
+ALTER TABLE `FX_BTC_JPY_15m0s` ADD COLUMN `buy_volume` float NOT NULL DEFAULT 0, ADD COLUMN `sell_volume` float NOT NULL DEFAULT 0;
+ALTER TABLE `FX_BTC_JPY_30m0s` ADD COLUMN `buy_volume` float NOT NULL DEFAULT 0, ADD COLUMN `sell_volume` float NOT NULL DEFAULT 0;
+ALTER TABLE `FX_BTC_JPY_1h0m0s` ADD COLUMN `buy_volume` float NOT NULL DEFAULT 0, ADD COLUMN `sell_volume` float NOT NULL DEFAULT 0;
+-- +migrate Down
+ALTER TABLE `FX_BTC_JPY_1s` DROP COLUMN `buy_volume`, DROP COLUMN `sell_volume`;
+ALTER TABLE `FX_BTC_JPY_30s` DROP COLUMN `buy_volume`, DROP COLUMN `sell_volume`;
+ALTER TABLE `FX_BTC_JPY_1m0s` DROP COLUMN `buy_volume`, DROP COLUMN `sell_volume`;
+ALTER TABLE `FX_BTC_JPY_5m0s` DROP COLUMN `buy_volume`, DROP COLUMN `sell_volume`;
+ALTER TABLE `FX_BTC_JPY_15m0s` DROP COLUMN `buy_volume`, DROP COLUMN `sell_volume`;
+ALTER TABLE `FX_BTC_JPY_30m0s` DROP COLUMN `buy_volume`, DROP COLUMN `sell_volume`;
+ALTER TABLE `FX_BTC_JPY_1h0m0s` DROP COLUMN `buy_volume`, DROP COLUMN `sell_volume`;
@@ -0,0 +1,8 @@
+-- +migrate Up
+ALTER TABLE `SIGNAL_EVENTS` ADD COLUMN `strategy_id` VARCHAR(50) NOT NULL DEFAULT '';
+ALTER TABLE `TRADES` ADD COLUMN `strategy_id` VARCHAR(50) NOT NULL DEFAULT '';
+ALTER TABLE `TRADES` MODIFY `open_product_code` VARCHAR(101);
+-- +migrate Down
+ALTER TABLE `TRADES` MODIFY `open_product_code` VARCHAR(50);
+ALTER TABLE `TRADES` DROP COLUMN `strategy_id`;
+ALTER TABLE `SIGNAL_EVENTS` DROP COLUMN `strategy_id`;
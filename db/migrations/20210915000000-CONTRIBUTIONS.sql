@@ -0,0 +1,4 @@
+-- +migrate Up
+ALTER TABLE `SIGNAL_EVENTS` ADD COLUMN `contributions` TEXT;
+-- +migrate Down
+ALTER TABLE `SIGNAL_EVENTS` DROP COLUMN `contributions`;
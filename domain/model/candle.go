@@ -12,4 +12,6 @@ type Candle struct {
 	High        float64       `json:"high"`
 	Low         float64       `json:"low"`
 	Volume      float64       `json:"volume"`
+	BuyVolume   float64       `json:"buy_volume"`  // 買いの成行で約定した数量（約定から作成した場合のみ）
+	SellVolume  float64       `json:"sell_volume"` // 売りの成行で約定した数量（約定から作成した場合のみ）
 }
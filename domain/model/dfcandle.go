@@ -3,6 +3,7 @@ package model
 import (
 	"app/config"
 	"app/domain/tradingalgo"
+	"context"
 	"github.com/markcheno/go-talib"
 	"sort"
 	"time"
@@ -45,11 +46,13 @@ type BBands struct {
 
 /** 一目均衡表 */
 type IchimokuCloud struct {
-	Tenkan  []float64 `json:"tenkan,omitempty"`
-	Kijun   []float64 `json:"kijun,omitempty"`
-	SenkouA []float64 `json:"senkoua,omitempty"`
-	SenkouB []float64 `json:"senkoub,omitempty"`
-	Chikou  []float64 `json:"chikou,omitempty"`
+	Periods tradingalgo.IchimokuPeriods `json:"periods"`
+	Tenkan  []float64                   `json:"tenkan,omitempty"`
+	Kijun   []float64                   `json:"kijun,omitempty"`
+	SenkouA []float64                   `json:"senkoua,omitempty"` // キャンドルごとの雲（Displacement本前に算出した値）
+	SenkouB []float64                   `json:"senkoub,omitempty"`
+	Chikou  []float64                   `json:"chikou,omitempty"` // Displacement本後の終値（最後のDisplacement本は0）
+	Signals *IchimokuSignals            `json:"signals,omitempty"`
 }
 
 /** RSI（買われすぎ, 売られすぎの指標）*/
@@ -173,17 +176,19 @@ func (df *DataFrameCandle) AddBBands(n int, k float64) bool {
 	return false
 }
 
-/** 一目均衡表 */
-func (df *DataFrameCandle) AddIchimoku() bool {
-	tenkanN := 9
-	if len(df.Closes()) >= tenkanN {
-		tenkan, kijun, senkouA, senkouB, chikou := tradingalgo.IchimokuCloud(df.Closes())
+/** 一目均衡表（高値・安値から算出し、シグナルも設定する） */
+func (df *DataFrameCandle) AddIchimoku(tenkanPeriod, kijunPeriod, senkouBPeriod, displacement int) bool {
+	periods := tradingalgo.IchimokuPeriods{Tenkan: tenkanPeriod, Kijun: kijunPeriod, SenkouB: senkouBPeriod, Displacement: displacement}
+	if len(df.Candles) >= tenkanPeriod {
+		tenkan, kijun, senkouA, senkouB, chikou := tradingalgo.Ichimoku(df.Highs(), df.Low(), df.Closes(), periods)
 		df.IchimokuCloud = &IchimokuCloud{
+			Periods: periods,
 			Tenkan:  tenkan,
 			Kijun:   kijun,
 			SenkouA: senkouA,
 			SenkouB: senkouB,
 			Chikou:  chikou,
+			Signals: df.IchimokuSignals(periods),
 		}
 		return true
 	}
@@ -233,7 +238,7 @@ func (df *DataFrameCandle) AddHv(period int) bool {
 }
 
 func (df *DataFrameCandle) AddEvents(timeTime time.Time) bool {
-	signalEvents := GetSignalEventsAfterTime(timeTime)
+	signalEvents := GetSignalEventsAfterTime(df.ProductCode, timeTime)
 	if len(signalEvents.Signals) > 0 {
 		df.Events = signalEvents
 		return true
@@ -248,7 +253,13 @@ func (df *DataFrameCandle) BackTestEma(period1, period2 int, reOpen bool) *Signa
 	if lenCandles <= period1 || lenCandles <= period2 {
 		return nil
 	}
-	signalEvents := NewSignalEvents()
+	return df.backTestSides(df.emaSides(period1, period2), reOpen)
+}
+
+/** キャンドルごとのEMAのシグナル */
+func (df *DataFrameCandle) emaSides(period1, period2 int) []string {
+	lenCandles := len(df.Candles)
+	sides := make([]string, lenCandles)
 	// EMAを算出
 	emaValue1 := talib.Ema(df.Closes(), period1)
 	emaValue2 := talib.Ema(df.Closes(), period2)
@@ -259,40 +270,57 @@ func (df *DataFrameCandle) BackTestEma(period1, period2 int, reOpen bool) *Signa
 		}
 		// ゴールデンクロス時は買い
 		if emaValue1[i-1] < emaValue2[i-1] && emaValue1[i] >= emaValue2[i] {
-			signalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false, reOpen, 0, 0, 0, 0)
+			sides[i] = "BUY"
 		}
 		// デッドクロスは売り
 		if emaValue1[i-1] > emaValue2[i-1] && emaValue1[i] <= emaValue2[i] {
-			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false, reOpen, 0, 0, 0, 0)
+			sides[i] = "SELL"
+		}
+	}
+	return sides
+}
+
+/*
+キャンドルごとのシグナル（BUY・SELL・空）の通りに売買した売買イベント
+Buy・Sellは建玉がない場合や反対の建玉がある場合のみ記録されるため、同じ方向のシグナルが続いた場合は最初のみ記録される
+*/
+func (df *DataFrameCandle) backTestSides(sides []string, reOpen bool) *SignalEvents {
+	signalEvents := NewSignalEvents()
+	for i, side := range sides {
+		switch side {
+		case "BUY":
+			signalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false, reOpen, 0, 0, 0, 0, nil)
+		case "SELL":
+			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false, reOpen, 0, 0, 0, 0, nil)
 		}
 	}
 	return signalEvents
 }
 
 /** EMA最適化
-利益が出ないと判断すれば0, 7, 14を返す
+探索範囲で最も損益の良い期間とその損益を返す（キャンドルが足りない場合は0, 7, 14を返す）
 */
 func (df *DataFrameCandle) OptimizeEma(reOpen bool) (performance float64, bestPeriod1 int, bestPeriod2 int) {
-	bestPeriod1 = 7
-	bestPeriod2 = 14
-	performance = 1
-	// TODO 数を伸ばしたりして要調整 No.129
-	//for period1 := 5; period1 < 30; period1++ {
-	//	for period2 := 12; period2 < 50; period2++ {
-	//		signalEvents := df.BackTestEma(period1, period2, reOpen)
-	//		if signalEvents == nil {
-	//			continue
-	//		}
-	//		// それぞれの利益を出して1番良い成績を残す日数を探す
-	//		profit := signalEvents.Profit()
-	//		if performance < profit {
-	//			performance = profit
-	//			bestPeriod1 = period1
-	//			bestPeriod2 = period2
-	//		}
-	//	}
-	//}
-	return performance, bestPeriod1, bestPeriod2
+	result := df.optimizeGrid(emaGrid(), reOpen)
+	return result.performance, result.params.EmaPeriod1, result.params.EmaPeriod2
+}
+
+/** EMA最適化の探索範囲（短期の期間が長期の期間より短い組み合わせのみ） */
+func emaGrid() optimizeGrid {
+	grid := optimizeGrid{
+		indicator: IndicatorEma,
+		defaults:  TradeParams{EmaPeriod1: 7, EmaPeriod2: 14},
+	}
+	for _, period1 := range configRange("ema_period1", paramRange{min: 5, max: 20, step: 1}).ints() {
+		for _, period2 := range configRange("ema_period2", paramRange{min: 12, max: 50, step: 2}).ints() {
+			if period1 >= period2 {
+				continue
+			}
+			grid.candidates = append(grid.candidates, TradeParams{EmaPeriod1: period1, EmaPeriod2: period2})
+		}
+	}
+	grid.candidates = sampleCandidates(grid.candidates)
+	return grid
 }
 
 /** ボリンジャーバンドバックテスト */
@@ -303,7 +331,13 @@ func (df *DataFrameCandle) BackTestBb(n int, k float64, reOpen bool) *SignalEven
 		return nil
 	}
 
-	signalEvents := &SignalEvents{}
+	return df.backTestSides(df.bbSides(n, k), reOpen)
+}
+
+/** キャンドルごとのボリンジャーバンドのシグナル */
+func (df *DataFrameCandle) bbSides(n int, k float64) []string {
+	lenCandles := len(df.Candles)
+	sides := make([]string, lenCandles)
 	bbUp, _, bbDown := talib.BBands(df.Closes(), n, k, k, 0)
 	// i < nの時は０が返ってくる？のでスキップ
 	for i := 1; i < lenCandles; i++ {
@@ -312,74 +346,76 @@ func (df *DataFrameCandle) BackTestBb(n int, k float64, reOpen bool) *SignalEven
 		}
 		// 買い（売られ過ぎ）判定
 		if bbDown[i-1] > df.Candles[i-1].Close && bbDown[i] <= df.Candles[i].Close {
-			signalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false, reOpen, 0, 0, 0, 0)
+			sides[i] = "BUY"
 		}
 		// 売り（買われ過ぎ）判定
 		if bbUp[i-1] < df.Candles[i-1].Close && bbUp[i] >= df.Candles[i].Close {
-			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false, reOpen, 0, 0, 0, 0)
+			sides[i] = "SELL"
 		}
 	}
-	return signalEvents
+	return sides
 }
 
 /** ボリンジャーバンド最適化 */
 func (df *DataFrameCandle) OptimizeBb(reOpen bool) (performance float64, bestN int, bestK float64) {
-	bestN = 20
-	bestK = 2.0
-	// TDOO 数を増やせば範囲が広がる（例 n := 10 n < 60 TODO No.130
-	for n := 10; n < 20; n++ {
+	result := df.optimizeGrid(bbGrid(), reOpen)
+	return result.performance, result.params.BbN, result.params.BbK
+}
+
+/** ボリンジャーバンド最適化の探索範囲 */
+func bbGrid() optimizeGrid {
+	grid := optimizeGrid{
+		indicator: IndicatorBb,
+		defaults:  TradeParams{BbN: 20, BbK: 2.0},
+	}
+	for _, n := range configRange("bb_n", paramRange{min: 10, max: 30, step: 1}).ints() {
 		// 1.0 , 3.0とかにすると範囲が広がり緩くなる
-		for k := 1.9; k < 2.1; k += 0.1 {
-			signalEvents := df.BackTestBb(n, k, reOpen)
-			if signalEvents == nil {
-				continue
-			}
-			profit := signalEvents.Profit()
-			if performance < profit {
-				performance = profit
-				bestN = n
-				bestK = k
-			}
+		for _, k := range configRange("bb_k", paramRange{min: 1.5, max: 2.5, step: 0.1}).values() {
+			grid.candidates = append(grid.candidates, TradeParams{BbN: n, BbK: k})
 		}
 	}
-	return performance, bestN, bestK
+	grid.candidates = sampleCandidates(grid.candidates)
+	return grid
 }
 
-/** 一目均衡表 */
-func (df *DataFrameCandle) BackTestIchimoku(reOpen bool) *SignalEvents {
+/** 一目均衡表バックテスト */
+func (df *DataFrameCandle) BackTestIchimoku(tenkanPeriod, kijunPeriod, senkouBPeriod, displacement int, reOpen bool) *SignalEvents {
 	lenCandles := len(df.Candles)
-
-	if lenCandles <= 52 {
+	// 雲が算出できるキャンドル数のチェック
+	if lenCandles <= senkouBPeriod+displacement || lenCandles <= kijunPeriod {
 		return nil
 	}
 
-	var signalEvents SignalEvents
-	tenkan, kijun, senkouA, senkouB, chikou := tradingalgo.IchimokuCloud(df.Closes())
-	for i := 1; i < lenCandles; i++ {
-		// 買い判定（三役好転）
-		if chikou[i-1] < df.Candles[i-1].High && chikou[i] >= df.Candles[i].High &&
-			senkouA[i] < df.Candles[i].Low && senkouB[i] < df.Candles[i].Low &&
-			tenkan[i] > kijun[i] {
-			signalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false, reOpen, 0, 0, 0, 0)
-		}
-		// 売り判定（三役逆転）
-		if chikou[i-1] > df.Candles[i-1].Low && chikou[i] <= df.Candles[i].Low &&
-			senkouA[i] > df.Candles[i].High && senkouB[i] > df.Candles[i].High &&
-			tenkan[i] < kijun[i] {
-			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false, reOpen, 0, 0, 0, 0)
-		}
-	}
-	return &signalEvents
+	return df.backTestSides(df.ichimokuSides(tradingalgo.IchimokuPeriods{Tenkan: tenkanPeriod, Kijun: kijunPeriod, SenkouB: senkouBPeriod, Displacement: displacement}), reOpen)
+}
+
+/** 一目均衡表最適化 */
+func (df *DataFrameCandle) OptimizeIchimoku(reOpen bool) (performance float64, bestTenkanPeriod, bestKijunPeriod, bestSenkouBPeriod, bestDisplacement int) {
+	result := df.optimizeGrid(ichimokuGrid(), reOpen)
+	return result.performance, result.params.IchimokuTenkan, result.params.IchimokuKijun, result.params.IchimokuSenkouB, result.params.IchimokuDisplacement
 }
 
-// 一目均衡表最適化
-func (df *DataFrameCandle) OptimizeIchimoku(reOpen bool) (performance float64) {
-	signalEvents := df.BackTestIchimoku(reOpen)
-	if signalEvents == nil {
-		return 0.0
+/** 一目均衡表最適化の探索範囲（転換線・基準線・先行スパンBの順に期間が長い組み合わせのみ） */
+func ichimokuGrid() optimizeGrid {
+	defaults := tradingalgo.DefaultIchimokuPeriods
+	grid := optimizeGrid{
+		indicator: IndicatorIchimoku,
+		defaults:  TradeParams{IchimokuTenkan: defaults.Tenkan, IchimokuKijun: defaults.Kijun, IchimokuSenkouB: defaults.SenkouB, IchimokuDisplacement: defaults.Displacement},
 	}
-	performance = signalEvents.Profit()
-	return performance
+	for _, tenkan := range configRange("ichimoku_tenkan", paramRange{min: 7, max: 11, step: 2}).ints() {
+		for _, kijun := range configRange("ichimoku_kijun", paramRange{min: 22, max: 30, step: 4}).ints() {
+			for _, senkouB := range configRange("ichimoku_senkou_b", paramRange{min: 44, max: 60, step: 8}).ints() {
+				if tenkan >= kijun || kijun >= senkouB {
+					continue
+				}
+				for _, displacement := range configRange("ichimoku_displacement", paramRange{min: 26, max: 26, step: 1}).ints() {
+					grid.candidates = append(grid.candidates, TradeParams{IchimokuTenkan: tenkan, IchimokuKijun: kijun, IchimokuSenkouB: senkouB, IchimokuDisplacement: displacement})
+				}
+			}
+		}
+	}
+	grid.candidates = sampleCandidates(grid.candidates)
+	return grid
 }
 
 /** MACDバックテスト */
@@ -390,7 +426,13 @@ func (df *DataFrameCandle) BackTestMacd(macdFastPeriod, macdSlowPeriod, macdSign
 		return nil
 	}
 
-	signalEvents := &SignalEvents{}
+	return df.backTestSides(df.macdSides(macdFastPeriod, macdSlowPeriod, macdSignalPeriod), reOpen)
+}
+
+/** キャンドルごとのMACDのシグナル */
+func (df *DataFrameCandle) macdSides(macdFastPeriod, macdSlowPeriod, macdSignalPeriod int) []string {
+	lenCandles := len(df.Candles)
+	sides := make([]string, lenCandles)
 	outMACD, outMACDSignal, _ := talib.Macd(df.Closes(), macdFastPeriod, macdSlowPeriod, macdSignalPeriod)
 	for i := 1; i < lenCandles; i++ {
 		// 買い判定
@@ -398,43 +440,43 @@ func (df *DataFrameCandle) BackTestMacd(macdFastPeriod, macdSlowPeriod, macdSign
 			outMACDSignal[i] < 0 &&
 			outMACD[i-1] < outMACDSignal[i-1] &&
 			outMACD[i] >= outMACDSignal[i] {
-			signalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false, reOpen, 0, 0, 0, 0)
+			sides[i] = "BUY"
 		}
 		// 売り判定
 		if outMACD[i] > 0 &&
 			outMACDSignal[i] > 0 &&
 			outMACD[i-1] > outMACDSignal[i-1] &&
 			outMACD[i] <= outMACDSignal[i] {
-			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false, reOpen, 0, 0, 0, 0)
+			sides[i] = "SELL"
 		}
 	}
-	return signalEvents
+	return sides
 }
 
 /** MACD最適化 */
 func (df *DataFrameCandle) OptimizeMacd(reOpen bool) (performance float64, bestMacdFastPeriod, bestMacdSlowPeriod, bestMacdSignalPeriod int) {
-	bestMacdFastPeriod = 10
-	bestMacdSlowPeriod = 26
-	bestMacdSignalPeriod = 9
-	performance = 1
-	//for fastPeriod := 10; fastPeriod < 25; fastPeriod++ {
-	//	for slowPeriod := 20; slowPeriod < 33; slowPeriod++ {
-	//		for signalPeriod := 5; signalPeriod < 18; signalPeriod++ {
-	//			signalEvents := df.BackTestMacd(bestMacdFastPeriod, bestMacdSlowPeriod, bestMacdSignalPeriod, reOpen)
-	//			if signalEvents == nil {
-	//				continue
-	//			}
-	//			profit := signalEvents.Profit()
-	//			if performance < profit {
-	//				performance = profit
-	//				bestMacdFastPeriod = fastPeriod
-	//				bestMacdSlowPeriod = slowPeriod
-	//				bestMacdSignalPeriod = signalPeriod
-	//			}
-	//		}
-	//	}
-	//}
-	return performance, bestMacdFastPeriod, bestMacdSlowPeriod, bestMacdSignalPeriod
+	result := df.optimizeGrid(macdGrid(), reOpen)
+	return result.performance, result.params.MacdFastPeriod, result.params.MacdSlowPeriod, result.params.MacdSignalPeriod
+}
+
+/** MACD最適化の探索範囲（短期の期間が長期の期間より短い組み合わせのみ） */
+func macdGrid() optimizeGrid {
+	grid := optimizeGrid{
+		indicator: IndicatorMacd,
+		defaults:  TradeParams{MacdFastPeriod: 10, MacdSlowPeriod: 26, MacdSignalPeriod: 9},
+	}
+	for _, fastPeriod := range configRange("macd_fast", paramRange{min: 8, max: 16, step: 2}).ints() {
+		for _, slowPeriod := range configRange("macd_slow", paramRange{min: 20, max: 32, step: 2}).ints() {
+			if fastPeriod >= slowPeriod {
+				continue
+			}
+			for _, signalPeriod := range configRange("macd_signal", paramRange{min: 5, max: 13, step: 2}).ints() {
+				grid.candidates = append(grid.candidates, TradeParams{MacdFastPeriod: fastPeriod, MacdSlowPeriod: slowPeriod, MacdSignalPeriod: signalPeriod})
+			}
+		}
+	}
+	grid.candidates = sampleCandidates(grid.candidates)
+	return grid
 }
 
 /** RSIバックテスト */
@@ -444,66 +486,80 @@ func (df *DataFrameCandle) BackTestRsi(period int, buyThread, sellThread float64
 		return nil
 	}
 
-	signalEvents := NewSignalEvents()
+	return df.backTestSides(df.rsiSides(period, buyThread, sellThread), reOpen)
+}
+
+/** キャンドルごとのRSIのシグナル */
+func (df *DataFrameCandle) rsiSides(period int, buyThread, sellThread float64) []string {
+	lenCandles := len(df.Candles)
+	sides := make([]string, lenCandles)
 	values := talib.Rsi(df.Closes(), period)
 	for i := 1; i < lenCandles; i++ {
 		if values[i-1] == 0 || values[i-1] == 100 {
 			continue
 		}
 		if values[i-1] < buyThread && values[i] >= buyThread {
-			signalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false, reOpen, 0, 0, 0, 0)
+			sides[i] = "BUY"
 		}
 
 		if values[i-1] > sellThread && values[i] <= sellThread {
-			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 1.0, false, reOpen, 0, 0, 0, 0)
+			sides[i] = "SELL"
 		}
 	}
-	return signalEvents
+	return sides
 }
 
 /** RSI最適化
 bestBuyThread: 買いのライン, bestSellThread: 売りのライン
 */
 func (df *DataFrameCandle) OptimizeRsi(reOpen bool) (performance float64, bestPeriod int, bestBuyThread, bestSellThread float64) {
-	// 各デフォルト
-	bestPeriod = 14
-	bestBuyThread, bestSellThread = 30.0, 70.0
+	result := df.optimizeGrid(rsiGrid(), reOpen)
+	return result.performance, result.params.RsiPeriod, result.params.RsiBuyThread, result.params.RsiSellThread
+}
 
-	for period := 5; period < 30; period++ {
-		signalEvents := df.BackTestRsi(period, bestBuyThread, bestSellThread, reOpen)
-		if signalEvents == nil {
-			continue
-		}
-		profit := signalEvents.Profit()
-		if performance < profit {
-			performance = profit
-			bestPeriod = period
-			bestBuyThread = bestBuyThread
-			bestSellThread = bestSellThread
+/** RSI最適化の探索範囲 */
+func rsiGrid() optimizeGrid {
+	// 各デフォルト
+	grid := optimizeGrid{
+		indicator: IndicatorRsi,
+		defaults:  TradeParams{RsiPeriod: 14, RsiBuyThread: 30.0, RsiSellThread: 70.0},
+	}
+	for _, period := range configRange("rsi_period", paramRange{min: 5, max: 29, step: 1}).ints() {
+		for _, buyThread := range configRange("rsi_buy", paramRange{min: 20, max: 40, step: 5}).values() {
+			for _, sellThread := range configRange("rsi_sell", paramRange{min: 60, max: 80, step: 5}).values() {
+				grid.candidates = append(grid.candidates, TradeParams{RsiPeriod: period, RsiBuyThread: buyThread, RsiSellThread: sellThread})
+			}
 		}
 	}
-	return performance, bestPeriod, bestBuyThread, bestSellThread
+	grid.candidates = sampleCandidates(grid.candidates)
+	return grid
 }
 
 type TradeParams struct {
-	EmaEnable        bool
-	EmaPeriod1       int
-	EmaPeriod2       int
-	BbEnable         bool
-	BbN              int
-	BbK              float64
-	IchimokuEnable   bool
-	MacdEnable       bool
-	MacdFastPeriod   int
-	MacdSlowPeriod   int
-	MacdSignalPeriod int
-	RsiEnable        bool
-	RsiPeriod        int
-	RsiBuyThread     float64
-	RsiSellThread    float64
+	EmaEnable            bool
+	EmaPeriod1           int
+	EmaPeriod2           int
+	BbEnable             bool
+	BbN                  int
+	BbK                  float64
+	IchimokuEnable       bool
+	IchimokuTenkan       int
+	IchimokuKijun        int
+	IchimokuSenkouB      int
+	IchimokuDisplacement int
+	MacdEnable           bool
+	MacdFastPeriod       int
+	MacdSlowPeriod       int
+	MacdSignalPeriod     int
+	RsiEnable            bool
+	RsiPeriod            int
+	RsiBuyThread         float64
+	RsiSellThread        float64
+	Performances         map[string]float64 // ランキングに使ったインディケータごとの損益（アンサンブルの重みに使う）
 }
 
 type Ranking struct {
+	Indicator   string
 	Enable      bool
 	Performance float64
 }
@@ -512,23 +568,21 @@ type Ranking struct {
 どのインディケータでトレードを行うかを返す
 return TradeParams */
 func (df *DataFrameCandle) OptimizeParams(reOpen bool) *TradeParams {
-	emaPerformance, emaPeriod1, emaPeriod2 := df.OptimizeEma(reOpen)
-	bbPerformance, bbN, bbK := df.OptimizeBb(reOpen)
-	macdPerformance, macdFastPeriod, macdSlowPeriod, macdSignalPeriod := df.OptimizeMacd(reOpen)
-	ichimokuPerforamcne := df.OptimizeIchimoku(reOpen)
-	rsiPerformance, rsiPeriod, rsiBuyThread, rsiSellThread := df.OptimizeRsi(reOpen)
-
-	emaRanking := &Ranking{false, emaPerformance}
-	bbRanking := &Ranking{false, bbPerformance}
-	macdRanking := &Ranking{false, macdPerformance}
-	ichimokuRanking := &Ranking{false, ichimokuPerforamcne}
-	rsiRanking := &Ranking{false, rsiPerformance}
+	tradeParams, _ := df.OptimizeParamsContext(context.Background(), reOpen, OptimizeOptions{})
+	return tradeParams
+}
 
+/** インディケータごとの損益の上位NumRanking個のうち利益が出ているものを有効にする */
+func rankParams(tradeParams *TradeParams, performances map[string]float64) *TradeParams {
+	tradeParams.Performances = performances
 	// Rankingに格納してソートする
-	rankings := []*Ranking{emaRanking, bbRanking, macdRanking, ichimokuRanking, rsiRanking}
+	rankings := make([]*Ranking, len(indicators))
+	for i, indicator := range indicators {
+		rankings[i] = &Ranking{Indicator: indicator, Performance: performances[indicator]}
+	}
 	sort.Slice(rankings, func(i, j int) bool { return rankings[i].Performance > rankings[j].Performance })
 
-	// いずれのインディケータもfalseの場合再度キャンドルの結果を得てからオプティマイズし直す
+	// 環境変数から使用するインディケータを選出する
 	isEnable := false
 	for i, ranking := range rankings {
 		if i >= config.Config.NumRanking {
@@ -536,6 +590,7 @@ func (df *DataFrameCandle) OptimizeParams(reOpen bool) *TradeParams {
 		}
 		if ranking.Performance > 0 {
 			ranking.Enable = true
+			tradeParams.enable(ranking.Indicator)
 			// 1つでもインディケータが使えるならtrueにする
 			isEnable = true
 		}
@@ -544,33 +599,5 @@ func (df *DataFrameCandle) OptimizeParams(reOpen bool) *TradeParams {
 	if !isEnable {
 		return nil
 	}
-
-	// 環境変数から使用するインディケータを選出する
-	for i, ranking := range rankings {
-		if i >= config.Config.NumRanking {
-			break
-		}
-		if ranking.Performance > 0 {
-			ranking.Enable = true
-		}
-	}
-
-	tradeParams := &TradeParams{
-		EmaEnable:        emaRanking.Enable,
-		EmaPeriod1:       emaPeriod1,
-		EmaPeriod2:       emaPeriod2,
-		BbEnable:         bbRanking.Enable,
-		BbN:              bbN,
-		BbK:              bbK,
-		IchimokuEnable:   ichimokuRanking.Enable,
-		MacdEnable:       macdRanking.Enable,
-		MacdFastPeriod:   macdFastPeriod,
-		MacdSlowPeriod:   macdSlowPeriod,
-		MacdSignalPeriod: macdSignalPeriod,
-		RsiEnable:        rsiRanking.Enable,
-		RsiPeriod:        rsiPeriod,
-		RsiBuyThread:     rsiBuyThread,
-		RsiSellThread:    rsiSellThread,
-	}
 	return tradeParams
 }
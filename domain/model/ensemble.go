@@ -0,0 +1,95 @@
+package model
+
+import (
+	"log"
+	"math"
+)
+
+/*
+インディケータの確信度を重み付けして合算するアンサンブル
+重みはバックテストのランキングのインディケータごとの損益から学習し、合計が閾値以上の方向に売買する
+*/
+type Ensemble struct {
+	Weights    map[string]float64 `json:"weights"`   // インディケータごとの重み（合計1、損益が出ていないインディケータは0）
+	Threshold  float64            `json:"threshold"` // 売買する合計スコアの絶対値の下限
+	strategies []Strategy
+}
+
+/** アンサンブルの判定結果 */
+type EnsembleDecision struct {
+	Side          string             `json:"side"`          // BUY・SELL（閾値に届かない場合は空）
+	Score         float64            `json:"score"`         // 合計スコア（買いは正、売りは負）
+	Contributions map[string]float64 `json:"contributions"` // インディケータごとのスコア（重み×確信度、売りは負）
+}
+
+/** 全てのインディケータの戦略を持つアンサンブルを作成する（重みはLearnで設定する） */
+func NewEnsemble(threshold float64) *Ensemble {
+	ensemble := &Ensemble{Weights: map[string]float64{}, Threshold: threshold}
+	for _, indicator := range indicators {
+		strategy, err := NewStrategy(indicator)
+		if err != nil {
+			log.Printf("action=NewEnsemble err=%s", err)
+			continue
+		}
+		ensemble.strategies = append(ensemble.strategies, strategy)
+	}
+	return ensemble
+}
+
+/*
+最適化済みのパラメータを設定し、有効なインディケータの損益に比例した重みを学習する
+損益が記録されていない場合は有効なインディケータを均等な重みにする
+*/
+func (e *Ensemble) Learn(params *TradeParams) {
+	weights := map[string]float64{}
+	total := 0.0
+	for _, strategy := range e.strategies {
+		strategy.SetParams(*params)
+		name := strategy.Name()
+		if !params.enabled(name) {
+			continue
+		}
+		weight := 1.0
+		if params.Performances != nil {
+			weight = math.Max(params.Performances[name], 0)
+		}
+		weights[name] = weight
+		total += weight
+	}
+	for name := range weights {
+		if total > 0 {
+			weights[name] /= total
+		} else {
+			weights[name] = 0
+		}
+	}
+	e.Weights = weights
+}
+
+/** dfの最後のキャンドルでの判定 */
+func (e *Ensemble) Decide(df *DataFrameCandle) EnsembleDecision {
+	decision := EnsembleDecision{Contributions: map[string]float64{}}
+	for _, strategy := range e.strategies {
+		weight := e.Weights[strategy.Name()]
+		if weight == 0 {
+			continue
+		}
+		signal := strategy.OnCandle(df)
+		switch signal.Side {
+		case "BUY":
+			decision.Contributions[strategy.Name()] = weight * signal.Score
+		case "SELL":
+			decision.Contributions[strategy.Name()] = -weight * signal.Score
+		default:
+			continue
+		}
+		decision.Score += decision.Contributions[strategy.Name()]
+	}
+	switch {
+	case decision.Score > 0 && decision.Score >= e.Threshold:
+		decision.Side = "BUY"
+	case decision.Score < 0 && -decision.Score >= e.Threshold:
+		decision.Side = "SELL"
+	}
+	return decision
+}
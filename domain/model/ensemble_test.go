@@ -0,0 +1,96 @@
+package model
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEnsembleLearn(t *testing.T) {
+	ensemble := NewEnsemble(0.5)
+	params := &TradeParams{
+		EmaEnable: true, EmaPeriod1: 5, EmaPeriod2: 20,
+		BbEnable: true, BbN: 20, BbK: 2,
+		RsiEnable: true, RsiPeriod: 14, RsiBuyThread: 30, RsiSellThread: 70,
+		Performances: map[string]float64{IndicatorEma: 300, IndicatorBb: -50, IndicatorRsi: 100, IndicatorMacd: 1000},
+	}
+	ensemble.Learn(params)
+	// 損益に比例し、損失・無効なインディケータは0
+	want := map[string]float64{IndicatorEma: 0.75, IndicatorBb: 0, IndicatorRsi: 0.25}
+	if len(ensemble.Weights) != len(want) {
+		t.Fatalf("Weights = %v, want %v", ensemble.Weights, want)
+	}
+	for name, weight := range want {
+		if math.Abs(ensemble.Weights[name]-weight) > 1e-9 {
+			t.Errorf("Weights[%s] = %v, want %v", name, ensemble.Weights[name], weight)
+		}
+	}
+	// パラメータも設定される
+	for _, strategy := range ensemble.strategies {
+		if strategy.Name() == IndicatorEma && strategy.Params().EmaPeriod1 != 5 {
+			t.Errorf("ema Params() = %+v", strategy.Params())
+		}
+	}
+
+	// 損益がない場合は均等
+	ensemble.Learn(&TradeParams{EmaEnable: true, EmaPeriod1: 7, EmaPeriod2: 14, MacdEnable: true, MacdFastPeriod: 12, MacdSlowPeriod: 26, MacdSignalPeriod: 9})
+	if ensemble.Weights[IndicatorEma] != 0.5 || ensemble.Weights[IndicatorMacd] != 0.5 {
+		t.Errorf("Weights without performances = %v", ensemble.Weights)
+	}
+}
+
+func TestEnsembleDecide(t *testing.T) {
+	df := newSineDataFrame(300)
+	ensemble := &Ensemble{
+		Weights:   map[string]float64{"up": 0.5, "down": 0.3, "flat": 0.2, "unused": 0},
+		Threshold: 0.3,
+		strategies: []Strategy{
+			&fixedStrategy{name: "up", side: "BUY", score: 0.9},
+			&fixedStrategy{name: "down", side: "SELL", score: 0.5},
+			&fixedStrategy{name: "flat"},
+			&fixedStrategy{name: "unused", side: "SELL", score: 1},
+		},
+	}
+	decision := ensemble.Decide(df)
+	// 0.5×0.9 - 0.3×0.5 = 0.3
+	if decision.Side != "BUY" || math.Abs(decision.Score-0.3) > 1e-9 {
+		t.Errorf("Decide() = %+v", decision)
+	}
+	if len(decision.Contributions) != 2 || decision.Contributions["up"] != 0.45 || decision.Contributions["down"] != -0.15 {
+		t.Errorf("Contributions = %v", decision.Contributions)
+	}
+
+	// 閾値に届かない場合はシグナルなし
+	ensemble.Threshold = 0.31
+	if decision := ensemble.Decide(df); decision.Side != "" {
+		t.Errorf("Decide() under the threshold = %+v", decision)
+	}
+	ensemble.Weights["down"] = 2
+	if decision := ensemble.Decide(df); decision.Side != "SELL" {
+		t.Errorf("Decide() = %+v, want SELL", decision)
+	}
+}
+
+func TestEnsembleSingleIndicator(t *testing.T) {
+	// 1つのインディケータのみで閾値0の場合はそのインディケータのシグナルと同じ
+	df := newSineDataFrame(300)
+	ensemble := NewEnsemble(0)
+	ensemble.Learn(&TradeParams{EmaEnable: true, EmaPeriod1: 7, EmaPeriod2: 14})
+	sides := df.emaSides(7, 14)
+	signals := 0
+	for i := 1; i <= len(df.Candles); i++ {
+		decision := ensemble.Decide(&DataFrameCandle{Candles: df.Candles[:i]})
+		if decision.Side != sides[i-1] {
+			t.Errorf("Decide() at %d = %+v, want %q", i-1, decision, sides[i-1])
+		}
+		if decision.Side == "" {
+			continue
+		}
+		signals++
+		if score := math.Abs(decision.Contributions[IndicatorEma]); score <= 0 || score > 1 {
+			t.Errorf("Contributions at %d = %v", i-1, decision.Contributions)
+		}
+	}
+	if signals == 0 {
+		t.Error("ensemble returned no signals")
+	}
+}
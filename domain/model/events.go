@@ -1,20 +1,12 @@
 package model
 
 import (
-	"app/config"
-	"app/domain"
 	"app/utils"
 	"encoding/json"
-	"fmt"
 	"log"
-	"strings"
 	"time"
 )
 
-const (
-	tableNameSignalEvents = "SIGNAL_EVENTS"
-)
-
 type SignalEvent struct {
 	Time        time.Time `json:"time"`
 	ProductCode string    `json:"product_code"`
@@ -26,32 +18,39 @@ type SignalEvent struct {
 	Pnl         float64   `json:"pnl"`
 	ReOpen      bool      `json:"re_open"`
 	BbRate      float64   `json:"bb_rate"`
+	StrategyID  string    `json:"strategy_id,omitempty"` // 戦略の売買イベントの場合のみ設定される
+	// アンサンブルで判定した場合のインディケータごとのスコア（買いは正、売りは負）
+	Contributions map[string]float64 `json:"contributions,omitempty"`
 }
 
-/** 売買のイベントを書き込む */
+/** 売買のイベントを書き込む（建玉のオープン・決済も同じトランザクションで記録する） */
 func (s *SignalEvent) Save() bool {
-	tableName := tableNameSignalEvents
-	cmd := fmt.Sprintf("INSERT INTO %s (time, product_code, side, price, size, atr, atr_rate, pnl, re_open, bb_rate) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", tableName)
-	ins, err := domain.DB.Prepare(cmd)
-	if err != nil {
-		log.Println(err)
-	}
-	_, err = ins.Exec(s.Time, s.ProductCode, s.Side, s.Price, s.Size, s.Atr, s.AtrRate, s.Pnl, s.ReOpen, s.BbRate)
+	trade, err := RecordSignalEvent(s)
 	if err != nil {
-		utils.SendLine("注文が保存できませんでした。ログを確認してください。")
-		log.Printf("注文が保存できませんでした。err: %s", err)
 		// 今回は同じ時間で複数売買させない
-		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		if err == ErrDuplicateSignalEvent {
 			log.Println(err)
 			return true
 		}
+		utils.SendLine("注文が保存できませんでした。ログを確認してください。")
+		log.Printf("注文が保存できませんでした。err: %s", err)
 		return false
 	}
+	log.Printf("action=SignalEvent.Save trade_id=%d side=%s open=%t pnl=%v", trade.ID, trade.Side, trade.IsOpen(), trade.Pnl)
 	return true
 }
 
+/** 売買イベントを保存し、オープンまたは決済した建玉を返す */
+func RecordSignalEvent(event *SignalEvent) (*Trade, error) {
+	if signalEventRepository == nil {
+		return nil, errNoSignalEventRepository
+	}
+	return signalEventRepository.Save(event)
+}
+
 type SignalEvents struct {
-	Signals []SignalEvent `json:"signals,omitempty"`
+	Signals    []SignalEvent `json:"signals,omitempty"`
+	StrategyID string        `json:"-"` // Buy・Sellで追加する売買イベントに設定する
 }
 
 func NewSignalEvents() *SignalEvents {
@@ -59,76 +58,58 @@ func NewSignalEvents() *SignalEvents {
 }
 
 // BUY SELL BUY SELL等の情報をlimitを指定して返却する
-func GetSignalEventsByCount(loadEvents int) *SignalEvents {
-	tableName := tableNameSignalEvents
-	cmd := fmt.Sprintf(`SELECT * FROM (SELECT time, product_code, side, price, size, atr, atr_rate, pnl, re_open, bb_rate FROM %s WHERE product_code = ? ORDER BY time DESC LIMIT ? ) as events ORDER BY time ASC;`, tableName)
-	rows, err := domain.DB.Query(cmd, config.Config.ProductCode, loadEvents)
-	if err != nil {
-		log.Println(err)
+func GetSignalEventsByCount(productCode string, loadEvents int) *SignalEvents {
+	if signalEventRepository == nil {
+		log.Println(errNoSignalEventRepository)
 		return nil
 	}
-	defer rows.Close()
-
-	var signalEvents SignalEvents
-	for rows.Next() {
-		var signalEvent SignalEvent
-		rows.Scan(&signalEvent.Time, &signalEvent.ProductCode, &signalEvent.Side, &signalEvent.Price, &signalEvent.Size, &signalEvent.Atr, &signalEvent.AtrRate, &signalEvent.Pnl, &signalEvent.ReOpen, &signalEvent.BbRate)
-		signalEvents.Signals = append(signalEvents.Signals, signalEvent)
-	}
-	err = rows.Err()
+	signals, err := signalEventRepository.SelectByCount(productCode, loadEvents)
 	if err != nil {
 		log.Println(err)
 		return nil
 	}
-	return &signalEvents
+	return &SignalEvents{Signals: signals}
 }
 
 // BUY SELL BUY SELL等の情報を全て取得する
-func GetAllSignalEvents() *SignalEvents {
-	tableName := tableNameSignalEvents
-	cmd := fmt.Sprintf(`SELECT * FROM (SELECT time, product_code, side, price, size, atr, atr_rate, pnl, re_open, bb_rate FROM %s WHERE product_code = ? ORDER BY time DESC) as events ORDER BY time ASC;`, tableName)
-	rows, err := domain.DB.Query(cmd, config.Config.ProductCode)
+func GetAllSignalEvents(productCode string) *SignalEvents {
+	if signalEventRepository == nil {
+		log.Println(errNoSignalEventRepository)
+		return nil
+	}
+	signals, err := signalEventRepository.SelectAll(productCode)
 	if err != nil {
 		log.Println(err)
 		return nil
 	}
-	defer rows.Close()
-	if rows == nil {
+	return &SignalEvents{Signals: signals}
+}
+
+/** 戦略の売買イベントを全て取得する */
+func GetStrategySignalEvents(productCode, strategyID string) *SignalEvents {
+	if signalEventRepository == nil {
+		log.Println(errNoSignalEventRepository)
 		return nil
 	}
-	var signalEvents SignalEvents
-	for rows.Next() {
-		var signalEvent SignalEvent
-		rows.Scan(&signalEvent.Time, &signalEvent.ProductCode, &signalEvent.Side, &signalEvent.Price, &signalEvent.Size, &signalEvent.Atr, &signalEvent.AtrRate, &signalEvent.Pnl, &signalEvent.ReOpen, &signalEvent.BbRate)
-		signalEvents.Signals = append(signalEvents.Signals, signalEvent)
-	}
-	err = rows.Err()
+	signals, err := signalEventRepository.SelectStrategy(productCode, strategyID)
 	if err != nil {
 		log.Println(err)
 		return nil
 	}
-	return &signalEvents
+	return &SignalEvents{Signals: signals, StrategyID: strategyID}
 }
 
 /** 時間を指定して売買イベントの結果を取得する */
-func GetSignalEventsAfterTime(timeTime time.Time) *SignalEvents {
-	tableName := tableNameSignalEvents
-	// MySqlの場合はサブクエリにasが必要
-	cmd := fmt.Sprintf(`SELECT * FROM (SELECT time, product_code, side, price, size, atr, atr_rate, pnl, re_open, bb_rate FROM %s WHERE time >= ? ORDER BY time DESC) as events ORDER BY time ASC;`, tableName)
-	rows, err := domain.DB.Query(cmd, timeTime)
+func GetSignalEventsAfterTime(productCode string, timeTime time.Time) *SignalEvents {
+	if signalEventRepository == nil {
+		log.Println(errNoSignalEventRepository)
+		return &SignalEvents{}
+	}
+	signals, err := signalEventRepository.SelectAfter(productCode, timeTime)
 	if err != nil {
 		log.Println(err)
-		return nil
-	}
-	defer rows.Close()
-
-	var signalEvents SignalEvents
-	for rows.Next() {
-		var signalEvent SignalEvent
-		rows.Scan(&signalEvent.Time, &signalEvent.ProductCode, &signalEvent.Side, &signalEvent.Price, &signalEvent.Size, &signalEvent.Atr, &signalEvent.AtrRate, &signalEvent.Pnl, &signalEvent.ReOpen, &signalEvent.BbRate)
-		signalEvents.Signals = append(signalEvents.Signals, signalEvent)
 	}
-	return &signalEvents
+	return &SignalEvents{Signals: signals}
 }
 
 type Events struct {
@@ -136,16 +117,16 @@ type Events struct {
 }
 
 /** 全ての売買イベント数を返す */
-func GetAllSignalEventsCount() int {
-	tableName := tableNameSignalEvents
-	cmd := fmt.Sprintf(`SELECT count(*) FROM %s ;`, tableName)
-	var events Events
-	err := domain.DB.QueryRow(cmd).Scan(&events.Length)
+func GetAllSignalEventsCount(productCode string) int {
+	if signalEventRepository == nil {
+		log.Println(errNoSignalEventRepository)
+		return 0
+	}
+	eventsLength, err := signalEventRepository.Count(productCode)
 	if err != nil {
 		log.Println(err)
 		return 0
 	}
-	eventsLength := events.Length
 	return eventsLength
 }
 
@@ -192,8 +173,8 @@ func (s *SignalEvents) CanSell(time time.Time, reOpen bool) bool {
 	return false
 }
 
-/** 購入 */
-func (s *SignalEvents) Buy(ProductCode string, time time.Time, price, size float64, save bool, reOpen bool, orderPrice float64, atr int, pnl float64, bbRate float64) bool {
+/** 購入（contributionsは判定に使ったアンサンブルのスコア。ない場合はnil） */
+func (s *SignalEvents) Buy(ProductCode string, time time.Time, price, size float64, save bool, reOpen bool, orderPrice float64, atr int, pnl float64, bbRate float64, contributions map[string]float64) bool {
 	atrRate := 0.0
 	canBuy := s.CanBuy(time, reOpen)
 	if !canBuy {
@@ -203,28 +184,33 @@ func (s *SignalEvents) Buy(ProductCode string, time time.Time, price, size float
 		atrRate = (float64(atr) / orderPrice) * 100
 	}
 	signalEvent := SignalEvent{
-		ProductCode: ProductCode,
-		Time:        time,
-		Side:        "BUY",
-		Price:       price,
-		Size:        size,
-		Atr:         atr,
-		AtrRate:     atrRate,
-		Pnl:         pnl,
-		ReOpen:      reOpen,
-		BbRate:      bbRate,
+		ProductCode:   ProductCode,
+		Time:          time,
+		Side:          "BUY",
+		Price:         price,
+		Size:          size,
+		Atr:           atr,
+		AtrRate:       atrRate,
+		Pnl:           pnl,
+		ReOpen:        reOpen,
+		BbRate:        bbRate,
+		StrategyID:    s.StrategyID,
+		Contributions: contributions,
 	}
 	// バックテスト等でセーブしたくない場合があるためBackTestフラグが必要
 	if save {
 		log.Printf("イベントを保存します：%s", signalEvent.Side)
-		signalEvent.Save()
+		// 保存できなかったイベントはメモリ上にも追加しない（建玉の状態とずれないようにする）
+		if !signalEvent.Save() {
+			return false
+		}
 	}
 	s.Signals = append(s.Signals, signalEvent)
 	return true
 }
 
-/** 売却 */
-func (s *SignalEvents) Sell(productCode string, time time.Time, price, size float64, save bool, reOpen bool, orderPrice float64, atr int, pnl float64, bbRate float64) bool {
+/** 売却（contributionsは判定に使ったアンサンブルのスコア。ない場合はnil） */
+func (s *SignalEvents) Sell(productCode string, time time.Time, price, size float64, save bool, reOpen bool, orderPrice float64, atr int, pnl float64, bbRate float64, contributions map[string]float64) bool {
 	atrRate := 0.0
 	canSell := s.CanSell(time, reOpen)
 	if !canSell {
@@ -235,21 +221,26 @@ func (s *SignalEvents) Sell(productCode string, time time.Time, price, size floa
 	}
 
 	signalEvent := SignalEvent{
-		ProductCode: productCode,
-		Time:        time,
-		Side:        "SELL",
-		Price:       price,
-		Size:        size,
-		Atr:         atr,
-		AtrRate:     atrRate,
-		Pnl:         pnl,
-		ReOpen:      reOpen,
-		BbRate:      bbRate,
+		ProductCode:   productCode,
+		Time:          time,
+		Side:          "SELL",
+		Price:         price,
+		Size:          size,
+		Atr:           atr,
+		AtrRate:       atrRate,
+		Pnl:           pnl,
+		ReOpen:        reOpen,
+		BbRate:        bbRate,
+		StrategyID:    s.StrategyID,
+		Contributions: contributions,
 	}
 	// バックテスト等でセーブしたくない場合があるためBackTestフラグが必要
 	if save {
 		log.Printf("イベントを保存します：%s", signalEvent.Side)
-		signalEvent.Save()
+		// 保存できなかったイベントはメモリ上にも追加しない（建玉の状態とずれないようにする）
+		if !signalEvent.Save() {
+			return false
+		}
 	}
 	s.Signals = append(s.Signals, signalEvent)
 	return true
@@ -319,31 +310,15 @@ func (s *SignalEvents) CollectAfter(time time.Time) *SignalEvents {
 }
 
 // return sellOpen(ショートでのオープン), buyOpen(ロングでのオープン)
-func OpenStatus() (bool, bool) {
-	events := GetAllSignalEvents()
-	sellOpen := false
-	buyOpen := false
-	eventsLength := len(events.Signals)
-	// 0件時は両方false
-	if eventsLength == 0 {
+func OpenStatus(productCode string) (bool, bool) {
+	trade, err := GetOpenTrade(productCode)
+	if err != nil {
+		log.Println(err)
 		return false, false
 	}
-	lastEvent := events.Signals[len(events.Signals)-1]
-	// ロングオープン判定
-	if lastEvent.Side == "BUY" && eventsLength%2 == 1 {
-		sellOpen = false
-		buyOpen = true
-		return sellOpen, buyOpen
-	}
-	// ショートオープン判定
-	if lastEvent.Side == "SELL" && eventsLength%2 == 1 {
-		sellOpen = true
-		buyOpen = false
-		return sellOpen, buyOpen
-	}
-	if eventsLength%2 == 0 {
-		sellOpen = false
-		buyOpen = false
+	// 建玉がない場合は両方false
+	if trade == nil {
+		return false, false
 	}
-	return sellOpen, buyOpen
+	return trade.Side == "SELL", trade.Side == "BUY"
 }
@@ -1,7 +1,26 @@
 package model
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestOpenStatus(t *testing.T) {
 
 }
+
+func TestSignalEventsContributions(t *testing.T) {
+	events := NewSignalEvents()
+	base := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	contributions := map[string]float64{IndicatorEma: 0.4}
+	if !events.Buy("FX_BTC_JPY", base, 1000, 1, false, false, 0, 0, 0, 0, contributions) {
+		t.Fatal("Buy() = false")
+	}
+	// 渡したスコアはその売買イベントにのみ記録する
+	if !events.Sell("FX_BTC_JPY", base.Add(time.Hour), 1100, 1, false, false, 0, 0, 0, 0, nil) {
+		t.Fatal("Sell() = false")
+	}
+	if events.Signals[0].Contributions[IndicatorEma] != 0.4 || events.Signals[1].Contributions != nil {
+		t.Errorf("Contributions = %v, %v", events.Signals[0].Contributions, events.Signals[1].Contributions)
+	}
+}
@@ -0,0 +1,139 @@
+package model
+
+import (
+	"app/domain/tradingalgo"
+)
+
+/*
+キャンドルごとの一目均衡表のシグナル（1: 好転、-1: 逆転、0: なし・算出できない）
+いずれもそのキャンドルまでの値のみから判定する（遅行スパンは終値とDisplacement本前の高値・安値を比べる）
+*/
+type IchimokuSignals struct {
+	TkCross    []int `json:"tk_cross"`    // 転換線が基準線を上抜け（ゴールデンクロス）・下抜け（デッドクロス）したキャンドル
+	Cloud      []int `json:"cloud"`       // 終値が雲の上・雲の下（雲の中は0）
+	CloudTwist []int `json:"cloud_twist"` // Displacement本先の雲のねじれ（先行スパンAがBを上抜け・下抜け）
+	Chikou     []int `json:"chikou"`      // 遅行スパン（終値）がDisplacement本前の高値より上・安値より下
+	Trend      []int `json:"trend"`       // 三役好転（転換線>基準線・雲の上・遅行スパンが上）・三役逆転
+}
+
+/** 期間を指定して一目均衡表のシグナルを算出する */
+func (df *DataFrameCandle) IchimokuSignals(periods tradingalgo.IchimokuPeriods) *IchimokuSignals {
+	lenCandles := len(df.Candles)
+	signals := &IchimokuSignals{
+		TkCross:    make([]int, lenCandles),
+		Cloud:      make([]int, lenCandles),
+		CloudTwist: make([]int, lenCandles),
+		Chikou:     make([]int, lenCandles),
+		Trend:      make([]int, lenCandles),
+	}
+	highs, lows, closes := df.Highs(), df.Low(), df.Closes()
+	tenkan, kijun, senkouA, senkouB, _ := tradingalgo.Ichimoku(highs, lows, closes, periods)
+	// 先行スパンをずらす前の値（このキャンドルで算出した雲）
+	leadingB := tradingalgo.Midpoint(highs, lows, periods.SenkouB)
+	leadingA := make([]float64, lenCandles)
+	for i := range leadingA {
+		leadingA[i] = (tenkan[i] + kijun[i]) / 2
+	}
+	d := periods.Displacement
+	tkFrom := maxInt(periods.Tenkan, periods.Kijun) - 1
+	leadingFrom := maxInt(tkFrom, periods.SenkouB-1)
+	for i := 0; i < lenCandles; i++ {
+		tk := 0
+		if i >= tkFrom {
+			tk = compare(tenkan[i], kijun[i])
+			if i > tkFrom {
+				signals.TkCross[i] = cross(tenkan[i-1]-kijun[i-1], tenkan[i]-kijun[i])
+			}
+		}
+		if i > leadingFrom {
+			signals.CloudTwist[i] = cross(leadingA[i-1]-leadingB[i-1], leadingA[i]-leadingB[i])
+		}
+		if i-d >= leadingFrom {
+			top, bottom := senkouA[i], senkouB[i]
+			if top < bottom {
+				top, bottom = bottom, top
+			}
+			switch {
+			case closes[i] > top:
+				signals.Cloud[i] = 1
+			case closes[i] < bottom:
+				signals.Cloud[i] = -1
+			}
+		}
+		if i-d >= 0 {
+			switch {
+			case closes[i] > highs[i-d]:
+				signals.Chikou[i] = 1
+			case closes[i] < lows[i-d]:
+				signals.Chikou[i] = -1
+			}
+		}
+		if tk != 0 && tk == signals.Cloud[i] && tk == signals.Chikou[i] {
+			signals.Trend[i] = tk
+		}
+	}
+	return signals
+}
+
+/** キャンドルごとの一目均衡表のシグナル（三役好転になったキャンドルで買い、三役逆転になったキャンドルで売り） */
+func (df *DataFrameCandle) ichimokuSides(periods tradingalgo.IchimokuPeriods) []string {
+	lenCandles := len(df.Candles)
+	sides := make([]string, lenCandles)
+	trend := df.IchimokuSignals(periods).Trend
+	for i := 1; i < lenCandles; i++ {
+		if trend[i] == trend[i-1] {
+			continue
+		}
+		switch trend[i] {
+		case 1:
+			sides[i] = "BUY"
+		case -1:
+			sides[i] = "SELL"
+		}
+	}
+	return sides
+}
+
+/** 遅行スパン（終値）とDisplacement本前の高値（買い）・安値（売り）の差 */
+func (df *DataFrameCandle) chikouSpread(periods tradingalgo.IchimokuPeriods, side string) []float64 {
+	closes := df.Closes()
+	prices := df.Highs()
+	if side == "SELL" {
+		prices = df.Low()
+	}
+	spread := make([]float64, len(closes))
+	for i := periods.Displacement; i < len(closes); i++ {
+		spread[i] = closes[i] - prices[i-periods.Displacement]
+	}
+	return spread
+}
+
+/** 一目均衡表の期間（最適化前のパラメータなど、指定がない場合は一般的な期間） */
+func (p *TradeParams) ichimokuPeriods() tradingalgo.IchimokuPeriods {
+	if p.IchimokuTenkan <= 0 || p.IchimokuKijun <= 0 || p.IchimokuSenkouB <= 0 || p.IchimokuDisplacement <= 0 {
+		return tradingalgo.DefaultIchimokuPeriods
+	}
+	return tradingalgo.IchimokuPeriods{Tenkan: p.IchimokuTenkan, Kijun: p.IchimokuKijun, SenkouB: p.IchimokuSenkouB, Displacement: p.IchimokuDisplacement}
+}
+
+/** aがbより大きい場合は1、小さい場合は-1 */
+func compare(a, b float64) int {
+	switch {
+	case a > b:
+		return 1
+	case a < b:
+		return -1
+	}
+	return 0
+}
+
+/** 2つの系列の差が負から0以上になった場合は1、正から0以下になった場合は-1 */
+func cross(before, after float64) int {
+	switch {
+	case before < 0 && after >= 0:
+		return 1
+	case before > 0 && after <= 0:
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,120 @@
+package model
+
+import (
+	"app/domain/tradingalgo"
+	"testing"
+	"time"
+)
+
+/** lengthずつ下落してから上昇するキャンドル */
+func newValleyDataFrame(length int) *DataFrameCandle {
+	base := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	df := &DataFrameCandle{ProductCode: "FX_BTC_JPY", Duration: time.Hour}
+	for i := 0; i < length*2; i++ {
+		price := 2000 - 5*float64(i)
+		if i >= length {
+			price = 2000 - 5*float64(length) + 5*float64(i-length)
+		}
+		df.Candles = append(df.Candles, Candle{
+			Time:  base.Add(time.Duration(i) * time.Hour),
+			Open:  price,
+			Close: price,
+			High:  price + 2,
+			Low:   price - 2,
+		})
+	}
+	return df
+}
+
+func TestIchimokuSignals(t *testing.T) {
+	df := newValleyDataFrame(150)
+	periods := tradingalgo.DefaultIchimokuPeriods
+	signals := df.IchimokuSignals(periods)
+	// 雲が算出できるまではシグナルなし
+	for i := 0; i < periods.SenkouB-1+periods.Displacement; i++ {
+		if signals.Cloud[i] != 0 || signals.Trend[i] != 0 {
+			t.Fatalf("signals at %d = cloud %d trend %d", i, signals.Cloud[i], signals.Trend[i])
+		}
+	}
+	// 下落の終わりは三役逆転、上昇の終わりは三役好転
+	if signals.Trend[149] != -1 || signals.Cloud[149] != -1 || signals.Chikou[149] != -1 {
+		t.Errorf("signals at the bottom = trend %d cloud %d chikou %d", signals.Trend[149], signals.Cloud[149], signals.Chikou[149])
+	}
+	if last := len(df.Candles) - 1; signals.Trend[last] != 1 || signals.Cloud[last] != 1 || signals.Chikou[last] != 1 {
+		t.Errorf("signals at the top = trend %d cloud %d chikou %d", signals.Trend[last], signals.Cloud[last], signals.Chikou[last])
+	}
+	// 反転後に1度ずつ転換線・基準線と雲がクロスする
+	count := func(values []int, from int, want int) int {
+		n := 0
+		for _, value := range values[from:] {
+			if value == want {
+				n++
+			}
+		}
+		return n
+	}
+	if count(signals.TkCross, 150, 1) != 1 || count(signals.TkCross, 150, -1) != 0 {
+		t.Errorf("TkCross after the bottom = %v", signals.TkCross[150:])
+	}
+	if count(signals.CloudTwist, 150, 1) != 1 || count(signals.CloudTwist, 150, -1) != 0 {
+		t.Errorf("CloudTwist after the bottom = %v", signals.CloudTwist[150:])
+	}
+
+	// 三役好転になったキャンドルで買う
+	sides := df.ichimokuSides(periods)
+	for i := 1; i < len(sides); i++ {
+		want := ""
+		if signals.Trend[i] != signals.Trend[i-1] && signals.Trend[i] == 1 {
+			want = "BUY"
+		}
+		if signals.Trend[i] != signals.Trend[i-1] && signals.Trend[i] == -1 {
+			want = "SELL"
+		}
+		if sides[i] != want {
+			t.Errorf("sides[%d] = %q, want %q", i, sides[i], want)
+		}
+	}
+	if count(signals.Trend, 150, 1) == 0 {
+		t.Error("no trend reversal after the bottom")
+	}
+}
+
+func TestAddIchimoku(t *testing.T) {
+	df := newValleyDataFrame(150)
+	if !df.AddIchimoku(7, 22, 44, 22) {
+		t.Fatal("AddIchimoku() = false")
+	}
+	cloud := df.IchimokuCloud
+	if cloud.Periods.Kijun != 22 || len(cloud.Tenkan) != len(df.Candles) || cloud.Signals == nil || len(cloud.Signals.Trend) != len(df.Candles) {
+		t.Errorf("IchimokuCloud = %+v", cloud.Periods)
+	}
+	if (&DataFrameCandle{Candles: df.Candles[:5]}).AddIchimoku(7, 22, 44, 22) {
+		t.Error("AddIchimoku() with 5 candles = true")
+	}
+}
+
+func TestIchimokuStrategy(t *testing.T) {
+	df := newValleyDataFrame(150)
+	strategy, _ := NewStrategy(IndicatorIchimoku)
+	params := strategy.Params()
+	if params.IchimokuTenkan != 9 || params.IchimokuKijun != 26 || params.IchimokuSenkouB != 52 || params.IchimokuDisplacement != 26 {
+		t.Fatalf("Params() = %+v", params)
+	}
+	sides := df.ichimokuSides(params.ichimokuPeriods())
+	buys := 0
+	for i := strategy.Warmup(); i <= len(df.Candles); i++ {
+		signal := strategy.OnCandle(&DataFrameCandle{Candles: df.Candles[:i]})
+		if signal.Side != sides[i-1] {
+			t.Errorf("OnCandle() at %d = %q, want %q", i-1, signal.Side, sides[i-1])
+		}
+		if signal.Side == "BUY" {
+			buys++
+			if signal.Score <= 0 || signal.Score > 1 {
+				t.Errorf("Score at %d = %v", i-1, signal.Score)
+			}
+		}
+	}
+	if buys == 0 {
+		t.Error("ichimoku strategy returned no BUY")
+	}
+}
@@ -0,0 +1,262 @@
+package model
+
+import (
+	"app/config"
+	"context"
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+/** インディケータごとのグリッドサーチの探索範囲 */
+type optimizeGrid struct {
+	indicator  string
+	defaults   TradeParams   // 1つもバックテストできない（キャンドルが足りない）場合のパラメータ
+	candidates []TradeParams // 探索する組み合わせ（対象インディケータのフィールドのみ使う）
+}
+
+/** パラメータの探索範囲（min以上max以下をstep刻み） */
+type paramRange struct {
+	min  float64
+	max  float64
+	step float64
+}
+
+/** config.iniの[optimize.range]にnameの指定があれば差し替えた探索範囲 */
+func configRange(name string, r paramRange) paramRange {
+	if c, ok := config.Config.OptimizeRanges[name]; ok {
+		return paramRange{min: c.Min, max: c.Max, step: c.Step}
+	}
+	return r
+}
+
+/** 探索範囲の値（stepの加算を繰り返すと誤差が出るため、個数から算出して丸める） */
+func (r paramRange) values() []float64 {
+	if r.step <= 0 || r.min > r.max {
+		return nil
+	}
+	count := int(math.Floor((r.max-r.min)/r.step+1e-9)) + 1
+	values := make([]float64, count)
+	for i := range values {
+		values[i] = math.Round((r.min+float64(i)*r.step)*1e9) / 1e9
+	}
+	return values
+}
+
+/** 整数のパラメータ（期間）の探索範囲の値 */
+func (r paramRange) ints() []int {
+	var values []int
+	for _, value := range r.values() {
+		values = append(values, int(math.Round(value)))
+	}
+	return values
+}
+
+/*
+探索方法がrandomの場合は組み合わせからOptimizeSamples個を無作為に選ぶ（gridの場合はそのまま）
+シードが同じなら同じ組み合わせになり、選んだ組み合わせは元の順に並べる（成績が同じ場合の採用順を変えないため）
+*/
+func sampleCandidates(candidates []TradeParams) []TradeParams {
+	samples := config.Config.OptimizeSamples
+	if config.Config.OptimizeSearch != config.OptimizeSearchRandom || samples <= 0 || len(candidates) <= samples {
+		return candidates
+	}
+	indexes := rand.New(rand.NewSource(config.Config.OptimizeSeed)).Perm(len(candidates))[:samples]
+	sort.Ints(indexes)
+	sampled := make([]TradeParams, samples)
+	for i, index := range indexes {
+		sampled[i] = candidates[index]
+	}
+	return sampled
+}
+
+/** グリッドサーチの結果 */
+type optimizeResult struct {
+	params      TradeParams
+	performance float64
+}
+
+/** 最適化の進捗 */
+type OptimizeProgress struct {
+	Indicator string `json:"indicator"` // 直前に評価したインディケータ
+	Done      int    `json:"done"`      // 評価済みの組み合わせ数（全インディケータの合計）
+	Total     int    `json:"total"`
+}
+
+/** 並列最適化の設定 */
+type OptimizeOptions struct {
+	Workers  int                    // 同時にバックテストするgoroutine数（0以下の場合はCPU数）
+	Progress func(OptimizeProgress) // 組み合わせを1つ評価するごとに呼ばれる（nilの場合は通知しない）
+}
+
+/** 最適化の対象となる全インディケータの探索範囲 */
+func optimizeGrids() []optimizeGrid {
+	return []optimizeGrid{emaGrid(), bbGrid(), macdGrid(), ichimokuGrid(), rsiGrid()}
+}
+
+/** 1つのインディケータのグリッドサーチ（Optimize〇〇から呼ぶ） */
+func (df *DataFrameCandle) optimizeGrid(grid optimizeGrid, reOpen bool) optimizeResult {
+	results, _ := df.searchGrids(context.Background(), []optimizeGrid{grid}, reOpen, OptimizeOptions{Workers: 1})
+	return results[grid.indicator]
+}
+
+/*
+どのインディケータでトレードを行うかを並列に最適化して返す
+ctxがキャンセルされた（タイムアウトした）場合は途中の結果を捨ててエラーを返す
+いずれのインディケータも利益が出ない場合はnilを返す
+*/
+func (df *DataFrameCandle) OptimizeParamsContext(ctx context.Context, reOpen bool, options OptimizeOptions) (*TradeParams, error) {
+	tradeParams, performances, err := df.optimizeIndicators(ctx, reOpen, options)
+	if err != nil {
+		return nil, err
+	}
+	return rankParams(tradeParams, performances), nil
+}
+
+/** 全インディケータを並列に最適化し、パラメータ（いずれも無効の状態）とインディケータごとの損益を返す */
+func (df *DataFrameCandle) optimizeIndicators(ctx context.Context, reOpen bool, options OptimizeOptions) (*TradeParams, map[string]float64, error) {
+	results, err := df.searchGrids(ctx, optimizeGrids(), reOpen, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	tradeParams := &TradeParams{}
+	performances := map[string]float64{}
+	for _, indicator := range indicators {
+		tradeParams.set(indicator, results[indicator].params)
+		performances[indicator] = results[indicator].performance
+	}
+	return tradeParams, performances, nil
+}
+
+/*
+複数インディケータの全組み合わせをワーカープールでバックテストし、インディケータごとに最も成績の良いパラメータと成績を返す
+成績が同じ場合は探索範囲の先に出てくる組み合わせを採用する（逐次実行の場合と同じ結果にするため）
+*/
+func (df *DataFrameCandle) searchGrids(ctx context.Context, grids []optimizeGrid, reOpen bool, options OptimizeOptions) (map[string]optimizeResult, error) {
+	type job struct {
+		grid  int
+		index int
+	}
+	type evaluation struct {
+		job
+		performance float64
+		ok          bool
+	}
+
+	total := 0
+	for _, grid := range grids {
+		total += len(grid.candidates)
+	}
+	workers := options.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan job)
+	evaluations := make(chan evaluation)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				signalEvents := df.backTestParams(grids[j.grid].indicator, &grids[j.grid].candidates[j.index], reOpen)
+				e := evaluation{job: j}
+				if signalEvents != nil {
+					e.performance, e.ok = signalEvents.Profit(), true
+				}
+				select {
+				case evaluations <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for g, grid := range grids {
+			for i := range grid.candidates {
+				select {
+				case jobs <- job{grid: g, index: i}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(evaluations)
+	}()
+
+	best := make([]optimizeResult, len(grids))
+	bestIndex := make([]int, len(grids))
+	for g, grid := range grids {
+		best[g] = optimizeResult{params: grid.defaults, performance: math.Inf(-1)}
+		bestIndex[g] = -1
+	}
+	done := 0
+	for e := range evaluations {
+		done++
+		if e.ok && (e.performance > best[e.grid].performance ||
+			(e.performance == best[e.grid].performance && bestIndex[e.grid] > e.index)) {
+			best[e.grid] = optimizeResult{params: grids[e.grid].candidates[e.index], performance: e.performance}
+			bestIndex[e.grid] = e.index
+		}
+		if options.Progress != nil {
+			options.Progress(OptimizeProgress{Indicator: grids[e.grid].indicator, Done: done, Total: total})
+		}
+	}
+	if err := ctx.Err(); err != nil && done < total {
+		return nil, err
+	}
+
+	results := map[string]optimizeResult{}
+	for g, grid := range grids {
+		// 一度も評価できなかった場合はデフォルトのパラメータで成績なしとする
+		if bestIndex[g] < 0 {
+			best[g].performance = 0
+		}
+		results[grid.indicator] = best[g]
+	}
+	return results, nil
+}
+
+/** 指定したインディケータのパラメータでバックテストする */
+func (df *DataFrameCandle) backTestParams(indicator string, params *TradeParams, reOpen bool) *SignalEvents {
+	switch indicator {
+	case IndicatorEma:
+		return df.BackTestEma(params.EmaPeriod1, params.EmaPeriod2, reOpen)
+	case IndicatorBb:
+		return df.BackTestBb(params.BbN, params.BbK, reOpen)
+	case IndicatorMacd:
+		return df.BackTestMacd(params.MacdFastPeriod, params.MacdSlowPeriod, params.MacdSignalPeriod, reOpen)
+	case IndicatorIchimoku:
+		periods := params.ichimokuPeriods()
+		return df.BackTestIchimoku(periods.Tenkan, periods.Kijun, periods.SenkouB, periods.Displacement, reOpen)
+	case IndicatorRsi:
+		return df.BackTestRsi(params.RsiPeriod, params.RsiBuyThread, params.RsiSellThread, reOpen)
+	}
+	return nil
+}
+
+/** 指定したインディケータのパラメータのみをfromからコピーする */
+func (p *TradeParams) set(indicator string, from TradeParams) {
+	switch indicator {
+	case IndicatorEma:
+		p.EmaPeriod1, p.EmaPeriod2 = from.EmaPeriod1, from.EmaPeriod2
+	case IndicatorBb:
+		p.BbN, p.BbK = from.BbN, from.BbK
+	case IndicatorMacd:
+		p.MacdFastPeriod, p.MacdSlowPeriod, p.MacdSignalPeriod = from.MacdFastPeriod, from.MacdSlowPeriod, from.MacdSignalPeriod
+	case IndicatorIchimoku:
+		p.IchimokuTenkan, p.IchimokuKijun, p.IchimokuSenkouB, p.IchimokuDisplacement = from.IchimokuTenkan, from.IchimokuKijun, from.IchimokuSenkouB, from.IchimokuDisplacement
+	case IndicatorRsi:
+		p.RsiPeriod, p.RsiBuyThread, p.RsiSellThread = from.RsiPeriod, from.RsiBuyThread, from.RsiSellThread
+	}
+}
@@ -0,0 +1,217 @@
+package model
+
+import (
+	"app/config"
+	"context"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newSineDataFrame(length int) *DataFrameCandle {
+	base := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	df := &DataFrameCandle{ProductCode: "FX_BTC_JPY", Duration: time.Hour}
+	for i := 0; i < length; i++ {
+		price := 1000 + 100*math.Sin(float64(i)/8) + float64(i)
+		df.Candles = append(df.Candles, Candle{
+			Time:  base.Add(time.Duration(i) * time.Hour),
+			Open:  price,
+			Close: price,
+			High:  price + 5,
+			Low:   price - 5,
+		})
+	}
+	return df
+}
+
+func TestOptimizeParamsContextMatchesSequential(t *testing.T) {
+	df := newSineDataFrame(300)
+	var progress []OptimizeProgress
+	params, performances, err := df.optimizeIndicators(context.Background(), false, OptimizeOptions{
+		Workers:  4,
+		Progress: func(p OptimizeProgress) { progress = append(progress, p) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bbPerformance, bbN, bbK := df.OptimizeBb(false)
+	rsiPerformance, rsiPeriod, _, _ := df.OptimizeRsi(false)
+	if params.BbN != bbN || params.BbK != bbK || performances[IndicatorBb] != bbPerformance {
+		t.Errorf("bb = %d, %v, %v, want %d, %v, %v", params.BbN, params.BbK, performances[IndicatorBb], bbN, bbK, bbPerformance)
+	}
+	if params.RsiPeriod != rsiPeriod || performances[IndicatorRsi] != rsiPerformance {
+		t.Errorf("rsi = %d, %v, want %d, %v", params.RsiPeriod, performances[IndicatorRsi], rsiPeriod, rsiPerformance)
+	}
+	ichimokuPerformance, tenkan, kijun, senkouB, displacement := df.OptimizeIchimoku(false)
+	if params.IchimokuTenkan != tenkan || params.IchimokuKijun != kijun || params.IchimokuSenkouB != senkouB || params.IchimokuDisplacement != displacement || performances[IndicatorIchimoku] != ichimokuPerformance {
+		t.Errorf("ichimoku = %+v, %v, want %d %d %d %d, %v", params, performances[IndicatorIchimoku], tenkan, kijun, senkouB, displacement, ichimokuPerformance)
+	}
+
+	total := 0
+	for _, grid := range optimizeGrids() {
+		total += len(grid.candidates)
+	}
+	if len(progress) != total || progress[total-1].Done != total || progress[total-1].Total != total {
+		t.Errorf("progress = %d reports, last %+v, want %d", len(progress), progress[len(progress)-1], total)
+	}
+}
+
+func TestOptimizeParamsContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := newSineDataFrame(300).OptimizeParamsContext(ctx, false, OptimizeOptions{Workers: 2}); err == nil {
+		t.Error("OptimizeParamsContext() with canceled context should return error")
+	}
+}
+
+func TestParamRangeValues(t *testing.T) {
+	values := paramRange{min: 1.5, max: 2.5, step: 0.1}.values()
+	// 加算の誤差でmaxが抜けない
+	if len(values) != 11 || values[5] != 2.0 || values[10] != 2.5 {
+		t.Errorf("values() = %v", values)
+	}
+	if ints := (paramRange{min: 12, max: 50, step: 2}).ints(); len(ints) != 20 || ints[0] != 12 || ints[19] != 50 {
+		t.Errorf("ints() = %v", ints)
+	}
+	if values := (paramRange{min: 3, max: 1, step: 1}).values(); values != nil {
+		t.Errorf("values() with min > max = %v", values)
+	}
+}
+
+func TestOptimizersFindBest(t *testing.T) {
+	df := newSineDataFrame(300)
+	for _, tt := range []struct {
+		grid     optimizeGrid
+		optimize func() (float64, TradeParams)
+		backTest func(p TradeParams) *SignalEvents
+	}{
+		{
+			grid: emaGrid(),
+			optimize: func() (float64, TradeParams) {
+				performance, period1, period2 := df.OptimizeEma(false)
+				return performance, TradeParams{EmaPeriod1: period1, EmaPeriod2: period2}
+			},
+			backTest: func(p TradeParams) *SignalEvents { return df.BackTestEma(p.EmaPeriod1, p.EmaPeriod2, false) },
+		},
+		{
+			grid: bbGrid(),
+			optimize: func() (float64, TradeParams) {
+				performance, n, k := df.OptimizeBb(false)
+				return performance, TradeParams{BbN: n, BbK: k}
+			},
+			backTest: func(p TradeParams) *SignalEvents { return df.BackTestBb(p.BbN, p.BbK, false) },
+		},
+		{
+			grid: macdGrid(),
+			optimize: func() (float64, TradeParams) {
+				performance, fast, slow, signal := df.OptimizeMacd(false)
+				return performance, TradeParams{MacdFastPeriod: fast, MacdSlowPeriod: slow, MacdSignalPeriod: signal}
+			},
+			backTest: func(p TradeParams) *SignalEvents {
+				return df.BackTestMacd(p.MacdFastPeriod, p.MacdSlowPeriod, p.MacdSignalPeriod, false)
+			},
+		},
+		{
+			grid: ichimokuGrid(),
+			optimize: func() (float64, TradeParams) {
+				performance, tenkan, kijun, senkouB, displacement := df.OptimizeIchimoku(false)
+				return performance, TradeParams{IchimokuTenkan: tenkan, IchimokuKijun: kijun, IchimokuSenkouB: senkouB, IchimokuDisplacement: displacement}
+			},
+			backTest: func(p TradeParams) *SignalEvents {
+				return df.BackTestIchimoku(p.IchimokuTenkan, p.IchimokuKijun, p.IchimokuSenkouB, p.IchimokuDisplacement, false)
+			},
+		},
+		{
+			grid: rsiGrid(),
+			optimize: func() (float64, TradeParams) {
+				performance, period, buyThread, sellThread := df.OptimizeRsi(false)
+				return performance, TradeParams{RsiPeriod: period, RsiBuyThread: buyThread, RsiSellThread: sellThread}
+			},
+			backTest: func(p TradeParams) *SignalEvents {
+				return df.BackTestRsi(p.RsiPeriod, p.RsiBuyThread, p.RsiSellThread, false)
+			},
+		},
+	} {
+		// 探索範囲を総当たりして最初に出てくる最良の組み合わせと同じ
+		if len(tt.grid.candidates) == 0 {
+			t.Fatalf("%s has no candidates", tt.grid.indicator)
+		}
+		var want TradeParams
+		wantPerformance := math.Inf(-1)
+		for _, candidate := range tt.grid.candidates {
+			if signalEvents := tt.backTest(candidate); signalEvents != nil && signalEvents.Profit() > wantPerformance {
+				want, wantPerformance = candidate, signalEvents.Profit()
+			}
+		}
+		performance, params := tt.optimize()
+		if !reflect.DeepEqual(params, want) || performance != wantPerformance {
+			t.Errorf("%s optimize = %v %+v, want %v %+v", tt.grid.indicator, performance, params, wantPerformance, want)
+		}
+		// 成績は最良のパラメータでのバックテストの損益そのもの
+		if got := tt.backTest(params).Profit(); performance != got {
+			t.Errorf("%s performance = %v, backtest = %v", tt.grid.indicator, performance, got)
+		}
+	}
+}
+
+func TestOptimizeRsiSearchesThresholds(t *testing.T) {
+	df := newSineDataFrame(300)
+	performance, period, buyThread, sellThread := df.OptimizeRsi(false)
+	if buyThread == 30 && sellThread == 70 {
+		t.Fatalf("best thresholds are the defaults: %v %d", performance, period)
+	}
+	// 閾値も探索しているため、デフォルトの閾値のみの場合より良い
+	for _, candidate := range (paramRange{min: 5, max: 29, step: 1}).ints() {
+		if signalEvents := df.BackTestRsi(candidate, 30, 70, false); signalEvents != nil && signalEvents.Profit() >= performance {
+			t.Errorf("rsi(%d, 30, 70) = %v >= best %v", candidate, signalEvents.Profit(), performance)
+		}
+	}
+}
+
+func TestOptimizeWithoutEnoughCandles(t *testing.T) {
+	df := newSineDataFrame(10)
+	if performance, period1, period2 := df.OptimizeEma(false); performance != 0 || period1 != 7 || period2 != 14 {
+		t.Errorf("OptimizeEma() = %v, %d, %d", performance, period1, period2)
+	}
+	if performance, fast, slow, signal := df.OptimizeMacd(false); performance != 0 || fast != 10 || slow != 26 || signal != 9 {
+		t.Errorf("OptimizeMacd() = %v, %d, %d, %d", performance, fast, slow, signal)
+	}
+}
+
+func TestRandomSearch(t *testing.T) {
+	search, samples, seed, ranges := config.Config.OptimizeSearch, config.Config.OptimizeSamples, config.Config.OptimizeSeed, config.Config.OptimizeRanges
+	defer func() {
+		config.Config.OptimizeSearch, config.Config.OptimizeSamples, config.Config.OptimizeSeed, config.Config.OptimizeRanges = search, samples, seed, ranges
+	}()
+	config.Config.OptimizeRanges = map[string]config.OptimizeRange{"rsi_period": {Min: 10, Max: 12, Step: 1}}
+	config.Config.OptimizeSearch = config.OptimizeSearchGrid
+	all := rsiGrid().candidates
+	if len(all) != 3*5*5 || all[0].RsiPeriod != 10 || all[len(all)-1].RsiPeriod != 12 {
+		t.Fatalf("rsiGrid() with range = %d candidates", len(all))
+	}
+
+	config.Config.OptimizeSearch, config.Config.OptimizeSamples, config.Config.OptimizeSeed = config.OptimizeSearchRandom, 20, 1
+	first, second := rsiGrid().candidates, rsiGrid().candidates
+	if len(first) != 20 {
+		t.Fatalf("random candidates = %d, want 20", len(first))
+	}
+	// 同じシードなら同じ組み合わせで、全ての組み合わせの順に並ぶ
+	next := 0
+	for i := range first {
+		if !reflect.DeepEqual(first[i], second[i]) {
+			t.Errorf("candidates[%d] = %+v, %+v", i, first[i], second[i])
+		}
+		for next < len(all) && !reflect.DeepEqual(all[next], first[i]) {
+			next++
+		}
+		if next == len(all) {
+			t.Fatalf("candidates[%d] = %+v is not in the grid order", i, first[i])
+		}
+	}
+	config.Config.OptimizeSeed = 2
+	if other := rsiGrid().candidates; reflect.DeepEqual(other, first) {
+		t.Error("different seeds returned the same candidates")
+	}
+}
@@ -0,0 +1,204 @@
+package model
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+/** 1取引（オープンからクローズまで）の結果 */
+type TradeResult struct {
+	Side        string        `json:"side"` // オープン時の売買（BUY: ロング, SELL: ショート）
+	OpenTime    time.Time     `json:"open_time"`
+	CloseTime   time.Time     `json:"close_time"`
+	OpenPrice   float64       `json:"open_price"`
+	ClosePrice  float64       `json:"close_price"`
+	Size        float64       `json:"size"`
+	Pnl         float64       `json:"pnl"`     // 手数料控除前の損益
+	Fee         float64       `json:"fee"`     // オープン・クローズの手数料
+	NetPnl      float64       `json:"net_pnl"` // 手数料控除後の損益
+	Return      float64       `json:"return"`  // 手数料控除後の損益率（NetPnl / オープン時の約定金額）
+	HoldingTime time.Duration `json:"holding_time"`
+}
+
+/** 資産推移（クローズごとの累積損益） */
+type EquityPoint struct {
+	Time   time.Time `json:"time"`
+	Equity float64   `json:"equity"`
+}
+
+/** 売買イベントから算出する成績 */
+type Performance struct {
+	CommissionRate      float64       `json:"commission_rate"`
+	Trades              []TradeResult `json:"trades"`
+	EquityCurve         []EquityPoint `json:"equity_curve"`
+	GrossPnl            float64       `json:"gross_pnl"`
+	Fee                 float64       `json:"fee"`
+	NetPnl              float64       `json:"net_pnl"`
+	MaxDrawdown         float64       `json:"max_drawdown"`
+	SharpeRatio         float64       `json:"sharpe_ratio"`  // 1取引あたりの損益率の平均 / 標準偏差
+	SortinoRatio        float64       `json:"sortino_ratio"` // 1取引あたりの損益率の平均 / 下方偏差
+	ProfitFactor        float64       `json:"profit_factor"` // 総利益 / 総損失（損失がない場合は0）
+	Wins                int           `json:"wins"`
+	Losses              int           `json:"losses"`
+	WinRate             float64       `json:"win_rate"`
+	AverageHoldingTime  time.Duration `json:"average_holding_time"`
+	LongestLosingStreak int           `json:"longest_losing_streak"`
+}
+
+/*
+売買イベントを取引（オープンからクローズ）にまとめて成績を算出する
+commissionRate: 約定金額に対する手数料率（GetTradingCommissionの値）
+オープン中の建玉と反対の売買でクローズし、同じ方向の売買は建玉に加算（平均価格）する
+クローズのサイズが建玉より大きい場合、残りは反対方向の新規建玉として扱う
+*/
+func (s *SignalEvents) Performance(commissionRate float64) *Performance {
+	performance := &Performance{CommissionRate: commissionRate}
+	if s == nil {
+		return performance
+	}
+
+	var open *SignalEvent
+	for _, signal := range s.Signals {
+		signal := signal
+		if signal.Size <= 0 {
+			continue
+		}
+		if open == nil {
+			open = &signal
+			continue
+		}
+		// 同じ方向は買い増し・売り増し
+		if open.Side == signal.Side {
+			totalSize := open.Size + signal.Size
+			open.Price = (open.Price*open.Size + signal.Price*signal.Size) / totalSize
+			open.Size = totalSize
+			continue
+		}
+		closeSize := math.Min(open.Size, signal.Size)
+		performance.Trades = append(performance.Trades, newTradeResult(open, &signal, closeSize, commissionRate))
+		open.Size -= closeSize
+		signal.Size -= closeSize
+		if signal.Size > 0 {
+			open = &signal
+		} else if open.Size <= 0 {
+			open = nil
+		}
+	}
+	performance.summarize()
+	return performance
+}
+
+/** オープンとクローズのイベントから1取引の結果を作る */
+func newTradeResult(open, close *SignalEvent, size, commissionRate float64) TradeResult {
+	trade := TradeResult{
+		Side:        open.Side,
+		OpenTime:    open.Time,
+		CloseTime:   close.Time,
+		OpenPrice:   open.Price,
+		ClosePrice:  close.Price,
+		Size:        size,
+		Fee:         (open.Price + close.Price) * size * commissionRate,
+		HoldingTime: close.Time.Sub(open.Time),
+	}
+	if open.Side == "BUY" {
+		trade.Pnl = (close.Price - open.Price) * size
+	} else {
+		trade.Pnl = (open.Price - close.Price) * size
+	}
+	trade.NetPnl = trade.Pnl - trade.Fee
+	if open.Price > 0 {
+		trade.Return = trade.NetPnl / (open.Price * size)
+	}
+	return trade
+}
+
+/** 取引の結果から各指標を集計する */
+func (p *Performance) summarize() {
+	if len(p.Trades) == 0 {
+		return
+	}
+	peak := 0.0
+	grossProfit, grossLoss := 0.0, 0.0
+	losingStreak := 0
+	holdingTime := time.Duration(0)
+	returns := make([]float64, len(p.Trades))
+	for i, trade := range p.Trades {
+		p.GrossPnl += trade.Pnl
+		p.Fee += trade.Fee
+		p.NetPnl += trade.NetPnl
+		p.EquityCurve = append(p.EquityCurve, EquityPoint{Time: trade.CloseTime, Equity: p.NetPnl})
+		if p.NetPnl > peak {
+			peak = p.NetPnl
+		}
+		if peak-p.NetPnl > p.MaxDrawdown {
+			p.MaxDrawdown = peak - p.NetPnl
+		}
+
+		if trade.NetPnl > 0 {
+			p.Wins++
+			grossProfit += trade.NetPnl
+			losingStreak = 0
+		} else {
+			p.Losses++
+			grossLoss -= trade.NetPnl
+			losingStreak++
+			if losingStreak > p.LongestLosingStreak {
+				p.LongestLosingStreak = losingStreak
+			}
+		}
+		holdingTime += trade.HoldingTime
+		returns[i] = trade.Return
+	}
+	p.WinRate = float64(p.Wins) / float64(len(p.Trades))
+	p.AverageHoldingTime = holdingTime / time.Duration(len(p.Trades))
+	if grossLoss > 0 {
+		p.ProfitFactor = grossProfit / grossLoss
+	}
+
+	mean := 0.0
+	for _, r := range returns {
+		mean += r
+	}
+	mean /= float64(len(returns))
+	variance, downside := 0.0, 0.0
+	for _, r := range returns {
+		variance += (r - mean) * (r - mean)
+		if r < 0 {
+			downside += r * r
+		}
+	}
+	if len(returns) > 1 {
+		if std := math.Sqrt(variance / float64(len(returns)-1)); std > 0 {
+			p.SharpeRatio = mean / std
+		}
+	}
+	if downsideDeviation := math.Sqrt(downside / float64(len(returns))); downsideDeviation > 0 {
+		p.SortinoRatio = mean / downsideDeviation
+	}
+}
+
+/** CLI向けのテキスト */
+func (p *Performance) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-4s %-25s %-25s %12s %12s %8s %12s %10s %12s %9s\n",
+		"side", "open_time", "close_time", "open", "close", "size", "pnl", "fee", "net_pnl", "return")
+	for _, trade := range p.Trades {
+		fmt.Fprintf(&b, "%-4s %-25s %-25s %12.0f %12.0f %8.4f %12.0f %10.0f %12.0f %8.2f%%\n",
+			trade.Side, trade.OpenTime.Format(time.RFC3339), trade.CloseTime.Format(time.RFC3339),
+			trade.OpenPrice, trade.ClosePrice, trade.Size, trade.Pnl, trade.Fee, trade.NetPnl, trade.Return*100)
+	}
+	fmt.Fprintf(&b, "\ntrades:                %d (win %d / lose %d)\n", len(p.Trades), p.Wins, p.Losses)
+	fmt.Fprintf(&b, "win_rate:              %.2f%%\n", p.WinRate*100)
+	fmt.Fprintf(&b, "gross_pnl:             %.0f\n", p.GrossPnl)
+	fmt.Fprintf(&b, "fee:                   %.0f (commission_rate %v)\n", p.Fee, p.CommissionRate)
+	fmt.Fprintf(&b, "net_pnl:               %.0f\n", p.NetPnl)
+	fmt.Fprintf(&b, "max_drawdown:          %.0f\n", p.MaxDrawdown)
+	fmt.Fprintf(&b, "sharpe_ratio:          %.4f\n", p.SharpeRatio)
+	fmt.Fprintf(&b, "sortino_ratio:         %.4f\n", p.SortinoRatio)
+	fmt.Fprintf(&b, "profit_factor:         %.4f\n", p.ProfitFactor)
+	fmt.Fprintf(&b, "average_holding_time:  %s\n", p.AverageHoldingTime)
+	fmt.Fprintf(&b, "longest_losing_streak: %d\n", p.LongestLosingStreak)
+	return b.String()
+}
@@ -0,0 +1,64 @@
+package model
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPerformance(t *testing.T) {
+	base := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	event := func(minute int, side string, price, size float64) SignalEvent {
+		return SignalEvent{Time: base.Add(time.Duration(minute) * time.Minute), Side: side, Price: price, Size: size}
+	}
+	events := &SignalEvents{Signals: []SignalEvent{
+		// ロング +100
+		event(0, "BUY", 1000, 1),
+		event(10, "SELL", 1100, 1),
+		// ショート -50
+		event(20, "SELL", 1200, 1),
+		event(30, "BUY", 1250, 1),
+		// 買い増し（平均1050）して一括決済 -100
+		event(40, "BUY", 1000, 1),
+		event(50, "BUY", 1100, 1),
+		event(60, "SELL", 1000, 2),
+		// クローズされていない建玉は集計しない
+		event(70, "BUY", 1000, 1),
+	}}
+
+	p := events.Performance(0.001)
+	if len(p.Trades) != 3 {
+		t.Fatalf("len(Trades) = %d, want 3", len(p.Trades))
+	}
+	if want := []float64{100, -50, -100}; p.Trades[0].Pnl != want[0] || p.Trades[1].Pnl != want[1] || p.Trades[2].Pnl != want[2] {
+		t.Errorf("Pnl = %v, %v, %v, want %v", p.Trades[0].Pnl, p.Trades[1].Pnl, p.Trades[2].Pnl, want)
+	}
+	if p.GrossPnl != -50 {
+		t.Errorf("GrossPnl = %v, want -50", p.GrossPnl)
+	}
+	fee := (1000+1100)*0.001 + (1200+1250)*0.001 + (1050+1000)*2*0.001
+	if math.Abs(p.Fee-fee) > 1e-9 || math.Abs(p.NetPnl-(-50-fee)) > 1e-9 {
+		t.Errorf("Fee = %v, NetPnl = %v, want %v, %v", p.Fee, p.NetPnl, fee, -50-fee)
+	}
+	if p.Wins != 1 || p.Losses != 2 || p.LongestLosingStreak != 2 {
+		t.Errorf("Wins = %d, Losses = %d, LongestLosingStreak = %d", p.Wins, p.Losses, p.LongestLosingStreak)
+	}
+	// 最初の取引後の資産がピーク
+	if want := p.EquityCurve[0].Equity - p.EquityCurve[2].Equity; math.Abs(p.MaxDrawdown-want) > 1e-9 {
+		t.Errorf("MaxDrawdown = %v, want %v", p.MaxDrawdown, want)
+	}
+	if want := p.Trades[0].NetPnl / -(p.Trades[1].NetPnl + p.Trades[2].NetPnl); math.Abs(p.ProfitFactor-want) > 1e-9 {
+		t.Errorf("ProfitFactor = %v, want %v", p.ProfitFactor, want)
+	}
+	// 買い増した建玉は最初のオープンから保有時間を数える
+	if p.AverageHoldingTime != (10*time.Minute+10*time.Minute+20*time.Minute)/3 {
+		t.Errorf("AverageHoldingTime = %v", p.AverageHoldingTime)
+	}
+	r := []float64{p.Trades[0].Return, p.Trades[1].Return, p.Trades[2].Return}
+	mean := (r[0] + r[1] + r[2]) / 3
+	std := math.Sqrt(((r[0]-mean)*(r[0]-mean) + (r[1]-mean)*(r[1]-mean) + (r[2]-mean)*(r[2]-mean)) / 2)
+	downside := math.Sqrt((r[1]*r[1] + r[2]*r[2]) / 3)
+	if math.Abs(p.SharpeRatio-mean/std) > 1e-9 || math.Abs(p.SortinoRatio-mean/downside) > 1e-9 {
+		t.Errorf("SharpeRatio = %v, SortinoRatio = %v, want %v, %v", p.SharpeRatio, p.SortinoRatio, mean/std, mean/downside)
+	}
+}
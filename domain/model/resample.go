@@ -0,0 +1,39 @@
+package model
+
+import (
+	"math"
+	"time"
+)
+
+/*
+durationの時間足にまとめたDataFrameCandleを返す（インディケータは含まない）
+キャンドルはdf.Durationの時間足で時刻の昇順に並んでいること
+時間足の区切りはtime.Truncateに合わせる（1dはUTCの0時、1wは月曜日のUTCの0時から）
+最初と最後のキャンドルは時間足の途中からや途中までの場合がある
+*/
+func (df *DataFrameCandle) Resample(duration time.Duration) *DataFrameCandle {
+	resampled := &DataFrameCandle{ProductCode: df.ProductCode, Duration: duration}
+	for _, candle := range df.Candles {
+		candleTime := candle.Time.Truncate(duration)
+		last := len(resampled.Candles) - 1
+		if last < 0 || !resampled.Candles[last].Time.Equal(candleTime) {
+			resampled.Candles = append(resampled.Candles, Candle{
+				ProductCode: df.ProductCode,
+				Duration:    duration,
+				Time:        candleTime,
+				Open:        candle.Open,
+				High:        candle.High,
+				Low:         candle.Low,
+			})
+			last++
+		}
+		c := &resampled.Candles[last]
+		c.Close = candle.Close
+		c.High = math.Max(c.High, candle.High)
+		c.Low = math.Min(c.Low, candle.Low)
+		c.Volume += candle.Volume
+		c.BuyVolume += candle.BuyVolume
+		c.SellVolume += candle.SellVolume
+	}
+	return resampled
+}
@@ -0,0 +1,37 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDataFrameCandleResample(t *testing.T) {
+	// 2021/08/01（日曜日）23:50から1分足を35本
+	base := time.Date(2021, 8, 1, 23, 50, 0, 0, time.UTC)
+	df := &DataFrameCandle{ProductCode: "FX_BTC_JPY", Duration: time.Minute}
+	for i := 0; i < 35; i++ {
+		price := float64(1000 + i)
+		df.Candles = append(df.Candles, Candle{Time: base.Add(time.Duration(i) * time.Minute), Open: price, High: price + 10, Low: price - 10, Close: price + 1, Volume: 1, BuyVolume: 0.5})
+	}
+
+	resampled := df.Resample(15 * time.Minute)
+	if len(resampled.Candles) != 3 || resampled.Duration != 15*time.Minute {
+		t.Fatalf("Resample(15m) = %+v", resampled)
+	}
+	// 23:45〜は途中（23:50）から、00:00〜は15本、00:15〜は途中（00:24）まで
+	c := resampled.Candles[1]
+	if !c.Time.Equal(time.Date(2021, 8, 2, 0, 0, 0, 0, time.UTC)) || c.Open != 1010 || c.Close != 1025 || c.High != 1034 || c.Low != 1000 || c.Volume != 15 || c.BuyVolume != 7.5 {
+		t.Errorf("Candles[1] = %+v", c)
+	}
+	if c.ProductCode != "FX_BTC_JPY" || c.Duration != 15*time.Minute {
+		t.Errorf("Candles[1] = %+v", c)
+	}
+
+	// 1dはUTCの0時、1wは月曜日のUTCの0時で区切る
+	if days := df.Resample(24 * time.Hour); len(days.Candles) != 2 || days.Candles[1].Open != 1010 {
+		t.Errorf("Resample(1d) = %+v", days.Candles)
+	}
+	if weeks := df.Resample(7 * 24 * time.Hour); len(weeks.Candles) != 2 || weeks.Candles[1].Time.Weekday() != time.Monday {
+		t.Errorf("Resample(1w) = %+v", weeks.Candles)
+	}
+}
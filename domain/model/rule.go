@@ -0,0 +1,421 @@
+package model
+
+import (
+	"app/domain/tradingalgo"
+	"fmt"
+	"github.com/markcheno/go-talib"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+/** ルールファイル（YAML・JSON）。書式はREADMEの「ルールファイル」を参照 */
+type RuleFile struct {
+	Strategies []RuleDefinition `yaml:"strategies"`
+}
+
+/** ルールで売買を判定する戦略（買いと売りの条件が同時に成り立つ場合はシグナルを出さない） */
+type RuleDefinition struct {
+	Name string         `yaml:"name"`
+	Buy  *RuleCondition `yaml:"buy"`
+	Sell *RuleCondition `yaml:"sell"`
+}
+
+/*
+売買の条件（いずれか1つのみ指定する）
+比較・クロスの値は系列（close・ema(7)・rsi(14)など）か数値を指定する
+*/
+type RuleCondition struct {
+	All        []RuleCondition `yaml:"all"`         // 全て成り立つ
+	Any        []RuleCondition `yaml:"any"`         // いずれかが成り立つ
+	Not        *RuleCondition  `yaml:"not"`         // 成り立たない
+	CrossOver  []string        `yaml:"cross_over"`  // 1つ目が2つ目を下から上に抜けた
+	CrossUnder []string        `yaml:"cross_under"` // 1つ目が2つ目を上から下に抜けた
+	Gt         []string        `yaml:"gt"`
+	Gte        []string        `yaml:"gte"`
+	Lt         []string        `yaml:"lt"`
+	Lte        []string        `yaml:"lte"`
+}
+
+/** ルールファイルを読み込み、戦略として登録する（登録した名前を返す） */
+func LoadRuleStrategies(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return RegisterRuleStrategies(data)
+}
+
+/** YAML・JSONのルールを解釈して戦略として登録する。組み込みの戦略と同じ名前は使えない */
+func RegisterRuleStrategies(data []byte) ([]string, error) {
+	var file RuleFile
+	// JSONはYAMLとしても読める
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+	var rules []*rule
+	for _, definition := range file.Strategies {
+		if _, ok := strategyFactories[definition.Name]; ok {
+			return nil, fmt.Errorf("strategy %s is already registered", definition.Name)
+		}
+		r, err := compileRule(definition)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	var names []string
+	for _, r := range rules {
+		r := r
+		RegisterStrategy(r.name, func() Strategy {
+			return newIndicatorStrategy(indicatorStrategy{
+				name: r.name,
+				sides: func(df *DataFrameCandle, p *TradeParams) []string {
+					return r.sides(df)
+				},
+				period: func(p *TradeParams) int {
+					return r.period
+				},
+			})
+		})
+		names = append(names, r.name)
+	}
+	return names, nil
+}
+
+/** 解釈済みのルール */
+type rule struct {
+	name   string
+	buy    *ruleNode
+	sell   *ruleNode
+	period int // 全ての系列の算出に必要な期間
+}
+
+/** 条件の木（opがall・any・notの場合はchildren、それ以外はoperands） */
+type ruleNode struct {
+	op       string
+	children []*ruleNode
+	operands [2]ruleOperand
+}
+
+/** 系列または数値 */
+type ruleOperand struct {
+	expr   string // 系列のキャッシュのキー
+	name   string
+	args   []float64
+	value  float64
+	number bool
+}
+
+func compileRule(definition RuleDefinition) (*rule, error) {
+	if definition.Name == "" {
+		return nil, fmt.Errorf("rule strategy has no name")
+	}
+	if definition.Buy == nil && definition.Sell == nil {
+		return nil, fmt.Errorf("rule %s has neither buy nor sell", definition.Name)
+	}
+	r := &rule{name: definition.Name}
+	var err error
+	if definition.Buy != nil {
+		if r.buy, err = compileCondition(*definition.Buy); err != nil {
+			return nil, fmt.Errorf("rule %s buy: %s", definition.Name, err)
+		}
+		r.period = maxInt(r.period, r.buy.period())
+	}
+	if definition.Sell != nil {
+		if r.sell, err = compileCondition(*definition.Sell); err != nil {
+			return nil, fmt.Errorf("rule %s sell: %s", definition.Name, err)
+		}
+		r.period = maxInt(r.period, r.sell.period())
+	}
+	return r, nil
+}
+
+func compileCondition(c RuleCondition) (*ruleNode, error) {
+	var nodes []*ruleNode
+	addChildren := func(op string, conditions []RuleCondition) error {
+		node := &ruleNode{op: op}
+		for _, condition := range conditions {
+			child, err := compileCondition(condition)
+			if err != nil {
+				return err
+			}
+			node.children = append(node.children, child)
+		}
+		if len(node.children) == 0 {
+			return fmt.Errorf("%s has no conditions", op)
+		}
+		nodes = append(nodes, node)
+		return nil
+	}
+	addComparison := func(op string, values []string) error {
+		values = joinRuleValues(values)
+		if len(values) != 2 {
+			return fmt.Errorf("%s needs 2 values: %v", op, values)
+		}
+		node := &ruleNode{op: op}
+		for i, value := range values {
+			operand, err := parseRuleOperand(value)
+			if err != nil {
+				return err
+			}
+			node.operands[i] = operand
+		}
+		nodes = append(nodes, node)
+		return nil
+	}
+
+	if c.All != nil {
+		if err := addChildren("all", c.All); err != nil {
+			return nil, err
+		}
+	}
+	if c.Any != nil {
+		if err := addChildren("any", c.Any); err != nil {
+			return nil, err
+		}
+	}
+	if c.Not != nil {
+		if err := addChildren("not", []RuleCondition{*c.Not}); err != nil {
+			return nil, err
+		}
+	}
+	for _, comparison := range []struct {
+		op     string
+		values []string
+	}{
+		{"cross_over", c.CrossOver}, {"cross_under", c.CrossUnder},
+		{"gt", c.Gt}, {"gte", c.Gte}, {"lt", c.Lt}, {"lte", c.Lte},
+	} {
+		if comparison.values == nil {
+			continue
+		}
+		if err := addComparison(comparison.op, comparison.values); err != nil {
+			return nil, err
+		}
+	}
+	if len(nodes) != 1 {
+		return nil, fmt.Errorf("condition must have exactly one of all, any, not, cross_over, cross_under, gt, gte, lt, lte")
+	}
+	return nodes[0], nil
+}
+
+/** YAMLのフローシーケンス（[macd(12,26,9), 0]）では引数のカンマでも分割されるため、括弧が閉じるまでつなげ直す */
+func joinRuleValues(values []string) []string {
+	var joined []string
+	depth := 0
+	for _, value := range values {
+		if depth > 0 {
+			joined[len(joined)-1] += "," + value
+		} else {
+			joined = append(joined, value)
+		}
+		depth += strings.Count(value, "(") - strings.Count(value, ")")
+	}
+	return joined
+}
+
+/** 系列の名前と引数の数（一目均衡表は引数を省略すると一般的な期間を使う） */
+var ruleSeriesArgs = map[string]int{
+	"open": 0, "high": 0, "low": 0, "close": 0, "volume": 0,
+	"sma": 1, "ema": 1, "rsi": 1, "hv": 1,
+	"bb_up": 2, "bb_mid": 2, "bb_down": 2,
+	"macd": 3, "macd_signal": 3, "macd_hist": 3,
+	"ichimoku_tenkan": 4, "ichimoku_kijun": 4, "ichimoku_senkou_a": 4, "ichimoku_senkou_b": 4, "ichimoku_chikou": 4,
+	"ichimoku_tk_cross": 4, "ichimoku_cloud": 4, "ichimoku_cloud_twist": 4, "ichimoku_chikou_signal": 4, "ichimoku_trend": 4,
+}
+
+/** 「30」「close」「ema(7)」「bb_up(20,2)」の形式の値を解釈する */
+func parseRuleOperand(s string) (ruleOperand, error) {
+	s = strings.TrimSpace(s)
+	if value, err := strconv.ParseFloat(s, 64); err == nil {
+		return ruleOperand{expr: s, value: value, number: true}, nil
+	}
+	operand := ruleOperand{name: s}
+	if open := strings.Index(s, "("); open >= 0 {
+		if !strings.HasSuffix(s, ")") {
+			return ruleOperand{}, fmt.Errorf("invalid series %s", s)
+		}
+		operand.name = strings.TrimSpace(s[:open])
+		for _, arg := range strings.Split(s[open+1:len(s)-1], ",") {
+			value, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+			if err != nil || value <= 0 {
+				return ruleOperand{}, fmt.Errorf("invalid argument %s in %s", arg, s)
+			}
+			operand.args = append(operand.args, value)
+		}
+	}
+	count, ok := ruleSeriesArgs[operand.name]
+	if !ok {
+		return ruleOperand{}, fmt.Errorf("unknown series %s", s)
+	}
+	if len(operand.args) != count && !(strings.HasPrefix(operand.name, "ichimoku_") && len(operand.args) == 0) {
+		return ruleOperand{}, fmt.Errorf("%s needs %d arguments", operand.name, count)
+	}
+	operand.expr = fmt.Sprintf("%s%v", operand.name, operand.args)
+	return operand, nil
+}
+
+/** 系列の算出に必要な期間 */
+func (o ruleOperand) period() int {
+	switch o.name {
+	case "sma", "ema", "rsi", "bb_up", "bb_mid", "bb_down":
+		return int(o.args[0])
+	case "hv":
+		return int(o.args[0]) + 1
+	case "macd", "macd_signal", "macd_hist":
+		return maxInt(int(o.args[0]), int(o.args[1])) + int(o.args[2])
+	}
+	if strings.HasPrefix(o.name, "ichimoku_") {
+		periods := o.ichimokuPeriods()
+		return maxInt(periods.Kijun, periods.SenkouB+periods.Displacement)
+	}
+	return 0
+}
+
+/** 一目均衡表の期間（ichimoku_tenkan(9,26,52,26)の引数。省略時は一般的な期間） */
+func (o ruleOperand) ichimokuPeriods() tradingalgo.IchimokuPeriods {
+	if len(o.args) == 0 {
+		return tradingalgo.DefaultIchimokuPeriods
+	}
+	return tradingalgo.IchimokuPeriods{Tenkan: int(o.args[0]), Kijun: int(o.args[1]), SenkouB: int(o.args[2]), Displacement: int(o.args[3])}
+}
+
+/** キャンドルごとの値（算出できないキャンドルは0） */
+func (o ruleOperand) series(df *DataFrameCandle) []float64 {
+	lenCandles := len(df.Candles)
+	values := make([]float64, lenCandles)
+	if lenCandles <= o.period() {
+		return values
+	}
+	closes := df.Closes()
+	switch o.name {
+	case "open":
+		return df.Opens()
+	case "high":
+		return df.Highs()
+	case "low":
+		return df.Low()
+	case "volume":
+		return df.Volume()
+	case "close":
+		return closes
+	case "sma":
+		return talib.Sma(closes, int(o.args[0]))
+	case "ema":
+		return talib.Ema(closes, int(o.args[0]))
+	case "rsi":
+		return talib.Rsi(closes, int(o.args[0]))
+	case "hv":
+		return tradingalgo.Hv(closes, int(o.args[0]))
+	case "bb_up", "bb_mid", "bb_down":
+		up, mid, down := talib.BBands(closes, int(o.args[0]), o.args[1], o.args[1], 0)
+		return map[string][]float64{"bb_up": up, "bb_mid": mid, "bb_down": down}[o.name]
+	case "macd", "macd_signal", "macd_hist":
+		macd, signal, hist := talib.Macd(closes, int(o.args[0]), int(o.args[1]), int(o.args[2]))
+		return map[string][]float64{"macd": macd, "macd_signal": signal, "macd_hist": hist}[o.name]
+	}
+	periods := o.ichimokuPeriods()
+	switch o.name {
+	// 遅行スパンはDisplacement本後の終値のため、直近Displacement本は0
+	case "ichimoku_tenkan", "ichimoku_kijun", "ichimoku_senkou_a", "ichimoku_senkou_b", "ichimoku_chikou":
+		tenkan, kijun, senkouA, senkouB, chikou := tradingalgo.Ichimoku(df.Highs(), df.Low(), closes, periods)
+		return map[string][]float64{
+			"ichimoku_tenkan":   tenkan,
+			"ichimoku_kijun":    kijun,
+			"ichimoku_senkou_a": senkouA,
+			"ichimoku_senkou_b": senkouB,
+			"ichimoku_chikou":   chikou,
+		}[o.name]
+	}
+	// 一目均衡表のシグナルは1（好転）・-1（逆転）・0の系列
+	signals := df.IchimokuSignals(periods)
+	signal := map[string][]int{
+		"ichimoku_tk_cross":      signals.TkCross,
+		"ichimoku_cloud":         signals.Cloud,
+		"ichimoku_cloud_twist":   signals.CloudTwist,
+		"ichimoku_chikou_signal": signals.Chikou,
+		"ichimoku_trend":         signals.Trend,
+	}[o.name]
+	for i, value := range signal {
+		values[i] = float64(value)
+	}
+	return values
+}
+
+func (n *ruleNode) period() int {
+	period := maxInt(n.operands[0].period(), n.operands[1].period())
+	for _, child := range n.children {
+		period = maxInt(period, child.period())
+	}
+	return period
+}
+
+/** i本目のキャンドルで条件が成り立つか（valuesは系列ごとのキャッシュ） */
+func (n *ruleNode) eval(df *DataFrameCandle, values map[string][]float64, i int) bool {
+	switch n.op {
+	case "all":
+		for _, child := range n.children {
+			if !child.eval(df, values, i) {
+				return false
+			}
+		}
+		return true
+	case "any":
+		for _, child := range n.children {
+			if child.eval(df, values, i) {
+				return true
+			}
+		}
+		return false
+	case "not":
+		return !n.children[0].eval(df, values, i)
+	}
+	a, b := n.operands[0].at(df, values, i), n.operands[1].at(df, values, i)
+	switch n.op {
+	case "cross_over":
+		return i > 0 && n.operands[0].at(df, values, i-1) < n.operands[1].at(df, values, i-1) && a >= b
+	case "cross_under":
+		return i > 0 && n.operands[0].at(df, values, i-1) > n.operands[1].at(df, values, i-1) && a <= b
+	case "gt":
+		return a > b
+	case "gte":
+		return a >= b
+	case "lt":
+		return a < b
+	case "lte":
+		return a <= b
+	}
+	return false
+}
+
+func (o ruleOperand) at(df *DataFrameCandle, values map[string][]float64, i int) float64 {
+	if o.number {
+		return o.value
+	}
+	series, ok := values[o.expr]
+	if !ok {
+		series = o.series(df)
+		values[o.expr] = series
+	}
+	return series[i]
+}
+
+/** キャンドルごとのシグナル（系列が算出できるキャンドルからクロスを判定する） */
+func (r *rule) sides(df *DataFrameCandle) []string {
+	lenCandles := len(df.Candles)
+	sides := make([]string, lenCandles)
+	values := map[string][]float64{}
+	for i := maxInt(r.period, 1); i < lenCandles; i++ {
+		buy := r.buy != nil && r.buy.eval(df, values, i)
+		sell := r.sell != nil && r.sell.eval(df, values, i)
+		switch {
+		case buy && !sell:
+			sides[i] = "BUY"
+		case sell && !buy:
+			sides[i] = "SELL"
+		}
+	}
+	return sides
+}
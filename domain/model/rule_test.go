@@ -0,0 +1,152 @@
+package model
+
+import (
+	"app/domain/tradingalgo"
+	"context"
+	"github.com/markcheno/go-talib"
+	"testing"
+)
+
+func TestRuleStrategy(t *testing.T) {
+	// 組み込みのema_macdと同じ条件
+	names, err := RegisterRuleStrategies([]byte(`
+strategies:
+  - name: test_rule_ema_macd
+    buy:
+      all:
+        - cross_over: [ema(7), ema(14)]
+        - any:
+            - gt: [macd(10,26,9), 0]
+            - gt: [macd_hist(10,26,9), 0]
+        - gte: [macd(10,26,9), macd_signal(10,26,9)]
+    sell:
+      all:
+        - cross_under: [ema(7), ema(14)]
+        - any:
+            - lt: [macd(10,26,9), 0]
+            - lt: [macd_hist(10,26,9), 0]
+        - lte: [macd(10,26,9), macd_signal(10,26,9)]
+`))
+	defer delete(strategyFactories, "test_rule_ema_macd")
+	if err != nil || len(names) != 1 {
+		t.Fatalf("RegisterRuleStrategies() = %v, %v", names, err)
+	}
+	strategy, err := NewStrategy("test_rule_ema_macd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// MACDが算出できるキャンドル以降は組み込みの戦略と同じシグナルになる
+	df := newSineDataFrame(300)
+	params := TradeParams{EmaPeriod1: 7, EmaPeriod2: 14, MacdFastPeriod: 10, MacdSlowPeriod: 26, MacdSignalPeriod: 9}
+	want := df.emaMacdSides(&params)
+	sides := make([]string, len(df.Candles))
+	signals := 0
+	for i := strategy.Warmup(); i <= len(df.Candles); i++ {
+		got := strategy.OnCandle(&DataFrameCandle{ProductCode: df.ProductCode, Candles: df.Candles[:i]})
+		if got.Side != want[i-1] {
+			t.Errorf("OnCandle() at %d = %q, want %q", i-1, got.Side, want[i-1])
+		}
+		if got.Side != "" {
+			signals++
+		}
+		sides[i-1] = got.Side
+	}
+	if signals == 0 {
+		t.Error("rule returned no signals")
+	}
+
+	// ルールにはパラメータがないため、最適化はバックテストの損益のみ返す
+	performance, err := strategy.Optimize(context.Background(), df, false)
+	if err != nil || performance != df.backTestSides(sides, false).Profit() {
+		t.Errorf("Optimize() = %v, %v", performance, err)
+	}
+}
+
+func TestRuleStrategyJSON(t *testing.T) {
+	_, err := RegisterRuleStrategies([]byte(`{"strategies": [{"name": "test_rule_rsi", "buy": {"lt": ["rsi(14)", 30]}, "sell": {"not": {"lte": ["rsi(14)", 70]}}}]}`))
+	defer delete(strategyFactories, "test_rule_rsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	strategy, _ := NewStrategy("test_rule_rsi")
+	df := newSineDataFrame(300)
+	rsi := talib.Rsi(df.Closes(), 14)
+	for i := strategy.Warmup(); i <= len(df.Candles); i++ {
+		want := ""
+		switch {
+		case rsi[i-1] < 30:
+			want = "BUY"
+		case rsi[i-1] > 70:
+			want = "SELL"
+		}
+		if got := strategy.OnCandle(&DataFrameCandle{Candles: df.Candles[:i]}); got.Side != want {
+			t.Errorf("OnCandle() at %d = %q, want %q (rsi %v)", i-1, got.Side, want, rsi[i-1])
+		}
+	}
+}
+
+func TestRuleStrategyErrors(t *testing.T) {
+	for _, data := range []string{
+		"strategies: [{name: test_rule_x, buy: {gt: [unknown(3), 0]}}]",
+		"strategies: [{name: test_rule_x, buy: {gt: [ema, 0]}}]",
+		"strategies: [{name: test_rule_x, buy: {gt: [close, 0], lt: [close, 1]}}]",
+		"strategies: [{name: test_rule_x, buy: {gt: [close]}}]",
+		"strategies: [{name: test_rule_x, buy: {all: []}}]",
+		"strategies: [{name: test_rule_x}]",
+		"strategies: [{name: test_rule_x, buy: {above: [close, 0]}}]",
+		"strategies: [{name: ema, buy: {gt: [close, 0]}}]",
+	} {
+		if _, err := RegisterRuleStrategies([]byte(data)); err == nil {
+			t.Errorf("RegisterRuleStrategies(%s) err = nil", data)
+		}
+	}
+	if _, err := NewStrategy("test_rule_x"); err == nil {
+		t.Error("invalid rule was registered")
+	}
+}
+
+func TestRuleStrategyIchimoku(t *testing.T) {
+	_, err := RegisterRuleStrategies([]byte("strategies: [{name: test_rule_ichimoku, buy: {gt: [ichimoku_cloud, 0]}, sell: {lt: [ichimoku_chikou_signal, 0]}}]"))
+	defer delete(strategyFactories, "test_rule_ichimoku")
+	if err != nil {
+		t.Fatal(err)
+	}
+	strategy, _ := NewStrategy("test_rule_ichimoku")
+	df := newValleyDataFrame(150)
+	signals := df.IchimokuSignals(tradingalgo.DefaultIchimokuPeriods)
+	for i := strategy.Warmup(); i <= len(df.Candles); i++ {
+		want := ""
+		switch {
+		case signals.Cloud[i-1] > 0 && signals.Chikou[i-1] < 0:
+		case signals.Cloud[i-1] > 0:
+			want = "BUY"
+		case signals.Chikou[i-1] < 0:
+			want = "SELL"
+		}
+		if got := strategy.OnCandle(&DataFrameCandle{Candles: df.Candles[:i]}); got.Side != want {
+			t.Errorf("OnCandle() at %d = %q, want %q", i-1, got.Side, want)
+		}
+	}
+	if _, err := RegisterRuleStrategies([]byte("strategies: [{name: test_rule_x, buy: {gt: [ichimoku_tenkan(9), 0]}}]")); err == nil {
+		t.Error("ichimoku_tenkan(9) err = nil")
+	}
+
+	// 期間を指定した一目均衡表と遅行スパンの線
+	tenkan, _, _, _, _ := tradingalgo.Ichimoku(df.Highs(), df.Low(), df.Closes(), tradingalgo.IchimokuPeriods{Tenkan: 7, Kijun: 22, SenkouB: 44, Displacement: 22})
+	_, _, _, _, chikou := tradingalgo.Ichimoku(df.Highs(), df.Low(), df.Closes(), tradingalgo.DefaultIchimokuPeriods)
+	for expr, want := range map[string][]float64{"ichimoku_tenkan(7,22,44,22)": tenkan, "ichimoku_chikou": chikou} {
+		operand, err := parseRuleOperand(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := operand.series(df)
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("%s[%d] = %v, want %v", expr, i, got[i], want[i])
+			}
+		}
+	}
+	if operand, _ := parseRuleOperand("ichimoku_trend(7,22,44,22)"); operand.period() != 66 {
+		t.Errorf("ichimoku_trend(7,22,44,22) period = %d, want 66", operand.period())
+	}
+}
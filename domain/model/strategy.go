@@ -0,0 +1,379 @@
+package model
+
+import (
+	"app/config"
+	"context"
+	"fmt"
+	"github.com/markcheno/go-talib"
+	"math"
+	"sort"
+	"time"
+)
+
+/** 最後のキャンドルでの売買シグナル */
+type Signal struct {
+	Side  string    `json:"side"` // BUY・SELL（シグナルが出ていない場合は空）
+	Time  time.Time `json:"time"`
+	Price float64   `json:"price"`
+	Score float64   `json:"score"` // シグナルの確信度（0〜1、シグナルが出ていない場合は0）
+}
+
+/*
+売買を判定する戦略
+RegisterStrategyで名前を付けて登録し、config.iniのtrade_strategiesや[strategy.<戦略ID>]のindicatorsに名前を指定して使う
+*/
+type Strategy interface {
+	// 登録した名前
+	Name() string
+	// 判定に必要なキャンドル数
+	Warmup() int
+	// dfの最後のキャンドルでの売買シグナル
+	OnCandle(df *DataFrameCandle) Signal
+	// 判定に使うパラメータ（戦略が使うインディケータのみ有効）
+	Params() TradeParams
+	// 最適化済みのパラメータを設定する（戦略が使うインディケータのフィールドのみ使う）
+	SetParams(params TradeParams)
+	// dfでパラメータを最適化して設定し、最適化したパラメータでのバックテストの損益を返す
+	Optimize(ctx context.Context, df *DataFrameCandle, reOpen bool) (float64, error)
+}
+
+/** 戦略ごとに状態（パラメータ）を持つため、登録するのは作成する関数 */
+var strategyFactories = map[string]func() Strategy{}
+
+// 組み込みの戦略の名前
+const (
+	StrategyEmaMacd = "ema_macd" // EMAのクロスをMACDの方向で絞り込む（以前のAI.Tradeの判定）
+)
+
+func init() {
+	RegisterStrategy(IndicatorEma, func() Strategy {
+		return newIndicatorStrategy(indicatorStrategy{
+			name:  IndicatorEma,
+			grids: []optimizeGrid{emaGrid()},
+			sides: func(df *DataFrameCandle, p *TradeParams) []string {
+				return df.emaSides(p.EmaPeriod1, p.EmaPeriod2)
+			},
+			period: func(p *TradeParams) int {
+				return maxInt(p.EmaPeriod1, p.EmaPeriod2)
+			},
+			spread: func(df *DataFrameCandle, p *TradeParams, side string) []float64 {
+				return subtract(talib.Ema(df.Closes(), p.EmaPeriod1), talib.Ema(df.Closes(), p.EmaPeriod2))
+			},
+		})
+	})
+	RegisterStrategy(IndicatorBb, func() Strategy {
+		return newIndicatorStrategy(indicatorStrategy{
+			name:  IndicatorBb,
+			grids: []optimizeGrid{bbGrid()},
+			sides: func(df *DataFrameCandle, p *TradeParams) []string {
+				return df.bbSides(p.BbN, p.BbK)
+			},
+			period: func(p *TradeParams) int {
+				return p.BbN
+			},
+			spread: func(df *DataFrameCandle, p *TradeParams, side string) []float64 {
+				bbUp, _, bbDown := talib.BBands(df.Closes(), p.BbN, p.BbK, p.BbK, 0)
+				if side == "BUY" {
+					return subtract(df.Closes(), bbDown)
+				}
+				return subtract(df.Closes(), bbUp)
+			},
+		})
+	})
+	RegisterStrategy(IndicatorMacd, func() Strategy {
+		return newIndicatorStrategy(indicatorStrategy{
+			name:  IndicatorMacd,
+			grids: []optimizeGrid{macdGrid()},
+			sides: func(df *DataFrameCandle, p *TradeParams) []string {
+				return df.macdSides(p.MacdFastPeriod, p.MacdSlowPeriod, p.MacdSignalPeriod)
+			},
+			period: func(p *TradeParams) int {
+				return maxInt(p.MacdFastPeriod, p.MacdSlowPeriod, p.MacdSignalPeriod)
+			},
+			spread: func(df *DataFrameCandle, p *TradeParams, side string) []float64 {
+				outMACD, outMACDSignal, _ := talib.Macd(df.Closes(), p.MacdFastPeriod, p.MacdSlowPeriod, p.MacdSignalPeriod)
+				return subtract(outMACD, outMACDSignal)
+			},
+		})
+	})
+	RegisterStrategy(IndicatorIchimoku, func() Strategy {
+		return newIndicatorStrategy(indicatorStrategy{
+			name:  IndicatorIchimoku,
+			grids: []optimizeGrid{ichimokuGrid()},
+			sides: func(df *DataFrameCandle, p *TradeParams) []string {
+				return df.ichimokuSides(p.ichimokuPeriods())
+			},
+			// 雲はDisplacement本前の先行スパンBの期間から算出する
+			period: func(p *TradeParams) int {
+				periods := p.ichimokuPeriods()
+				return maxInt(periods.Kijun, periods.SenkouB+periods.Displacement)
+			},
+			spread: func(df *DataFrameCandle, p *TradeParams, side string) []float64 {
+				return df.chikouSpread(p.ichimokuPeriods(), side)
+			},
+		})
+	})
+	RegisterStrategy(IndicatorRsi, func() Strategy {
+		return newIndicatorStrategy(indicatorStrategy{
+			name:  IndicatorRsi,
+			grids: []optimizeGrid{rsiGrid()},
+			sides: func(df *DataFrameCandle, p *TradeParams) []string {
+				return df.rsiSides(p.RsiPeriod, p.RsiBuyThread, p.RsiSellThread)
+			},
+			period: func(p *TradeParams) int {
+				return p.RsiPeriod
+			},
+			// 閾値は一定のため、RSIの変化幅と同じになる
+			spread: func(df *DataFrameCandle, p *TradeParams, side string) []float64 {
+				return talib.Rsi(df.Closes(), p.RsiPeriod)
+			},
+		})
+	})
+	RegisterStrategy(StrategyEmaMacd, func() Strategy {
+		return newIndicatorStrategy(indicatorStrategy{
+			name:  StrategyEmaMacd,
+			grids: []optimizeGrid{emaGrid(), macdGrid()},
+			sides: func(df *DataFrameCandle, p *TradeParams) []string {
+				return df.emaMacdSides(p)
+			},
+			// MACDのシグナル線はMACDの期間の後にシグナルの期間が必要（ルールのmacdと同じ）
+			period: func(p *TradeParams) int {
+				return maxInt(p.EmaPeriod1, p.EmaPeriod2, maxInt(p.MacdFastPeriod, p.MacdSlowPeriod)+p.MacdSignalPeriod)
+			},
+			spread: func(df *DataFrameCandle, p *TradeParams, side string) []float64 {
+				return subtract(talib.Ema(df.Closes(), p.EmaPeriod1), talib.Ema(df.Closes(), p.EmaPeriod2))
+			},
+		})
+	})
+}
+
+/** 戦略を登録する（同じ名前の場合は上書きする）。init()から呼ぶ */
+func RegisterStrategy(name string, factory func() Strategy) {
+	strategyFactories[name] = factory
+}
+
+/** 登録した名前の戦略を作成する */
+func NewStrategy(name string) (Strategy, error) {
+	factory, ok := strategyFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown strategy %s (registered: %v)", name, StrategyNames())
+	}
+	return factory(), nil
+}
+
+/** 名前を指定した順に戦略を作成する */
+func NewStrategies(names []string) ([]Strategy, error) {
+	var strategies []Strategy
+	for _, name := range names {
+		strategy, err := NewStrategy(name)
+		if err != nil {
+			return nil, err
+		}
+		strategies = append(strategies, strategy)
+	}
+	return strategies, nil
+}
+
+/** 登録されている戦略の名前 */
+func StrategyNames() []string {
+	var names []string
+	for name := range strategyFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/** 最後のキャンドルで買いと売りのシグナルを出した戦略の数の多い方（同数の場合は空） */
+func MajoritySignal(df *DataFrameCandle, strategies []Strategy) string {
+	buyPoint, sellPoint := 0, 0
+	for _, strategy := range strategies {
+		switch strategy.OnCandle(df).Side {
+		case "BUY":
+			buyPoint++
+		case "SELL":
+			sellPoint++
+		}
+	}
+	switch {
+	case buyPoint > sellPoint:
+		return "BUY"
+	case sellPoint > buyPoint:
+		return "SELL"
+	}
+	return ""
+}
+
+/** 戦略のパラメータをまとめたもの（それぞれの戦略が使うインディケータを有効にする） */
+func StrategyParams(strategies []Strategy) *TradeParams {
+	tradeParams := &TradeParams{}
+	for _, strategy := range strategies {
+		params := strategy.Params()
+		for _, indicator := range indicators {
+			if params.enabled(indicator) {
+				tradeParams.set(indicator, params)
+				tradeParams.enable(indicator)
+			}
+		}
+	}
+	return tradeParams
+}
+
+/** キャンドルごとのシグナルをインディケータから算出する組み込みの戦略 */
+type indicatorStrategy struct {
+	name   string
+	grids  []optimizeGrid // 最適化の探索範囲（使うインディケータ）
+	params TradeParams
+	sides  func(df *DataFrameCandle, p *TradeParams) []string // キャンドルごとのシグナル（BUY・SELL・空）
+	period func(p *TradeParams) int                           // インディケータの算出に必要な期間
+	// シグナルの判定でクロスした2つの系列の差（確信度の算出に使う。nilの場合は確信度を1とする）
+	spread func(df *DataFrameCandle, p *TradeParams, side string) []float64
+}
+
+/** パラメータは探索範囲のデフォルトで始める */
+func newIndicatorStrategy(s indicatorStrategy) *indicatorStrategy {
+	for _, grid := range s.grids {
+		s.params.set(grid.indicator, grid.defaults)
+	}
+	return &s
+}
+
+func (s *indicatorStrategy) Name() string {
+	return s.name
+}
+
+/** クロスの判定に1つ前のキャンドルも使うため期間+1本 */
+func (s *indicatorStrategy) Warmup() int {
+	return s.period(&s.params) + 1
+}
+
+func (s *indicatorStrategy) OnCandle(df *DataFrameCandle) Signal {
+	lenCandles := len(df.Candles)
+	if lenCandles == 0 || lenCandles < s.Warmup() {
+		return Signal{}
+	}
+	last := df.Candles[lenCandles-1]
+	signal := Signal{Side: s.sides(df, &s.params)[lenCandles-1], Time: last.Time, Price: last.Close}
+	if signal.Side != "" {
+		signal.Score = 1
+		if s.spread != nil {
+			signal.Score = crossConfidence(s.spread(df, &s.params, signal.Side), s.period(&s.params))
+		}
+	}
+	return signal
+}
+
+/*
+クロスの確信度（0〜1）
+最後のキャンドルでの系列の差の変化幅を、from以降の平均的な変化幅と比べる（平均と同じ場合は0.5、大きいほど1に近づく）
+*/
+func crossConfidence(spread []float64, from int) float64 {
+	last := len(spread) - 1
+	if last < 1 {
+		return 1
+	}
+	move := math.Abs(spread[last] - spread[last-1])
+	total, count := 0.0, 0
+	for i := maxInt(from, 1); i <= last; i++ {
+		total += math.Abs(spread[i] - spread[i-1])
+		count++
+	}
+	if total == 0 {
+		return 1
+	}
+	return move / (move + total/float64(count))
+}
+
+/** 要素ごとの差（a - b） */
+func subtract(a, b []float64) []float64 {
+	values := make([]float64, len(a))
+	for i := range a {
+		if i < len(b) {
+			values[i] = a[i] - b[i]
+		}
+	}
+	return values
+}
+
+func (s *indicatorStrategy) Params() TradeParams {
+	params := s.params
+	for _, grid := range s.grids {
+		params.enable(grid.indicator)
+	}
+	return params
+}
+
+func (s *indicatorStrategy) SetParams(params TradeParams) {
+	for _, grid := range s.grids {
+		s.params.set(grid.indicator, params)
+	}
+}
+
+/** インディケータごとにグリッドサーチしたパラメータを組み合わせてバックテストする */
+func (s *indicatorStrategy) Optimize(ctx context.Context, df *DataFrameCandle, reOpen bool) (float64, error) {
+	results, err := df.searchGrids(ctx, s.grids, reOpen, OptimizeOptions{Workers: config.Config.OptimizeWorkers})
+	if err != nil {
+		return 0, err
+	}
+	for _, grid := range s.grids {
+		s.params.set(grid.indicator, results[grid.indicator].params)
+	}
+	if len(df.Candles) < s.Warmup() {
+		return 0, nil
+	}
+	return df.backTestSides(s.sides(df, &s.params), reOpen).Profit(), nil
+}
+
+/*
+キャンドルごとのEMAのクロスとMACDの方向が一致した時のシグナル
+ゴールデンクロスかつMACDが0より上（またはヒストグラムが正）でシグナル以上の場合は買い、デッドクロスはその逆で売り
+*/
+func (df *DataFrameCandle) emaMacdSides(p *TradeParams) []string {
+	lenCandles := len(df.Candles)
+	sides := make([]string, lenCandles)
+	emaValues1 := talib.Ema(df.Closes(), p.EmaPeriod1)
+	emaValues2 := talib.Ema(df.Closes(), p.EmaPeriod2)
+	outMACD, outMACDSignal, outMACDHist := talib.Macd(df.Closes(), p.MacdFastPeriod, p.MacdSlowPeriod, p.MacdSignalPeriod)
+	for i := 1; i < lenCandles; i++ {
+		// ゴールデンクロス・デッドクロスが計算できる条件
+		if i < p.EmaPeriod1 || i < p.EmaPeriod2 {
+			continue
+		}
+		// ADD: #63 MACDのメインライン（outMACD[i]）が0より大きい && シグナル（outMACDSignal）より大きい を条件として追加
+		if emaValues1[i-1] < emaValues2[i-1] && emaValues1[i] >= emaValues2[i] && (outMACD[i] > 0 || outMACDHist[i] > 0) && outMACD[i] >= outMACDSignal[i] {
+			sides[i] = "BUY"
+		}
+		// ADD: #63 MACDのメインライン（outMACD[i]）が0より小さい && シグナル（outMACDSignal）より小さい を条件として追加
+		if emaValues1[i-1] > emaValues2[i-1] && emaValues1[i] <= emaValues2[i] && (outMACD[i] < 0 || outMACDHist[i] < 0) && outMACD[i] <= outMACDSignal[i] {
+			sides[i] = "SELL"
+		}
+	}
+	return sides
+}
+
+/** インディケータが有効か */
+func (p *TradeParams) enabled(indicator string) bool {
+	switch indicator {
+	case IndicatorEma:
+		return p.EmaEnable
+	case IndicatorBb:
+		return p.BbEnable
+	case IndicatorMacd:
+		return p.MacdEnable
+	case IndicatorIchimoku:
+		return p.IchimokuEnable
+	case IndicatorRsi:
+		return p.RsiEnable
+	}
+	return false
+}
+
+func maxInt(values ...int) int {
+	max := 0
+	for _, value := range values {
+		if value > max {
+			max = value
+		}
+	}
+	return max
+}
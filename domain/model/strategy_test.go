@@ -0,0 +1,139 @@
+package model
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNewStrategy(t *testing.T) {
+	for _, name := range []string{IndicatorEma, IndicatorBb, IndicatorMacd, IndicatorIchimoku, IndicatorRsi, StrategyEmaMacd} {
+		strategy, err := NewStrategy(name)
+		if err != nil || strategy.Name() != name {
+			t.Errorf("NewStrategy(%s) = %v, %v", name, strategy, err)
+		}
+	}
+	if _, err := NewStrategy("unknown"); err == nil {
+		t.Error("NewStrategy(unknown) err = nil")
+	}
+	// 戦略ごとにパラメータを持つ
+	first, _ := NewStrategy(IndicatorEma)
+	second, _ := NewStrategy(IndicatorEma)
+	first.SetParams(TradeParams{EmaPeriod1: 5, EmaPeriod2: 20})
+	if params := second.Params(); params.EmaPeriod1 != 7 || params.EmaPeriod2 != 14 || !params.EmaEnable {
+		t.Errorf("second.Params() = %+v", params)
+	}
+}
+
+func TestStrategyOnCandle(t *testing.T) {
+	df := newSineDataFrame(300)
+	strategy, _ := NewStrategy(IndicatorEma)
+	events := df.BackTestEma(7, 14, false)
+	if events == nil || len(events.Signals) == 0 {
+		t.Fatal("BackTestEma() returned no signals")
+	}
+	first := events.Signals[0]
+	for i, candle := range df.Candles {
+		if !candle.Time.Equal(first.Time) {
+			continue
+		}
+		// シグナルが出たキャンドルが最後の場合のみシグナルを返す
+		if got := strategy.OnCandle(&DataFrameCandle{ProductCode: df.ProductCode, Candles: df.Candles[:i+1]}); got.Side != first.Side || !got.Time.Equal(first.Time) || got.Price != first.Price {
+			t.Errorf("OnCandle() = %+v, want %+v", got, first)
+		}
+		if got := strategy.OnCandle(&DataFrameCandle{ProductCode: df.ProductCode, Candles: df.Candles[:i]}); got.Side != "" {
+			t.Errorf("OnCandle() before the signal = %+v", got)
+		}
+	}
+	if got := strategy.OnCandle(&DataFrameCandle{Candles: df.Candles[:strategy.Warmup()-1]}); got.Side != "" {
+		t.Errorf("OnCandle() before warmup = %+v", got)
+	}
+}
+
+func TestEmaMacdStrategy(t *testing.T) {
+	df := newSineDataFrame(300)
+	strategy, _ := NewStrategy(StrategyEmaMacd)
+	params := strategy.Params()
+	if !params.EmaEnable || !params.MacdEnable {
+		t.Fatalf("Params() = %+v", params)
+	}
+	// MACDのシグナル線が算出できるまでのキャンドルが必要
+	if want := maxInt(params.MacdFastPeriod, params.MacdSlowPeriod) + params.MacdSignalPeriod + 1; strategy.Warmup() < want {
+		t.Errorf("Warmup() = %d, want >= %d", strategy.Warmup(), want)
+	}
+	// EMAのクロスのうちMACDの方向が一致するものだけがシグナルになる
+	emaSides := df.emaSides(params.EmaPeriod1, params.EmaPeriod2)
+	signals := 0
+	for i, side := range df.emaMacdSides(&params) {
+		if side == "" {
+			continue
+		}
+		signals++
+		if emaSides[i] != side {
+			t.Errorf("ema_macd side[%d] = %s, ema = %s", i, side, emaSides[i])
+		}
+	}
+	if signals == 0 {
+		t.Error("ema_macd returned no signals")
+	}
+}
+
+func TestStrategyOptimize(t *testing.T) {
+	df := newSineDataFrame(300)
+	strategy, _ := NewStrategy(IndicatorRsi)
+	performance, err := strategy.Optimize(context.Background(), df, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, period, buyThread, sellThread := df.OptimizeRsi(false)
+	params := strategy.Params()
+	if params.RsiPeriod != period || params.RsiBuyThread != buyThread || params.RsiSellThread != sellThread {
+		t.Errorf("Params() = %+v, want %d %v %v", params, period, buyThread, sellThread)
+	}
+	if want := df.BackTestRsi(period, buyThread, sellThread, false).Profit(); performance != want {
+		t.Errorf("Optimize() = %v, want %v", performance, want)
+	}
+
+	// 複数の戦略のパラメータをまとめる
+	ema, _ := NewStrategy(IndicatorEma)
+	merged := StrategyParams([]Strategy{strategy, ema})
+	if !merged.RsiEnable || !merged.EmaEnable || merged.MacdEnable || merged.RsiPeriod != period || merged.EmaPeriod1 != 7 {
+		t.Errorf("StrategyParams() = %+v", merged)
+	}
+}
+
+func TestMajoritySignal(t *testing.T) {
+	df := newSineDataFrame(300)
+	RegisterStrategy("test_buy", func() Strategy { return &fixedStrategy{side: "BUY"} })
+	RegisterStrategy("test_sell", func() Strategy { return &fixedStrategy{side: "SELL"} })
+	defer delete(strategyFactories, "test_buy")
+	defer delete(strategyFactories, "test_sell")
+
+	strategies, err := NewStrategies([]string{"test_buy", "test_sell", "test_buy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := MajoritySignal(df, strategies); got != "BUY" {
+		t.Errorf("MajoritySignal() = %q, want BUY", got)
+	}
+	if got := MajoritySignal(df, strategies[:2]); got != "" {
+		t.Errorf("MajoritySignal() with a tie = %q", got)
+	}
+}
+
+/** 常に同じシグナル・確信度を返す戦略 */
+type fixedStrategy struct {
+	name  string
+	side  string
+	score float64
+}
+
+func (s *fixedStrategy) Name() string                 { return s.name }
+func (s *fixedStrategy) Warmup() int                  { return 0 }
+func (s *fixedStrategy) Params() TradeParams          { return TradeParams{} }
+func (s *fixedStrategy) SetParams(params TradeParams) {}
+func (s *fixedStrategy) OnCandle(df *DataFrameCandle) Signal {
+	return Signal{Side: s.side, Score: s.score}
+}
+func (s *fixedStrategy) Optimize(ctx context.Context, df *DataFrameCandle, reOpen bool) (float64, error) {
+	return 0, nil
+}
@@ -0,0 +1,149 @@
+package model
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+var (
+	// オープン中の建玉と同じ方向の売買イベント（二重に保存しようとした場合など）
+	ErrPositionAlreadyOpen = errors.New("position is already open on the same side")
+	// 同じ時刻・方向の売買イベントが既に保存されている
+	ErrDuplicateSignalEvent = errors.New("signal event is already saved")
+)
+
+/*
+建玉（オープンした売買イベントと決済した売買イベントの組）
+ポジションの有無・方向は売買イベント数の偶奇ではなく、決済されていない建玉から判断する
+*/
+type Trade struct {
+	ID          int64        `json:"id"`
+	ProductCode string       `json:"product_code"`
+	Side        string       `json:"side"` // BUY: ロング, SELL: ショート
+	Size        float64      `json:"size"`
+	Open        SignalEvent  `json:"open"`
+	Close       *SignalEvent `json:"close,omitempty"` // 決済前はnil
+	Pnl         float64      `json:"pnl"`
+	StrategyID  string       `json:"strategy_id,omitempty"` // 戦略の建玉の場合のみ設定される
+}
+
+/** 決済されていないか */
+func (t *Trade) IsOpen() bool {
+	return t.Close == nil
+}
+
+/** 決済した時の損益（数量はオープン時のもの） */
+func (t *Trade) closePnl(closePrice float64) float64 {
+	if t.Side == "BUY" {
+		return (closePrice - t.Open.Price) * t.Size
+	}
+	return (t.Open.Price - closePrice) * t.Size
+}
+
+/*
+オープン中の建玉を売買イベントでどう扱うかを決める
+建玉がなければ新規の建玉、反対方向なら決済した建玉を返す。同じ方向の場合はErrPositionAlreadyOpen
+リポジトリの実装はこの結果をトランザクション内で保存する
+*/
+func ApplySignalEvent(open *Trade, event *SignalEvent) (*Trade, error) {
+	if open == nil {
+		return &Trade{
+			ProductCode: event.ProductCode,
+			StrategyID:  event.StrategyID,
+			Side:        event.Side,
+			Size:        event.Size,
+			Open:        *event,
+		}, nil
+	}
+	if open.Side == event.Side {
+		return nil, ErrPositionAlreadyOpen
+	}
+	closed := *open
+	closeEvent := *event
+	closed.Close = &closeEvent
+	closed.Pnl = open.closePnl(event.Price)
+	return &closed, nil
+}
+
+/*
+売買イベントと建玉の保存先
+建玉はプロダクトと戦略（strategy_id）ごとに1つまでオープンできる
+プロダクトコードのみを指定するメソッドは戦略ではない売買イベント（AI.Tradeのもの）を対象にする
+*/
+type SignalEventRepository interface {
+	// 売買イベントを保存し、建玉のオープンまたは決済を同じトランザクションで記録する
+	Save(event *SignalEvent) (*Trade, error)
+	// 直近limit件の売買イベント（時刻の昇順）
+	SelectByCount(productCode string, limit int) ([]SignalEvent, error)
+	// 全ての売買イベント（時刻の昇順）
+	SelectAll(productCode string) ([]SignalEvent, error)
+	// 指定時刻以降の売買イベント（時刻の昇順）
+	SelectAfter(productCode string, after time.Time) ([]SignalEvent, error)
+	// 売買イベント数
+	Count(productCode string) (int, error)
+	// 決済されていない建玉（ない場合はnil）
+	OpenTrade(productCode string) (*Trade, error)
+	// 直近limit件の建玉（オープンした時刻の昇順）
+	Trades(productCode string, limit int) ([]Trade, error)
+	// 戦略の全ての売買イベント（時刻の昇順）
+	SelectStrategy(productCode, strategyID string) ([]SignalEvent, error)
+	// 戦略の決済されていない建玉（ない場合はnil）
+	OpenStrategyTrade(productCode, strategyID string) (*Trade, error)
+}
+
+var signalEventRepository SignalEventRepository
+
+/** 売買イベントの保存先を設定する（domain/serviceの初期化時に設定される） */
+func SetSignalEventRepository(repo SignalEventRepository) {
+	signalEventRepository = repo
+}
+
+var errNoSignalEventRepository = errors.New("signal event repository is not set")
+
+/** 決済されていない建玉（ない場合はnil） */
+func GetOpenTrade(productCode string) (*Trade, error) {
+	if signalEventRepository == nil {
+		return nil, errNoSignalEventRepository
+	}
+	return signalEventRepository.OpenTrade(productCode)
+}
+
+/** 戦略の決済されていない建玉（ない場合はnil） */
+func GetOpenStrategyTrade(productCode, strategyID string) (*Trade, error) {
+	if signalEventRepository == nil {
+		return nil, errNoSignalEventRepository
+	}
+	return signalEventRepository.OpenStrategyTrade(productCode, strategyID)
+}
+
+/** 直近limit件の建玉 */
+func GetTrades(productCode string, limit int) []Trade {
+	if signalEventRepository == nil {
+		log.Println(errNoSignalEventRepository)
+		return nil
+	}
+	trades, err := signalEventRepository.Trades(productCode, limit)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return trades
+}
+
+/** メモリ上の売買イベントから決済されていない建玉を返す（バックテスト用） */
+func (s *SignalEvents) OpenTrade() *Trade {
+	var open *Trade
+	for i := range s.Signals {
+		trade, err := ApplySignalEvent(open, &s.Signals[i])
+		if err != nil {
+			continue
+		}
+		if trade.IsOpen() {
+			open = trade
+		} else {
+			open = nil
+		}
+	}
+	return open
+}
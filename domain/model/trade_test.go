@@ -0,0 +1,28 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignalEventsOpenTrade(t *testing.T) {
+	base := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	event := func(minute int, side string, price float64) SignalEvent {
+		return SignalEvent{Time: base.Add(time.Duration(minute) * time.Minute), ProductCode: "FX_BTC_JPY", Side: side, Price: price, Size: 2}
+	}
+	events := &SignalEvents{Signals: []SignalEvent{event(0, "SELL", 1000), event(10, "BUY", 900)}}
+	if trade := events.OpenTrade(); trade != nil {
+		t.Fatalf("OpenTrade() = %+v, want nil", trade)
+	}
+	closed, err := ApplySignalEvent(&Trade{Side: "SELL", Size: 2, Open: events.Signals[0]}, &events.Signals[1])
+	if err != nil || closed.IsOpen() || closed.Pnl != 200 {
+		t.Errorf("ApplySignalEvent() = %+v, %v", closed, err)
+	}
+
+	// 同じ方向が続いた場合は最初のイベントの建玉のまま
+	events.Signals = append(events.Signals, event(20, "BUY", 950), event(30, "BUY", 960))
+	trade := events.OpenTrade()
+	if trade == nil || trade.Side != "BUY" || trade.Open.Price != 950 {
+		t.Errorf("OpenTrade() = %+v", trade)
+	}
+}
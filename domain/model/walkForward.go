@@ -0,0 +1,211 @@
+package model
+
+import (
+	"app/config"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// 最適化の対象となるインディケータ
+const (
+	IndicatorEma      = "ema"
+	IndicatorBb       = "bb"
+	IndicatorMacd     = "macd"
+	IndicatorIchimoku = "ichimoku"
+	IndicatorRsi      = "rsi"
+)
+
+var indicators = []string{IndicatorEma, IndicatorBb, IndicatorMacd, IndicatorIchimoku, IndicatorRsi}
+
+/** インディケータごとの学習期間（In-Sample）と検証期間（Out-of-Sample）の損益 */
+type WalkForwardScore struct {
+	Indicator   string  `json:"indicator"`
+	Params      string  `json:"params"`
+	InSample    float64 `json:"in_sample"`
+	OutOfSample float64 `json:"out_of_sample"`
+}
+
+/** ウォークフォワードの1区間（学習期間で最適化したパラメータを直後の検証期間で評価する） */
+type WalkForwardWindow struct {
+	TrainFrom time.Time          `json:"train_from"`
+	TrainTo   time.Time          `json:"train_to"`
+	TestFrom  time.Time          `json:"test_from"`
+	TestTo    time.Time          `json:"test_to"`
+	Scores    []WalkForwardScore `json:"scores"`
+}
+
+/** インディケータごとのパラメータの安定性 */
+type WalkForwardStability struct {
+	Indicator         string  `json:"indicator"`
+	Windows           int     `json:"windows"`
+	ProfitableWindows int     `json:"profitable_windows"` // 検証期間で利益が出た区間数
+	HitRate           float64 `json:"hit_rate"`           // ProfitableWindows / Windows
+	OutOfSample       float64 `json:"out_of_sample"`      // 検証期間の損益の合計
+	ParamChanges      int     `json:"param_changes"`      // 前の区間から最適なパラメータが変わった回数
+	Stable            bool    `json:"stable"`             // 検証期間でも通用したか
+}
+
+/** ウォークフォワード最適化の結果 */
+type WalkForwardResult struct {
+	TrainSize  int                    `json:"train_size"`
+	TestSize   int                    `json:"test_size"`
+	MinHitRate float64                `json:"min_hit_rate"`
+	Windows    []WalkForwardWindow    `json:"windows"`
+	Stability  []WalkForwardStability `json:"stability"`
+	Params     *TradeParams           `json:"params"` // 直近の学習期間で最適化し、安定していたインディケータのみ有効にしたパラメータ
+}
+
+/*
+ウォークフォワード最適化
+キャンドルをtrainSize件の学習期間とtestSize件の検証期間に分け、testSize件ずつずらしながら
+学習期間で最適化したパラメータを直後の検証期間で評価する
+検証期間で利益が出た区間の割合がminHitRate以上かつ検証期間の損益の合計がプラスのインディケータのみを安定とみなし、
+直近trainSize件で最適化したパラメータのうち安定していたインディケータを検証期間の損益順にNumRanking個まで有効にする
+区間が1つも作れない場合や安定したインディケータがない場合はParamsがnilになる
+*/
+func (df *DataFrameCandle) WalkForward(trainSize, testSize int, minHitRate float64, reOpen bool) *WalkForwardResult {
+	result, _ := df.WalkForwardContext(context.Background(), trainSize, testSize, minHitRate, reOpen, OptimizeOptions{})
+	return result
+}
+
+/** 各区間の最適化を並列に行うウォークフォワード最適化（ctxがキャンセルされた場合はエラーを返す） */
+func (df *DataFrameCandle) WalkForwardContext(ctx context.Context, trainSize, testSize int, minHitRate float64, reOpen bool, options OptimizeOptions) (*WalkForwardResult, error) {
+	result := &WalkForwardResult{TrainSize: trainSize, TestSize: testSize, MinHitRate: minHitRate}
+	lenCandles := len(df.Candles)
+	if trainSize <= 0 || testSize <= 0 || lenCandles < trainSize+testSize {
+		log.Printf("action=WalkForward status=not_enough_candles candles=%d train_size=%d test_size=%d", lenCandles, trainSize, testSize)
+		return result, nil
+	}
+
+	for start := 0; start+trainSize+testSize <= lenCandles; start += testSize {
+		trainEnd := start + trainSize
+		testEnd := trainEnd + testSize
+		train := df.slice(start, trainEnd)
+		params, inSample, err := train.optimizeIndicators(ctx, reOpen, options)
+		if err != nil {
+			return nil, err
+		}
+		// 検証期間のインディケータ算出には学習期間のキャンドルも使い、検証期間にオープンした取引だけを評価する
+		test := df.slice(start, testEnd)
+		testFrom := df.Candles[trainEnd].Time
+		window := WalkForwardWindow{
+			TrainFrom: df.Candles[start].Time,
+			TrainTo:   df.Candles[trainEnd-1].Time,
+			TestFrom:  testFrom,
+			TestTo:    df.Candles[testEnd-1].Time,
+		}
+		for _, indicator := range indicators {
+			window.Scores = append(window.Scores, WalkForwardScore{
+				Indicator:   indicator,
+				Params:      params.describe(indicator),
+				InSample:    inSample[indicator],
+				OutOfSample: test.backTestProfitAfter(indicator, params, testFrom, reOpen),
+			})
+		}
+		result.Windows = append(result.Windows, window)
+	}
+
+	for i, indicator := range indicators {
+		stability := WalkForwardStability{Indicator: indicator, Windows: len(result.Windows)}
+		for j, window := range result.Windows {
+			score := window.Scores[i]
+			stability.OutOfSample += score.OutOfSample
+			if score.OutOfSample > 0 {
+				stability.ProfitableWindows++
+			}
+			if j > 0 && result.Windows[j-1].Scores[i].Params != score.Params {
+				stability.ParamChanges++
+			}
+		}
+		stability.HitRate = float64(stability.ProfitableWindows) / float64(stability.Windows)
+		stability.Stable = stability.HitRate >= minHitRate && stability.OutOfSample > 0
+		result.Stability = append(result.Stability, stability)
+	}
+
+	// 直近の学習期間で最適化し、安定していたインディケータのみ有効にする
+	params, _, err := df.slice(lenCandles-trainSize, lenCandles).optimizeIndicators(ctx, reOpen, options)
+	if err != nil {
+		return nil, err
+	}
+	stabilities := make([]WalkForwardStability, len(result.Stability))
+	copy(stabilities, result.Stability)
+	sort.SliceStable(stabilities, func(i, j int) bool { return stabilities[i].OutOfSample > stabilities[j].OutOfSample })
+	params.Performances = map[string]float64{}
+	for _, stability := range result.Stability {
+		params.Performances[stability.Indicator] = stability.OutOfSample
+	}
+	isEnable := false
+	for i, stability := range stabilities {
+		if i >= config.Config.NumRanking {
+			break
+		}
+		if stability.Stable {
+			params.enable(stability.Indicator)
+			isEnable = true
+		}
+	}
+	if isEnable {
+		result.Params = params
+	}
+	return result, nil
+}
+
+/** 指定した範囲のキャンドルのDataFrameCandle */
+func (df *DataFrameCandle) slice(start, end int) *DataFrameCandle {
+	return &DataFrameCandle{
+		ProductCode: df.ProductCode,
+		Duration:    df.Duration,
+		Candles:     df.Candles[start:end],
+	}
+}
+
+/** 指定したインディケータのパラメータでバックテストし、from以降にオープンした取引の損益を返す */
+func (df *DataFrameCandle) backTestProfitAfter(indicator string, params *TradeParams, from time.Time, reOpen bool) float64 {
+	signalEvents := df.backTestParams(indicator, params, reOpen)
+	if signalEvents == nil {
+		return 0
+	}
+	profit := 0.0
+	for _, trade := range signalEvents.Performance(0).Trades {
+		if !trade.OpenTime.Before(from) {
+			profit += trade.Pnl
+		}
+	}
+	return profit
+}
+
+/** インディケータのパラメータを文字列で返す（区間ごとのパラメータの変化の比較用） */
+func (p *TradeParams) describe(indicator string) string {
+	switch indicator {
+	case IndicatorEma:
+		return fmt.Sprintf("period1=%d period2=%d", p.EmaPeriod1, p.EmaPeriod2)
+	case IndicatorBb:
+		return fmt.Sprintf("n=%d k=%.1f", p.BbN, p.BbK)
+	case IndicatorMacd:
+		return fmt.Sprintf("fast=%d slow=%d signal=%d", p.MacdFastPeriod, p.MacdSlowPeriod, p.MacdSignalPeriod)
+	case IndicatorIchimoku:
+		return fmt.Sprintf("tenkan=%d kijun=%d senkou_b=%d displacement=%d", p.IchimokuTenkan, p.IchimokuKijun, p.IchimokuSenkouB, p.IchimokuDisplacement)
+	case IndicatorRsi:
+		return fmt.Sprintf("period=%d buy=%.1f sell=%.1f", p.RsiPeriod, p.RsiBuyThread, p.RsiSellThread)
+	}
+	return ""
+}
+
+/** インディケータを有効にする */
+func (p *TradeParams) enable(indicator string) {
+	switch indicator {
+	case IndicatorEma:
+		p.EmaEnable = true
+	case IndicatorBb:
+		p.BbEnable = true
+	case IndicatorMacd:
+		p.MacdEnable = true
+	case IndicatorIchimoku:
+		p.IchimokuEnable = true
+	case IndicatorRsi:
+		p.RsiEnable = true
+	}
+}
@@ -0,0 +1,48 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWalkForwardWindows(t *testing.T) {
+	base := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	df := newSineDataFrame(250)
+
+	result := df.WalkForward(100, 50, 0.5, false)
+	// 0-100/100-150, 50-150/150-200, 100-200/200-250
+	if len(result.Windows) != 3 {
+		t.Fatalf("len(Windows) = %d, want 3", len(result.Windows))
+	}
+	if !result.Windows[1].TestFrom.Equal(base.Add(150*time.Hour)) || !result.Windows[2].TestTo.Equal(base.Add(249*time.Hour)) {
+		t.Errorf("Windows[1].TestFrom = %v, Windows[2].TestTo = %v", result.Windows[1].TestFrom, result.Windows[2].TestTo)
+	}
+	if len(result.Stability) != len(indicators) {
+		t.Fatalf("len(Stability) = %d, want %d", len(result.Stability), len(indicators))
+	}
+	for _, stability := range result.Stability {
+		if stability.Windows != 3 || stability.HitRate != float64(stability.ProfitableWindows)/3 {
+			t.Errorf("Stability = %+v", stability)
+		}
+	}
+
+	// 安定していないインディケータは有効にしない
+	if p := result.Params; p != nil {
+		enabled := map[string]bool{
+			IndicatorEma:      p.EmaEnable,
+			IndicatorBb:       p.BbEnable,
+			IndicatorMacd:     p.MacdEnable,
+			IndicatorIchimoku: p.IchimokuEnable,
+			IndicatorRsi:      p.RsiEnable,
+		}
+		for _, stability := range result.Stability {
+			if enabled[stability.Indicator] && !stability.Stable {
+				t.Errorf("%s is enabled but not stable: %+v", stability.Indicator, stability)
+			}
+		}
+	}
+
+	if result := df.WalkForward(200, 100, 0.5, false); len(result.Windows) != 0 || result.Params != nil {
+		t.Errorf("WalkForward() with not enough candles = %+v", result)
+	}
+}
@@ -0,0 +1,40 @@
+package repository
+
+import (
+	"app/domain/model"
+	"fmt"
+	"time"
+)
+
+// config.iniの[db] driverに指定できる保存先
+const (
+	DriverMySQL  = "mysql"
+	DriverSQLite = "sqlite3"
+	DriverMemory = "memory"
+)
+
+/*
+キャンドルの保存先
+テーブル（メモリ上の場合はキー）はプロダクトコードと時間足ごとに分かれる（例：FX_BTC_JPY_15m0s）
+*/
+type CandleRepository interface {
+	// 指定時刻のキャンドル（存在しない場合はnil）
+	SelectOne(productCode string, duration time.Duration, dateTime time.Time) (*model.Candle, error)
+	// 直近limit件のキャンドル（時刻の昇順）
+	SelectAll(productCode string, duration time.Duration, limit int) ([]model.Candle, error)
+	// from <= time < toのキャンドル（時刻の昇順）
+	SelectRange(productCode string, duration time.Duration, from, to time.Time) ([]model.Candle, error)
+	// キャンドルを追加する（同じ時刻のキャンドルがある場合はエラー）
+	Insert(candle *model.Candle) error
+	// 同じ時刻のキャンドルを更新する
+	Save(candle *model.Candle) error
+	// 複数のキャンドルを1つのトランザクションで追加または更新する
+	SaveAll(candles []model.Candle) error
+	// 古い順にlimit件削除する
+	Prune(productCode string, duration time.Duration, limit int) error
+}
+
+/** テーブル名（プロダクトコード_時間足） */
+func CandleTableName(productCode string, duration time.Duration) string {
+	return fmt.Sprintf("%s_%s", productCode, duration)
+}
@@ -0,0 +1,113 @@
+package repository
+
+import (
+	"app/domain/model"
+	"testing"
+	"time"
+)
+
+func testCandleRepository(t *testing.T, repo CandleRepository) {
+	base := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	candle := func(i int, price float64) *model.Candle {
+		return &model.Candle{
+			ProductCode: "FX_BTC_JPY",
+			Duration:    time.Minute,
+			Time:        base.Add(time.Duration(i) * time.Minute),
+			Open:        price,
+			Close:       price,
+			High:        price,
+			Low:         price,
+			Volume:      1,
+		}
+	}
+	// 順不同で追加しても時刻順に取得できる
+	for _, i := range []int{2, 0, 4, 1, 3} {
+		if err := repo.Insert(candle(i, float64(1000+i))); err != nil {
+			t.Fatalf("Insert(%d) err = %v", i, err)
+		}
+	}
+	if err := repo.Insert(candle(2, 0)); err == nil {
+		t.Error("Insert() with duplicate time should return error")
+	}
+
+	one, err := repo.SelectOne("FX_BTC_JPY", time.Minute, base.Add(2*time.Minute))
+	if err != nil || one == nil || one.Close != 1002 || !one.Time.Equal(base.Add(2*time.Minute)) {
+		t.Fatalf("SelectOne() = %+v, %v", one, err)
+	}
+	if one, err := repo.SelectOne("FX_BTC_JPY", time.Minute, base.Add(time.Hour)); one != nil || err != nil {
+		t.Errorf("SelectOne() for missing time = %+v, %v", one, err)
+	}
+
+	updated := candle(2, 1002)
+	updated.High, updated.Volume, updated.BuyVolume, updated.SellVolume = 1100, 5, 3, 2
+	if err := repo.Save(updated); err != nil {
+		t.Fatal(err)
+	}
+	if one, _ := repo.SelectOne("FX_BTC_JPY", time.Minute, base.Add(2*time.Minute)); one.High != 1100 || one.Volume != 5 || one.BuyVolume != 3 || one.SellVolume != 2 {
+		t.Errorf("SelectOne() after Save = %+v", one)
+	}
+
+	// SaveAllは既存のキャンドルを更新し、ないものは追加する
+	saved := candle(4, 1004)
+	saved.Close = 1040
+	if err := repo.SaveAll([]model.Candle{*saved, *candle(0, 1000), *candle(5, 1005)}); err != nil {
+		t.Fatal(err)
+	}
+	if one, _ := repo.SelectOne("FX_BTC_JPY", time.Minute, base.Add(4*time.Minute)); one.Close != 1040 {
+		t.Errorf("SelectOne() after SaveAll = %+v", one)
+	}
+
+	all, err := repo.SelectAll("FX_BTC_JPY", time.Minute, 3)
+	if err != nil || len(all) != 3 || all[0].Close != 1003 || all[2].Close != 1005 {
+		t.Fatalf("SelectAll() = %+v, %v", all, err)
+	}
+	ranged, err := repo.SelectRange("FX_BTC_JPY", time.Minute, base.Add(time.Minute), base.Add(3*time.Minute))
+	if err != nil || len(ranged) != 2 || ranged[0].Close != 1001 || ranged[1].Close != 1002 {
+		t.Fatalf("SelectRange() = %+v, %v", ranged, err)
+	}
+	// 時間足ごとに別のテーブル
+	if other, err := repo.SelectAll("FX_BTC_JPY", time.Hour, 10); err != nil || len(other) != 0 {
+		t.Errorf("SelectAll() for other duration = %+v, %v", other, err)
+	}
+
+	if err := repo.Prune("FX_BTC_JPY", time.Minute, 2); err != nil {
+		t.Fatal(err)
+	}
+	all, _ = repo.SelectAll("FX_BTC_JPY", time.Minute, 10)
+	if len(all) != 4 || all[0].Close != 1002 {
+		t.Errorf("SelectAll() after Prune = %+v", all)
+	}
+}
+
+func TestMemoryCandleRepository(t *testing.T) {
+	testCandleRepository(t, NewMemoryCandleRepository())
+}
+
+func TestSQLiteCandleRepository(t *testing.T) {
+	db, err := OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCandleRepository(t, NewSQLiteCandleRepository(db))
+}
+
+func TestSQLiteCandleRepositoryAddsVolumeColumns(t *testing.T) {
+	db, err := OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 売買別の出来高の列がない以前のテーブル
+	_, err = db.Exec(`CREATE TABLE FX_BTC_JPY_1m0s (time DATETIME PRIMARY KEY NOT NULL, open REAL, close REAL, high REAL, low REAL, volume REAL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	_, err = db.Exec(`INSERT INTO FX_BTC_JPY_1m0s VALUES (?, 1000, 1000, 1000, 1000, 1)`, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	one, err := NewSQLiteCandleRepository(db).SelectOne("FX_BTC_JPY", time.Minute, base)
+	if err != nil || one == nil || one.Volume != 1 || one.BuyVolume != 0 || one.SellVolume != 0 {
+		t.Errorf("SelectOne() = %+v, %v", one, err)
+	}
+}
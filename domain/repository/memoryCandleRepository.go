@@ -0,0 +1,113 @@
+package repository
+
+import (
+	"app/domain/model"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+/** メモリ上にキャンドルを保持する（ローカル実行・テスト用。プロセスを終了すると消える） */
+type memoryCandleRepository struct {
+	mu     sync.RWMutex
+	tables map[string][]model.Candle // テーブル名ごとに時刻の昇順で保持する
+}
+
+func NewMemoryCandleRepository() CandleRepository {
+	return &memoryCandleRepository{tables: map[string][]model.Candle{}}
+}
+
+/** dateTime以降の最初のキャンドルの位置 */
+func (r *memoryCandleRepository) search(candles []model.Candle, dateTime time.Time) int {
+	return sort.Search(len(candles), func(i int) bool {
+		return !candles[i].Time.Before(dateTime)
+	})
+}
+
+func (r *memoryCandleRepository) SelectOne(productCode string, duration time.Duration, dateTime time.Time) (*model.Candle, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	candles := r.tables[CandleTableName(productCode, duration)]
+	i := r.search(candles, dateTime)
+	if i == len(candles) || !candles[i].Time.Equal(dateTime) {
+		return nil, nil
+	}
+	candle := candles[i]
+	return &candle, nil
+}
+
+func (r *memoryCandleRepository) SelectAll(productCode string, duration time.Duration, limit int) ([]model.Candle, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	candles := r.tables[CandleTableName(productCode, duration)]
+	start := len(candles) - limit
+	if start < 0 {
+		start = 0
+	}
+	return append([]model.Candle(nil), candles[start:]...), nil
+}
+
+func (r *memoryCandleRepository) SelectRange(productCode string, duration time.Duration, from, to time.Time) ([]model.Candle, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	candles := r.tables[CandleTableName(productCode, duration)]
+	start := r.search(candles, from)
+	end := r.search(candles, to)
+	if end < start {
+		end = start
+	}
+	return append([]model.Candle(nil), candles[start:end]...), nil
+}
+
+func (r *memoryCandleRepository) Insert(candle *model.Candle) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tableName := CandleTableName(candle.ProductCode, candle.Duration)
+	candles := r.tables[tableName]
+	i := r.search(candles, candle.Time)
+	if i < len(candles) && candles[i].Time.Equal(candle.Time) {
+		return fmt.Errorf("duplicate entry %s for %s", candle.Time, tableName)
+	}
+	candles = append(candles, model.Candle{})
+	copy(candles[i+1:], candles[i:])
+	candles[i] = *candle
+	r.tables[tableName] = candles
+	return nil
+}
+
+func (r *memoryCandleRepository) Save(candle *model.Candle) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	candles := r.tables[CandleTableName(candle.ProductCode, candle.Duration)]
+	i := r.search(candles, candle.Time)
+	// UPDATEと同様に該当するキャンドルがなければ何もしない
+	if i < len(candles) && candles[i].Time.Equal(candle.Time) {
+		candles[i] = *candle
+	}
+	return nil
+}
+
+func (r *memoryCandleRepository) SaveAll(candles []model.Candle) error {
+	for i := range candles {
+		// 同じ時刻のキャンドルがあれば更新する
+		if err := r.Insert(&candles[i]); err != nil {
+			if err := r.Save(&candles[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *memoryCandleRepository) Prune(productCode string, duration time.Duration, limit int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tableName := CandleTableName(productCode, duration)
+	candles := r.tables[tableName]
+	if limit > len(candles) {
+		limit = len(candles)
+	}
+	r.tables[tableName] = append([]model.Candle(nil), candles[limit:]...)
+	return nil
+}
@@ -0,0 +1,130 @@
+package repository
+
+import (
+	"app/domain/model"
+	"sort"
+	"sync"
+	"time"
+)
+
+/** メモリ上に売買イベントと建玉を保持する（ローカル実行・テスト用。プロセスを終了すると消える） */
+type memorySignalEventRepository struct {
+	mu     sync.RWMutex
+	events []model.SignalEvent // 時刻の昇順
+	trades []model.Trade       // オープンした順
+}
+
+func NewMemorySignalEventRepository() model.SignalEventRepository {
+	return &memorySignalEventRepository{}
+}
+
+func (r *memorySignalEventRepository) Save(event *model.SignalEvent) (*model.Trade, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.events {
+		if e.ProductCode == event.ProductCode && e.StrategyID == event.StrategyID && e.Side == event.Side && e.Time.Equal(event.Time) {
+			return nil, model.ErrDuplicateSignalEvent
+		}
+	}
+	open := r.openTradeIndex(event.ProductCode, event.StrategyID)
+	var openTrade *model.Trade
+	if open >= 0 {
+		openTrade = &r.trades[open]
+	}
+	trade, err := model.ApplySignalEvent(openTrade, event)
+	if err != nil {
+		return nil, err
+	}
+
+	// イベントと建玉は同じロックの中で更新する
+	i := sort.Search(len(r.events), func(i int) bool { return r.events[i].Time.After(event.Time) })
+	r.events = append(r.events, model.SignalEvent{})
+	copy(r.events[i+1:], r.events[i:])
+	r.events[i] = *event
+	if trade.IsOpen() {
+		trade.ID = int64(len(r.trades) + 1)
+		r.trades = append(r.trades, *trade)
+	} else {
+		r.trades[open] = *trade
+	}
+	result := *trade
+	return &result, nil
+}
+
+func (r *memorySignalEventRepository) SelectByCount(productCode string, limit int) ([]model.SignalEvent, error) {
+	events, _ := r.SelectAll(productCode)
+	if len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events, nil
+}
+
+func (r *memorySignalEventRepository) SelectAll(productCode string) ([]model.SignalEvent, error) {
+	return r.SelectAfter(productCode, time.Time{})
+}
+
+func (r *memorySignalEventRepository) SelectAfter(productCode string, after time.Time) ([]model.SignalEvent, error) {
+	return r.selectEvents(productCode, "", after), nil
+}
+
+func (r *memorySignalEventRepository) Count(productCode string) (int, error) {
+	events, _ := r.SelectAll(productCode)
+	return len(events), nil
+}
+
+func (r *memorySignalEventRepository) OpenTrade(productCode string) (*model.Trade, error) {
+	return r.OpenStrategyTrade(productCode, "")
+}
+
+func (r *memorySignalEventRepository) Trades(productCode string, limit int) ([]model.Trade, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var trades []model.Trade
+	for _, trade := range r.trades {
+		if trade.ProductCode == productCode && trade.StrategyID == "" {
+			trades = append(trades, trade)
+		}
+	}
+	if len(trades) > limit {
+		trades = trades[len(trades)-limit:]
+	}
+	return trades, nil
+}
+
+func (r *memorySignalEventRepository) SelectStrategy(productCode, strategyID string) ([]model.SignalEvent, error) {
+	return r.selectEvents(productCode, strategyID, time.Time{}), nil
+}
+
+func (r *memorySignalEventRepository) OpenStrategyTrade(productCode, strategyID string) (*model.Trade, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	open := r.openTradeIndex(productCode, strategyID)
+	if open < 0 {
+		return nil, nil
+	}
+	trade := r.trades[open]
+	return &trade, nil
+}
+
+/** プロダクトと戦略のafter以降の売買イベント */
+func (r *memorySignalEventRepository) selectEvents(productCode, strategyID string, after time.Time) []model.SignalEvent {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var events []model.SignalEvent
+	for _, event := range r.events {
+		if event.ProductCode == productCode && event.StrategyID == strategyID && !event.Time.Before(after) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+/** 決済されていない建玉の位置（ない場合は-1） */
+func (r *memorySignalEventRepository) openTradeIndex(productCode, strategyID string) int {
+	for i := len(r.trades) - 1; i >= 0; i-- {
+		if r.trades[i].ProductCode == productCode && r.trades[i].StrategyID == strategyID && r.trades[i].IsOpen() {
+			return i
+		}
+	}
+	return -1
+}
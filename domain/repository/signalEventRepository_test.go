@@ -0,0 +1,134 @@
+package repository
+
+import (
+	"app/domain/model"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testSignalEventRepository(t *testing.T, repo model.SignalEventRepository) {
+	base := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	event := func(minute int, side string, price float64) *model.SignalEvent {
+		return &model.SignalEvent{Time: base.Add(time.Duration(minute) * time.Minute), ProductCode: "FX_BTC_JPY", Side: side, Price: price, Size: 0.01}
+	}
+
+	if trade, err := repo.OpenTrade("FX_BTC_JPY"); trade != nil || err != nil {
+		t.Fatalf("OpenTrade() before any event = %+v, %v", trade, err)
+	}
+	opened, err := repo.Save(event(0, "BUY", 1000000))
+	if err != nil || !opened.IsOpen() || opened.Side != "BUY" {
+		t.Fatalf("Save(BUY) = %+v, %v", opened, err)
+	}
+	// 同じイベントの二重保存・同じ方向のイベントではポジションが変わらない
+	if _, err := repo.Save(event(0, "BUY", 1000000)); err != model.ErrDuplicateSignalEvent {
+		t.Errorf("Save(duplicate) err = %v, want %v", err, model.ErrDuplicateSignalEvent)
+	}
+	if _, err := repo.Save(event(1, "BUY", 1000000)); err != model.ErrPositionAlreadyOpen {
+		t.Errorf("Save(BUY) on long err = %v, want %v", err, model.ErrPositionAlreadyOpen)
+	}
+	if count, _ := repo.Count("FX_BTC_JPY"); count != 1 {
+		t.Errorf("Count() = %d, want 1", count)
+	}
+	open, err := repo.OpenTrade("FX_BTC_JPY")
+	if err != nil || open == nil || open.ID != opened.ID || open.Open.Price != 1000000 || !open.Open.Time.Equal(base) {
+		t.Fatalf("OpenTrade() = %+v, %v", open, err)
+	}
+
+	closed, err := repo.Save(event(15, "SELL", 1010000))
+	if err != nil || closed.IsOpen() || closed.ID != opened.ID || fmt.Sprintf("%.0f", closed.Pnl) != "100" {
+		t.Fatalf("Save(SELL) = %+v, %v", closed, err)
+	}
+	if trade, err := repo.OpenTrade("FX_BTC_JPY"); trade != nil || err != nil {
+		t.Fatalf("OpenTrade() after close = %+v, %v", trade, err)
+	}
+	// 決済後は反対方向でも新規にオープンできる（アンサンブルのスコアも保存する）
+	shortEvent := event(30, "SELL", 1020000)
+	shortEvent.Contributions = map[string]float64{model.IndicatorEma: -0.4, model.IndicatorRsi: 0.1}
+	short, err := repo.Save(shortEvent)
+	if err != nil || !short.IsOpen() || short.Side != "SELL" || short.ID == opened.ID {
+		t.Fatalf("Save(SELL) after close = %+v, %v", short, err)
+	}
+
+	trades, err := repo.Trades("FX_BTC_JPY", 10)
+	if err != nil || len(trades) != 2 || trades[0].Close == nil || !trades[0].Close.Time.Equal(base.Add(15*time.Minute)) || !trades[1].IsOpen() {
+		t.Fatalf("Trades() = %+v, %v", trades, err)
+	}
+	events, err := repo.SelectByCount("FX_BTC_JPY", 2)
+	if err != nil || len(events) != 2 || events[0].Side != "SELL" || !events[1].Time.Equal(base.Add(30*time.Minute)) {
+		t.Fatalf("SelectByCount() = %+v, %v", events, err)
+	}
+	if events[0].Contributions != nil || len(events[1].Contributions) != 2 || events[1].Contributions[model.IndicatorEma] != -0.4 || events[1].Contributions[model.IndicatorRsi] != 0.1 {
+		t.Errorf("Contributions = %v, %v", events[0].Contributions, events[1].Contributions)
+	}
+	if events, _ := repo.SelectAfter("FX_BTC_JPY", base.Add(time.Minute)); len(events) != 2 {
+		t.Errorf("SelectAfter() = %+v", events)
+	}
+
+	// 戦略の建玉は戦略ごとにオープンでき、戦略ではない建玉・売買イベントとは混ざらない
+	for _, strategyID := range []string{"trend", "reversal"} {
+		strategyEvent := event(30, "BUY", 1020000)
+		strategyEvent.StrategyID = strategyID
+		trade, err := repo.Save(strategyEvent)
+		if err != nil || !trade.IsOpen() || trade.StrategyID != strategyID {
+			t.Fatalf("Save(%s) = %+v, %v", strategyID, trade, err)
+		}
+	}
+	if open, _ := repo.OpenTrade("FX_BTC_JPY"); open == nil || open.Side != "SELL" || open.StrategyID != "" {
+		t.Errorf("OpenTrade() with strategies = %+v", open)
+	}
+	if open, err := repo.OpenStrategyTrade("FX_BTC_JPY", "trend"); err != nil || open == nil || open.Side != "BUY" || open.StrategyID != "trend" {
+		t.Errorf("OpenStrategyTrade() = %+v, %v", open, err)
+	}
+	if events, _ := repo.SelectStrategy("FX_BTC_JPY", "reversal"); len(events) != 1 || events[0].StrategyID != "reversal" {
+		t.Errorf("SelectStrategy() = %+v", events)
+	}
+	if count, _ := repo.Count("FX_BTC_JPY"); count != 3 {
+		t.Errorf("Count() with strategies = %d, want 3", count)
+	}
+}
+
+func TestMemorySignalEventRepository(t *testing.T) {
+	testSignalEventRepository(t, NewMemorySignalEventRepository())
+}
+
+func TestSQLiteSignalEventRepository(t *testing.T) {
+	db, err := OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := NewSQLiteSignalEventRepository(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSignalEventRepository(t, repo)
+}
+
+func TestSQLiteSignalEventRepositoryMigratesTrades(t *testing.T) {
+	db, err := OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := NewSQLiteSignalEventRepository(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// TRADES導入前の売買イベント（BUYが二重に保存されている）
+	base := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	for i, side := range []string{"BUY", "SELL", "SELL", "SELL", "BUY"} {
+		_, err := db.Exec("INSERT INTO SIGNAL_EVENTS (time, product_code, side, price, size, atr, atr_rate, pnl, re_open, bb_rate) VALUES (?, 'FX_BTC_JPY', ?, 1000, 1, 0, 0, 0, 0, 0)",
+			base.Add(time.Duration(i)*time.Minute), side)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	open, err := repo.OpenTrade("FX_BTC_JPY")
+	if err != nil || open != nil {
+		t.Fatalf("OpenTrade() = %+v, %v", open, err)
+	}
+	trades, _ := repo.Trades("FX_BTC_JPY", 10)
+	if len(trades) != 2 || trades[1].Side != "SELL" || !trades[1].Close.Time.Equal(base.Add(4*time.Minute)) {
+		t.Errorf("Trades() = %+v", trades)
+	}
+}
@@ -0,0 +1,263 @@
+package repository
+
+import (
+	"app/domain/model"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/** MySQL・SQLiteにキャンドルを保存する */
+type sqlCandleRepository struct {
+	db     *sql.DB
+	driver string
+
+	mu     sync.Mutex
+	tables map[string]bool // 作成済みのテーブル
+}
+
+/** MySQLのテーブルはマイグレーション（db/migrations）で作成する（マイグレーションのない時間足は初回アクセス時に作成する） */
+func NewMySQLCandleRepository(db *sql.DB) CandleRepository {
+	return &sqlCandleRepository{db: db, driver: DriverMySQL, tables: map[string]bool{}}
+}
+
+/** SQLiteのテーブルは初回アクセス時に作成する */
+func NewSQLiteCandleRepository(db *sql.DB) CandleRepository {
+	return &sqlCandleRepository{db: db, driver: DriverSQLite, tables: map[string]bool{}}
+}
+
+/** テーブル名を返す（テーブルがなければ作成する） */
+func (r *sqlCandleRepository) table(productCode string, duration time.Duration) (string, error) {
+	tableName := CandleTableName(productCode, duration)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tables[tableName] {
+		return tableName, nil
+	}
+	if r.driver == DriverMySQL {
+		// 4h・1dなど後から追加した時間足のテーブル（列はマイグレーションのテーブルと同じ）
+		cmd := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			time TIMESTAMP PRIMARY KEY NOT NULL DEFAULT '2020-01-01 00:00:01',
+			open float,
+			close float,
+			high float,
+			low float,
+			volume float,
+			buy_volume float NOT NULL DEFAULT 0,
+			sell_volume float NOT NULL DEFAULT 0)`, tableName)
+		if _, err := r.db.Exec(cmd); err != nil {
+			return "", err
+		}
+	} else {
+		cmd := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			time DATETIME PRIMARY KEY NOT NULL,
+			open REAL,
+			close REAL,
+			high REAL,
+			low REAL,
+			volume REAL,
+			buy_volume REAL NOT NULL DEFAULT 0,
+			sell_volume REAL NOT NULL DEFAULT 0)`, tableName)
+		if _, err := r.db.Exec(cmd); err != nil {
+			return "", err
+		}
+	}
+	if err := r.addVolumeColumns(tableName); err != nil {
+		return "", err
+	}
+	r.tables[tableName] = true
+	return tableName, nil
+}
+
+/*
+売買別の出来高の列がない以前のテーブルに列を追加する
+MySQLのマイグレーションで作成したテーブルはマイグレーションで追加するが、手動で作成した他のプロダクトのテーブルなどにも追加する
+*/
+func (r *sqlCandleRepository) addVolumeColumns(tableName string) error {
+	columns, err := r.columns(tableName)
+	if err != nil {
+		return err
+	}
+	columnType := "REAL"
+	if r.driver == DriverMySQL {
+		columnType = "float"
+	}
+	for _, column := range []string{"buy_volume", "sell_volume"} {
+		if columns[column] {
+			continue
+		}
+		if _, err := r.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s NOT NULL DEFAULT 0", tableName, column, columnType)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/** テーブルの列名 */
+func (r *sqlCandleRepository) columns(tableName string) (map[string]bool, error) {
+	columns := map[string]bool{}
+	if r.driver == DriverMySQL {
+		rows, err := r.db.Query("SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", tableName)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return nil, err
+			}
+			columns[name] = true
+		}
+		return columns, rows.Err()
+	}
+	rows, err := r.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", tableName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+func (r *sqlCandleRepository) time(t time.Time) time.Time {
+	return dbTime(r.driver, t)
+}
+
+func (r *sqlCandleRepository) SelectOne(productCode string, duration time.Duration, dateTime time.Time) (*model.Candle, error) {
+	tableName, err := r.table(productCode, duration)
+	if err != nil {
+		return nil, err
+	}
+	cmd := fmt.Sprintf("SELECT time, open, close, high, low, volume, buy_volume, sell_volume FROM %s WHERE time = ?", tableName)
+	candle := model.Candle{ProductCode: productCode, Duration: duration}
+	err = r.db.QueryRow(cmd, r.time(dateTime)).Scan(&candle.Time, &candle.Open, &candle.Close, &candle.High, &candle.Low, &candle.Volume, &candle.BuyVolume, &candle.SellVolume)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &candle, nil
+}
+
+func (r *sqlCandleRepository) SelectAll(productCode string, duration time.Duration, limit int) ([]model.Candle, error) {
+	tableName, err := r.table(productCode, duration)
+	if err != nil {
+		return nil, err
+	}
+	cmd := fmt.Sprintf(`SELECT * FROM (
+		SELECT time, open, close, high, low, volume, buy_volume, sell_volume FROM %s ORDER BY time DESC LIMIT ?
+		) AS candle ORDER BY time ASC`, tableName)
+	rows, err := r.db.Query(cmd, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanCandles(productCode, duration, rows)
+}
+
+func (r *sqlCandleRepository) SelectRange(productCode string, duration time.Duration, from, to time.Time) ([]model.Candle, error) {
+	tableName, err := r.table(productCode, duration)
+	if err != nil {
+		return nil, err
+	}
+	cmd := fmt.Sprintf("SELECT time, open, close, high, low, volume, buy_volume, sell_volume FROM %s WHERE time >= ? AND time < ? ORDER BY time ASC", tableName)
+	rows, err := r.db.Query(cmd, r.time(from), r.time(to))
+	if err != nil {
+		return nil, err
+	}
+	return scanCandles(productCode, duration, rows)
+}
+
+func (r *sqlCandleRepository) Insert(candle *model.Candle) error {
+	tableName, err := r.table(candle.ProductCode, candle.Duration)
+	if err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf("INSERT INTO %s (time, open, close, high, low, volume, buy_volume, sell_volume) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", tableName)
+	_, err = r.db.Exec(cmd, r.time(candle.Time), candle.Open, candle.Close, candle.High, candle.Low, candle.Volume, candle.BuyVolume, candle.SellVolume)
+	return err
+}
+
+func (r *sqlCandleRepository) Save(candle *model.Candle) error {
+	tableName, err := r.table(candle.ProductCode, candle.Duration)
+	if err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf("UPDATE %s SET open = ?, close = ?, high = ?, low = ?, volume = ?, buy_volume = ?, sell_volume = ? WHERE time = ?", tableName)
+	_, err = r.db.Exec(cmd, candle.Open, candle.Close, candle.High, candle.Low, candle.Volume, candle.BuyVolume, candle.SellVolume, r.time(candle.Time))
+	return err
+}
+
+func (r *sqlCandleRepository) SaveAll(candles []model.Candle) error {
+	if len(candles) == 0 {
+		return nil
+	}
+	// SQLiteは接続が1つなので、テーブルの作成はトランザクションを始める前に行う
+	tableNames := make([]string, len(candles))
+	for i, candle := range candles {
+		tableName, err := r.table(candle.ProductCode, candle.Duration)
+		if err != nil {
+			return err
+		}
+		tableNames[i] = tableName
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	for i, candle := range candles {
+		tableName := tableNames[i]
+		cmd := fmt.Sprintf(`INSERT INTO %s (time, open, close, high, low, volume, buy_volume, sell_volume) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE open = VALUES(open), close = VALUES(close), high = VALUES(high), low = VALUES(low),
+			volume = VALUES(volume), buy_volume = VALUES(buy_volume), sell_volume = VALUES(sell_volume)`, tableName)
+		if r.driver == DriverSQLite {
+			cmd = fmt.Sprintf(`INSERT INTO %s (time, open, close, high, low, volume, buy_volume, sell_volume) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT(time) DO UPDATE SET open = excluded.open, close = excluded.close, high = excluded.high, low = excluded.low,
+				volume = excluded.volume, buy_volume = excluded.buy_volume, sell_volume = excluded.sell_volume`, tableName)
+		}
+		_, err = tx.Exec(cmd, r.time(candle.Time), candle.Open, candle.Close, candle.High, candle.Low, candle.Volume, candle.BuyVolume, candle.SellVolume)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *sqlCandleRepository) Prune(productCode string, duration time.Duration, limit int) error {
+	tableName, err := r.table(productCode, duration)
+	if err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf("DELETE FROM %s ORDER BY time ASC LIMIT ?", tableName)
+	// SQLiteはDELETEのORDER BY/LIMITに対応していないためサブクエリで指定する
+	if r.driver == DriverSQLite {
+		cmd = fmt.Sprintf("DELETE FROM %[1]s WHERE time IN (SELECT time FROM %[1]s ORDER BY time ASC LIMIT ?)", tableName)
+	}
+	_, err = r.db.Exec(cmd, limit)
+	return err
+}
+
+/** 取得結果をキャンドルに詰める */
+func scanCandles(productCode string, duration time.Duration, rows *sql.Rows) ([]model.Candle, error) {
+	defer rows.Close()
+	var candles []model.Candle
+	for rows.Next() {
+		candle := model.Candle{ProductCode: productCode, Duration: duration}
+		if err := rows.Scan(&candle.Time, &candle.Open, &candle.Close, &candle.High, &candle.Low, &candle.Volume, &candle.BuyVolume, &candle.SellVolume); err != nil {
+			return nil, err
+		}
+		candles = append(candles, candle)
+	}
+	return candles, rows.Err()
+}
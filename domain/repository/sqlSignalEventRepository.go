@@ -0,0 +1,432 @@
+package repository
+
+import (
+	"app/domain/model"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	tableNameSignalEvents = "SIGNAL_EVENTS"
+	tableNameTrades       = "TRADES"
+
+	signalEventColumns = "id, time, product_code, side, price, size, atr, atr_rate, pnl, re_open, bb_rate, strategy_id, contributions"
+)
+
+/** *sql.DBと*sql.Txの共通部分 */
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+/*
+MySQL・SQLiteに売買イベントと建玉を保存する
+TRADESのopen_product_codeは決済されるまでproduct_code（戦略の建玉はproduct_code/strategy_id）が入るユニークキーで、
+同じプロダクト・戦略で建玉が2つオープンしないようにする
+*/
+type sqlSignalEventRepository struct {
+	db     *sql.DB
+	driver string
+
+	migrateOnce sync.Once
+}
+
+/** MySQLのテーブルはマイグレーション（db/migrations）で作成する */
+func NewMySQLSignalEventRepository(db *sql.DB) model.SignalEventRepository {
+	return &sqlSignalEventRepository{db: db, driver: DriverMySQL}
+}
+
+/** SQLiteのテーブルがなければ作成する */
+func NewSQLiteSignalEventRepository(db *sql.DB) (model.SignalEventRepository, error) {
+	cmds := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			time DATETIME NOT NULL,
+			product_code TEXT,
+			side TEXT,
+			price REAL,
+			size REAL,
+			atr INTEGER,
+			atr_rate REAL,
+			pnl REAL,
+			re_open BOOLEAN,
+			bb_rate REAL,
+			strategy_id TEXT NOT NULL DEFAULT '',
+			contributions TEXT)`, tableNameSignalEvents),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_code TEXT NOT NULL,
+			side TEXT NOT NULL,
+			size REAL NOT NULL,
+			open_event_id INTEGER NOT NULL,
+			close_event_id INTEGER,
+			pnl REAL NOT NULL DEFAULT 0,
+			open_product_code TEXT UNIQUE,
+			strategy_id TEXT NOT NULL DEFAULT '')`, tableNameTrades),
+	}
+	for _, cmd := range cmds {
+		if _, err := db.Exec(cmd); err != nil {
+			return nil, err
+		}
+	}
+	// strategy_idの導入前に作成したテーブルには列を追加する
+	for _, table := range []string{tableNameSignalEvents, tableNameTrades} {
+		if err := addSQLiteColumn(db, table, "strategy_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return nil, err
+		}
+	}
+	if err := addSQLiteColumn(db, tableNameSignalEvents, "contributions", "TEXT"); err != nil {
+		return nil, err
+	}
+	return &sqlSignalEventRepository{db: db, driver: DriverSQLite}, nil
+}
+
+func (r *sqlSignalEventRepository) Save(event *model.SignalEvent) (*model.Trade, error) {
+	r.migrate()
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// Commit後のRollbackは何もしない
+	defer tx.Rollback()
+
+	var count int
+	cmd := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE product_code = ? AND strategy_id = ? AND time = ? AND side = ?", tableNameSignalEvents)
+	if err := tx.QueryRow(cmd, event.ProductCode, event.StrategyID, r.time(event.Time), event.Side).Scan(&count); err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, model.ErrDuplicateSignalEvent
+	}
+
+	open, err := r.openTrade(tx, event.ProductCode, event.StrategyID, true)
+	if err != nil {
+		return nil, err
+	}
+	trade, err := model.ApplySignalEvent(open, event)
+	if err != nil {
+		return nil, err
+	}
+
+	eventID, err := r.insertEvent(tx, event)
+	if err != nil {
+		return nil, err
+	}
+	if trade.IsOpen() {
+		result, err := insertTrade(tx, trade, eventID)
+		if err != nil {
+			return nil, err
+		}
+		if trade.ID, err = result.LastInsertId(); err != nil {
+			return nil, err
+		}
+	} else {
+		cmd := fmt.Sprintf("UPDATE %s SET close_event_id = ?, pnl = ?, open_product_code = NULL WHERE id = ? AND close_event_id IS NULL", tableNameTrades)
+		result, err := tx.Exec(cmd, eventID, trade.Pnl, trade.ID)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := result.RowsAffected(); err != nil || n != 1 {
+			return nil, fmt.Errorf("trade %d could not be closed: rows=%d err=%v", trade.ID, n, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return trade, nil
+}
+
+func (r *sqlSignalEventRepository) SelectByCount(productCode string, limit int) ([]model.SignalEvent, error) {
+	// MySqlの場合はサブクエリにasが必要
+	cmd := fmt.Sprintf(`SELECT * FROM (SELECT %s FROM %s WHERE product_code = ? AND strategy_id = '' ORDER BY time DESC LIMIT ?) as events ORDER BY time ASC`, signalEventColumns, tableNameSignalEvents)
+	return r.selectEvents(cmd, productCode, limit)
+}
+
+func (r *sqlSignalEventRepository) SelectAll(productCode string) ([]model.SignalEvent, error) {
+	return r.SelectStrategy(productCode, "")
+}
+
+func (r *sqlSignalEventRepository) SelectAfter(productCode string, after time.Time) ([]model.SignalEvent, error) {
+	cmd := fmt.Sprintf(`SELECT %s FROM %s WHERE product_code = ? AND strategy_id = '' AND time >= ? ORDER BY time ASC`, signalEventColumns, tableNameSignalEvents)
+	return r.selectEvents(cmd, productCode, r.time(after))
+}
+
+func (r *sqlSignalEventRepository) Count(productCode string) (int, error) {
+	var count int
+	cmd := fmt.Sprintf(`SELECT count(*) FROM %s WHERE product_code = ? AND strategy_id = ''`, tableNameSignalEvents)
+	err := r.db.QueryRow(cmd, productCode).Scan(&count)
+	return count, err
+}
+
+func (r *sqlSignalEventRepository) OpenTrade(productCode string) (*model.Trade, error) {
+	return r.OpenStrategyTrade(productCode, "")
+}
+
+func (r *sqlSignalEventRepository) Trades(productCode string, limit int) ([]model.Trade, error) {
+	r.migrate()
+	cmd := fmt.Sprintf(`SELECT * FROM (SELECT id, product_code, side, size, open_event_id, close_event_id, pnl FROM %s WHERE product_code = ? AND strategy_id = '' ORDER BY id DESC LIMIT ?) as trades ORDER BY id ASC`, tableNameTrades)
+	rows, err := r.db.Query(cmd, productCode, limit)
+	if err != nil {
+		return nil, err
+	}
+	type tradeRow struct {
+		trade        model.Trade
+		openEventID  int64
+		closeEventID sql.NullInt64
+	}
+	var tradeRows []tradeRow
+	for rows.Next() {
+		var row tradeRow
+		if err := rows.Scan(&row.trade.ID, &row.trade.ProductCode, &row.trade.Side, &row.trade.Size, &row.openEventID, &row.closeEventID, &row.trade.Pnl); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tradeRows = append(tradeRows, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	trades := make([]model.Trade, 0, len(tradeRows))
+	for _, row := range tradeRows {
+		if err := r.fillEvents(r.db, &row.trade, row.openEventID, row.closeEventID); err != nil {
+			return nil, err
+		}
+		trades = append(trades, row.trade)
+	}
+	return trades, nil
+}
+
+func (r *sqlSignalEventRepository) SelectStrategy(productCode, strategyID string) ([]model.SignalEvent, error) {
+	cmd := fmt.Sprintf(`SELECT %s FROM %s WHERE product_code = ? AND strategy_id = ? ORDER BY time ASC`, signalEventColumns, tableNameSignalEvents)
+	return r.selectEvents(cmd, productCode, strategyID)
+}
+
+func (r *sqlSignalEventRepository) OpenStrategyTrade(productCode, strategyID string) (*model.Trade, error) {
+	r.migrate()
+	return r.openTrade(r.db, productCode, strategyID, false)
+}
+
+/** 決済されていない建玉（forUpdateの場合、MySQLでは行ロックを取る） */
+func (r *sqlSignalEventRepository) openTrade(q queryer, productCode, strategyID string, forUpdate bool) (*model.Trade, error) {
+	cmd := fmt.Sprintf("SELECT id, product_code, side, size, open_event_id, pnl, strategy_id FROM %s WHERE product_code = ? AND strategy_id = ? AND close_event_id IS NULL ORDER BY id DESC LIMIT 1", tableNameTrades)
+	if forUpdate && r.driver == DriverMySQL {
+		cmd += " FOR UPDATE"
+	}
+	var trade model.Trade
+	var openEventID int64
+	err := q.QueryRow(cmd, productCode, strategyID).Scan(&trade.ID, &trade.ProductCode, &trade.Side, &trade.Size, &openEventID, &trade.Pnl, &trade.StrategyID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := r.fillEvents(q, &trade, openEventID, sql.NullInt64{}); err != nil {
+		return nil, err
+	}
+	return &trade, nil
+}
+
+/** 建玉にオープン・決済の売買イベントを詰める */
+func (r *sqlSignalEventRepository) fillEvents(q queryer, trade *model.Trade, openEventID int64, closeEventID sql.NullInt64) error {
+	open, err := r.selectEvent(q, openEventID)
+	if err != nil {
+		return err
+	}
+	trade.Open = *open
+	if closeEventID.Valid {
+		if trade.Close, err = r.selectEvent(q, closeEventID.Int64); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *sqlSignalEventRepository) selectEvent(q queryer, id int64) (*model.SignalEvent, error) {
+	cmd := fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", signalEventColumns, tableNameSignalEvents)
+	rows, err := q.Query(cmd, id)
+	if err != nil {
+		return nil, err
+	}
+	events, _, err := scanSignalEvents(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("signal event %d not found", id)
+	}
+	return &events[0], nil
+}
+
+func (r *sqlSignalEventRepository) insertEvent(tx *sql.Tx, event *model.SignalEvent) (int64, error) {
+	contributions, err := marshalContributions(event.Contributions)
+	if err != nil {
+		return 0, err
+	}
+	cmd := fmt.Sprintf("INSERT INTO %s (time, product_code, side, price, size, atr, atr_rate, pnl, re_open, bb_rate, strategy_id, contributions) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", tableNameSignalEvents)
+	result, err := tx.Exec(cmd, r.time(event.Time), event.ProductCode, event.Side, event.Price, event.Size, event.Atr, event.AtrRate, event.Pnl, event.ReOpen, event.BbRate, event.StrategyID, contributions)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (r *sqlSignalEventRepository) selectEvents(cmd string, args ...interface{}) ([]model.SignalEvent, error) {
+	rows, err := r.db.Query(cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+	events, _, err := scanSignalEvents(rows)
+	return events, err
+}
+
+func (r *sqlSignalEventRepository) time(t time.Time) time.Time {
+	return dbTime(r.driver, t)
+}
+
+/*
+TRADESが空でSIGNAL_EVENTSがある場合（TRADES導入前のデータ）は売買イベントを順に再生して建玉を作成する
+初回アクセス時に1度だけ行う
+*/
+func (r *sqlSignalEventRepository) migrate() {
+	r.migrateOnce.Do(func() {
+		var count int
+		if err := r.db.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s", tableNameTrades)).Scan(&count); err != nil || count > 0 {
+			if err != nil {
+				log.Printf("action=migrateTrades err=%s", err.Error())
+			}
+			return
+		}
+		rows, err := r.db.Query(fmt.Sprintf("SELECT %s FROM %s ORDER BY time ASC, id ASC", signalEventColumns, tableNameSignalEvents))
+		if err != nil {
+			log.Printf("action=migrateTrades err=%s", err.Error())
+			return
+		}
+		events, ids, err := scanSignalEvents(rows)
+		if err != nil || len(events) == 0 {
+			if err != nil {
+				log.Printf("action=migrateTrades err=%s", err.Error())
+			}
+			return
+		}
+
+		tx, err := r.db.Begin()
+		if err != nil {
+			log.Printf("action=migrateTrades err=%s", err.Error())
+			return
+		}
+		defer tx.Rollback()
+		open := map[string]*model.Trade{}
+		for i := range events {
+			event := &events[i]
+			key := openTradeKey(event.ProductCode, event.StrategyID)
+			trade, err := model.ApplySignalEvent(open[key], event)
+			// 同じ方向が続く場合（保存漏れ・二重保存）は後のイベントを無視する
+			if err != nil {
+				log.Printf("action=migrateTrades status=skip event=%+v err=%s", *event, err.Error())
+				continue
+			}
+			if trade.IsOpen() {
+				result, err := insertTrade(tx, trade, ids[i])
+				if err != nil {
+					log.Printf("action=migrateTrades err=%s", err.Error())
+					return
+				}
+				trade.ID, _ = result.LastInsertId()
+				open[key] = trade
+				continue
+			}
+			cmd := fmt.Sprintf("UPDATE %s SET close_event_id = ?, pnl = ?, open_product_code = NULL WHERE id = ?", tableNameTrades)
+			if _, err := tx.Exec(cmd, ids[i], trade.Pnl, trade.ID); err != nil {
+				log.Printf("action=migrateTrades err=%s", err.Error())
+				return
+			}
+			open[key] = nil
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("action=migrateTrades err=%s", err.Error())
+			return
+		}
+		log.Printf("action=migrateTrades events=%d", len(events))
+	})
+}
+
+/** 取得結果を売買イベントに詰める（idsは同じ順序の売買イベントのID） */
+func scanSignalEvents(rows *sql.Rows) (events []model.SignalEvent, ids []int64, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		// MySQLのSIGNAL_EVENTS.idはFLOAT
+		var id float64
+		var event model.SignalEvent
+		var contributions sql.NullString
+		if err := rows.Scan(&id, &event.Time, &event.ProductCode, &event.Side, &event.Price, &event.Size, &event.Atr, &event.AtrRate, &event.Pnl, &event.ReOpen, &event.BbRate, &event.StrategyID, &contributions); err != nil {
+			return nil, nil, err
+		}
+		if contributions.Valid {
+			if err := json.Unmarshal([]byte(contributions.String), &event.Contributions); err != nil {
+				return nil, nil, err
+			}
+		}
+		events = append(events, event)
+		ids = append(ids, int64(id))
+	}
+	return events, ids, rows.Err()
+}
+
+/** アンサンブルのスコアはJSONで保存する（アンサンブルで判定していない場合はNULL） */
+func marshalContributions(contributions map[string]float64) (sql.NullString, error) {
+	if len(contributions) == 0 {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(contributions)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+/** オープンした建玉を保存する */
+func insertTrade(tx *sql.Tx, trade *model.Trade, openEventID int64) (sql.Result, error) {
+	cmd := fmt.Sprintf("INSERT INTO %s (product_code, side, size, open_event_id, pnl, open_product_code, strategy_id) VALUES (?, ?, ?, ?, 0, ?, ?)", tableNameTrades)
+	return tx.Exec(cmd, trade.ProductCode, trade.Side, trade.Size, openEventID, openTradeKey(trade.ProductCode, trade.StrategyID), trade.StrategyID)
+}
+
+/** 建玉のオープン中に入るユニークキー（戦略ごとに1つずつオープンできる） */
+func openTradeKey(productCode, strategyID string) string {
+	if strategyID == "" {
+		return productCode
+	}
+	return productCode + "/" + strategyID
+}
+
+/** SQLiteのテーブルに列がなければ追加する */
+func addSQLiteColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
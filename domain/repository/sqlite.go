@@ -0,0 +1,27 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+/** SQLiteのファイル（":memory:"も可）を開く */
+func OpenSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open(DriverSQLite, path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLiteは同時書き込みできないため接続を1つにする（:memory:は接続ごとに別のDBになる）
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+/** SQLiteは文字列で時刻を比較するためUTCに揃える */
+func dbTime(driver string, t time.Time) time.Time {
+	if driver == DriverSQLite {
+		return t.UTC()
+	}
+	return t
+}
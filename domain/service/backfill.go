@@ -0,0 +1,222 @@
+package service
+
+import (
+	"app/bitflyer"
+	"app/domain/model"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// /v1/executionsで1回に取得できる約定の最大件数
+const executionsPageSize = 500
+
+// 流量制限（429）の場合にやり直す回数と最初に待つ時間（やり直すごとに2倍にする）
+var (
+	backfillMaxRetries = 5
+	backfillRetryWait  = 30 * time.Second
+)
+
+/** 約定履歴の取得元（bitflyer.APIClient） */
+type ExecutionHistory interface {
+	GetExecutions(query map[string]string) ([]bitflyer.Execution, error)
+}
+
+/** バックフィルの結果 */
+type BackfillResult struct {
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Requests   int       `json:"requests"`
+	Executions int       `json:"executions"`
+	Candles    int       `json:"candles"`
+	Reached    bool      `json:"reached"` // fromより前の約定まで遡ったか（範囲内の約定を全て反映した）
+}
+
+/** バックフィルする期間（from <= 約定日時 < to） */
+type BackfillSpan struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+/*
+バックフィルが必要な期間（新しい期間から順に返す）
+全ての時間足に保存済みのキャンドルがある場合は、最新のキャンドルより後と最古のキャンドルより前のみ作成する
+Backfillは新しいキャンドルから保存するため、中断した場合は最古のキャンドルより前から再開する（間の欠けはRepairCandleGapsで補う）
+*/
+func BackfillSpans(productCode string, durations []time.Duration, from, to time.Time) ([]BackfillSpan, error) {
+	var first, last time.Time
+	for _, duration := range durations {
+		candles, err := candleRepository.SelectRange(productCode, duration, from, to)
+		if err != nil {
+			return nil, err
+		}
+		if len(candles) == 0 {
+			return []BackfillSpan{{From: from, To: to}}, nil
+		}
+		// 全ての時間足で保存済みの範囲（最古のキャンドルの時刻が最も新しい時間足、最新のキャンドルの終わりが最も古い時間足）
+		if oldest := candles[0].Time; first.IsZero() || oldest.After(first) {
+			first = oldest
+		}
+		if newest := candles[len(candles)-1].Time.Add(duration); last.IsZero() || newest.Before(last) {
+			last = newest
+		}
+	}
+	var spans []BackfillSpan
+	if last.Before(to) {
+		spans = append(spans, BackfillSpan{From: last, To: to})
+	}
+	if from.Before(first) {
+		spans = append(spans, BackfillSpan{From: from, To: first})
+	}
+	return spans, nil
+}
+
+/*
+約定履歴を新しい順にページングしてfrom <= 約定日時 < toのキャンドルを時間足ごとに作成し、ページごとに保存する
+保存するのは時間足の全体が範囲に含まれ、全ての約定を反映し終わったキャンドルのみ（作成途中のキャンドルを上書きしないため）
+/v1/executionsは約定日時で指定できないため、最新の約定からbeforeで遡る
+流量制限にかからないようintervalごとに1回リクエストし、流量制限（429）の場合は待つ時間を延ばしながらやり直す
+途中でエラーになった場合やctxがキャンセルされた場合も、それまでに保存したキャンドルは残る（BackfillSpansで残りから再開できる）
+*/
+func Backfill(ctx context.Context, history ExecutionHistory, productCode string, durations []time.Duration, from, to time.Time, interval time.Duration) (*BackfillResult, error) {
+	return backfill(ctx, history, productCode, durations, from, to, interval, nil)
+}
+
+/** Backfillと同じだが、keepがnilでない場合はkeepがtrueを返すキャンドルのみ保存する */
+func backfill(ctx context.Context, history ExecutionHistory, productCode string, durations []time.Duration, from, to time.Time, interval time.Duration, keep func(duration time.Duration, candleTime time.Time) bool) (*BackfillResult, error) {
+	result := &BackfillResult{From: from, To: to}
+	candles := map[time.Duration]map[time.Time]*model.Candle{}
+	for _, duration := range durations {
+		candles[duration] = map[time.Time]*model.Candle{}
+	}
+
+	var before int64
+	retries := 0
+	for {
+		query := map[string]string{"product_code": productCode, "count": strconv.Itoa(executionsPageSize)}
+		if before > 0 {
+			query["before"] = strconv.FormatInt(before, 10)
+		}
+		executions, err := history.GetExecutions(query)
+		if errors.Is(err, bitflyer.ErrTooManyRequests) && retries < backfillMaxRetries {
+			wait := backfillRetryWait << uint(retries)
+			retries++
+			log.Printf("action=Backfill err=%s retry=%d wait=%s", err.Error(), retries, wait)
+			select {
+			case <-ctx.Done():
+				return result, ctx.Err()
+			case <-time.After(wait):
+			}
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		retries = 0
+		result.Requests++
+		if len(executions) == 0 {
+			break
+		}
+		reached := false
+		for _, execution := range executions {
+			dateTime := execution.DateTime()
+			if dateTime.Before(from) {
+				reached = true
+				result.Reached = true
+				break
+			}
+			if !dateTime.Before(to) {
+				continue
+			}
+			result.Executions++
+			addBackfillExecution(candles, productCode, dateTime, execution)
+		}
+		if reached || len(executions) < executionsPageSize {
+			break
+		}
+		// 最も古い約定より後のキャンドルは全ての約定を反映し終わっている
+		oldest := executions[len(executions)-1].DateTime()
+		if err := saveBackfillCandles(candles, from, to, oldest, keep, result); err != nil {
+			return result, err
+		}
+		before = executions[len(executions)-1].ID
+		if result.Requests%100 == 0 {
+			log.Printf("action=Backfill requests=%d executions=%d candles=%d reached=%s", result.Requests, result.Executions, result.Candles, oldest)
+		}
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+	// fromより前まで遡ったか約定履歴の最後まで取得したため、残りのキャンドルも全て保存する
+	return result, saveBackfillCandles(candles, from, to, time.Time{}, keep, result)
+}
+
+/** oldestより後に始まる（oldestがゼロ値の場合は全ての）キャンドルのうち、時間足の全体が範囲に含まれるもの（keepがnilでない場合はさらにkeepがtrueを返すもの）を保存してcandlesから除く */
+func saveBackfillCandles(candles map[time.Duration]map[time.Time]*model.Candle, from, to, oldest time.Time, keep func(duration time.Duration, candleTime time.Time) bool, result *BackfillResult) error {
+	var completed []model.Candle
+	for duration, byTime := range candles {
+		for candleTime, candle := range byTime {
+			if !oldest.IsZero() && !oldest.Before(candleTime) {
+				continue
+			}
+			delete(byTime, candleTime)
+			if candleTime.Before(from) || candleTime.Add(duration).After(to) {
+				continue
+			}
+			if keep != nil && !keep(duration, candleTime) {
+				continue
+			}
+			completed = append(completed, *candle)
+		}
+	}
+	if len(completed) == 0 {
+		return nil
+	}
+	sort.Slice(completed, func(i, j int) bool {
+		if completed[i].Duration != completed[j].Duration {
+			return completed[i].Duration < completed[j].Duration
+		}
+		return completed[i].Time.Before(completed[j].Time)
+	})
+	if err := candleRepository.SaveAll(completed); err != nil {
+		return fmt.Errorf("save candles: %w", err)
+	}
+	result.Candles += len(completed)
+	return nil
+}
+
+/** 新しい順に届く約定をキャンドルに反映する（最初の約定が終値、最後の約定が始値になる） */
+func addBackfillExecution(candles map[time.Duration]map[time.Time]*model.Candle, productCode string, dateTime time.Time, execution bitflyer.Execution) {
+	for duration, byTime := range candles {
+		candleTime := dateTime.Truncate(duration)
+		candle := byTime[candleTime]
+		if candle == nil {
+			candle = &model.Candle{
+				ProductCode: productCode,
+				Duration:    duration,
+				Time:        candleTime,
+				High:        execution.Price,
+				Low:         execution.Price,
+				Close:       execution.Price,
+			}
+			byTime[candleTime] = candle
+		}
+		candle.Open = execution.Price
+		candle.High = math.Max(candle.High, execution.Price)
+		candle.Low = math.Min(candle.Low, execution.Price)
+		candle.Volume += execution.Size
+		switch execution.Side {
+		case "BUY":
+			candle.BuyVolume += execution.Size
+		case "SELL":
+			candle.SellVolume += execution.Size
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"app/bitflyer"
+	"app/domain/repository"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/** 約定IDの降順に並んだ約定をbeforeでページングして返す */
+type pagedHistory struct {
+	executions []bitflyer.Execution
+	queries    []map[string]string
+	errs       []error // リクエストごとに返すエラー（足りない分はnil）
+}
+
+func (h *pagedHistory) GetExecutions(query map[string]string) ([]bitflyer.Execution, error) {
+	h.queries = append(h.queries, query)
+	if i := len(h.queries) - 1; i < len(h.errs) && h.errs[i] != nil {
+		return nil, h.errs[i]
+	}
+	count, _ := strconv.Atoi(query["count"])
+	before, _ := strconv.ParseInt(query["before"], 10, 64)
+	var page []bitflyer.Execution
+	for _, execution := range h.executions {
+		if before > 0 && execution.ID >= before {
+			continue
+		}
+		if len(page) == count {
+			break
+		}
+		page = append(page, execution)
+	}
+	return page, nil
+}
+
+/** 11:59から12:10まで1秒ごとの約定（価格は経過秒数）、新しい順 */
+func newPagedHistory(base time.Time) *pagedHistory {
+	history := &pagedHistory{}
+	for i := 11 * 60; i >= -60; i-- {
+		side := "BUY"
+		if i%2 != 0 {
+			side = "SELL"
+		}
+		history.executions = append(history.executions, bitflyer.Execution{
+			ID:       int64(i + 100),
+			Side:     side,
+			Price:    float64(1000 + i),
+			Size:     1,
+			ExecDate: base.Add(time.Duration(i) * time.Second).Format("2006-01-02T15:04:05.999999999"),
+		})
+	}
+	return history
+}
+
+func TestBackfill(t *testing.T) {
+	SetCandleRepository(repository.NewMemoryCandleRepository())
+	base := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	history := newPagedHistory(base)
+	// 流量制限の場合は待ってからやり直す
+	history.errs = []error{fmt.Errorf("status=429: %w", bitflyer.ErrTooManyRequests)}
+	backfillRetryWait = time.Millisecond
+	defer func() { backfillRetryWait = 30 * time.Second }()
+
+	durations := []time.Duration{time.Minute, 5 * time.Minute}
+	to := base.Add(10*time.Minute + 30*time.Second)
+	spans, err := BackfillSpans("FX_BTC_JPY", durations, base, to)
+	if err != nil || len(spans) != 1 || !spans[0].From.Equal(base) || !spans[0].To.Equal(to) {
+		t.Fatalf("BackfillSpans() = %+v, %v", spans, err)
+	}
+	result, err := Backfill(context.Background(), history, "FX_BTC_JPY", durations, base, to, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 12:10:29まで遡って12:00:00の前の約定で止まる
+	if result.Executions != 630 || result.Requests != 2 {
+		t.Errorf("result = %+v", result)
+	}
+	if result.Candles != 12 {
+		t.Errorf("Candles = %d, want 12 (1m x10, 5m x2)", result.Candles)
+	}
+	if before := history.queries[2]["before"]; before != strconv.Itoa(11*60+100-499) {
+		t.Errorf("before = %s", before)
+	}
+
+	candle, _ := candleRepository.SelectOne("FX_BTC_JPY", time.Minute, base.Add(time.Minute))
+	if candle == nil || candle.Open != 1060 || candle.High != 1119 || candle.Low != 1060 || candle.Close != 1119 {
+		t.Fatalf("1m = %+v", candle)
+	}
+	if candle.Volume != 60 || candle.BuyVolume != 30 || candle.SellVolume != 30 {
+		t.Errorf("1m volume = %+v", candle)
+	}
+	candle, _ = candleRepository.SelectOne("FX_BTC_JPY", 5*time.Minute, base.Add(5*time.Minute))
+	if candle == nil || candle.Open != 1300 || candle.Close != 1599 || candle.Volume != 300 {
+		t.Errorf("5m = %+v", candle)
+	}
+	// 時間足の途中までしか範囲に含まれないキャンドルは保存しない
+	if candle, _ := candleRepository.SelectOne("FX_BTC_JPY", time.Minute, base.Add(10*time.Minute)); candle != nil {
+		t.Errorf("partial 1m = %+v", candle)
+	}
+
+	// 全て保存済みの場合はバックフィルしない
+	if spans, err := BackfillSpans("FX_BTC_JPY", durations, base, base.Add(10*time.Minute)); err != nil || len(spans) != 0 {
+		t.Errorf("BackfillSpans() = %+v, %v", spans, err)
+	}
+}
+
+func TestBackfillResume(t *testing.T) {
+	SetCandleRepository(repository.NewMemoryCandleRepository())
+	base := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	history := newPagedHistory(base)
+	history.errs = []error{nil, errors.New("connection reset")}
+	durations := []time.Duration{time.Minute, 5 * time.Minute}
+	to := base.Add(10 * time.Minute)
+
+	// 最初のページ（12:02:41まで）で全ての約定を反映し終わったキャンドルはエラーになっても保存されている
+	result, err := Backfill(context.Background(), history, "FX_BTC_JPY", durations, base, to, 0)
+	if err == nil || result.Candles != 8 {
+		t.Fatalf("Backfill() = %+v, %v", result, err)
+	}
+	// 最古のキャンドルが最も新しい時間足（5分足の12:05）より前から再開する
+	spans, err := BackfillSpans("FX_BTC_JPY", durations, base, to)
+	if err != nil || len(spans) != 1 || !spans[0].From.Equal(base) || !spans[0].To.Equal(base.Add(5*time.Minute)) {
+		t.Fatalf("BackfillSpans() = %+v, %v", spans, err)
+	}
+	history.errs = nil
+	if _, err := Backfill(context.Background(), history, "FX_BTC_JPY", durations, spans[0].From, spans[0].To, 0); err != nil {
+		t.Fatal(err)
+	}
+	minutes, _ := candleRepository.SelectRange("FX_BTC_JPY", time.Minute, base, to)
+	fives, _ := candleRepository.SelectRange("FX_BTC_JPY", 5*time.Minute, base, to)
+	if len(minutes) != 10 || len(fives) != 2 || minutes[0].Open != 1000 || minutes[1].Close != 1119 {
+		t.Errorf("1m = %+v, 5m = %+v", minutes, fives)
+	}
+}
@@ -1,13 +1,44 @@
 package service
 
 import (
+	"app/config"
 	"app/domain"
-	"database/sql"
-	"fmt"
+	"app/domain/model"
+	"app/domain/repository"
 	"log"
 	"time"
 )
 
+// キャンドルの保存先（config.iniの[db] driverで切り替える）
+var candleRepository repository.CandleRepository
+
+func init() {
+	switch config.Config.SQLDriver {
+	case repository.DriverSQLite:
+		db, err := repository.OpenSQLite(config.Config.SQLitePath)
+		if err != nil {
+			log.Fatalf("action=OpenSQLite err=%s", err.Error())
+		}
+		signalEventRepository, err := repository.NewSQLiteSignalEventRepository(db)
+		if err != nil {
+			log.Fatalf("action=NewSQLiteSignalEventRepository err=%s", err.Error())
+		}
+		candleRepository = repository.NewSQLiteCandleRepository(db)
+		model.SetSignalEventRepository(signalEventRepository)
+	case repository.DriverMemory:
+		candleRepository = repository.NewMemoryCandleRepository()
+		model.SetSignalEventRepository(repository.NewMemorySignalEventRepository())
+	default:
+		candleRepository = repository.NewMySQLCandleRepository(domain.DB)
+		model.SetSignalEventRepository(repository.NewMySQLSignalEventRepository(domain.DB))
+	}
+}
+
+// キャンドルの保存先を差し替える（テスト用）
+func SetCandleRepository(repo repository.CandleRepository) {
+	candleRepository = repo
+}
+
 type candleInfraStruct struct {
 	ProductCode string
 	Duration    time.Duration
@@ -17,6 +48,8 @@ type candleInfraStruct struct {
 	High        float64
 	Low         float64
 	Volume      float64
+	BuyVolume   float64
+	SellVolume  float64
 }
 
 func NewCandle(productCode string, duration time.Duration, timeDate time.Time, open, close, high, low, volume float64) *candleInfraStruct {
@@ -34,7 +67,7 @@ func NewCandle(productCode string, duration time.Duration, timeDate time.Time, o
 
 // テーブルネームを取得する関数
 func GetCandleTableName(productCode string, duration time.Duration) string {
-	return fmt.Sprintf("%s_%s", productCode, duration)
+	return repository.CandleTableName(productCode, duration)
 }
 
 // テーブルネームを取得するメソッド
@@ -42,97 +75,62 @@ func (c *candleInfraStruct) TableName() string {
 	return GetCandleTableName(c.ProductCode, c.Duration)
 }
 
-// テーブルを空にする
-func Truncate() (bool, error) {
-	isTruncate := false
-	cmd1 := fmt.Sprintf(" delete from FX_BTC_JPY_1h0m0s order by time asc limit 24")
-	cmd2 := fmt.Sprintf(" delete from FX_BTC_JPY_15m0s order by time asc limit 96")
-	cmd3 := fmt.Sprintf(" delete from FX_BTC_JPY_5m0s order by time asc limit 288")
-
-	truncate1, err1 := domain.DB.Prepare(cmd1)
-	truncate2, err2 := domain.DB.Prepare(cmd2)
-	truncate3, err3 := domain.DB.Prepare(cmd3)
-	if err1 != nil {
-		log.Println(err1)
-	}
-	if err2 != nil {
-		log.Println(err2)
-	}
-	if err3 != nil {
-		log.Println(err3)
-	}
-	_, err1 = truncate1.Exec()
-	_, err2 = truncate2.Exec()
-	_, err3 = truncate3.Exec()
-	if err1 != nil {
-		log.Println(err1)
-	}
-	if err2 != nil {
-		log.Println(err2)
+func (c *candleInfraStruct) candle() *model.Candle {
+	return &model.Candle{
+		ProductCode: c.ProductCode,
+		Duration:    c.Duration,
+		Time:        c.Time,
+		Open:        c.Open,
+		Close:       c.Close,
+		High:        c.High,
+		Low:         c.Low,
+		Volume:      c.Volume,
+		BuyVolume:   c.BuyVolume,
+		SellVolume:  c.SellVolume,
 	}
-	if err3 != nil {
-		log.Println(err3)
+}
+
+// テーブルを空にする
+func Truncate(productCode string) (bool, error) {
+	isTruncate := true
+	prunes := map[time.Duration]int{
+		time.Hour:        24,
+		time.Minute * 15: 96,
+		time.Minute * 5:  288,
 	}
-	if err1 == nil && err2 == nil && err3 == nil {
-		return true, nil
+	for duration, limit := range prunes {
+		if err := candleRepository.Prune(productCode, duration, limit); err != nil {
+			log.Println(err)
+			isTruncate = false
+		}
 	}
 	return isTruncate, nil
 }
 
 // キャンドル情報を追加する
 func (c *candleInfraStruct) Insert() error {
-	cmd := fmt.Sprintf("INSERT INTO %s (time, open, close, high, low, volume) VALUES (?, ?, ?, ?, ?, ?)", c.TableName())
-	ins, err := domain.DB.Prepare(cmd)
-	if err != nil {
+	if err := candleRepository.Insert(c.candle()); err != nil {
 		log.Println(err)
 	}
-	// jst, _ := time.LoadLocation("Asia/Tokyo")
-	if ins != nil {
-		_, err = ins.Exec(c.Time, c.Open, c.Close, c.High, c.Low, c.Volume)
-		if err != nil {
-			log.Println(err)
-		}
-	}
 	return nil
 }
 
 // キャンドル情報を更新する
 func (c *candleInfraStruct) Save() error {
-	cmd := fmt.Sprintf("UPDATE %s SET open = ?, close = ?, high = ?, low = ?, volume = ? WHERE time = ?", c.TableName())
-	upd, err := domain.DB.Prepare(cmd)
-	// jst, _ := time.LoadLocation("Asia/Tokyo")
-	if err != nil {
+	if err := candleRepository.Save(c.candle()); err != nil {
 		log.Println(err)
 	}
-	if upd != nil {
-		upd.Exec(c.Open, c.Close, c.High, c.Low, c.Volume, c.Time)
-	}
 	return nil
 }
 
 // キャンドル情報を取得する
 func SelectOne(productCode string, duration time.Duration, dateTime time.Time) *candleInfraStruct {
-	tableName := GetCandleTableName(productCode, duration)
-	cmd := fmt.Sprintf("SELECT time, open, close, high, low, volume FROM  %s WHERE time = ?", tableName)
-	var candle candleInfraStruct
-	err := domain.DB.QueryRow(cmd, dateTime).Scan(&candle.Time, &candle.Open, &candle.Close, &candle.High, &candle.Low, &candle.Volume)
-	if err != nil {
-		// log.Println(err)
-		return nil
-	}
-	return NewCandle(productCode, duration, candle.Time, candle.Open, candle.Close, candle.High, candle.Low, candle.Volume)
-}
-
-// キャンドル情報を全て取得する
-func SelectAll(productCode string, duration time.Duration, limit int) *sql.Rows {
-	tableName := GetCandleTableName(productCode, duration)
-	cmd := fmt.Sprintf(`SELECT * FROM (
-		SELECT time, open, close, high, low, volume FROM %s ORDER BY time DESC LIMIT ?
-		) AS candle ORDER BY time ASC`, tableName)
-	rows, err := domain.DB.Query(cmd, limit)
-	if err != nil {
-		log.Println(err)
+	candle, err := candleRepository.SelectOne(productCode, duration, dateTime)
+	if err != nil || candle == nil {
 		return nil
 	}
-	return rows
+	c := NewCandle(productCode, duration, candle.Time, candle.Open, candle.Close, candle.High, candle.Low, candle.Volume)
+	c.BuyVolume = candle.BuyVolume
+	c.SellVolume = candle.SellVolume
+	return c
 }
@@ -0,0 +1,232 @@
+package service
+
+import (
+	"app/bitflyer"
+	"app/domain/model"
+	"context"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 確定したキャンドルを受け取るチャンネルのバッファ
+const candleClosedBuffer = 16
+
+/*
+メモリ上で複数の時間足のキャンドルを作成する
+時間足ごとに作成途中のキャンドルを1つ持ち、次の時間足の約定が来るか時刻が過ぎると確定して購読者に通知する
+データベースへは確定したキャンドルと作成途中のキャンドルをFlushでまとめて保存する
+*/
+type CandleAggregator struct {
+	productCode string
+	durations   []time.Duration
+	closeDelay  time.Duration // 時刻が過ぎてから確定するまでの猶予（遅れて届く約定のため）
+
+	mu          sync.Mutex
+	open        map[time.Duration]*model.Candle // 作成途中のキャンドル
+	dirty       map[time.Duration]bool          // 作成途中のキャンドルに保存していない更新がある
+	pending     []model.Candle                  // 確定して保存していないキャンドル
+	latest      time.Time                       // 反映した最新の約定時刻（遅れて届いた約定で終値を戻さないため）
+	subscribers []candleSubscriber
+}
+
+/** 確定したキャンドルの購読者 */
+type candleSubscriber struct {
+	ch        chan model.Candle
+	durations map[time.Duration]bool // 受け取る時間足（空の場合は全ての時間足）
+}
+
+func NewCandleAggregator(productCode string, durations []time.Duration) *CandleAggregator {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return &CandleAggregator{
+		productCode: productCode,
+		durations:   sorted,
+		closeDelay:  2 * time.Second,
+		open:        map[time.Duration]*model.Candle{},
+		dirty:       map[time.Duration]bool{},
+	}
+}
+
+/*
+確定したキャンドルを受け取る（durationsを指定した場合はその時間足のみ、省略した場合は全ての時間足）
+受信が追いつかずバッファが埋まっている間のキャンドルは捨てる
+*/
+func (a *CandleAggregator) Subscribe(durations ...time.Duration) <-chan model.Candle {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	subscriber := candleSubscriber{ch: make(chan model.Candle, candleClosedBuffer), durations: map[time.Duration]bool{}}
+	for _, duration := range durations {
+		subscriber.durations[duration] = true
+	}
+	a.subscribers = append(a.subscribers, subscriber)
+	return subscriber.ch
+}
+
+/** 約定を反映する（成行の方向ごとの出来高も足す） */
+func (a *CandleAggregator) AddExecution(execution bitflyer.Execution) {
+	a.add(execution.DateTime(), execution.Price, execution.Size, execution.Side)
+}
+
+/** Tickerの仲値を反映する（Tickerの出来高は24時間の累計のため足さない） */
+func (a *CandleAggregator) AddTicker(ticker bitflyer.Ticker) {
+	a.add(ticker.DateTime(), ticker.GetMidPrice(), 0, "")
+}
+
+func (a *CandleAggregator) add(dateTime time.Time, price, size float64, side string) {
+	if dateTime.IsZero() || price <= 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	isLatest := !dateTime.Before(a.latest)
+	if isLatest {
+		a.latest = dateTime
+	}
+	for _, duration := range a.durations {
+		candleTime := dateTime.Truncate(duration)
+		candle := a.open[duration]
+		if candle != nil && candleTime.Before(candle.Time) {
+			// 確定済みのキャンドルの約定は反映しない
+			continue
+		}
+		if candle != nil && candleTime.After(candle.Time) {
+			a.close(duration)
+			candle = nil
+		}
+		if candle == nil {
+			candle = a.load(duration, candleTime, price)
+			a.open[duration] = candle
+		}
+		candle.High = math.Max(candle.High, price)
+		candle.Low = math.Min(candle.Low, price)
+		if isLatest {
+			candle.Close = price
+		}
+		candle.Volume += size
+		switch side {
+		case "BUY":
+			candle.BuyVolume += size
+		case "SELL":
+			candle.SellVolume += size
+		}
+		a.dirty[duration] = true
+	}
+}
+
+/** 新しい時間足のキャンドル（再起動した場合などデータベースにあれば続きから作成する） */
+func (a *CandleAggregator) load(duration time.Duration, candleTime time.Time, price float64) *model.Candle {
+	saved, err := candleRepository.SelectOne(a.productCode, duration, candleTime)
+	if err != nil {
+		log.Printf("action=CandleAggregator err=%s", err.Error())
+	}
+	if saved != nil {
+		return saved
+	}
+	return &model.Candle{
+		ProductCode: a.productCode,
+		Duration:    duration,
+		Time:        candleTime,
+		Open:        price,
+		High:        price,
+		Low:         price,
+		Close:       price,
+	}
+}
+
+/** 作成途中のキャンドルを確定して購読者に通知する */
+func (a *CandleAggregator) close(duration time.Duration) {
+	candle := a.open[duration]
+	if candle == nil {
+		return
+	}
+	delete(a.open, duration)
+	delete(a.dirty, duration)
+	a.pending = append(a.pending, *candle)
+	for _, subscriber := range a.subscribers {
+		if len(subscriber.durations) > 0 && !subscriber.durations[duration] {
+			continue
+		}
+		select {
+		case subscriber.ch <- *candle:
+		default:
+			log.Printf("action=CandleAggregator err=subscriber is full duration=%s time=%s", duration, candle.Time)
+		}
+	}
+}
+
+/** 時刻が過ぎた（closeDelayを含む）作成途中のキャンドルを確定する */
+func (a *CandleAggregator) CloseExpired(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, duration := range a.durations {
+		if candle := a.open[duration]; candle != nil && !now.Before(candle.Time.Add(duration+a.closeDelay)) {
+			a.close(duration)
+		}
+	}
+}
+
+/** 作成途中のキャンドル（時間足に約定がまだない場合はnil） */
+func (a *CandleAggregator) Current(duration time.Duration) *model.Candle {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if candle := a.open[duration]; candle != nil {
+		current := *candle
+		return &current
+	}
+	return nil
+}
+
+/** 確定したキャンドルと作成途中のキャンドルの更新を1つのトランザクションで保存する（失敗した場合は次回に持ち越す） */
+func (a *CandleAggregator) Flush() error {
+	a.mu.Lock()
+	candles := a.pending
+	a.pending = nil
+	var flushed []time.Duration
+	for _, duration := range a.durations {
+		if a.dirty[duration] {
+			candles = append(candles, *a.open[duration])
+			a.dirty[duration] = false
+			flushed = append(flushed, duration)
+		}
+	}
+	a.mu.Unlock()
+	if len(candles) == 0 {
+		return nil
+	}
+
+	err := candleRepository.SaveAll(candles)
+	if err != nil {
+		a.mu.Lock()
+		a.pending = append(candles[:len(candles)-len(flushed)], a.pending...)
+		for _, duration := range flushed {
+			if a.open[duration] != nil {
+				a.dirty[duration] = true
+			}
+		}
+		a.mu.Unlock()
+	}
+	return err
+}
+
+/** ctxがキャンセルされるまでinterval毎に確定・保存し、終了時に作成途中のキャンドルも保存する */
+func (a *CandleAggregator) Run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := a.Flush(); err != nil {
+				log.Printf("action=CandleAggregator err=%s", err.Error())
+			}
+			return
+		case now := <-tick.C:
+			a.CloseExpired(now)
+			if err := a.Flush(); err != nil {
+				log.Printf("action=CandleAggregator err=%s", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"app/bitflyer"
+	"app/domain/model"
+	"app/domain/repository"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCandleAggregator(t *testing.T) {
+	SetCandleRepository(repository.NewMemoryCandleRepository())
+	base := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	// 再起動前に保存された作成途中のキャンドル
+	candleRepository.Insert(&model.Candle{ProductCode: "FX_BTC_JPY", Duration: time.Hour, Time: base, Open: 900, High: 1020, Low: 900, Close: 950, Volume: 2})
+
+	aggregator := NewCandleAggregator("FX_BTC_JPY", []time.Duration{time.Hour, time.Minute})
+	closed := aggregator.Subscribe()
+	hourly := aggregator.Subscribe(time.Hour)
+	execution := func(seconds float64, side string, price, size float64) bitflyer.Execution {
+		return bitflyer.Execution{Side: side, Price: price, Size: size, ExecDate: base.Add(time.Duration(seconds * float64(time.Second))).Format(time.RFC3339Nano)}
+	}
+	aggregator.AddExecution(execution(1.5, "BUY", 1000, 0.5))
+	aggregator.AddExecution(execution(20, "SELL", 990, 0.2))
+	aggregator.AddExecution(execution(40, "BUY", 1010, 0.1))
+	aggregator.AddExecution(execution(59.999, "", 1005, 1))
+	if err := aggregator.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// 作成途中のキャンドルも保存される
+	if saved, _ := candleRepository.SelectOne("FX_BTC_JPY", time.Minute, base); saved == nil || saved.Close != 1005 {
+		t.Fatalf("SelectOne() = %+v", saved)
+	}
+
+	// 次の時間足の約定で確定する
+	aggregator.AddExecution(execution(60, "SELL", 1003, 0.3))
+	select {
+	case c := <-closed:
+		if c.Duration != time.Minute || c.Open != 1000 || c.High != 1010 || c.Low != 990 || c.Close != 1005 {
+			t.Errorf("closed = %+v", c)
+		}
+		if math.Abs(c.Volume-1.8) > 1e-9 || math.Abs(c.BuyVolume-0.6) > 1e-9 || c.SellVolume != 0.2 {
+			t.Errorf("volume = %v buy = %v sell = %v", c.Volume, c.BuyVolume, c.SellVolume)
+		}
+	default:
+		t.Fatal("candle is not closed")
+	}
+	// 時間足を指定した購読者には他の時間足のキャンドルは届かない
+	if len(hourly) != 0 {
+		t.Errorf("hourly subscriber received %d candles", len(hourly))
+	}
+	// 遅れて届いた約定は確定済みの1分足には反映せず、1時間足の終値も戻さない
+	aggregator.AddExecution(execution(30, "BUY", 2000, 1))
+
+	// 1時間足はデータベースのキャンドルの続き
+	hour := aggregator.Current(time.Hour)
+	if hour == nil || hour.Open != 900 || hour.High != 2000 || hour.Low != 900 || hour.Close != 1003 || math.Abs(hour.Volume-5.1) > 1e-9 {
+		t.Errorf("Current(1h) = %+v", hour)
+	}
+
+	// 時刻が過ぎると約定がなくても確定する
+	aggregator.CloseExpired(base.Add(2*time.Minute + time.Second))
+	if len(closed) != 0 {
+		t.Errorf("closed before closeDelay")
+	}
+	aggregator.CloseExpired(base.Add(2*time.Minute + 2*time.Second))
+	if c := <-closed; c.Duration != time.Minute || !c.Time.Equal(base.Add(time.Minute)) {
+		t.Errorf("closed = %+v", c)
+	}
+	if err := aggregator.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	candles, _ := candleRepository.SelectAll("FX_BTC_JPY", time.Minute, 10)
+	if len(candles) != 2 || candles[0].High != 1010 || candles[1].Close != 1003 {
+		t.Errorf("SelectAll() = %+v", candles)
+	}
+}
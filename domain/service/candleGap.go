@@ -0,0 +1,337 @@
+package service
+
+import (
+	"app/domain/model"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+/** キャンドルが欠けている期間（From <= キャンドルの時刻 < To） */
+type CandleGap struct {
+	Duration time.Duration `json:"duration"`
+	From     time.Time     `json:"from"`
+	To       time.Time     `json:"to"`
+	Missing  int           `json:"missing"` // 欠けているキャンドルの数
+}
+
+func (g CandleGap) String() string {
+	return fmt.Sprintf("%s %s〜%s（%d本）", g.Duration, g.From.Format("01/02 15:04"), g.To.Format("01/02 15:04"), g.Missing)
+}
+
+/** durationのcandleTimeのキャンドルが期間に含まれるか */
+func (g CandleGap) Contains(duration time.Duration, candleTime time.Time) bool {
+	return g.Duration == duration && !candleTime.Before(g.From) && candleTime.Before(g.To)
+}
+
+/** 欠けとみなさないキャンドルか（メンテナンス中・約定がなかったキャンドル） */
+type CandleGapExclusion func(duration time.Duration, candleTime time.Time) bool
+
+/** キャンドルの欠けの検出・修復結果 */
+type CandleGapReport struct {
+	ProductCode string      `json:"product_code"`
+	Time        time.Time   `json:"time"`
+	Gaps        []CandleGap `json:"gaps"`
+	Repaired    []string    `json:"repaired"` // 修復した内容
+	Unrepaired  []CandleGap `json:"unrepaired"`
+	NoTrades    []CandleGap `json:"no_trades"` // 約定履歴に約定がなかった期間（次回からは欠けとみなさない）
+}
+
+/** 欠けがないか */
+func (r *CandleGapReport) OK() bool {
+	return len(r.Gaps) == 0
+}
+
+/** durationのcandleTimeのキャンドルが約定のなかった期間に含まれるか */
+func (r *CandleGapReport) NoTrade(duration time.Duration, candleTime time.Time) bool {
+	for _, gap := range r.NoTrades {
+		if gap.Contains(duration, candleTime) {
+			return true
+		}
+	}
+	return false
+}
+
+/** previousで見つかっていない欠けがあるか（同じ欠けを何度も通知しないため） */
+func (r *CandleGapReport) HasNewGaps(previous *CandleGapReport) bool {
+	for _, gap := range r.Gaps {
+		found := false
+		if previous != nil {
+			for _, old := range previous.Gaps {
+				if gap.Duration == old.Duration && gap.From.Equal(old.From) && gap.To.Equal(old.To) {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return true
+		}
+	}
+	return false
+}
+
+/** LINE・ログ向けの文字列 */
+func (r *CandleGapReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "キャンドルの欠け（%s）\n", r.ProductCode)
+	for _, gap := range r.Gaps {
+		fmt.Fprintf(&b, "- %s\n", gap)
+	}
+	for _, repaired := range r.Repaired {
+		fmt.Fprintf(&b, "修復: %s\n", repaired)
+	}
+	for _, gap := range r.Unrepaired {
+		fmt.Fprintf(&b, "未修復: %s\n", gap)
+	}
+	return b.String()
+}
+
+/*
+from <= 時刻 < toの範囲で時間足のテーブルに欠けているキャンドルを探す
+範囲内の最初のキャンドルより前は欠けとみなさない（保存を始める前の期間のため）
+excludedがtrueを返すキャンドルは欠けとみなさない（excludedはnilでもよい）
+*/
+func FindCandleGaps(productCode string, duration time.Duration, from, to time.Time, excluded CandleGapExclusion) ([]CandleGap, error) {
+	candles, err := candleRepository.SelectRange(productCode, duration, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(candles) == 0 {
+		return nil, nil
+	}
+	skip := func(candleTime time.Time) bool {
+		return excluded != nil && excluded(duration, candleTime)
+	}
+	var gaps []CandleGap
+	expected := candles[0].Time
+	for _, candle := range candles {
+		gaps = append(gaps, candleRuns(duration, expected, candle.Time, skip)...)
+		expected = candle.Time.Add(duration)
+	}
+	gaps = append(gaps, candleRuns(duration, expected, to.Truncate(duration), skip)...)
+	return gaps, nil
+}
+
+/** from <= 時刻 < toのキャンドルのうちskipがfalseを返すものを、連続する期間ごとにまとめる */
+func candleRuns(duration time.Duration, from, to time.Time, skip func(candleTime time.Time) bool) []CandleGap {
+	var runs []CandleGap
+	extending := false
+	for candleTime := from; candleTime.Before(to); candleTime = candleTime.Add(duration) {
+		if skip(candleTime) {
+			extending = false
+			continue
+		}
+		if !extending {
+			runs = append(runs, CandleGap{Duration: duration, From: candleTime})
+			extending = true
+		}
+		run := &runs[len(runs)-1]
+		run.To = candleTime.Add(duration)
+		run.Missing++
+	}
+	return runs
+}
+
+/** 全ての時間足で直近windowの間（確定していない最新のキャンドルは除く）に欠けているキャンドルを探す */
+func DetectCandleGaps(productCode string, durations []time.Duration, now time.Time, window time.Duration, excluded CandleGapExclusion) (*CandleGapReport, error) {
+	report := &CandleGapReport{ProductCode: productCode, Time: now.Truncate(time.Second)}
+	for _, duration := range durations {
+		gaps, err := FindCandleGaps(productCode, duration, now.Add(-window).Truncate(duration), now.Truncate(duration), excluded)
+		if err != nil {
+			return nil, err
+		}
+		report.Gaps = append(report.Gaps, gaps...)
+	}
+	return report, nil
+}
+
+/** 欠けている期間のうち、まだ保存されていないキャンドルの期間 */
+func missingCandles(productCode string, gap CandleGap) ([]CandleGap, error) {
+	candles, err := candleRepository.SelectRange(productCode, gap.Duration, gap.From, gap.To)
+	if err != nil {
+		return nil, err
+	}
+	saved := map[int64]bool{}
+	for _, candle := range candles {
+		saved[candle.Time.UnixNano()] = true
+	}
+	return candleRuns(gap.Duration, gap.From, gap.To, func(candleTime time.Time) bool {
+		return saved[candleTime.UnixNano()]
+	}), nil
+}
+
+/** 期間の合計の本数 */
+func countCandles(gaps []CandleGap) int {
+	count := 0
+	for _, gap := range gaps {
+		count += gap.Missing
+	}
+	return count
+}
+
+/*
+欠けているキャンドルを修復する
+細かい時間足のキャンドルが全て揃っている場合はそれをまとめて作成し、
+揃っていない場合はhistoryの約定履歴から作成する（historyがnilの場合は修復しない）
+約定履歴を遡っても作成できなかったキャンドルは約定がなかったものとしてNoTradesに移し、
+1本も作成できなかった欠けはUnrepairedとして報告する
+*/
+func RepairCandleGaps(ctx context.Context, history ExecutionHistory, report *CandleGapReport, durations []time.Duration, interval time.Duration) error {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var unresolved []CandleGap
+	for _, gap := range report.Gaps {
+		rebuilt, err := rebuildFromFinerCandles(report.ProductCode, gap, sorted)
+		if err != nil {
+			return err
+		}
+		if rebuilt > 0 {
+			report.Repaired = append(report.Repaired, fmt.Sprintf("%s のうち%d本を細かい時間足から作成しました", gap, rebuilt))
+		}
+		if rebuilt < gap.Missing {
+			unresolved = append(unresolved, gap)
+		}
+	}
+	if len(unresolved) == 0 {
+		return nil
+	}
+	// 細かい時間足から作成できなかったキャンドル
+	var remaining []CandleGap
+	for _, gap := range unresolved {
+		missing, err := missingCandles(report.ProductCode, gap)
+		if err != nil {
+			return err
+		}
+		remaining = append(remaining, missing...)
+	}
+	if len(remaining) == 0 {
+		return nil
+	}
+	if history == nil {
+		report.Unrepaired = remaining
+		return nil
+	}
+
+	// 約定履歴は新しい順に遡るため1回で取得し、欠けているキャンドルのみ保存する（間の保存済みのキャンドルは上書きしない）
+	from, to := remaining[0].From, remaining[0].To
+	gapDurations := map[time.Duration]bool{}
+	for _, gap := range remaining {
+		if gap.From.Before(from) {
+			from = gap.From
+		}
+		if gap.To.After(to) {
+			to = gap.To
+		}
+		gapDurations[gap.Duration] = true
+	}
+	var backfillDurations []time.Duration
+	for _, duration := range sorted {
+		if gapDurations[duration] {
+			backfillDurations = append(backfillDurations, duration)
+		}
+	}
+	keep := func(duration time.Duration, candleTime time.Time) bool {
+		for _, gap := range remaining {
+			if gap.Contains(duration, candleTime) {
+				return true
+			}
+		}
+		return false
+	}
+	result, backfillErr := backfill(ctx, history, report.ProductCode, backfillDurations, from, to, interval, keep)
+
+	var noTrades []CandleGap
+	for _, gap := range remaining {
+		missing, err := missingCandles(report.ProductCode, gap)
+		if err != nil {
+			return err
+		}
+		if created := gap.Missing - countCandles(missing); created > 0 {
+			report.Repaired = append(report.Repaired, fmt.Sprintf("%s のうち%d本を約定履歴から作成しました", gap, created))
+		}
+		if backfillErr == nil && result.Reached {
+			noTrades = append(noTrades, missing...)
+		} else {
+			report.Unrepaired = append(report.Unrepaired, missing...)
+		}
+	}
+	report.NoTrades = append(report.NoTrades, noTrades...)
+	// 全てのキャンドルが約定のなかった期間だった欠けは欠けとみなさない
+	var gaps []CandleGap
+	for _, gap := range report.Gaps {
+		if countCandles(noTradesIn(noTrades, gap)) < gap.Missing {
+			gaps = append(gaps, gap)
+		}
+	}
+	report.Gaps = gaps
+	return backfillErr
+}
+
+/** gapに含まれる約定のなかった期間 */
+func noTradesIn(noTrades []CandleGap, gap CandleGap) []CandleGap {
+	var contained []CandleGap
+	for _, noTrade := range noTrades {
+		if gap.Contains(noTrade.Duration, noTrade.From) {
+			contained = append(contained, noTrade)
+		}
+	}
+	return contained
+}
+
+/*
+欠けている期間のキャンドルを、割り切れる細かい時間足のキャンドルが全て揃っているものだけ作成して保存する（作成した数を返す）
+細かい時間足から順に試し、揃っていないキャンドルは次の時間足で試す
+*/
+func rebuildFromFinerCandles(productCode string, gap CandleGap, durations []time.Duration) (int, error) {
+	rebuilt := map[int64]bool{}
+	for _, finer := range durations {
+		if len(rebuilt) == gap.Missing {
+			break
+		}
+		if finer >= gap.Duration || gap.Duration%finer != 0 {
+			continue
+		}
+		finerCandles, err := candleRepository.SelectRange(productCode, finer, gap.From, gap.To)
+		if err != nil {
+			return len(rebuilt), err
+		}
+		perCandle := int(gap.Duration / finer)
+		buckets := map[time.Time][]int{}
+		for i, candle := range finerCandles {
+			candleTime := candle.Time.Truncate(gap.Duration)
+			buckets[candleTime] = append(buckets[candleTime], i)
+		}
+		for candleTime, indexes := range buckets {
+			if rebuilt[candleTime.UnixNano()] || len(indexes) != perCandle {
+				continue
+			}
+			first, last := finerCandles[indexes[0]], finerCandles[indexes[len(indexes)-1]]
+			candle := model.Candle{
+				ProductCode: productCode,
+				Duration:    gap.Duration,
+				Time:        candleTime,
+				Open:        first.Open,
+				Close:       last.Close,
+				High:        first.High,
+				Low:         first.Low,
+			}
+			for _, i := range indexes {
+				candle.High = math.Max(candle.High, finerCandles[i].High)
+				candle.Low = math.Min(candle.Low, finerCandles[i].Low)
+				candle.Volume += finerCandles[i].Volume
+				candle.BuyVolume += finerCandles[i].BuyVolume
+				candle.SellVolume += finerCandles[i].SellVolume
+			}
+			if err := candleRepository.Insert(&candle); err != nil {
+				return len(rebuilt), err
+			}
+			rebuilt[candleTime.UnixNano()] = true
+		}
+	}
+	return len(rebuilt), nil
+}
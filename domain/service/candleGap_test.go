@@ -0,0 +1,163 @@
+package service
+
+import (
+	"app/bitflyer"
+	"app/domain/model"
+	"app/domain/repository"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCandleGaps(t *testing.T) {
+	SetCandleRepository(repository.NewMemoryCandleRepository())
+	base := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	// 1分足は12:03・12:04が欠けている、5分足は12:05が欠けている
+	for i := 0; i < 10; i++ {
+		if i == 3 || i == 4 {
+			continue
+		}
+		price := float64(1000 + i)
+		candleRepository.Insert(&model.Candle{ProductCode: "FX_BTC_JPY", Duration: time.Minute, Time: base.Add(time.Duration(i) * time.Minute), Open: price, High: price + 5, Low: price - 5, Close: price + 1, Volume: 1, BuyVolume: 1})
+	}
+	candleRepository.Insert(&model.Candle{ProductCode: "FX_BTC_JPY", Duration: 5 * time.Minute, Time: base, Open: 1000, High: 1010, Low: 990, Close: 1005})
+
+	durations := []time.Duration{time.Minute, 5 * time.Minute}
+	report, err := DetectCandleGaps("FX_BTC_JPY", durations, base.Add(10*time.Minute+30*time.Second), time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Gaps) != 2 {
+		t.Fatalf("Gaps = %+v", report.Gaps)
+	}
+	if gap := report.Gaps[0]; gap.Duration != time.Minute || !gap.From.Equal(base.Add(3*time.Minute)) || !gap.To.Equal(base.Add(5*time.Minute)) || gap.Missing != 2 {
+		t.Errorf("Gaps[0] = %+v", gap)
+	}
+	if gap := report.Gaps[1]; gap.Duration != 5*time.Minute || !gap.From.Equal(base.Add(5*time.Minute)) || gap.Missing != 1 {
+		t.Errorf("Gaps[1] = %+v", gap)
+	}
+
+	// historyがない場合は細かい時間足が揃っている5分足だけ修復する
+	if err := RepairCandleGaps(context.Background(), nil, report, durations, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Repaired) != 1 || len(report.Unrepaired) != 1 {
+		t.Errorf("Repaired = %v Unrepaired = %+v", report.Repaired, report.Unrepaired)
+	}
+	candle, _ := candleRepository.SelectOne("FX_BTC_JPY", 5*time.Minute, base.Add(5*time.Minute))
+	if candle == nil || candle.Open != 1005 || candle.Close != 1010 || candle.High != 1014 || candle.Low != 1000 || candle.Volume != 5 || candle.BuyVolume != 5 {
+		t.Fatalf("rebuilt 5m = %+v", candle)
+	}
+
+	// 1分足は約定履歴から修復する（12:02〜12:05の約定、新しい順）
+	report, _ = DetectCandleGaps("FX_BTC_JPY", durations, base.Add(10*time.Minute+30*time.Second), time.Hour, nil)
+	history := &pagedHistory{}
+	for i := 5*60 - 1; i >= 2*60; i-- {
+		history.executions = append(history.executions, bitflyer.Execution{ID: int64(i), Side: "SELL", Price: 2000, Size: 1, ExecDate: base.Add(time.Duration(i) * time.Second).Format(time.RFC3339)})
+	}
+	if err := RepairCandleGaps(context.Background(), history, report, durations, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Unrepaired) != 0 {
+		t.Errorf("Unrepaired = %+v", report.Unrepaired)
+	}
+	for _, minute := range []int{3, 4} {
+		candle, _ := candleRepository.SelectOne("FX_BTC_JPY", time.Minute, base.Add(time.Duration(minute)*time.Minute))
+		if candle == nil || candle.Close != 2000 || candle.SellVolume != 60 {
+			t.Errorf("repaired 1m %d = %+v", minute, candle)
+		}
+	}
+	if report, _ := DetectCandleGaps("FX_BTC_JPY", durations, base.Add(10*time.Minute+30*time.Second), time.Hour, nil); !report.OK() {
+		t.Errorf("Gaps after repair = %+v", report.Gaps)
+	}
+}
+
+func TestCandleGapsNoTrades(t *testing.T) {
+	SetCandleRepository(repository.NewMemoryCandleRepository())
+	base := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	// 12:02・12:03・12:06・12:08が欠けている（12:08はメンテナンス中とする）
+	for i := 0; i < 10; i++ {
+		if i == 2 || i == 3 || i == 6 || i == 8 {
+			continue
+		}
+		candleRepository.Insert(&model.Candle{ProductCode: "FX_BTC_JPY", Duration: time.Minute, Time: base.Add(time.Duration(i) * time.Minute), Open: 1000, High: 1000, Low: 1000, Close: 1000, Volume: 1})
+	}
+	maintenance := func(duration time.Duration, candleTime time.Time) bool {
+		return candleTime.Equal(base.Add(8 * time.Minute))
+	}
+	durations := []time.Duration{time.Minute}
+	now := base.Add(10*time.Minute + 30*time.Second)
+	report, err := DetectCandleGaps("FX_BTC_JPY", durations, now, time.Hour, maintenance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Gaps) != 2 || report.Gaps[0].Missing != 2 || report.Gaps[1].Missing != 1 {
+		t.Fatalf("Gaps = %+v", report.Gaps)
+	}
+
+	// 約定履歴を取得できない場合は1本も作成できないため未修復とする
+	if err := RepairCandleGaps(context.Background(), &pagedHistory{}, report, durations, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Repaired) != 0 || len(report.Unrepaired) != 2 || len(report.NoTrades) != 0 {
+		t.Errorf("Repaired = %v Unrepaired = %+v NoTrades = %+v", report.Repaired, report.Unrepaired, report.NoTrades)
+	}
+
+	// 12:01〜12:08の約定（12:06は約定なし）、新しい順
+	report, _ = DetectCandleGaps("FX_BTC_JPY", durations, now, time.Hour, maintenance)
+	history := &pagedHistory{}
+	for i := 8*60 - 1; i >= 60; i-- {
+		if i/60 == 6 {
+			continue
+		}
+		history.executions = append(history.executions, bitflyer.Execution{ID: int64(i), Side: "BUY", Price: 2000, Size: 1, ExecDate: base.Add(time.Duration(i) * time.Second).Format(time.RFC3339)})
+	}
+	if err := RepairCandleGaps(context.Background(), history, report, durations, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Unrepaired) != 0 || len(report.Repaired) != 1 {
+		t.Errorf("Repaired = %v Unrepaired = %+v", report.Repaired, report.Unrepaired)
+	}
+	if len(report.NoTrades) != 1 || !report.NoTrade(time.Minute, base.Add(6*time.Minute)) {
+		t.Errorf("NoTrades = %+v", report.NoTrades)
+	}
+	// 約定がなかった12:06だけの欠けは欠けとみなさない
+	if len(report.Gaps) != 1 || !report.Gaps[0].From.Equal(base.Add(2*time.Minute)) {
+		t.Errorf("Gaps = %+v", report.Gaps)
+	}
+	// 欠けの間の保存済みのキャンドルは上書きしない
+	for _, minute := range []int{4, 5} {
+		if candle, _ := candleRepository.SelectOne("FX_BTC_JPY", time.Minute, base.Add(time.Duration(minute)*time.Minute)); candle == nil || candle.Close != 1000 {
+			t.Errorf("saved 1m %d = %+v", minute, candle)
+		}
+	}
+
+	excluded := func(duration time.Duration, candleTime time.Time) bool {
+		return maintenance(duration, candleTime) || report.NoTrade(duration, candleTime)
+	}
+	if after, _ := DetectCandleGaps("FX_BTC_JPY", durations, now, time.Hour, excluded); !after.OK() || after.HasNewGaps(report) {
+		t.Errorf("Gaps after repair = %+v", after.Gaps)
+	}
+}
+
+func TestRebuildFromFinerCandles(t *testing.T) {
+	SetCandleRepository(repository.NewMemoryCandleRepository())
+	base := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	// 12:00〜12:15の15分足は1分足が欠けているが5分足は揃っている
+	for i := 0; i < 15; i++ {
+		if i != 7 {
+			candleRepository.Insert(&model.Candle{ProductCode: "FX_BTC_JPY", Duration: time.Minute, Time: base.Add(time.Duration(i) * time.Minute), Open: 1000, High: 1000, Low: 1000, Close: 1000, Volume: 1})
+		}
+		if i%5 == 0 {
+			candleRepository.Insert(&model.Candle{ProductCode: "FX_BTC_JPY", Duration: 5 * time.Minute, Time: base.Add(time.Duration(i) * time.Minute), Open: 1000, High: 1010, Low: 990, Close: 1000, Volume: 5})
+		}
+	}
+	gap := CandleGap{Duration: 15 * time.Minute, From: base, To: base.Add(15 * time.Minute), Missing: 1}
+	rebuilt, err := rebuildFromFinerCandles("FX_BTC_JPY", gap, []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute})
+	if err != nil || rebuilt != 1 {
+		t.Fatalf("rebuildFromFinerCandles() = %d, %v", rebuilt, err)
+	}
+	if candle, _ := candleRepository.SelectOne("FX_BTC_JPY", 15*time.Minute, base); candle == nil || candle.High != 1010 || candle.Volume != 15 {
+		t.Errorf("rebuilt 15m = %+v", candle)
+	}
+}
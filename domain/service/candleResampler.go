@@ -0,0 +1,105 @@
+package service
+
+import (
+	"app/domain/model"
+	"context"
+	"log"
+	"time"
+)
+
+/*
+baseの時間足（1分足）のfrom <= 時刻 < toのキャンドルからdurationの時間足のキャンドルを作成して保存する（保存した数を返す）
+partialでない場合は時間足の全体の1分足が揃っているキャンドルのみ保存する（約定から作成したキャンドルを欠けた1分足で上書きしないため）
+partialの場合は1分足が欠けているキャンドルや作成途中の最後のキャンドルも保存する
+*/
+func DeriveCandles(productCode string, base, duration time.Duration, from, to time.Time, partial bool) (int, error) {
+	from = from.Truncate(duration)
+	candles, err := candleRepository.SelectRange(productCode, base, from, to)
+	if err != nil {
+		return 0, err
+	}
+	df := &model.DataFrameCandle{ProductCode: productCode, Duration: base, Candles: candles}
+	counts := map[time.Time]int{}
+	for _, candle := range candles {
+		counts[candle.Time.Truncate(duration)]++
+	}
+	resampled := df.Resample(duration)
+	var derived []model.Candle
+	for _, candle := range resampled.Candles {
+		switch {
+		case partial:
+			derived = append(derived, candle)
+		case !candle.Time.Add(duration).After(to) && counts[candle.Time] == int(duration/base):
+			derived = append(derived, candle)
+		}
+	}
+	if err := candleRepository.SaveAll(derived); err != nil {
+		return 0, err
+	}
+	return len(derived), nil
+}
+
+/*
+1分足から上位の時間足のキャンドルを作成し直す
+約定から作成した時間足（15m・30m・1hなど）も確定後に1分足から作成し直し、全ての時間足の値を揃える
+約定から作成しない時間足（4h・1d・1wなど）は作成途中のキャンドルも保存する
+*/
+type CandleResampler struct {
+	productCode string
+	base        time.Duration
+	durations   []time.Duration
+	partial     map[time.Duration]bool
+	delay       time.Duration // 1分足が確定して保存されるまでの猶予
+}
+
+/** durationsのうちderivedは約定から作成しない時間足 */
+func NewCandleResampler(productCode string, base time.Duration, durations, derived []time.Duration) *CandleResampler {
+	r := &CandleResampler{productCode: productCode, base: base, partial: map[time.Duration]bool{}, delay: 10 * time.Second}
+	for _, duration := range durations {
+		if duration > base {
+			r.durations = append(r.durations, duration)
+		}
+	}
+	for _, duration := range derived {
+		r.partial[duration] = true
+	}
+	return r
+}
+
+/** from <= 時刻 < toの1分足から全ての時間足を作成し直す */
+func (r *CandleResampler) Rebuild(from, to time.Time) error {
+	for _, duration := range r.durations {
+		if _, err := DeriveCandles(r.productCode, r.base, duration, from, to, r.partial[duration]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/** 確定した1分足から、作成途中と直前のキャンドルを作成し直す */
+func (r *CandleResampler) Resample(now time.Time) error {
+	to := now.Add(-r.delay).Truncate(r.base)
+	for _, duration := range r.durations {
+		from := to.Add(-r.base).Truncate(duration)
+		if _, err := DeriveCandles(r.productCode, r.base, duration, from, to, r.partial[duration]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/** ctxがキャンセルされるまでinterval毎にResampleする */
+func (r *CandleResampler) Run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			if err := r.Resample(now); err != nil {
+				log.Printf("action=CandleResampler err=%s", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"app/domain/model"
+	"app/domain/repository"
+	"testing"
+	"time"
+)
+
+func TestCandleResampler(t *testing.T) {
+	SetCandleRepository(repository.NewMemoryCandleRepository())
+	base := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	// 12:00〜12:29の1分足（12:17が欠けている）
+	for i := 0; i < 30; i++ {
+		if i == 17 {
+			continue
+		}
+		price := float64(1000 + i)
+		candleRepository.Insert(&model.Candle{ProductCode: "FX_BTC_JPY", Duration: time.Minute, Time: base.Add(time.Duration(i) * time.Minute), Open: price, High: price, Low: price, Close: price, Volume: 1})
+	}
+	// 約定から作成された15分足（1分足と値が異なる）
+	candleRepository.Insert(&model.Candle{ProductCode: "FX_BTC_JPY", Duration: 15 * time.Minute, Time: base, Open: 990, High: 2000, Low: 990, Close: 1014})
+	candleRepository.Insert(&model.Candle{ProductCode: "FX_BTC_JPY", Duration: 15 * time.Minute, Time: base.Add(15 * time.Minute), Open: 1015, High: 1029, Low: 1015, Close: 1029, Volume: 15})
+
+	resampler := NewCandleResampler("FX_BTC_JPY", time.Minute, []time.Duration{time.Minute, 15 * time.Minute, time.Hour}, []time.Duration{time.Hour})
+	if err := resampler.Rebuild(base, base.Add(30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	// 1分足が揃っている15分足は1分足から作成し直す
+	candle, _ := candleRepository.SelectOne("FX_BTC_JPY", 15*time.Minute, base)
+	if candle == nil || candle.Open != 1000 || candle.High != 1014 || candle.Close != 1014 || candle.Volume != 15 {
+		t.Errorf("15m = %+v", candle)
+	}
+	// 1分足が欠けている15分足は上書きしない
+	candle, _ = candleRepository.SelectOne("FX_BTC_JPY", 15*time.Minute, base.Add(15*time.Minute))
+	if candle == nil || candle.Volume != 15 {
+		t.Errorf("15m with missing 1m = %+v", candle)
+	}
+	// 約定から作成しない1時間足は作成途中でも保存する
+	candle, _ = candleRepository.SelectOne("FX_BTC_JPY", time.Hour, base)
+	if candle == nil || candle.Open != 1000 || candle.Close != 1029 || candle.Volume != 29 {
+		t.Fatalf("1h = %+v", candle)
+	}
+
+	// 確定した1分足で作成途中の1時間足を更新する
+	candleRepository.Insert(&model.Candle{ProductCode: "FX_BTC_JPY", Duration: time.Minute, Time: base.Add(30 * time.Minute), Open: 3000, High: 3000, Low: 3000, Close: 3000, Volume: 1})
+	if err := resampler.Resample(base.Add(31*time.Minute + 5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if candle, _ := candleRepository.SelectOne("FX_BTC_JPY", time.Hour, base); candle.Close != 1029 {
+		t.Errorf("1h before delay = %+v", candle)
+	}
+	if err := resampler.Resample(base.Add(31*time.Minute + 10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if candle, _ := candleRepository.SelectOne("FX_BTC_JPY", time.Hour, base); candle.Close != 3000 || candle.High != 3000 || candle.Volume != 30 {
+		t.Errorf("1h = %+v", candle)
+	}
+}
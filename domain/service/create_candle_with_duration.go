@@ -1,73 +1,41 @@
 package service
 
 import (
-	"app/bitflyer"
-	"app/config"
 	"app/domain/model"
 	"github.com/markcheno/go-talib"
+	"log"
 	"time"
 )
 
-// キャンドル情報を保存する
-func CreateCandleWithDuration(ticker bitflyer.Ticker, productCode string, duration time.Duration) bool {
-	currentCandle := SelectOne(productCode, duration, ticker.TruncateDateTime(duration))
-	price := ticker.GetMidPrice()
-	// 秒単位は毎回insert
-	if currentCandle == nil {
-		candle := NewCandle(productCode, duration, ticker.TruncateDateTime(duration),
-			price, price, price, price, ticker.Volume)
-		if candle != nil {
-		}
-		candle.Insert()
-		return true
-	}
-	// High, Lowの更新があった場合のみデータベースに保存する
-	shouldSave := false
-	// 分・時単位は秒単位ではupdateする
-	if currentCandle.High < price {
-		currentCandle.High = price
-		shouldSave = true
-	} else if currentCandle.Low > price {
-		currentCandle.Low = price
-		shouldSave = true
-	}
-	// Volumeは毎回足す
-	currentCandle.Volume += ticker.Volume
-	if shouldSave == true || time.Now().Truncate(time.Second).Second() > 59 {
-		currentCandle.Close = price
-		currentCandle.Save()
-		shouldSave = false
-	}
-	return false
-}
-
 // chart?product_code=FX_BTC_JPY&duration=1h
 func GetAllCandle(productCode string, duration time.Duration, limit int) (dfCandle *model.DataFrameCandle, err error) {
-	rows := SelectAll(productCode, duration, limit)
-	defer rows.Close()
-	dfCandle = &model.DataFrameCandle{}
-	dfCandle.ProductCode = productCode
-	dfCandle.Duration = duration
-	if rows == nil {
-		return
-	}
-	for rows.Next() {
-		var candle model.Candle
-		candle.ProductCode = productCode
-		candle.Duration = duration
-		rows.Scan(&candle.Time, &candle.Open, &candle.Close, &candle.High, &candle.Low, &candle.Volume)
-		dfCandle.Candles = append(dfCandle.Candles, candle)
+	candles, err := candleRepository.SelectAll(productCode, duration, limit)
+	return newDataFrameCandle(productCode, duration, candles, err)
+}
+
+// 期間を指定してキャンドル情報を取得する（バックテスト用）
+func GetCandlesBetween(productCode string, duration time.Duration, from, to time.Time) (dfCandle *model.DataFrameCandle, err error) {
+	candles, err := candleRepository.SelectRange(productCode, duration, from, to)
+	return newDataFrameCandle(productCode, duration, candles, err)
+}
+
+// 取得結果をDataFrameCandleに詰める
+func newDataFrameCandle(productCode string, duration time.Duration, candles []model.Candle, err error) (*model.DataFrameCandle, error) {
+	dfCandle := &model.DataFrameCandle{
+		ProductCode: productCode,
+		Duration:    duration,
+		Candles:     candles,
 	}
-	err = rows.Err()
 	if err != nil {
-		return
+		log.Println(err)
+		return dfCandle, err
 	}
 	return dfCandle, nil
 }
 
 // 指定された分数分のVolumeを取得する
-func IsAvailableVolume() bool {
-	dfH, err := GetAllCandle(config.Config.ProductCode, time.Duration(time.Hour), 2)
+func IsAvailableVolume(productCode string) bool {
+	dfH, err := GetAllCandle(productCode, time.Duration(time.Hour), 2)
 	if err != nil {
 		return false
 	}
@@ -80,8 +48,8 @@ func IsAvailableVolume() bool {
 }
 
 // 指定された分のキャンドルに対するボラティリティを出力する
-func Atr(limit int) (int, error) {
-	dfM, err := GetAllCandle(config.Config.ProductCode, time.Duration(time.Minute), limit)
+func Atr(productCode string, limit int) (int, error) {
+	dfM, err := GetAllCandle(productCode, time.Duration(time.Minute), limit)
 	if err != nil {
 		return 0, err
 	}
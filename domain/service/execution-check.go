@@ -2,18 +2,15 @@ package service
 
 import (
 	"app/bitflyer"
-	"app/config"
 	"fmt"
 )
 
 // クローズが約定しているかのチェック（建玉を保有していれば false, 保有していなければ true）
-func CloseOrderExecutionCheck() bool {
-
-	bitflyerClient := bitflyer.New(config.Config.ApiKey, config.Config.ApiSecret)
+func CloseOrderExecutionCheck(exchange bitflyer.Exchange, productCode string) bool {
 	params := map[string]string{
-		"product_code": "FX_BTC_JPY",
+		"product_code": productCode,
 	}
-	positionRes, _ := bitflyerClient.GetPositions(params)
+	positionRes, _ := exchange.GetPositions(params)
 	if len(positionRes) == 0 {
 		fmt.Println("クローズオーダーなしのため取引可能")
 		return true
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"app/bitflyer"
+	"app/domain/model"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// 照合で見つかる不一致の種類
+const (
+	DiscrepancyOrphanExchangePosition = "orphan_exchange_position" // 取引所に建玉があるがローカルにはない
+	DiscrepancyStaleLocalOpen         = "stale_local_open"         // ローカルでオープン中だが取引所に建玉がない
+	DiscrepancySideMismatch           = "side_mismatch"            // 建玉の方向が異なる
+	DiscrepancySizeMismatch           = "size_mismatch"            // 建玉の数量が異なる
+)
+
+// 数量の比較の許容誤差（bitFlyerの最小注文単位より十分小さい値）
+const reconcileSizeTolerance = 1e-8
+
+// 照合結果・修復した売買イベントの時刻（テストでは固定の時刻に差し替える）
+var reconcileNow = time.Now
+
+/** 照合で見つかった不一致 */
+type Discrepancy struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+/** ローカルの建玉と取引所の建玉の照合結果 */
+type ReconcileReport struct {
+	ProductCode   string           `json:"product_code"`
+	Time          time.Time        `json:"time"`
+	LocalTrade    *model.Trade     `json:"local_trade"`
+	ExchangeSide  string           `json:"exchange_side"` // 取引所の建玉を相殺した方向（建玉がない場合は空）
+	ExchangeSize  float64          `json:"exchange_size"`
+	ExchangePrice float64          `json:"exchange_price"` // 取引所の建玉の平均価格
+	ActiveOrders  []bitflyer.Order `json:"active_orders"`
+	Discrepancies []Discrepancy    `json:"discrepancies"`
+	Repaired      []string         `json:"repaired"` // 修復した内容
+}
+
+/** 不一致がないか */
+func (r *ReconcileReport) OK() bool {
+	return len(r.Discrepancies) == 0
+}
+
+/** LINE・ログ向けの文字列 */
+func (r *ReconcileReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "建玉の照合結果（%s）\n", r.ProductCode)
+	for _, d := range r.Discrepancies {
+		fmt.Fprintf(&b, "- %s: %s\n", d.Kind, d.Message)
+	}
+	if len(r.ActiveOrders) > 0 {
+		fmt.Fprintf(&b, "未約定の注文: %d件\n", len(r.ActiveOrders))
+	}
+	for _, repaired := range r.Repaired {
+		fmt.Fprintf(&b, "修復: %s\n", repaired)
+	}
+	return b.String()
+}
+
+/*
+ローカルの建玉（TRADES）と取引所の建玉（getpositions）・未約定の注文（getchildorders）を照合する
+repairの場合、未約定の注文がなければ取引所の建玉に合わせてローカルに決済・オープンの売買イベントを保存する
+数量の不一致は建玉を部分的に表現できないため報告のみ行う
+*/
+func Reconcile(exchange bitflyer.Exchange, productCode string, repair bool) (*ReconcileReport, error) {
+	report := &ReconcileReport{ProductCode: productCode, Time: reconcileNow().Truncate(time.Second)}
+
+	localTrade, err := model.GetOpenTrade(productCode)
+	if err != nil {
+		return nil, err
+	}
+	report.LocalTrade = localTrade
+
+	positions, err := exchange.GetPositions(map[string]string{"product_code": productCode})
+	if err != nil {
+		return nil, err
+	}
+	report.ExchangeSide, report.ExchangeSize, report.ExchangePrice = netPosition(positions)
+
+	orders, err := exchange.ListOrder(map[string]string{"product_code": productCode, "child_order_state": "ACTIVE"})
+	if err != nil {
+		return nil, err
+	}
+	report.ActiveOrders = orders
+
+	switch {
+	case localTrade == nil && report.ExchangeSide != "":
+		report.Discrepancies = append(report.Discrepancies, Discrepancy{
+			Kind:    DiscrepancyOrphanExchangePosition,
+			Message: fmt.Sprintf("取引所に%s %vの建玉がありますがローカルにはありません", report.ExchangeSide, report.ExchangeSize),
+		})
+	case localTrade != nil && report.ExchangeSide == "":
+		report.Discrepancies = append(report.Discrepancies, Discrepancy{
+			Kind:    DiscrepancyStaleLocalOpen,
+			Message: fmt.Sprintf("ローカルで%s %vがオープン中ですが取引所に建玉がありません", localTrade.Side, localTrade.Size),
+		})
+	case localTrade != nil && localTrade.Side != report.ExchangeSide:
+		report.Discrepancies = append(report.Discrepancies, Discrepancy{
+			Kind:    DiscrepancySideMismatch,
+			Message: fmt.Sprintf("ローカルは%s %v、取引所は%s %vです", localTrade.Side, localTrade.Size, report.ExchangeSide, report.ExchangeSize),
+		})
+	case localTrade != nil && math.Abs(localTrade.Size-report.ExchangeSize) > reconcileSizeTolerance:
+		report.Discrepancies = append(report.Discrepancies, Discrepancy{
+			Kind:    DiscrepancySizeMismatch,
+			Message: fmt.Sprintf("数量がローカルは%v、取引所は%vです", localTrade.Size, report.ExchangeSize),
+		})
+	}
+
+	if !repair || report.OK() {
+		return report, nil
+	}
+	// 注文が約定する途中の可能性があるため未約定の注文がある場合は修復しない
+	if len(report.ActiveOrders) > 0 {
+		return report, nil
+	}
+	return report, repairPosition(exchange, report)
+}
+
+/** 取引所の建玉に合わせてローカルの建玉を決済・オープンする */
+func repairPosition(exchange bitflyer.Exchange, report *ReconcileReport) error {
+	kind := report.Discrepancies[0].Kind
+	if kind == DiscrepancySizeMismatch {
+		return nil
+	}
+	if kind == DiscrepancyStaleLocalOpen || kind == DiscrepancySideMismatch {
+		local := report.LocalTrade
+		price := local.Open.Price
+		if ticker, err := exchange.GetTicker(report.ProductCode); err == nil {
+			price = ticker.GetMidPrice()
+		}
+		closeSide := "SELL"
+		if local.Side == "SELL" {
+			closeSide = "BUY"
+		}
+		trade, err := model.RecordSignalEvent(&model.SignalEvent{
+			Time:        report.Time,
+			ProductCode: report.ProductCode,
+			Side:        closeSide,
+			Price:       price,
+			Size:        local.Size,
+		})
+		if err != nil {
+			return err
+		}
+		report.Repaired = append(report.Repaired, fmt.Sprintf("ローカルの%s %vを%vで決済しました（損益%v）", local.Side, local.Size, price, trade.Pnl))
+	}
+	if kind == DiscrepancyOrphanExchangePosition || kind == DiscrepancySideMismatch {
+		// 決済と同じ時刻・方向のイベントは重複扱いになるため1秒ずらす
+		openTime := report.Time
+		if kind == DiscrepancySideMismatch {
+			openTime = openTime.Add(time.Second)
+		}
+		_, err := model.RecordSignalEvent(&model.SignalEvent{
+			Time:        openTime,
+			ProductCode: report.ProductCode,
+			Side:        report.ExchangeSide,
+			Price:       report.ExchangePrice,
+			Size:        report.ExchangeSize,
+		})
+		if err != nil {
+			return err
+		}
+		report.Repaired = append(report.Repaired, fmt.Sprintf("取引所の%s %vをローカルでオープンしました", report.ExchangeSide, report.ExchangeSize))
+	}
+	return nil
+}
+
+/** 取引所の建玉を相殺した方向・数量・平均価格 */
+func netPosition(positions []bitflyer.Position) (side string, size, price float64) {
+	buySize, buyValue, sellSize, sellValue := 0.0, 0.0, 0.0, 0.0
+	for _, position := range positions {
+		if position.Side == "BUY" {
+			buySize += position.Size
+			buyValue += position.Price * position.Size
+		} else if position.Side == "SELL" {
+			sellSize += position.Size
+			sellValue += position.Price * position.Size
+		}
+	}
+	switch {
+	case buySize-sellSize > reconcileSizeTolerance:
+		return "BUY", buySize - sellSize, buyValue / buySize
+	case sellSize-buySize > reconcileSizeTolerance:
+		return "SELL", sellSize - buySize, sellValue / sellSize
+	}
+	return "", 0, 0
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"app/bitflyer"
+	"app/domain/model"
+	"app/domain/repository"
+	"testing"
+	"time"
+)
+
+// テスト用の取引所（照合で使うメソッドのみ実装する）
+type reconcileExchange struct {
+	bitflyer.Exchange
+	positions []bitflyer.Position
+	orders    []bitflyer.Order
+	ticker    *bitflyer.Ticker
+}
+
+func (f *reconcileExchange) GetPositions(query map[string]string) ([]bitflyer.Position, error) {
+	return f.positions, nil
+}
+
+func (f *reconcileExchange) ListOrder(query map[string]string) ([]bitflyer.Order, error) {
+	return f.orders, nil
+}
+
+func (f *reconcileExchange) GetTicker(productCode string) (*bitflyer.Ticker, error) {
+	return f.ticker, nil
+}
+
+func TestReconcile(t *testing.T) {
+	const productCode = "FX_BTC_JPY"
+	model.SetSignalEventRepository(repository.NewMemorySignalEventRepository())
+	now := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	reconcileNow = func() time.Time { return now }
+	defer func() { reconcileNow = time.Now }()
+	exchange := &reconcileExchange{ticker: &bitflyer.Ticker{BestBid: 1090, BestAsk: 1110}}
+
+	// 一致している場合は不一致なし
+	report, err := Reconcile(exchange, productCode, true)
+	if err != nil || !report.OK() {
+		t.Fatalf("Reconcile() = %+v, %v", report, err)
+	}
+
+	// 取引所にのみ建玉がある場合、未約定の注文があれば修復しない
+	exchange.positions = []bitflyer.Position{{Side: "BUY", Price: 1000, Size: 1}, {Side: "BUY", Price: 1030, Size: 2}}
+	exchange.orders = []bitflyer.Order{{ChildOrderState: "ACTIVE"}}
+	report, err = Reconcile(exchange, productCode, true)
+	if err != nil || len(report.Discrepancies) != 1 || report.Discrepancies[0].Kind != DiscrepancyOrphanExchangePosition || len(report.Repaired) != 0 {
+		t.Fatalf("Reconcile() = %+v, %v", report, err)
+	}
+
+	// 注文がなくなれば取引所の建玉でローカルをオープンする
+	exchange.orders = nil
+	report, err = Reconcile(exchange, productCode, true)
+	if err != nil || len(report.Repaired) != 1 {
+		t.Fatalf("Reconcile() = %+v, %v", report, err)
+	}
+	trade, _ := model.GetOpenTrade(productCode)
+	if trade == nil || trade.Side != "BUY" || trade.Size != 3 || trade.Open.Price != 1020 {
+		t.Fatalf("GetOpenTrade() = %+v", trade)
+	}
+
+	// 数量のみ異なる場合は報告のみ
+	exchange.positions = []bitflyer.Position{{Side: "BUY", Price: 1000, Size: 5}}
+	report, err = Reconcile(exchange, productCode, true)
+	if err != nil || len(report.Discrepancies) != 1 || report.Discrepancies[0].Kind != DiscrepancySizeMismatch || len(report.Repaired) != 0 {
+		t.Fatalf("Reconcile() = %+v, %v", report, err)
+	}
+
+	// 方向が異なる場合、repairでなければ報告のみ
+	exchange.positions = []bitflyer.Position{{Side: "SELL", Price: 1200, Size: 1}}
+	report, err = Reconcile(exchange, productCode, false)
+	if err != nil || len(report.Discrepancies) != 1 || report.Discrepancies[0].Kind != DiscrepancySideMismatch || len(report.Repaired) != 0 {
+		t.Fatalf("Reconcile() = %+v, %v", report, err)
+	}
+
+	// repairの場合は仲値で決済してから取引所の方向でオープンする
+	report, err = Reconcile(exchange, productCode, true)
+	if err != nil || len(report.Repaired) != 2 {
+		t.Fatalf("Reconcile() = %+v, %v", report, err)
+	}
+	trades := model.GetTrades(productCode, 10)
+	if len(trades) != 2 || trades[0].IsOpen() || trades[0].Close.Price != 1100 || trades[1].Side != "SELL" || !trades[1].IsOpen() {
+		t.Fatalf("GetTrades() = %+v", trades)
+	}
+
+	// 取引所の建玉がなくなればローカルの建玉を決済する
+	exchange.positions = nil
+	// 同じ時刻・方向の売買イベントは重複扱いになるため時刻をずらす
+	now = now.Add(time.Second)
+	report, err = Reconcile(exchange, productCode, true)
+	if err != nil || report.Discrepancies[0].Kind != DiscrepancyStaleLocalOpen || len(report.Repaired) != 1 {
+		t.Fatalf("Reconcile() = %+v, %v", report, err)
+	}
+	if trade, _ := model.GetOpenTrade(productCode); trade != nil {
+		t.Errorf("GetOpenTrade() = %+v, want nil", trade)
+	}
+}
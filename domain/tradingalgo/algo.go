@@ -1,7 +1,6 @@
 package tradingalgo
 
 import (
-	"github.com/markcheno/go-talib"
 	"math"
 )
 
@@ -20,59 +19,87 @@ func minMax(inReal []float64) (float64, float64) {
 	return min, max
 }
 
-/** 小さい方を返す */
-func min(x, y int) int {
-	if x < y {
-		return x
-	} else {
-		return y
+/** 一目均衡表の期間 */
+type IchimokuPeriods struct {
+	Tenkan       int `json:"tenkan"`       // 転換線の期間
+	Kijun        int `json:"kijun"`        // 基準線の期間
+	SenkouB      int `json:"senkou_b"`     // 先行スパンBの期間
+	Displacement int `json:"displacement"` // 先行スパンを先に・遅行スパンを前にずらす本数
+}
+
+/** 一般的な期間（9, 26, 52, 26） */
+var DefaultIchimokuPeriods = IchimokuPeriods{Tenkan: 9, Kijun: 26, SenkouB: 52, Displacement: 26}
+
+/** i本目を含む直近period本の最高値と最安値の平均（算出できない位置は0） */
+func Midpoint(high, low []float64, period int) []float64 {
+	values := make([]float64, len(high))
+	if period <= 0 {
+		return values
 	}
+	for i := period - 1; i < len(high) && i < len(low); i++ {
+		_, max := minMax(high[i-period+1 : i+1])
+		min, _ := minMax(low[i-period+1 : i+1])
+		values[i] = (min + max) / 2
+	}
+	return values
 }
 
 /*
-Tenkan = (9-day high + 9-day low) / 2
-Kijun = (26-day high + 26-day low) / 2
-Senkou Span A = (Tenkan + Kijun) / 2
-Senkou Span B = (52-day high + 52-day low) / 2
-Chikou Span = Close plotted 26 days in the past
+高値・安値・終値から一目均衡表を算出する（全て入力と同じ長さで、算出できない位置は0）
+転換線 = 直近Tenkan本の(最高値+最安値)/2
+基準線 = 直近Kijun本の(最高値+最安値)/2
+先行スパンA = Displacement本前の(転換線+基準線)/2（i本目の雲）
+先行スパンB = Displacement本前の直近SenkouB本の(最高値+最安値)/2（i本目の雲）
+遅行スパン = Displacement本後の終値（i本目に描く値。最後のDisplacement本は0）
 */
-func IchimokuCloud(inReal []float64) ([]float64, []float64, []float64, []float64, []float64) {
-	length := len(inReal)
-	tenkan := make([]float64, min(9, length))
-	kijun := make([]float64, min(26, length))
-	senkouA := make([]float64, min(26, length))
-	senkouB := make([]float64, min(52, length))
-	chikou := make([]float64, min(26, length))
-
-	for i := range inReal {
-		if i >= 9 {
-			min, max := minMax(inReal[i-9 : i])
-			tenkan = append(tenkan, (min+max)/2)
-		}
-		if i >= 26 {
-			min, max := minMax(inReal[i-26 : i])
-			kijun = append(kijun, (min+max)/2)
-			senkouA = append(senkouA, (tenkan[i]+kijun[i])/2)
-			chikou = append(chikou, inReal[i-26])
+func Ichimoku(high, low, close []float64, periods IchimokuPeriods) (tenkan, kijun, senkouA, senkouB, chikou []float64) {
+	length := len(close)
+	tenkan = Midpoint(high, low, periods.Tenkan)
+	kijun = Midpoint(high, low, periods.Kijun)
+	leadingB := Midpoint(high, low, periods.SenkouB)
+	senkouA = make([]float64, length)
+	senkouB = make([]float64, length)
+	chikou = make([]float64, length)
+	d := periods.Displacement
+	for i := 0; i < length; i++ {
+		if j := i - d; j >= 0 {
+			if tenkan[j] != 0 && kijun[j] != 0 {
+				senkouA[i] = (tenkan[j] + kijun[j]) / 2
+			}
+			senkouB[i] = leadingB[j]
 		}
-
-		if i >= 52 {
-			min, max := minMax(inReal[i-52 : i])
-			senkouB = append(senkouB, (min+max)/2)
+		if j := i + d; j < length {
+			chikou[i] = close[j]
 		}
 	}
 	return tenkan, kijun, senkouA, senkouB, chikou
 }
 
+/*
+ヒストリカルボラティリティ（入力と同じ長さで、算出できない位置は0）
+i本目までの直近inTimePeriod本の対数収益率（前の終値との比）の標準偏差×100
+*/
 func Hv(inReal []float64, inTimePeriod int) []float64 {
-	change := make([]float64, 0)
-	for i := range inReal {
-		if i == 0 {
-			continue
+	values := make([]float64, len(inReal))
+	if inTimePeriod <= 0 {
+		return values
+	}
+	change := make([]float64, len(inReal))
+	for i := 1; i < len(inReal); i++ {
+		change[i] = math.Log(inReal[i] / inReal[i-1])
+	}
+	for i := inTimePeriod; i < len(inReal); i++ {
+		window := change[i-inTimePeriod+1 : i+1]
+		mean := 0.0
+		for _, c := range window {
+			mean += c
+		}
+		mean /= float64(inTimePeriod)
+		variance := 0.0
+		for _, c := range window {
+			variance += (c - mean) * (c - mean)
 		}
-		dayChange := math.Log(
-			float64(inReal[i]) / float64(inReal[i-1]))
-		change = append(change, dayChange)
+		values[i] = math.Sqrt(variance/float64(inTimePeriod)) * 100
 	}
-	return talib.StdDev(change, inTimePeriod, math.Sqrt(1)*100)
+	return values
 }
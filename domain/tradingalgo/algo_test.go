@@ -0,0 +1,78 @@
+package tradingalgo
+
+import (
+	"github.com/markcheno/go-talib"
+	"math"
+	"testing"
+)
+
+func TestIchimoku(t *testing.T) {
+	// 高値i+2・安値i・終値i+1の上昇
+	var high, low, close []float64
+	for i := 0; i < 8; i++ {
+		high = append(high, float64(i+2))
+		low = append(low, float64(i))
+		close = append(close, float64(i+1))
+	}
+	tenkan, kijun, senkouA, senkouB, chikou := Ichimoku(high, low, close, IchimokuPeriods{Tenkan: 2, Kijun: 3, SenkouB: 4, Displacement: 2})
+	for i := 0; i < 8; i++ {
+		want := [5]float64{}
+		if i >= 1 {
+			want[0] = float64(i) + 0.5 // (i+2 + i-1) / 2
+		}
+		if i >= 2 {
+			want[1] = float64(i) // (i+2 + i-2) / 2
+		}
+		if i >= 4 {
+			want[2] = float64(i) - 1.75 // 2本前の(転換線+基準線)/2
+		}
+		if i >= 5 {
+			want[3] = float64(i) - 2.5 // 2本前の(i+2 + i-3) / 2
+		}
+		if i < 6 {
+			want[4] = float64(i) + 3 // 2本後の終値
+		}
+		if got := [5]float64{tenkan[i], kijun[i], senkouA[i], senkouB[i], chikou[i]}; got != want {
+			t.Errorf("Ichimoku()[%d] = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestMidpoint(t *testing.T) {
+	got := Midpoint([]float64{5, 9, 7, 8}, []float64{1, 4, 3, 6}, 3)
+	want := []float64{0, 0, 5, 6}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Midpoint() = %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestHv(t *testing.T) {
+	var prices []float64
+	for i := 0; i < 60; i++ {
+		prices = append(prices, 1000+50*math.Sin(float64(i)/3)+float64(i))
+	}
+	got := Hv(prices, 20)
+	if len(got) != len(prices) {
+		t.Fatalf("len(Hv()) = %d, want %d", len(got), len(prices))
+	}
+	// i本目の値はi本目までの前日比の標準偏差
+	var change []float64
+	for i := 1; i < len(prices); i++ {
+		change = append(change, math.Log(prices[i]/prices[i-1]))
+	}
+	want := talib.StdDev(change, 20, 100)
+	for i := range got {
+		if i < 20 {
+			if got[i] != 0 {
+				t.Errorf("Hv()[%d] = %v before the period", i, got[i])
+			}
+			continue
+		}
+		if math.Abs(got[i]-want[i-1]) > 1e-9 {
+			t.Errorf("Hv()[%d] = %v, want %v", i, got[i], want[i-1])
+		}
+	}
+}
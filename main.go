@@ -4,11 +4,17 @@ import (
 	"app/application/controllers"
 	"app/application/server"
 	"app/config"
+	"app/domain/model"
 	"app/utils"
+	"context"
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"github.com/sirupsen/logrus"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func init() {
@@ -21,6 +27,23 @@ func init() {
 }
 
 func main() {
+	// サブコマンド
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backtest":
+			runBackTest(os.Args[2:])
+			return
+		case "performance":
+			runPerformance(os.Args[2:])
+			return
+		case "backfill":
+			runBackfill(os.Args[2:])
+			return
+		}
+	}
+
+	loadRuleStrategies(config.Config.RuleFile)
+
 	e := echo.New()
 
 	//Middleware
@@ -29,9 +52,42 @@ func main() {
 
 	utils.LoggingSettings(config.Config.LogFile)
 
+	// SIGINT・SIGTERMで停止処理を行う（コンテナの再デプロイ時など）
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	served := make(chan struct{})
+
 	/**
 	リアルタイム controllerから
 	*/
-	go controllers.StreamIngestionData()
-	server.Serve()
+	go controllers.StreamIngestionData(ctx)
+	go func() {
+		server.Serve(ctx)
+		close(served)
+	}()
+
+	select {
+	case sig := <-signals:
+		log.Printf("received %s, shutting down", sig)
+	case <-served:
+		// サーバーが起動できなかった場合も停止処理を行う
+	}
+	cancel()
+	if err := controllers.Shutdown(config.Config.ShutdownPositionPolicy, config.Config.ShutdownTimeout); err != nil {
+		log.Printf("action=Shutdown err=%s", err.Error())
+	}
+	<-served
+}
+
+/** ルールファイルの戦略を登録する（trade_strategies・strategiesで名前を指定して使う） */
+func loadRuleStrategies(path string) {
+	if path == "" {
+		return
+	}
+	names, err := model.LoadRuleStrategies(path)
+	if err != nil {
+		log.Fatalf("action=loadRuleStrategies path=%s err=%s", path, err)
+	}
+	log.Printf("action=loadRuleStrategies path=%s strategies=%v", path, names)
 }
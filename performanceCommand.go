@@ -0,0 +1,42 @@
+package main
+
+import (
+	"app/bitflyer"
+	"app/config"
+	"app/domain/model"
+	"flag"
+	"fmt"
+	"log"
+)
+
+/*
+performanceサブコマンド
+SIGNAL_EVENTSに保存されている売買イベントの成績をテキストで出力する
+例）go run . performance
+*/
+func runPerformance(args []string) {
+	flags := flag.NewFlagSet("performance", flag.ExitOnError)
+	productCode := flags.String("product_code", config.Config.ProductCode, "プロダクトコード")
+	commissionRate := flags.Float64("commission_rate", -1, "手数料率（省略時はbitFlyerのGetTradingCommissionから取得する）")
+	flags.Parse(args)
+
+	events := model.GetAllSignalEvents(*productCode)
+	if events == nil {
+		log.Fatal("action=performance err=signal events could not be loaded")
+	}
+	*commissionRate = tradingCommissionRate(*productCode, *commissionRate)
+	fmt.Print(events.Performance(*commissionRate).String())
+}
+
+/** 手数料率（負の値の場合はbitFlyerのGetTradingCommissionから取得し、取得できなければ0） */
+func tradingCommissionRate(productCode string, commissionRate float64) float64 {
+	if commissionRate >= 0 {
+		return commissionRate
+	}
+	commission, err := bitflyer.New(config.Config.ApiKey, config.Config.ApiSecret).GetTradingCommission(productCode)
+	if err != nil {
+		log.Printf("action=tradingCommissionRate 手数料が取得できなかったため0で計算します err=%s", err)
+		return 0
+	}
+	return commission.CommissionRate
+}